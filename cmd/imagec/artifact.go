@@ -0,0 +1,258 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/stringid"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// Manifest and config media types that tell images and artifacts apart
+const (
+	MediaTypeManifest       = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeImageConfig    = "application/vnd.docker.container.image.v1+json"
+	MediaTypeOCIImageConfig = "application/vnd.oci.image.config.v1+json"
+)
+
+// DefaultArtifactDirectory is the directory under the destination that holds the artifact blobs
+const DefaultArtifactDirectory = "blobs"
+
+// imageConfigs are the config media types of runnable images, any other config media type
+// denotes an artifact
+var imageConfigs = map[string]bool{
+	MediaTypeImageConfig:    true,
+	MediaTypeOCIImageConfig: true,
+}
+
+// Descriptor references a blob by its digest
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// String returns the short form of the digest used as the progress ID
+func (d Descriptor) String() string {
+	return stringid.TruncateID(d.Digest)
+}
+
+// ArtifactManifest represents an OCI image manifest, which is also used to store artifacts
+type ArtifactManifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+
+	// Annotations are passed on for provenance, they don't affect the pull
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Digest identifies the manifest in the registry, it isn't part of the document
+	Digest string `json:"-"`
+}
+
+// IsArtifact reports whether the manifest references something other than a runnable image
+func (m *ArtifactManifest) IsArtifact() bool {
+	return m.SchemaVersion == 2 && m.Config.MediaType != "" && !imageConfigs[m.Config.MediaType]
+}
+
+// Blobs returns the config followed by the layers of the manifest
+func (m *ArtifactManifest) Blobs() []Descriptor {
+	return append([]Descriptor{m.Config}, m.Layers...)
+}
+
+// FetchArtifactManifest fetches the OCI manifest of the reference
+func FetchArtifactManifest(options ImageCOptions) (*ArtifactManifest, []byte, error) {
+	defer trace.End(trace.Begin(options.image + "/" + options.digest))
+
+	content, _, _, err := fetchManifest(options, []string{MediaTypeOCIManifest, MediaTypeManifest})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := &ArtifactManifest{}
+	if err = json.Unmarshal(content, manifest); err != nil {
+		return nil, nil, err
+	}
+
+	return manifest, content, nil
+}
+
+// FetchArtifactBlob downloads the blob verbatim, verifies its digest and size and writes it
+// under the artifact directory by digest
+func FetchArtifactBlob(options ImageCOptions, blob Descriptor) error {
+	defer trace.End(trace.Begin(blob.Digest))
+
+	destination, err := artifactBlobPath(options, blob.Digest)
+	if err != nil {
+		return err
+	}
+
+	url, err := options.repositoryURL("blobs", blob.Digest)
+	if err != nil {
+		return err
+	}
+
+	options.logger().Debugf("URL: %s", url)
+
+	po := options.progressOutput()
+	progress.Update(po, blob.String(), "Pulling blob")
+
+	fetcher := options.newFetcher(FetcherOptions{
+		Timeout:            options.timeout,
+		Username:           options.username,
+		Password:           options.password,
+		Token:              options.token,
+		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+		Progress:           po,
+		RateLimit:          options.rateLimit,
+		Limiter:            options.limiter,
+		Meter:              options.meter,
+		DisableCompression: true,
+	})
+	blobFileName, err := fetcher.FetchWithProgress(url, blob.String())
+	if err != nil {
+		if fetcher.IsStatusNotFound() {
+			return ErrImageNotFound{Image: options.image, Reference: blob.Digest, Registry: options.registry}
+		}
+		return err
+	}
+
+	// Cleanup function for the error case
+	defer func() {
+		if err != nil {
+			os.Remove(blobFileName)
+		}
+	}()
+
+	progress.Update(po, blob.String(), "Verifying Checksum")
+
+	f, err := os.Open(blobFileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum := sha256.New()
+	size, err := io.Copy(sum, f)
+	if err != nil {
+		return err
+	}
+
+	if bs := fmt.Sprintf("sha256:%x", sum.Sum(nil)); bs != blob.Digest {
+		err = ErrChecksum{Expected: blob.Digest, Got: bs}
+		return err
+	}
+
+	if blob.Size > 0 && size != blob.Size {
+		err = fmt.Errorf("Blob %s is %d bytes, expected %d", blob.Digest, size, blob.Size)
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(destination), 0755); err != nil {
+		return err
+	}
+
+	if options.fsync {
+		if err = f.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err = os.Rename(blobFileName, destination); err != nil {
+		return err
+	}
+
+	if options.fsync {
+		if err = syncDir(path.Dir(destination)); err != nil {
+			return err
+		}
+	}
+
+	progress.Update(po, blob.String(), "Download complete")
+
+	return nil
+}
+
+// artifactBlobPath returns where the blob with the given digest is stored
+func artifactBlobPath(options ImageCOptions, digest string) (string, error) {
+	return digestPath(path.Join(DestinationDirectory(options), DefaultArtifactDirectory), digest)
+}
+
+// PullArtifact downloads the blobs of the artifact in parallel and writes its manifest next to them.
+// Unlike images, the blobs are stored as they are - there's no decompression or diffID to compute.
+func PullArtifact(options ImageCOptions, manifest *ArtifactManifest, content []byte) error {
+	defer trace.End(trace.Begin(options.image + "/" + options.digest))
+
+	po := options.progressOutput()
+	progress.Message(po, options.indexTag(), "Pulling artifact "+options.image+" ("+manifest.Config.MediaType+")")
+
+	blobs := manifest.Blobs()
+
+	if options.onThroughput != nil {
+		options.meter = NewThroughputMeter(options.throughputInterval, options.onThroughput)
+		defer options.meter.Stop()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(blobs))
+
+	results := make(chan error, len(blobs))
+	for _, blob := range blobs {
+		go func(blob Descriptor) {
+			defer wg.Done()
+
+			if err := FetchArtifactBlob(options, blob); err != nil {
+				results <- fmt.Errorf("%s/%s returned %s", options.image, blob.Digest, err)
+				return
+			}
+			results <- nil
+		}(blob)
+	}
+	wg.Wait()
+	close(results)
+
+	for err := range results {
+		if err != nil {
+			return fmt.Errorf("Failed to fetch artifact blob: %s", err)
+		}
+	}
+
+	destination := DestinationDirectory(options)
+	if err := os.MkdirAll(destination, 0755); err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path.Join(destination, "manifest.json"), content, 0644); err != nil {
+		return err
+	}
+
+	progress.Message(po, "", "Status: Downloaded artifact "+options.displayName())
+
+	return nil
+}
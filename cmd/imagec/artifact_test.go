@@ -0,0 +1,148 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func TestPullArtifact(t *testing.T) {
+	config := []byte(`{"name":"chart","version":"1.0.0"}`)
+	chart := []byte("not a tarball, stored verbatim")
+
+	manifest := ArtifactManifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeOCIManifest,
+		Config: Descriptor{
+			MediaType: "application/vnd.cncf.helm.config.v1+json",
+			Digest:    digest(config),
+			Size:      int64(len(config)),
+		},
+		Layers: []Descriptor{
+			{
+				MediaType: "application/vnd.cncf.helm.chart.content.v1.tar+gzip",
+				Digest:    digest(chart),
+				Size:      int64(len(chart)),
+			},
+		},
+	}
+
+	blobs := map[string][]byte{
+		digest(config): config,
+		digest(chart):  chart,
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				if !strings.Contains(strings.Join(r.Header["Accept"], ","), MediaTypeOCIManifest) {
+					t.Errorf("Manifest requested without accepting %s", MediaTypeOCIManifest)
+				}
+
+				body, err := json.Marshal(manifest)
+				if err != nil {
+					t.Errorf(err.Error())
+				}
+				w.Header().Set("Content-Type", MediaTypeOCIManifest)
+				w.Write(body)
+				return
+			}
+
+			blob, ok := blobs[path.Base(r.URL.Path)]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(blob)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+	options.destination = dir
+	options.token = &Token{Token: OAuthToken}
+
+	artifact, content, err := FetchArtifactManifest(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !artifact.IsArtifact() {
+		t.Fatalf("Expected %s to be an artifact", artifact.Config.MediaType)
+	}
+
+	if err = PullArtifact(options, artifact, content); err != nil {
+		t.Fatal(err)
+	}
+
+	for d, expected := range blobs {
+		name, err := artifactBlobPath(options, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != string(expected) {
+			t.Errorf("Blob %s is %q, expected %q", d, data, expected)
+		}
+	}
+
+	// a blob that doesn't match its digest is refused
+	blobs[digest(chart)] = []byte("tampered")
+	err = FetchArtifactBlob(options, manifest.Layers[0])
+	if _, ok := err.(ErrChecksum); !ok {
+		t.Errorf("Expected an ErrChecksum, got %#v", err)
+	}
+}
+
+func TestIsArtifact(t *testing.T) {
+	tests := []struct {
+		manifest ArtifactManifest
+		artifact bool
+	}{
+		{ArtifactManifest{SchemaVersion: 1}, false},
+		{ArtifactManifest{SchemaVersion: 2, Config: Descriptor{MediaType: MediaTypeImageConfig}}, false},
+		{ArtifactManifest{SchemaVersion: 2, Config: Descriptor{MediaType: MediaTypeOCIImageConfig}}, false},
+		{ArtifactManifest{SchemaVersion: 2, Config: Descriptor{MediaType: "application/spdx+json"}}, true},
+	}
+
+	for _, test := range tests {
+		if test.manifest.IsArtifact() != test.artifact {
+			t.Errorf("IsArtifact for %#v returned %t", test.manifest, !test.artifact)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultDiffIDDirectory is the directory under the destination that indexes the diffIDs of the
+// kept layers by their digest
+const DefaultDiffIDDirectory = "diffids"
+
+// digestPath returns the path of the file named after the digest under dir, laid out as
+// dir/<algorithm>/<hex> like the OCI image layout
+func digestPath(dir string, digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || parts[1] == "" || strings.ContainsAny(parts[1], "/.") {
+		return "", fmt.Errorf("Unsupported digest %q", digest)
+	}
+
+	return path.Join(dir, parts[0], parts[1]), nil
+}
+
+// layerBlobPath returns where the compressed layer with the given digest is kept. The blobs are
+// shared by all the images under the destination.
+func layerBlobPath(options ImageCOptions, digest string) (string, error) {
+	return digestPath(path.Join(options.destination, DefaultArtifactDirectory), digest)
+}
+
+// LayerDiffID returns the diffID recorded for the kept layer with the given digest
+func LayerDiffID(options ImageCOptions, digest string) (string, bool) {
+	name, err := digestPath(path.Join(options.destination, DefaultDiffIDDirectory), digest)
+	if err != nil {
+		return "", false
+	}
+
+	diffID, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", false
+	}
+
+	return string(diffID), true
+}
+
+// ComputeMissingLayers returns the layers of the manifest that aren't kept under the destination,
+// in manifest order and without duplicates. A layer counts as kept once both its compressed blob
+// is stored under its digest and its diffID is recorded, as keepLayerBlob leaves it.
+func ComputeMissingLayers(options ImageCOptions, manifest *Manifest) ([]FSLayer, error) {
+	var missing []FSLayer
+
+	seen := make(map[string]bool)
+	for _, layer := range manifest.FSLayers {
+		if seen[layer.BlobSum] {
+			continue
+		}
+		seen[layer.BlobSum] = true
+
+		kept, err := layerKept(options, layer.BlobSum)
+		if err != nil {
+			return nil, err
+		}
+		if !kept {
+			missing = append(missing, layer)
+		}
+	}
+
+	options.logger().Debugf("%d of %d layers are missing", len(missing), len(seen))
+
+	return missing, nil
+}
+
+// layerKept returns true if the layer with the given digest is kept along with its diffID
+func layerKept(options ImageCOptions, digest string) (bool, error) {
+	blob, err := layerBlobPath(options, digest)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err = os.Stat(blob); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	diffID, ok := LayerDiffID(options, digest)
+
+	return ok && strings.HasPrefix(diffID, "sha256:"), nil
+}
+
+// keepLayerBlob keeps the compressed layer in layerFile under its digest and records its diffID.
+// A layer that's already kept, for another image or tag, isn't stored again. The layer is tracked
+// in the cache index as used by the reference being pulled.
+func keepLayerBlob(options ImageCOptions, digest string, diffID string, layerFile string) error {
+	blob, err := layerBlobPath(options, digest)
+	if err != nil {
+		return err
+	}
+
+	index, err := digestPath(path.Join(options.destination, DefaultDiffIDDirectory), digest)
+	if err != nil {
+		return err
+	}
+
+	reference := options.repositoryName() + ":" + options.indexTag()
+
+	return updateLayerCache(options.destination, func(cache *LayerCache) error {
+		for _, dir := range []string{path.Dir(blob), path.Dir(index)} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return err
+			}
+		}
+
+		if _, err := os.Stat(blob); os.IsNotExist(err) {
+			if err = linkOrCopy(layerFile, blob); err != nil {
+				return err
+			}
+		} else {
+			options.logger().Debugf("Layer %s is already kept", digest)
+		}
+
+		if err := ioutil.WriteFile(index, []byte(diffID), 0644); err != nil {
+			return err
+		}
+
+		fi, err := os.Stat(blob)
+		if err != nil {
+			return err
+		}
+
+		layer, ok := cache.Layers[digest]
+		if !ok {
+			layer = &CachedLayer{}
+			cache.Layers[digest] = layer
+		}
+		layer.Size = fi.Size()
+		layer.LastAccess = accessTime()
+		if !containsString(layer.References, reference) {
+			layer.References = append(layer.References, reference)
+		}
+
+		return nil
+	})
+}
+
+// removeLayerBlob removes the kept layer with the given digest along with its diffID
+func removeLayerBlob(options ImageCOptions, digest string) error {
+	blob, err := layerBlobPath(options, digest)
+	if err != nil {
+		return err
+	}
+
+	index, err := digestPath(path.Join(options.destination, DefaultDiffIDDirectory), digest)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range []string{blob, index} {
+		if err = os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// linkOrCopy hard links src to dst, copying it if they're on different filesystems. The copy is
+// written to a temporary file first, so that dst is either complete or missing.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil || os.IsExist(err) {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := ioutil.TempFile(path.Dir(dst), path.Base(dst))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+	}
+
+	return err
+}
@@ -0,0 +1,187 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestKeepLayers(t *testing.T) {
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write([]byte(LayerContent))
+	gw.Close()
+
+	blobSum := fmt.Sprintf("sha256:%x", sha256.Sum256(compressed.Bytes()))
+	diffID := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(LayerContent)))
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(compressed.Bytes())
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.destination = dir
+	opts.keepLayers = true
+
+	// two tags sharing the layer
+	for _, tag := range []string{"latest", "edge"} {
+		opts.digest = tag
+
+		parent := "scratch"
+		image := ImageWithMeta{
+			Image: &models.Image{
+				ID:     LayerID,
+				Parent: &parent,
+				Store:  Storename,
+			},
+			history: History{V1Compatibility: LayerHistory},
+			layer:   FSLayer{BlobSum: blobSum},
+		}
+
+		if _, err = FetchImageBlob(opts, &image); err != nil {
+			t.Fatal(err)
+		}
+
+		// the download directory is removed once the layers are written to the storage layer
+		if err = os.RemoveAll(DestinationDirectory(opts)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blob, err := layerBlobPath(opts, blobSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, compressed.Bytes()) {
+		t.Errorf("The kept layer isn't the compressed blob")
+	}
+
+	if got, ok := LayerDiffID(opts, blobSum); !ok || got != diffID {
+		t.Errorf("Expected diffID %s, got %q", diffID, got)
+	}
+
+	if _, ok := LayerDiffID(opts, DigestSHA256EmptyTar); ok {
+		t.Errorf("Unexpected diffID for a layer that wasn't kept")
+	}
+
+	if _, err = layerBlobPath(opts, "sha256:../../etc"); err == nil {
+		t.Errorf("Expected an error for an invalid digest")
+	}
+}
+
+func TestComputeMissingLayers(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(LayerContent))
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.keepLayers = true
+
+	// the layer is listed twice, as empty layers often are
+	manifest := &Manifest{
+		FSLayers: []FSLayer{
+			{BlobSum: DigestSHA256LayerContent},
+			{BlobSum: DigestSHA256EmptyTar},
+			{BlobSum: DigestSHA256LayerContent},
+		},
+	}
+
+	missing := func() []FSLayer {
+		layers, err := ComputeMissingLayers(opts, manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return layers
+	}
+
+	if layers := missing(); len(layers) != 2 || layers[0].BlobSum != DigestSHA256LayerContent || layers[1].BlobSum != DigestSHA256EmptyTar {
+		t.Errorf("Expected both layers to be missing, got %#v", layers)
+	}
+
+	parent := "scratch"
+	image := ImageWithMeta{
+		Image: &models.Image{
+			ID:     LayerID,
+			Parent: &parent,
+			Store:  Storename,
+		},
+		history: History{V1Compatibility: LayerHistory},
+		layer:   FSLayer{BlobSum: DigestSHA256LayerContent},
+	}
+
+	if _, err = FetchImageBlob(opts, &image); err != nil {
+		t.Fatal(err)
+	}
+
+	if layers := missing(); len(layers) != 1 || layers[0].BlobSum != DigestSHA256EmptyTar {
+		t.Errorf("Expected the empty layer to be missing, got %#v", layers)
+	}
+
+	// a blob without its diffID isn't complete
+	index, err := digestPath(path.Join(dir, DefaultDiffIDDirectory), DigestSHA256LayerContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(index); err != nil {
+		t.Fatal(err)
+	}
+
+	if layers := missing(); len(layers) != 2 {
+		t.Errorf("Expected both layers to be missing, got %#v", layers)
+	}
+
+	manifest.FSLayers = append(manifest.FSLayers, FSLayer{BlobSum: "md5:1234"})
+	if _, err = ComputeMissingLayers(opts, manifest); err == nil {
+		t.Errorf("Expected an error for an unsupported digest")
+	}
+}
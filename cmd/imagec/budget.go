@@ -0,0 +1,67 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+)
+
+// ByteBudget limits the number of bytes downloaded at the same time. A download takes its size
+// from the budget before it starts and returns it once it's over, so a large layer waits until
+// enough of the others are done.
+type ByteBudget struct {
+	m    sync.Mutex
+	cond *sync.Cond
+
+	capacity int64
+	inFlight int64
+}
+
+// NewByteBudget returns a ByteBudget that lets up to capacity bytes be in flight
+func NewByteBudget(capacity int64) *ByteBudget {
+	b := &ByteBudget{capacity: capacity}
+	b.cond = sync.NewCond(&b.m)
+
+	return b
+}
+
+// Acquire blocks until n bytes fit in the budget and takes them. A download larger than the whole
+// budget, or of unknown size, waits until nothing else is in flight and then runs on its own.
+func (b *ByteBudget) Acquire(n int64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if n < 0 || n > b.capacity {
+		n = b.capacity
+	}
+
+	for b.inFlight > 0 && b.inFlight+n > b.capacity {
+		b.cond.Wait()
+	}
+	b.inFlight += n
+}
+
+// Release returns the n bytes taken by Acquire to the budget
+func (b *ByteBudget) Release(n int64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	if n < 0 || n > b.capacity {
+		n = b.capacity
+	}
+
+	b.inFlight -= n
+	b.cond.Broadcast()
+}
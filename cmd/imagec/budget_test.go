@@ -0,0 +1,155 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestByteBudget(t *testing.T) {
+	budget := NewByteBudget(100)
+
+	budget.Acquire(60)
+
+	// doesn't fit until the first one is released
+	acquired := make(chan struct{})
+	go func() {
+		budget.Acquire(50)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Acquired more than the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(60)
+	<-acquired
+
+	// larger than the budget, runs on its own
+	acquired = make(chan struct{})
+	go func() {
+		budget.Acquire(500)
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("An oversized download didn't wait for the others")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	budget.Release(50)
+	<-acquired
+	budget.Release(500)
+
+	if budget.inFlight != 0 {
+		t.Errorf("Expected nothing in flight, got %d", budget.inFlight)
+	}
+}
+
+func TestDownloadImageBlobsMaxInFlight(t *testing.T) {
+	const limit = 600
+
+	blobs := make(map[string][]byte)
+	var images []*ImageWithMeta
+	for i, size := range []int{300, 300, 200, 500, 800} {
+		content := bytes.Repeat([]byte{byte('a' + i)}, size)
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+		blobs[digest] = content
+
+		images = append(images, &ImageWithMeta{
+			Image:   &models.Image{ID: fmt.Sprintf("layer%d", i), Store: Storename},
+			history: History{V1Compatibility: LayerHistory},
+			layer:   FSLayer{BlobSum: digest},
+		})
+	}
+
+	var m sync.Mutex
+	var inFlight, peak int
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			content, ok := blobs[path.Base(r.URL.Path)]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if r.Method == "HEAD" {
+				return
+			}
+
+			m.Lock()
+			inFlight += len(content)
+			if inFlight > peak {
+				peak = inFlight
+			}
+			m.Unlock()
+
+			// keep the download going long enough for the others to overlap it
+			time.Sleep(50 * time.Millisecond)
+			w.Write(content)
+
+			m.Lock()
+			inFlight -= len(content)
+			m.Unlock()
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.standalone = true
+	opts.skipSpaceCheck = true
+	opts.maxInFlight = limit
+
+	if err = NewPuller(opts).DownloadImageBlobs(images); err != nil {
+		t.Fatal(err)
+	}
+
+	// the oversized layer is downloaded on its own
+	if peak > 800 || (peak > limit && peak != 800) {
+		t.Errorf("Downloaded %d bytes at once with a limit of %d", peak, limit)
+	}
+
+	for _, image := range images {
+		if image.diffID == "" {
+			t.Errorf("Layer %s wasn't downloaded", image.ID)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// CacheFile is the name of the index of the layers kept under the destination, which tracks
+// their size, when they were last used and the images using them
+const CacheFile = "cache.json"
+
+// accessTime returns the time a cached layer is used at
+var accessTime = time.Now
+
+// CachedLayer is a layer kept under the destination by its digest
+type CachedLayer struct {
+	// Size is the size of the kept layer in bytes
+	Size int64 `json:"size"`
+	// LastAccess is when the layer was last kept or reused by a pull
+	LastAccess time.Time `json:"lastAccess"`
+	// References are the repository:tag references that resolve to an image using the layer,
+	// a layer isn't evicted while it has any
+	References []string `json:"references,omitempty"`
+}
+
+// LayerCache is the content of the index, mapping digest -> layer
+type LayerCache struct {
+	Layers map[string]*CachedLayer `json:"layers"`
+}
+
+// byLastAccess sorts digests from the least to the most recently used layer
+type byLastAccess struct {
+	digests []string
+	cache   *LayerCache
+}
+
+func (b byLastAccess) Len() int      { return len(b.digests) }
+func (b byLastAccess) Swap(i, j int) { b.digests[i], b.digests[j] = b.digests[j], b.digests[i] }
+func (b byLastAccess) Less(i, j int) bool {
+	x, y := b.cache.Layers[b.digests[i]], b.cache.Layers[b.digests[j]]
+	if !x.LastAccess.Equal(y.LastAccess) {
+		return x.LastAccess.Before(y.LastAccess)
+	}
+	return b.digests[i] < b.digests[j]
+}
+
+// ReadLayerCache reads the index from dir, returning an empty one if there's none yet
+func ReadLayerCache(dir string) (*LayerCache, error) {
+	cache := &LayerCache{
+		Layers: make(map[string]*CachedLayer),
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, CacheFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, cache); err != nil {
+		return nil, err
+	}
+
+	if cache.Layers == nil {
+		cache.Layers = make(map[string]*CachedLayer)
+	}
+
+	return cache, nil
+}
+
+// updateLayerCache applies update to the index in dir under an exclusive lock and replaces the
+// index atomically through updateIndex. The lock also covers the kept layer files, so that a
+// layer isn't evicted while a pull keeps or reuses it.
+func updateLayerCache(dir string, update func(cache *LayerCache) error) error {
+	return updateIndex(dir, CacheFile, func() (interface{}, error) {
+		cache, err := ReadLayerCache(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return cache, update(cache)
+	})
+}
+
+// TouchCachedLayers records that the kept layers with the given digests are reused, digests of
+// layers that aren't kept are ignored
+func TouchCachedLayers(options ImageCOptions, digests ...string) error {
+	return updateLayerCache(options.destination, func(cache *LayerCache) error {
+		now := accessTime()
+		for _, digest := range digests {
+			if layer, ok := cache.Layers[digest]; ok {
+				layer.LastAccess = now
+			}
+		}
+		return nil
+	})
+}
+
+// ReferenceCachedLayers records that the reference resolves to an image made of the kept layers
+// with the given digests, releasing the layers it resolved to before. No digests releases the
+// reference.
+func ReferenceCachedLayers(options ImageCOptions, reference string, digests ...string) error {
+	defer trace.End(trace.Begin(reference))
+
+	return updateLayerCache(options.destination, func(cache *LayerCache) error {
+		used := make(map[string]bool)
+		for _, digest := range digests {
+			used[digest] = true
+		}
+
+		for digest, layer := range cache.Layers {
+			var refs []string
+			for _, ref := range layer.References {
+				if ref != reference {
+					refs = append(refs, ref)
+				}
+			}
+			if used[digest] {
+				refs = append(refs, reference)
+			}
+			layer.References = refs
+		}
+
+		return nil
+	})
+}
+
+// Prune evicts the least recently used layers that no reference uses until the kept layers
+// take up at most maxBytes, returning the digests of the evicted layers. The layers in use are
+// never evicted, even if they alone take up more than maxBytes.
+func Prune(options ImageCOptions, maxBytes int64) ([]string, error) {
+	defer trace.End(trace.Begin(""))
+
+	var evicted []string
+	err := updateLayerCache(options.destination, func(cache *LayerCache) error {
+		var total int64
+		var unused []string
+		for digest, layer := range cache.Layers {
+			total += layer.Size
+			if len(layer.References) == 0 {
+				unused = append(unused, digest)
+			}
+		}
+
+		sort.Sort(byLastAccess{unused, cache})
+
+		for _, digest := range unused {
+			if total <= maxBytes {
+				break
+			}
+
+			if err := removeLayerBlob(options, digest); err != nil {
+				return err
+			}
+
+			total -= cache.Layers[digest].Size
+			delete(cache.Layers, digest)
+			evicted = append(evicted, digest)
+
+			options.logger().Debugf("Evicted layer %s", digest)
+		}
+
+		if total > maxBytes {
+			options.logger().Warnf("The layers in use take up %d bytes, more than the %d allowed", total, maxBytes)
+		}
+
+		return nil
+	})
+
+	return evicted, err
+}
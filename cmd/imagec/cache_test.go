@@ -0,0 +1,182 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keepTestLayers keeps a layer of each of the given sizes as used by the reference, each one
+// accessed a second after the previous one. The digests are returned in the same order.
+func keepTestLayers(t *testing.T, opts ImageCOptions, clock *time.Time, sizes ...int) []string {
+	var digests []string
+	for _, size := range sizes {
+		content := []byte(strings.Repeat(fmt.Sprintf("%d", len(digests)), size))
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+
+		layerFile := path.Join(opts.destination, "layer.tar")
+		if err := ioutil.WriteFile(layerFile, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		*clock = clock.Add(time.Second)
+		if err := keepLayerBlob(opts, digest, digest, layerFile); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(layerFile)
+
+		digests = append(digests, digest)
+	}
+
+	return digests
+}
+
+func TestPruneLeastRecentlyUsed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := time.Unix(0, 0)
+	accessTime = func() time.Time { return clock }
+	defer func() {
+		accessTime = time.Now
+	}()
+
+	opts := options
+	opts.registry = DefaultDockerURL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+
+	layers := keepTestLayers(t, opts, &clock, 100, 200, 300)
+
+	// the image is gone, its layers are only cached
+	reference := opts.repositoryName() + ":" + opts.indexTag()
+	if err = ReferenceCachedLayers(opts, reference); err != nil {
+		t.Fatal(err)
+	}
+
+	// the oldest layer is reused
+	clock = clock.Add(time.Second)
+	if err = TouchCachedLayers(opts, layers[0], DigestSHA256EmptyTar); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing to evict while the layers fit
+	if evicted, err := Prune(opts, 600); err != nil || len(evicted) != 0 {
+		t.Fatalf("Unexpected eviction of %v: %v", evicted, err)
+	}
+
+	evicted, err := Prune(opts, 350)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{layers[1], layers[2]}; !reflect.DeepEqual(evicted, expected) {
+		t.Errorf("Expected %v to be evicted, got %v", expected, evicted)
+	}
+
+	for i, digest := range layers {
+		blob, err := layerBlobPath(opts, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = os.Stat(blob)
+		_, kept := LayerDiffID(opts, digest)
+		if i == 0 && (err != nil || !kept) {
+			t.Errorf("Layer %d was removed", i)
+		}
+		if i != 0 && (!os.IsNotExist(err) || kept) {
+			t.Errorf("Layer %d wasn't removed", i)
+		}
+	}
+
+	cache, err := ReadLayerCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache.Layers) != 1 || cache.Layers[layers[0]] == nil || cache.Layers[layers[0]].Size != 100 {
+		t.Errorf("Unexpected cache index %#v", cache.Layers)
+	}
+}
+
+func TestPruneReferencedLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	clock := time.Unix(0, 0)
+	accessTime = func() time.Time { return clock }
+	defer func() {
+		accessTime = time.Now
+	}()
+
+	opts := options
+	opts.registry = DefaultDockerURL
+	opts.image = Image
+	opts.destination = dir
+
+	opts.digest = "latest"
+	latest := keepTestLayers(t, opts, &clock, 100, 200)
+
+	opts.digest = "edge"
+	edge := keepTestLayers(t, opts, &clock, 300)
+
+	// latest now resolves to an image that only uses its base layer and the layer of edge
+	if err = ReferenceCachedLayers(opts, opts.repository()+":latest", latest[0], edge[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	evicted, err := Prune(opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{latest[1]}; !reflect.DeepEqual(evicted, expected) {
+		t.Errorf("Expected %v to be evicted, got %v", expected, evicted)
+	}
+
+	// edge still uses its layer once latest is released
+	if err = ReferenceCachedLayers(opts, opts.repository()+":latest"); err != nil {
+		t.Fatal(err)
+	}
+
+	evicted, err = Prune(opts, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{latest[0]}; !reflect.DeepEqual(evicted, expected) {
+		t.Errorf("Expected %v to be evicted, got %v", expected, evicted)
+	}
+
+	cache, err := ReadLayerCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if layer := cache.Layers[edge[0]]; layer == nil || !reflect.DeepEqual(layer.References, []string{opts.repository() + ":edge"}) {
+		t.Errorf("Unexpected cache index %#v", cache.Layers)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// ContainerConfig is the part of the image config that the container is created from
+type ContainerConfig struct {
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+}
+
+// ImageConfig is the config blob of a schema 2 image
+type ImageConfig struct {
+	Platform
+
+	Config *ContainerConfig `json:"config,omitempty"`
+	RootFS ImageRootFS      `json:"rootfs"`
+}
+
+// ImageRootFS lists the diffIDs of the layers of the image, base layer first
+type ImageRootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// ParseImageConfig returns the runtime config of the image. Both the schema 2 config blob and the
+// V1Compatibility of the topmost layer of a schema 1 manifest carry it in their config field,
+// so either can be passed. An image without a config results in an empty ContainerConfig.
+func ParseImageConfig(data []byte) (*ContainerConfig, error) {
+	image := struct {
+		Config *ContainerConfig `json:"config"`
+	}{}
+
+	if err := json.Unmarshal(data, &image); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshall image config: %s", err)
+	}
+
+	if image.Config == nil {
+		return &ContainerConfig{}, nil
+	}
+
+	return image.Config, nil
+}
+
+// ManifestImageConfig returns the runtime config of the image described by the schema 1 manifest,
+// which is held by the history of the topmost layer
+func ManifestImageConfig(manifest *Manifest) (*ContainerConfig, error) {
+	if len(manifest.History) == 0 {
+		return nil, errors.New("Manifest has no history")
+	}
+
+	// the history is ordered from the topmost layer down
+	return ParseImageConfig([]byte(manifest.History[0].V1Compatibility))
+}
+
+// FetchImageConfig downloads the config blob referenced by the schema 2 manifest, verifies it
+// against the digest the manifest has for it and returns it parsed. An image without a runtime
+// config gets an empty ContainerConfig.
+func FetchImageConfig(options ImageCOptions, manifest *ArtifactManifest) (*ImageConfig, error) {
+	defer trace.End(trace.Begin(options.image + "/" + manifest.Config.Digest))
+
+	if manifest.Config.Digest == "" {
+		return nil, errors.New("Manifest doesn't reference a config")
+	}
+
+	content, err := fetchConfigBlob(options, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ImageConfig{}
+	if err = json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshall image config: %s", err)
+	}
+
+	if config.Config == nil {
+		config.Config = &ContainerConfig{}
+	}
+
+	return config, nil
+}
+
+// fetchConfigBlob fetches the config blob into memory and verifies its digest
+func fetchConfigBlob(options ImageCOptions, config Descriptor) ([]byte, error) {
+	url, err := options.repositoryURL("blobs", config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	options.logger().Debugf("URL: %s", url)
+
+	fetcher := options.newFetcher(FetcherOptions{
+		Timeout:            options.timeout,
+		Username:           options.username,
+		Password:           options.password,
+		Token:              options.token,
+		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+	})
+	configFileName, err := fetcher.Fetch(url)
+	if err != nil {
+		if fetcher.IsStatusNotFound() {
+			return nil, ErrImageNotFound{Image: options.image, Reference: config.Digest, Registry: options.registry}
+		}
+		return nil, err
+	}
+	defer os.Remove(configFileName)
+
+	content, err := ioutil.ReadFile(configFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if bs := fmt.Sprintf("sha256:%x", sha256.Sum256(content)); bs != config.Digest {
+		return nil, ErrChecksum{Expected: config.Digest, Got: bs}
+	}
+
+	if config.Size > 0 && int64(len(content)) != config.Size {
+		return nil, fmt.Errorf("Config %s is %d bytes, expected %d", config.Digest, len(content), config.Size)
+	}
+
+	return content, nil
+}
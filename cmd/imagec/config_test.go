@@ -0,0 +1,161 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseImageConfig(t *testing.T) {
+	expected := &ContainerConfig{
+		Cmd:          []string{"nginx", "-g", "daemon off;"},
+		Env:          []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "NGINX_VERSION=1.11.1"},
+		WorkingDir:   "/srv",
+		ExposedPorts: map[string]struct{}{"443/tcp": {}, "80/tcp": {}},
+		Volumes:      map[string]struct{}{"/var/cache/nginx": {}},
+	}
+
+	// schema 2 config blob
+	blob := `{
+		"architecture": "amd64",
+		"config": {
+			"Cmd": ["nginx", "-g", "daemon off;"],
+			"Env": ["PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "NGINX_VERSION=1.11.1"],
+			"WorkingDir": "/srv",
+			"ExposedPorts": {"443/tcp": {}, "80/tcp": {}},
+			"Volumes": {"/var/cache/nginx": {}}
+		},
+		"rootfs": {"type": "layers", "diff_ids": []}
+	}`
+
+	config, err := ParseImageConfig([]byte(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, config)
+	}
+
+	// schema 1 manifest, the topmost layer comes first
+	manifest := &Manifest{
+		History: []History{
+			{V1Compatibility: `{"id":"top","parent":"base","config":{"Entrypoint":["/docker-entrypoint.sh"],"Cmd":["postgres"],"Env":["PGDATA=/var/lib/postgresql/data"]}}`},
+			{V1Compatibility: LayerHistory},
+		},
+	}
+
+	config, err = ManifestImageConfig(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = &ContainerConfig{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Cmd:        []string{"postgres"},
+		Env:        []string{"PGDATA=/var/lib/postgresql/data"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, config)
+	}
+
+	// layers without a config
+	config, err = ParseImageConfig([]byte(LayerHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, &ContainerConfig{}) {
+		t.Errorf("Expected an empty config, got %#v", config)
+	}
+
+	if _, err = ParseImageConfig([]byte("not json")); err == nil {
+		t.Errorf("Expected an error for an invalid config")
+	}
+
+	if _, err = ManifestImageConfig(&Manifest{}); err == nil {
+		t.Errorf("Expected an error for a manifest without history")
+	}
+}
+
+func TestFetchImageConfig(t *testing.T) {
+	blob := `{"architecture":"amd64","os":"linux","config":{"Cmd":["/bin/sh"]},` +
+		`"rootfs":{"type":"layers","diff_ids":["sha256:aaaa","sha256:bbbb"]}}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(blob)))
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(blob))
+		}))
+	defer s.Close()
+
+	// the temp files are cleaned up whether or not the blob verifies
+	tmp, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	saved := os.Getenv("TMPDIR")
+	os.Setenv("TMPDIR", tmp)
+	defer os.Setenv("TMPDIR", saved)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.token = &Token{Token: OAuthToken}
+
+	manifest := &ArtifactManifest{
+		SchemaVersion: 2,
+		Config:        Descriptor{MediaType: MediaTypeImageConfig, Digest: digest, Size: int64(len(blob))},
+	}
+
+	config, err := FetchImageConfig(opts, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Architecture != "amd64" || config.OS != "linux" {
+		t.Errorf("Unexpected platform %#v", config.Platform)
+	}
+	if !reflect.DeepEqual(config.Config, &ContainerConfig{Cmd: []string{"/bin/sh"}}) {
+		t.Errorf("Unexpected runtime config %#v", config.Config)
+	}
+	if !reflect.DeepEqual(config.RootFS.DiffIDs, []string{"sha256:aaaa", "sha256:bbbb"}) {
+		t.Errorf("Unexpected diffIDs %#v", config.RootFS.DiffIDs)
+	}
+
+	// a blob that doesn't match the digest of the manifest is rejected
+	manifest.Config.Digest = DigestSHA256EmptyTar
+	if _, err = FetchImageConfig(opts, manifest); err == nil {
+		t.Errorf("Expected a checksum error")
+	} else if _, ok := err.(ErrChecksum); !ok {
+		t.Errorf("Expected an ErrChecksum, got %#v", err)
+	}
+
+	manifest.Config = Descriptor{}
+	if _, err = FetchImageConfig(opts, manifest); err == nil {
+		t.Errorf("Expected an error for a manifest without config")
+	}
+
+	if files, _ := ioutil.ReadDir(tmp); len(files) != 0 {
+		t.Errorf("%d temp files were left behind", len(files))
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// The environment variables the registry credentials are read from when they aren't given as
+// options. The per-registry variants have the host the requests are sent to appended, upper-cased
+// and with anything but letters and digits replaced by _, as REGISTRY_USERNAME_MIRROR_EXAMPLE_COM_5000
+// for mirror.example.com:5000 or REGISTRY_USERNAME_DOCKER_IO for Docker Hub.
+const (
+	EnvRegistryUsername = "REGISTRY_USERNAME"
+	EnvRegistryPassword = "REGISTRY_PASSWORD"
+)
+
+// redacted replaces secrets in the log lines
+const redacted = "<redacted>"
+
+// redact returns the secret as it's written to the logs
+func redact(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+// registryEnvSuffix returns the suffix of the per-registry variables of host
+func registryEnvSuffix(host string) string {
+	return strings.Map(func(r rune) rune {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, host)
+}
+
+// EnvCredentials returns the username and password of the pull, reading those the options don't
+// give from the environment. The precedence is
+//
+//	-username and -password
+//	REGISTRY_USERNAME_<HOST> and REGISTRY_PASSWORD_<HOST>
+//	REGISTRY_USERNAME and REGISTRY_PASSWORD
+//	anonymous
+//
+// A per-registry pair is used as a whole if either of its variables is set. The host is the one
+// the requests are sent to, after the registry rewrite rules. The names of the variables the
+// credentials were read from are returned along with them.
+func EnvCredentials(options ImageCOptions, getenv func(string) string) (username, password string, sources []string) {
+	username, password = options.username, options.password
+	if username != "" && password != "" {
+		return username, password, nil
+	}
+
+	names := [][2]string{{EnvRegistryUsername, EnvRegistryPassword}}
+	if u, _, err := options.remote(); err == nil && u.Host != "" {
+		host := u.Host
+		if dockerHubHosts[host] {
+			host = dockerHubName
+		}
+
+		suffix := "_" + registryEnvSuffix(host)
+		names = append([][2]string{{EnvRegistryUsername + suffix, EnvRegistryPassword + suffix}}, names...)
+	}
+
+	for _, pair := range names {
+		envUsername, envPassword := getenv(pair[0]), getenv(pair[1])
+		if envUsername == "" && envPassword == "" {
+			continue
+		}
+
+		if username == "" && envUsername != "" {
+			username = envUsername
+			sources = append(sources, pair[0])
+		}
+		if password == "" && envPassword != "" {
+			password = envPassword
+			sources = append(sources, pair[1])
+		}
+		break
+	}
+
+	return username, password, sources
+}
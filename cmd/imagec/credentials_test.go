@@ -0,0 +1,90 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEnvCredentials(t *testing.T) {
+	env := map[string]string{
+		"REGISTRY_USERNAME":                         "ci",
+		"REGISTRY_PASSWORD":                         "ci-secret",
+		"REGISTRY_USERNAME_DOCKER_IO":               "hub",
+		"REGISTRY_PASSWORD_DOCKER_IO":               "hub-secret",
+		"REGISTRY_PASSWORD_MIRROR_EXAMPLE_COM_5000": "mirror-secret",
+	}
+	getenv := func(name string) string {
+		return env[name]
+	}
+
+	mirror, err := ParseRegistryRewrite("quay.io=mirror.example.com:5000/quay")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		registry string
+		username string
+		password string
+		rewrites []RegistryRewrite
+
+		expectUsername string
+		expectPassword string
+		expectSources  []string
+	}{
+		// explicit options win
+		{DefaultDockerURL, "me", "secret", nil, "me", "secret", nil},
+		// per-registry variables win over the generic ones
+		{DefaultDockerURL, "", "", nil, "hub", "hub-secret", []string{"REGISTRY_USERNAME_DOCKER_IO", "REGISTRY_PASSWORD_DOCKER_IO"}},
+		{"https://index.docker.io", "", "", nil, "hub", "hub-secret", []string{"REGISTRY_USERNAME_DOCKER_IO", "REGISTRY_PASSWORD_DOCKER_IO"}},
+		// options fill in only what's missing
+		{DefaultDockerURL, "me", "", nil, "me", "hub-secret", []string{"REGISTRY_PASSWORD_DOCKER_IO"}},
+		// registries without their own variables use the generic ones
+		{"https://quay.io", "", "", nil, "ci", "ci-secret", []string{"REGISTRY_USERNAME", "REGISTRY_PASSWORD"}},
+		// the per-registry pair is used as a whole and is that of the rewritten host
+		{"https://quay.io", "", "", []RegistryRewrite{mirror}, "", "mirror-secret", []string{"REGISTRY_PASSWORD_MIRROR_EXAMPLE_COM_5000"}},
+	}
+
+	for i, test := range tests {
+		opts := options
+		opts.registry = test.registry
+		opts.image = Image
+		opts.username = test.username
+		opts.password = test.password
+		opts.rewrites = test.rewrites
+
+		username, password, sources := EnvCredentials(opts, getenv)
+		if username != test.expectUsername || password != test.expectPassword {
+			t.Errorf("%d: expected %q/%q, got %q/%q", i, test.expectUsername, test.expectPassword, username, password)
+		}
+		if !reflect.DeepEqual(sources, test.expectSources) {
+			t.Errorf("%d: expected the credentials from %v, got %v", i, test.expectSources, sources)
+		}
+	}
+
+	// anonymous without any variables
+	opts := options
+	opts.registry = DefaultDockerURL
+	opts.username, opts.password = "", ""
+	if username, password, sources := EnvCredentials(opts, func(string) string { return "" }); username != "" || password != "" || sources != nil {
+		t.Errorf("expected anonymous, got %q/%q from %v", username, password, sources)
+	}
+
+	if redact("hub-secret") != redacted || redact("") != "" {
+		t.Errorf("password wasn't redacted")
+	}
+}
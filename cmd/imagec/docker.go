@@ -15,7 +15,9 @@
 package main
 
 import (
+	"bufio"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,20 +25,41 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"strings"
 	"time"
 
-	log "github.com/Sirupsen/logrus"
-
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/progress"
 
 	"github.com/vmware/vic/pkg/trace"
 )
 
+// Layer media types, used to validate the format of the downloaded layer
+const (
+	MediaTypeLayer                = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeUncompressedLayer    = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeOCILayer             = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCIUncompressedLayer = "application/vnd.oci.image.layer.v1.tar"
+)
+
+// layerCompression maps the layer media types to the compression of the layer
+var layerCompression = map[string]archive.Compression{
+	MediaTypeLayer:                archive.Gzip,
+	MediaTypeUncompressedLayer:    archive.Uncompressed,
+	MediaTypeOCILayer:             archive.Gzip,
+	MediaTypeOCIUncompressedLayer: archive.Uncompressed,
+}
+
 // FSLayer is a container struct for BlobSums defined in an image manifest
 type FSLayer struct {
 	// BlobSum is the tarsum of the referenced filesystem image layer
 	BlobSum string `json:"blobSum"`
+
+	// MediaType is the media type of the layer, if known
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Size is the size of the compressed layer, if known
+	Size int64 `json:"size,omitempty"`
 }
 
 // History is a container struct for V1Compatibility defined in an image manifest
@@ -51,6 +74,33 @@ type Manifest struct {
 	FSLayers []FSLayer `json:"fsLayers"`
 	History  []History `json:"history"`
 	// ignoring signatures
+
+	// Digest identifies the manifest in the registry, it isn't part of the document
+	Digest string `json:"-"`
+}
+
+// BlobSums returns the digests of the layers of the manifest
+func (m *Manifest) BlobSums() []string {
+	sums := make([]string, len(m.FSLayers))
+	for i, layer := range m.FSLayers {
+		sums[i] = layer.BlobSum
+	}
+	return sums
+}
+
+// SetLayerSizes records the sizes of the layers that are among blobs, such as the layers of the
+// OCI manifest of the same image - schema 1 manifests don't have them
+func (m *Manifest) SetLayerSizes(blobs []Descriptor) {
+	sizes := make(map[string]int64)
+	for _, blob := range blobs {
+		sizes[blob.Digest] = blob.Size
+	}
+
+	for i := range m.FSLayers {
+		if size, ok := sizes[m.FSLayers[i].BlobSum]; ok && size > 0 {
+			m.FSLayers[i].Size = size
+		}
+	}
 }
 
 // V1Compatibility represents some parts of V1Compatibility
@@ -66,49 +116,140 @@ type V1Compatibility struct {
 func LearnAuthURL(options ImageCOptions) (*url.URL, error) {
 	defer trace.End(trace.Begin(options.image + "/" + options.digest))
 
-	url, err := url.Parse(options.registry)
+	url, err := options.repositoryURL("manifests", options.digest)
 	if err != nil {
 		return nil, err
 	}
-	url.Path = path.Join(url.Path, options.image, "manifests", options.digest)
 
-	log.Debugf("URL: %s", url)
+	options.logger().Debugf("URL: %s", url)
 
-	fetcher := NewFetcher(FetcherOptions{
+	// Probe anonymously so that the registry tells us which auth scheme it expects
+	fetcher := options.newFetcher(FetcherOptions{
 		Timeout:            options.timeout,
-		Username:           options.username,
-		Password:           options.password,
 		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
 	})
 	// We expect docker registry to return a 401 to us - with a WWW-Authenticate header
 	// We parse that header and learn the OAuth endpoint to fetch OAuth token.
 	_, err = fetcher.Fetch(url)
+
+	// Fail early on registries that only speak the v1 API instead of choking on their responses
+	if verr := checkAPIVersion(options, fetcher); verr != nil {
+		return nil, verr
+	}
+
 	if err != nil && fetcher.IsStatusUnauthorized() {
-		return fetcher.AuthURL(), nil
+		// Registry doesn't have a token service, Fetchers send the credentials with every request
+		if fetcher.IsBasicAuth() {
+			if options.username == "" || options.password == "" {
+				return nil, ErrUnauthorized{
+					URL:     url.String(),
+					Message: fmt.Sprintf("%s requires basic authentication but no credentials were given", options.registry),
+				}
+			}
+			options.logger().Debugf("%s uses basic authentication", url)
+			return nil, nil
+		}
+		return addPullScope(fetcher.AuthURL(), options), nil
 	}
 
 	// Private registry returned the manifest directly as auth option is optional.
 	// https://github.com/docker/distribution/blob/master/docs/configuration.md#auth
 	if err == nil && options.registry != DefaultDockerURL && fetcher.IsStatusOK() {
-		log.Debugf("%s does not support OAuth", url)
+		options.logger().Debugf("%s does not support OAuth", url)
 		return nil, nil
 	}
 
 	// Do we even have the image on that registry
 	if err != nil && fetcher.IsStatusNotFound() {
-		return nil, fmt.Errorf("%s:%s does not exists at %s", options.image, options.digest, options.registry)
+		return nil, ErrImageNotFound{Image: options.image, Reference: options.digest, Registry: options.registry}
 	}
 
 	return nil, fmt.Errorf("%s returned an unexpected response: %s", url, err)
 }
 
+// addPullScope adds the pull scope of the repository to the token request unless the challenge
+// already asked for a scope on it. Registries that challenge without a scope hand out tokens
+// that grant nothing unless the repository is asked for explicitly.
+func addPullScope(auth *url.URL, options ImageCOptions) *url.URL {
+	// the token is for the repository the requests are sent to, which a rewrite rule may change
+	repository := options.repository()
+	if _, remote, err := options.remote(); err == nil {
+		repository = remote
+	}
+	prefix := "repository:" + repository + ":"
+
+	q := auth.Query()
+	for _, scope := range q["scope"] {
+		if strings.HasPrefix(scope, prefix) {
+			return auth
+		}
+	}
+
+	q.Add("scope", prefix+"pull")
+	auth.RawQuery = q.Encode()
+
+	return auth
+}
+
+// APIVersionHeader is set by v2 registries on their responses
+const (
+	APIVersionHeader = "Docker-Distribution-Api-Version"
+	APIVersion       = "registry/2.0"
+)
+
+// checkAPIVersion verifies that the registry that sent the last response of fetcher supports the v2 API.
+// The version header is authoritative, if it's missing the registry is pinged on its /v2/ endpoint
+// which a v2 registry answers with either 200 or 401.
+func checkAPIVersion(options ImageCOptions, fetcher Fetcher) error {
+	hdr := fetcher.ResponseHeader()
+	if hdr == nil {
+		// no response at all, nothing to tell
+		return nil
+	}
+
+	if strings.TrimSpace(hdr.Get(APIVersionHeader)) == APIVersion {
+		return nil
+	}
+
+	ping, err := options.registryURL()
+	if err != nil {
+		return err
+	}
+
+	options.logger().Debugf("%s is missing, pinging %s", APIVersionHeader, ping)
+
+	pinger := options.newFetcher(FetcherOptions{
+		Timeout:            options.timeout,
+		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+	})
+	name, err := pinger.Fetch(ping)
+	if err == nil {
+		os.Remove(name)
+		return nil
+	}
+
+	if pinger.IsStatusUnauthorized() {
+		return nil
+	}
+
+	if pinger.ResponseHeader() == nil {
+		// the ping didn't get through, leave the error to the actual requests
+		return nil
+	}
+
+	return ErrUnsupportedAPI{Registry: options.registry}
+}
+
 // FetchToken fetches the OAuth token from OAuth endpoint
-func FetchToken(url *url.URL) (*Token, error) {
+func FetchToken(options ImageCOptions, url *url.URL) (*Token, error) {
 	defer trace.End(trace.Begin(url.String()))
 
-	log.Debugf("URL: %s", url)
+	options.logger().Debugf("URL: %s", url)
 
-	fetcher := NewFetcher(FetcherOptions{
+	// The fingerprint pins the registry certificate, the token service can be another host with its own
+	fetcher := options.newFetcher(FetcherOptions{
 		Timeout:            options.timeout,
 		Username:           options.username,
 		Password:           options.password,
@@ -144,6 +285,36 @@ func FetchToken(url *url.URL) (*Token, error) {
 	return token, nil
 }
 
+// ValidateToken checks that the registry accepts the token for the manifest of the image.
+// An ErrUnauthorized is returned if the token is rejected.
+func ValidateToken(options ImageCOptions) error {
+	defer trace.End(trace.Begin(options.image + "/" + options.digest))
+
+	url, err := options.repositoryURL("manifests", options.digest)
+	if err != nil {
+		return err
+	}
+
+	options.logger().Debugf("URL: %s", url)
+
+	fetcher := options.newFetcher(FetcherOptions{
+		Timeout:            options.timeout,
+		Token:              options.token,
+		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+	})
+	manifestFileName, err := fetcher.Fetch(url)
+	if err != nil {
+		if fetcher.IsStatusNotFound() {
+			return ErrImageNotFound{Image: options.image, Reference: options.digest, Registry: options.registry}
+		}
+		return err
+	}
+	os.Remove(manifestFileName)
+
+	return nil
+}
+
 // FetchImageBlob fetches the image blob
 func FetchImageBlob(options ImageCOptions, image *ImageWithMeta) (string, error) {
 	defer trace.End(trace.Begin(options.image + "/" + image.layer.BlobSum))
@@ -153,25 +324,70 @@ func FetchImageBlob(options ImageCOptions, image *ImageWithMeta) (string, error)
 	history := image.history.V1Compatibility
 	diffID := ""
 
-	url, err := url.Parse(options.registry)
+	logger := options.logger().WithField("layer", id)
+
+	// the layers above wait for this one to be applied to the rootfs, let them go however this ends
+	if image.applied != nil {
+		defer close(image.applied)
+	}
+
+	url, err := options.repositoryURL("blobs", layer)
 	if err != nil {
 		return diffID, err
 	}
-	url.Path = path.Join(url.Path, options.image, "blobs", layer)
 
-	log.Debugf("URL: %s\n ", url)
+	logger.Debugf("URL: %s", url)
 
+	po := options.progressOutput()
 	progress.Update(po, image.String(), "Pulling fs layer")
 
-	fetcher := NewFetcher(FetcherOptions{
+	fo := FetcherOptions{
 		Timeout:            options.timeout,
 		Username:           options.username,
 		Password:           options.password,
-		Token:              options.token,
+		Token:              options.currentToken(),
 		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+		Progress:           po,
+		RateLimit:          options.rateLimit,
+		Limiter:            options.limiter,
+		Meter:              options.meter,
+		MaxSize:            options.maxLayerSize,
+		DisableCompression: true,
+	}
+
+	// the layer is downloaded next to where it ends up, where a later pull finds what's done
+	if options.pullState != nil {
+		fo.ResumeFile = partialLayerPath(options, id)
+		if err = os.MkdirAll(path.Dir(fo.ResumeFile), 0755); err != nil {
+			return diffID, err
+		}
+	}
+
+	// the layer only starts downloading once it fits in the budget of the pull. The budget is
+	// returned once it's downloaded, the layers waiting for the one below them must not hold it.
+	if options.budget != nil {
+		options.budget.Acquire(image.size)
+	}
+
+	var imageFileName string
+	fetcher, err := options.fetchWithRefresh(fo, func(fetcher Fetcher) (err error) {
+		imageFileName, err = fetcher.FetchWithProgress(url, image.String())
+		return err
 	})
-	imageFileName, err := fetcher.FetchWithProgress(url, image.String())
+
+	if options.budget != nil {
+		options.budget.Release(image.size)
+	}
+
 	if err != nil {
+		if fetcher.IsStatusNotFound() {
+			return diffID, ErrImageNotFound{Image: options.image, Reference: layer, Registry: options.registry}
+		}
+		if e, ok := err.(ErrLayerTooLarge); ok {
+			e.Layer = layer
+			return diffID, e
+		}
 		return diffID, err
 	}
 
@@ -200,74 +416,190 @@ func FetchImageBlob(options ImageCOptions, image *ImageWithMeta) (string, error)
 	blobTr := io.TeeReader(imageFile, blobSum)
 
 	progress.Update(po, image.String(), "Verifying Checksum")
-	tar, err := archive.DecompressStream(blobTr)
+
+	// detect the format so that it can be validated against the media type
+	buf := bufio.NewReader(blobTr)
+	header, err := buf.Peek(10)
+	if err != nil && err != io.EOF {
+		return diffID, err
+	}
+
+	compression := archive.DetectCompression(header)
+	if expected, ok := layerCompression[image.layer.MediaType]; ok && expected != compression {
+		err = fmt.Errorf("Layer %s is a %s, expected a %s for media type %s",
+			layer, compression.Extension(), expected.Extension(), image.layer.MediaType)
+		return diffID, err
+	}
+
+	if compression == archive.Uncompressed {
+		// the diffID is the same as the blobSum
+		logger.Infof("Layer %s is not compressed", layer)
+	}
+
+	tar, err := archive.DecompressStream(buf)
 	if err != nil {
 		return diffID, err
 	}
 
+	// a small compressed layer can expand without bound, stop reading one byte past the limit
+	var uncompressed io.Reader = tar
+	if options.maxLayerSize > 0 {
+		uncompressed = io.LimitReader(tar, options.maxLayerSize+1)
+	}
+
 	// Copy bytes from decompressed layer into diffIDSum to calculate diffID
-	if _, cerr := io.Copy(diffIDSum, tar); cerr != nil {
-		return diffID, cerr
+	n, err := io.Copy(diffIDSum, uncompressed)
+	if err != nil {
+		return diffID, err
+	}
+
+	if options.maxLayerSize > 0 && n > options.maxLayerSize {
+		err = ErrLayerTooLarge{Layer: layer, Limit: options.maxLayerSize}
+		return diffID, err
 	}
 
 	bs := fmt.Sprintf("sha256:%x", blobSum.Sum(nil))
 	if bs != layer {
-		return diffID, fmt.Errorf("Failed to validate layer checksum. Expected %s got %s", layer, bs)
+		err = ErrChecksum{Expected: layer, Got: bs}
+		return diffID, err
 	}
 
 	diffID = fmt.Sprintf("sha256:%x", diffIDSum.Sum(nil))
 
-	log.Infof("diffID for layer %s: %s", id, diffID)
+	logger.Infof("diffID for layer %s: %s", id, diffID)
 
 	// Ensure the parent directory exists
-	destination := path.Join(DestinationDirectory(), id)
+	destination := path.Join(DestinationDirectory(options), id)
 	err = os.MkdirAll(destination, 0755)
 	if err != nil {
 		return diffID, err
 	}
 
-	// Move(rename) the temporary file to its final destination
-	err = os.Rename(string(imageFileName), path.Join(destination, id+".tar"))
+	// Dump the history next to it, before the layer so that a present layer has its history
+	err = writeFile(path.Join(destination, id+".json"), []byte(history), 0644, options.fsync)
 	if err != nil {
 		return diffID, err
 	}
 
-	// Dump the history next to it
-	err = ioutil.WriteFile(path.Join(destination, id+".json"), []byte(history), 0644)
+	// a crash after the rename mustn't leave a truncated layer under its final name
+	if options.fsync {
+		if err = imageFile.Sync(); err != nil {
+			return diffID, err
+		}
+	}
+
+	// Move(rename) the temporary file to its final destination
+	err = os.Rename(string(imageFileName), path.Join(destination, id+".tar"))
 	if err != nil {
 		return diffID, err
 	}
 
+	if options.fsync {
+		if err = syncDir(destination); err != nil {
+			return diffID, err
+		}
+	}
+
+	if options.keepLayers {
+		if err = keepLayerBlob(options, layer, diffID, path.Join(destination, id+".tar")); err != nil {
+			return diffID, err
+		}
+	}
+
+	if options.pullState != nil {
+		if err = options.pullState.Complete(id, diffID); err != nil {
+			return diffID, err
+		}
+	}
+
+	if options.rootfs != "" {
+		progress.Update(po, image.String(), "Extracting")
+		if err = applyImageLayer(options.rootfs, image, path.Join(destination, id+".tar")); err != nil {
+			return diffID, err
+		}
+	}
+
 	progress.Update(po, image.String(), "Download complete")
 
 	return diffID, nil
 }
 
-// FetchImageManifest fetches the image manifest file
+// ManifestETagFile holds the ETag of the manifest stored next to it
+const ManifestETagFile = "manifest.etag"
+
+// manifestETag returns the ETag of the manifest stored in dir, empty if there's no manifest
+// stored or no ETag for it
+func manifestETag(dir string) string {
+	if _, err := os.Stat(path.Join(dir, "manifest.json")); err != nil {
+		return ""
+	}
+
+	etag, err := ioutil.ReadFile(path.Join(dir, ManifestETagFile))
+	if err != nil {
+		return ""
+	}
+
+	return string(etag)
+}
+
+// FetchImageManifest fetches the image manifest file. A manifest fetched before is only
+// downloaded again if the registry reports that it changed.
 func FetchImageManifest(options ImageCOptions) (*Manifest, error) {
+	manifest, _, _, err := fetchImageManifest(options, nil)
+	return manifest, err
+}
+
+// fetchImageManifest fetches the manifest the reference resolves to, accepting the given media
+// types as well as schema 1. An OCI manifest, which may be that of an artifact, is returned as it
+// is along with its content. Only schema 1 manifests are kept for the next fetch.
+func fetchImageManifest(options ImageCOptions, accept []string) (*Manifest, *ArtifactManifest, []byte, error) {
 	defer trace.End(trace.Begin(options.image + "/" + options.digest))
 
-	url, err := url.Parse(options.registry)
+	url, err := options.repositoryURL("manifests", options.digest)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
-	url.Path = path.Join(url.Path, options.image, "manifests", options.digest)
 
-	log.Debugf("URL: %s", url)
+	options.logger().Debugf("URL: %s", url)
+
+	destination := DestinationDirectory(options)
+	cached := path.Join(destination, "manifest.json")
+
+	// the ETag is only sent while the manifest it's for is on disk
+	headers := options.headers
+	etag := manifestETag(destination)
+	if etag != "" {
+		headers = map[string]string{"If-None-Match": etag}
+		for name, value := range options.headers {
+			headers[name] = value
+		}
+	}
 
-	fetcher := NewFetcher(FetcherOptions{
-		Timeout:            10 * time.Second,
+	fetcher := options.newFetcher(FetcherOptions{
+		Timeout:            options.manifestTimeout,
 		Username:           options.username,
 		Password:           options.password,
 		Token:              options.token,
 		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+		Headers:            headers,
+		Accept:             accept,
 	})
 	manifestFileName, err := fetcher.Fetch(url)
+
+	notModified := err != nil && etag != "" && fetcher.IsStatusNotModified()
+	if notModified {
+		options.logger().Debugf("Manifest of %s:%s is unchanged", options.image, options.digest)
+		manifestFileName, err = cached, nil
+	}
 	if err != nil {
-		return nil, err
+		if fetcher.IsStatusNotFound() {
+			return nil, nil, nil, ErrImageNotFound{Image: options.image, Reference: options.digest, Registry: options.registry}
+		}
+		return nil, nil, nil, err
 	}
 
-	// Cleanup function for the error case
+	// Cleanup function for the error case, a cached manifest that's no good is dropped as well
 	defer func() {
 		if err != nil {
 			os.Remove(manifestFileName)
@@ -277,36 +609,256 @@ func FetchImageManifest(options ImageCOptions) (*Manifest, error) {
 	// Read the entire file into []byte for json.Unmarshal
 	content, err := ioutil.ReadFile(manifestFileName)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+
+	if !notModified {
+		if err = checkManifestMediaType(options, fetcher.ResponseHeader().Get("Content-Type"), content); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	// the digest the registry reports has to be that of the manifest it sent
+	digest, err := manifestDigest(content)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if reported := fetcher.ResponseHeader().Get("Docker-Content-Digest"); reported != "" && reported != digest {
+		err = ErrManifestMismatch{Field: "Docker-Content-Digest", Expected: reported, Got: digest}
+		return nil, nil, nil, err
+	}
+
+	// a manifest fetched by digest has to be the one named
+	if options.byDigest() && digest != options.digest {
+		err = ErrManifestMismatch{Field: "digest", Expected: options.digest, Got: digest}
+		return nil, nil, nil, err
+	}
+
+	oci := &ArtifactManifest{}
+	if err = json.Unmarshal(content, oci); err != nil {
+		return nil, nil, nil, err
+	}
+	if oci.SchemaVersion == 2 {
+		if !notModified {
+			os.Remove(manifestFileName)
+		}
+		oci.Digest = digest
+		return nil, oci, content, nil
 	}
 
 	manifest := &Manifest{}
 
 	err = json.Unmarshal(content, manifest)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
+	}
+
+	// a mirror may name the manifest after the repository it serves it from
+	if manifest.Name != options.repository() && !options.isRemoteRepository(manifest.Name) {
+		err = ErrManifestMismatch{Field: "name", Expected: options.repository(), Got: manifest.Name}
+		return nil, nil, nil, err
 	}
+	manifest.Digest = digest
 
-	if manifest.Name != options.image {
-		return nil, fmt.Errorf("name doesn't match what was requested, expected: %s, downloaded: %s", options.image, manifest.Name)
+	// the tag of a manifest fetched by digest is whichever it was pushed with
+	if !options.byDigest() && manifest.Tag != options.digest {
+		err = ErrManifestMismatch{Field: "tag", Expected: options.digest, Got: manifest.Tag}
+		return nil, nil, nil, err
 	}
 
-	if manifest.Tag != options.digest {
-		return nil, fmt.Errorf("tag doesn't match what was requested, expected: %s, downloaded: %s", options.digest, manifest.Tag)
+	if notModified {
+		return manifest, nil, nil, nil
 	}
 
 	// Ensure the parent directory exists
-	destination := DestinationDirectory()
 	err = os.MkdirAll(destination, 0755)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
 	// Move(rename) the temporary file to its final destination
-	err = os.Rename(string(manifestFileName), path.Join(destination, "manifest.json"))
+	err = os.Rename(string(manifestFileName), cached)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Remember the ETag for the next fetch, the digest serves as one if the registry doesn't send it
+	header := fetcher.ResponseHeader()
+	etag = header.Get("ETag")
+	if etag == "" && header.Get("Docker-Content-Digest") != "" {
+		etag = `"` + header.Get("Docker-Content-Digest") + `"`
+	}
+
+	if etag == "" {
+		os.Remove(path.Join(destination, ManifestETagFile))
+	} else if werr := ioutil.WriteFile(path.Join(destination, ManifestETagFile), []byte(etag), 0644); werr != nil {
+		options.logger().Warnf("Failed to store the ETag of the manifest: %s", werr)
+	}
+
+	return manifest, nil, nil, nil
+}
+
+// manifestDigest returns the digest of the manifest content. The digest of a signed schema 1
+// manifest is that of its payload, which is the content with the signatures cut out as their
+// protected header describes.
+func manifestDigest(content []byte) (string, error) {
+	var signed struct {
+		Signatures []struct {
+			Protected string `json:"protected"`
+		} `json:"signatures"`
+	}
+	if err := json.Unmarshal(content, &signed); err != nil {
+		return "", err
+	}
+
+	payload := content
+	if len(signed.Signatures) > 0 {
+		var header struct {
+			FormatLength int    `json:"formatLength"`
+			FormatTail   string `json:"formatTail"`
+		}
+
+		protected, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed.Signatures[0].Protected, "="))
+		if err == nil {
+			err = json.Unmarshal(protected, &header)
+		}
+		if err != nil {
+			return "", fmt.Errorf("Invalid protected header of the manifest signature: %s", err)
+		}
+
+		tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(header.FormatTail, "="))
+		if err != nil || header.FormatLength <= 0 || header.FormatLength > len(content) {
+			return "", fmt.Errorf("Invalid format of the signed manifest")
+		}
+
+		payload = append(content[:header.FormatLength:header.FormatLength], tail...)
+	}
+
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(payload)), nil
+}
+
+// Tags represents the response of the registry tags/list endpoint
+type Tags struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ListTags returns all tags of the repository, following the pagination links of the registry
+func ListTags(options ImageCOptions) ([]string, error) {
+	defer trace.End(trace.Begin(options.image))
+
+	url, err := options.repositoryURL("tags", "list")
 	if err != nil {
 		return nil, err
 	}
 
-	return manifest, nil
+	var tags []string
+	for url != nil {
+		options.logger().Debugf("URL: %s", url)
+
+		fetcher := options.newFetcher(FetcherOptions{
+			Timeout:            options.manifestTimeout,
+			Username:           options.username,
+			Password:           options.password,
+			Token:              options.token,
+			InsecureSkipVerify: options.insecure,
+			PinnedFingerprint:  options.fingerprint,
+		})
+		tagsFileName, err := fetcher.Fetch(url)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := ioutil.ReadFile(tagsFileName)
+		os.Remove(tagsFileName)
+		if err != nil {
+			return nil, err
+		}
+
+		page := &Tags{}
+		if err = json.Unmarshal(content, page); err != nil {
+			return nil, err
+		}
+		tags = append(tags, page.Tags...)
+
+		url, err = nextLink(url, fetcher.ResponseHeader().Get("Link"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tags, nil
+}
+
+// ResolveDigestPrefix returns a tag of the repository whose manifest digest starts with the hex
+// prefix. The manifest of every tag is fetched to learn its digest, the prefix has to match the
+// digest of exactly one of them.
+func ResolveDigestPrefix(options ImageCOptions, prefix string) (string, error) {
+	defer trace.End(trace.Begin(options.image + "@" + prefix))
+
+	tags, err := ListTags(options)
+	if err != nil {
+		return "", fmt.Errorf("Failed to list tags: %s", err)
+	}
+
+	// digest -> the first tag that references it
+	matches := make(map[string]string)
+	var digests []string
+	for _, tag := range tags {
+		opts := options
+		opts.digest = tag
+
+		_, _, digest, err := fetchManifest(opts, inspectAccept)
+		if err != nil {
+			return "", fmt.Errorf("Failed to fetch the manifest of %s: %s", tag, err)
+		}
+
+		if !strings.HasPrefix(digest, "sha256:"+prefix) {
+			continue
+		}
+		if _, ok := matches[digest]; !ok {
+			matches[digest] = tag
+			digests = append(digests, digest)
+		}
+	}
+
+	switch len(digests) {
+	case 0:
+		return "", ErrImageNotFound{Image: options.image, Reference: "sha256:" + prefix, Registry: options.registry}
+	case 1:
+		options.logger().Debugf("Resolved %s@%s to %s (%s)", options.image, prefix, matches[digests[0]], digests[0])
+		return matches[digests[0]], nil
+	default:
+		return "", ErrAmbiguousDigest{Image: options.image, Prefix: prefix, Digests: digests}
+	}
+}
+
+// nextLink parses a RFC 5988 Link header and returns the rel="next" URL resolved against base.
+// It returns nil if there is no next page.
+func nextLink(base *url.URL, hdr string) (*url.URL, error) {
+	for _, link := range strings.Split(hdr, ",") {
+		parts := strings.Split(link, ";")
+		if len(parts) < 2 {
+			continue
+		}
+
+		next := false
+		for _, param := range parts[1:] {
+			if strings.Replace(strings.TrimSpace(param), " ", "", -1) == `rel="next"` {
+				next = true
+			}
+		}
+		if !next {
+			continue
+		}
+
+		ref := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+		u, err := url.Parse(ref)
+		if err != nil {
+			return nil, fmt.Errorf("Link header is corrupted: %s", err)
+		}
+		return base.ResolveReference(u), nil
+	}
+
+	return nil, nil
 }
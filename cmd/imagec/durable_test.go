@@ -0,0 +1,85 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestFetchImageBlobFsync(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(LayerContent))
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.fsync = true
+
+	parent := "scratch"
+	image := ImageWithMeta{
+		Image: &models.Image{
+			ID:     LayerID,
+			Parent: &parent,
+			Store:  Storename,
+		},
+		history: History{V1Compatibility: LayerHistory},
+		layer:   FSLayer{BlobSum: DigestSHA256LayerContent},
+	}
+
+	if _, err = FetchImageBlob(opts, &image); err != nil {
+		t.Fatal(err)
+	}
+
+	destination := path.Join(DestinationDirectory(opts), LayerID)
+
+	layer, err := ioutil.ReadFile(path.Join(destination, LayerID+".tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(layer) != LayerContent {
+		t.Errorf("Layer is %d bytes, expected %d", len(layer), len(LayerContent))
+	}
+
+	history, err := ioutil.ReadFile(path.Join(destination, LayerID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(history) != LayerHistory {
+		t.Errorf("Unexpected history %q", history)
+	}
+
+	// a layer dir that isn't there can't be synced
+	if err = syncDir(path.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected syncing a missing directory to fail")
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Error is implemented by the errors imagec returns for the failures callers need to tell
+// apart. Type switch on the concrete type to find out what went wrong.
+type Error interface {
+	error
+
+	// Temporary reports whether retrying the operation may succeed
+	Temporary() bool
+}
+
+// ErrImageNotFound is returned when the registry doesn't have the requested image or layer
+type ErrImageNotFound struct {
+	Image     string
+	Reference string
+	Registry  string
+}
+
+func (e ErrImageNotFound) Error() string {
+	return fmt.Sprintf("%s:%s does not exists at %s", e.Image, e.Reference, e.Registry)
+}
+
+// Temporary is false as the image won't appear by retrying
+func (e ErrImageNotFound) Temporary() bool {
+	return false
+}
+
+// ErrUnauthorized is returned when the registry refuses the request for lack of valid credentials
+type ErrUnauthorized struct {
+	URL     string
+	Message string
+}
+
+func (e ErrUnauthorized) Error() string {
+	return e.Message
+}
+
+// Temporary is false as the same credentials are refused again
+func (e ErrUnauthorized) Temporary() bool {
+	return false
+}
+
+// ErrManifestMismatch is returned when the downloaded manifest isn't for the requested image
+type ErrManifestMismatch struct {
+	Field    string
+	Expected string
+	Got      string
+}
+
+func (e ErrManifestMismatch) Error() string {
+	return fmt.Sprintf("%s doesn't match what was requested, expected: %s, downloaded: %s", e.Field, e.Expected, e.Got)
+}
+
+// Temporary is false as the registry serves the same manifest again
+func (e ErrManifestMismatch) Temporary() bool {
+	return false
+}
+
+// ErrChecksum is returned when the digest of a downloaded layer doesn't match its blobSum
+type ErrChecksum struct {
+	Expected string
+	Got      string
+}
+
+func (e ErrChecksum) Error() string {
+	return fmt.Sprintf("Failed to validate layer checksum. Expected %s got %s", e.Expected, e.Got)
+}
+
+// Temporary is true as the layer may have been corrupted in transit
+func (e ErrChecksum) Temporary() bool {
+	return true
+}
+
+// ErrUnsupportedAPI is returned when the registry doesn't support the v2 API
+type ErrUnsupportedAPI struct {
+	Registry string
+}
+
+func (e ErrUnsupportedAPI) Error() string {
+	return fmt.Sprintf("%s does not support registry API v2", e.Registry)
+}
+
+// Temporary is false as the registry won't start speaking v2 by retrying
+func (e ErrUnsupportedAPI) Temporary() bool {
+	return false
+}
+
+// ErrLayerTooLarge is returned when a layer is larger than the maximum layer size, either as
+// downloaded or once decompressed
+type ErrLayerTooLarge struct {
+	// Layer is the digest of the layer, or the URL it was downloaded from
+	Layer string
+	Limit int64
+}
+
+func (e ErrLayerTooLarge) Error() string {
+	return fmt.Sprintf("Layer %s exceeds the maximum layer size of %d bytes", e.Layer, e.Limit)
+}
+
+// Temporary is false as the layer doesn't shrink by retrying
+func (e ErrLayerTooLarge) Temporary() bool {
+	return false
+}
+
+// ErrInsufficientSpace is returned when there isn't enough free space to pull the image
+type ErrInsufficientSpace struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e ErrInsufficientSpace) Error() string {
+	return fmt.Sprintf("Insufficient space in %s: %d bytes required, %d bytes available", e.Path, e.Required, e.Available)
+}
+
+// Temporary is false as the space won't be freed by retrying
+func (e ErrInsufficientSpace) Temporary() bool {
+	return false
+}
+
+// ErrAmbiguousDigest is returned when a digest prefix matches the manifests of more than one image
+type ErrAmbiguousDigest struct {
+	Image   string
+	Prefix  string
+	Digests []string
+}
+
+func (e ErrAmbiguousDigest) Error() string {
+	return fmt.Sprintf("Digest prefix %s of %s is ambiguous, it matches %s", e.Prefix, e.Image, strings.Join(e.Digests, ", "))
+}
+
+// Temporary is false as the prefix stays ambiguous
+func (e ErrAmbiguousDigest) Temporary() bool {
+	return false
+}
+
+// ErrUnsupportedMediaType is returned when the reference resolves to a manifest that isn't an
+// image or artifact imagec knows how to pull, such as a buildkit cache
+type ErrUnsupportedMediaType struct {
+	Image     string
+	Reference string
+	MediaType string
+}
+
+func (e ErrUnsupportedMediaType) Error() string {
+	return fmt.Sprintf("%s:%s has unsupported media type %s, it doesn't reference an image", e.Image, e.Reference, e.MediaType)
+}
+
+// Temporary is false as the manifest doesn't change by retrying
+func (e ErrUnsupportedMediaType) Temporary() bool {
+	return false
+}
+
+// ErrLayerDownloads is returned when the pull attempted every layer instead of failing fast and
+// some of the downloads failed
+type ErrLayerDownloads struct {
+	Image string
+	// Errors holds the failure of each layer by its digest
+	Errors map[string]error
+}
+
+func (e ErrLayerDownloads) Error() string {
+	var digests []string
+	for digest := range e.Errors {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+
+	failures := make([]string, len(digests))
+	for i, digest := range digests {
+		failures[i] = fmt.Sprintf("%s: %s", digest, e.Errors[digest])
+	}
+
+	return fmt.Sprintf("Failed to fetch %d layers of %s: %s", len(digests), e.Image, strings.Join(failures, "; "))
+}
+
+// Temporary is true if retrying may succeed for every failed layer
+func (e ErrLayerDownloads) Temporary() bool {
+	for _, err := range e.Errors {
+		if err, ok := err.(Error); !ok || !err.Temporary() {
+			return false
+		}
+	}
+
+	return len(e.Errors) != 0
+}
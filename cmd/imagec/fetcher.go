@@ -15,15 +15,21 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -41,12 +47,18 @@ import (
 type Fetcher interface {
 	Fetch(url *url.URL) (string, error)
 	FetchWithProgress(url *url.URL, ID string) (string, error)
+	Head(url *url.URL) (int64, error)
 
 	IsStatusUnauthorized() bool
 	IsStatusOK() bool
 	IsStatusNotFound() bool
+	IsStatusNotModified() bool
+
+	IsBasicAuth() bool
 
 	AuthURL() *url.URL
+
+	ResponseHeader() http.Header
 }
 
 // Token represents https://docs.docker.com/registry/spec/auth/token/
@@ -57,6 +69,11 @@ type Token struct {
 	Expires time.Time `json:"expires_in"`
 }
 
+// DefaultUserAgent identifies imagec and its version to the registries
+func DefaultUserAgent() string {
+	return fmt.Sprintf("vic-imagec/%s (%s/%s)", Version, runtime.GOOS, runtime.GOARCH)
+}
+
 // FetcherOptions struct
 type FetcherOptions struct {
 	Timeout time.Duration
@@ -66,7 +83,49 @@ type FetcherOptions struct {
 
 	InsecureSkipVerify bool
 
+	// PinnedFingerprint, if set, is the SHA-256 fingerprint of the server certificate in hex. A
+	// certificate with that fingerprint is accepted without verifying its chain, any other is rejected.
+	PinnedFingerprint string
+
 	Token *Token
+
+	// Progress receives the download progress, nil discards it
+	Progress progress.Output
+
+	// RateLimit limits the download rate of the fetcher in bytes per second, 0 is unlimited
+	RateLimit int64
+
+	// Limiter, if set, is shared with other fetchers to limit their aggregate download rate
+	Limiter *RateLimiter
+
+	// Meter, if set, counts the bytes downloaded, it's shared with other fetchers to measure
+	// their aggregate throughput
+	Meter *ThroughputMeter
+
+	// Accept lists the media types the request accepts, in order of preference
+	Accept []string
+
+	// UserAgent is sent with every request, DefaultUserAgent if empty
+	UserAgent string
+
+	// Headers are added to every request
+	Headers map[string]string
+
+	// MaxSize limits the size of the response body in bytes, 0 is unlimited. A larger body
+	// fails the fetch with ErrLayerTooLarge.
+	MaxSize int64
+
+	// DisableCompression asks for the body as stored. Otherwise the transport negotiates gzip
+	// and transparently decompresses it, which changes the bytes a blob digest is computed over.
+	DisableCompression bool
+
+	// ResumeFile, if set, is where the body is written instead of a temporary file. A download
+	// that was interrupted continues from the end of the file with a Range request, it starts
+	// over if the server ignores the range. The file is left as is if the fetch fails.
+	ResumeFile string
+
+	// Context, if set, cancels the requests of the fetcher before their timeout
+	Context context.Context
 }
 
 // URLFetcher struct
@@ -75,19 +134,142 @@ type URLFetcher struct {
 
 	OAuthEndpoint *url.URL
 
+	// BasicAuth is set when the server challenged us for HTTP Basic credentials
+	BasicAuth bool
+
 	StatusCode int
 
+	// Header holds the headers of the last response
+	Header http.Header
+
 	options FetcherOptions
 }
 
-// NewFetcher creates a new Fetcher instance
+// FetcherPool hands out Fetchers that share their http.Client, so that the connections
+// to a registry are reused across the manifest, token and blob requests of a pull.
+type FetcherPool struct {
+	m sync.Mutex
+
+	// clients are keyed by the TLS options as those are part of the transport config
+	clients map[tlsOptions]*http.Client
+}
+
+// tlsOptions are the FetcherOptions that configure the transport
+type tlsOptions struct {
+	insecure    bool
+	fingerprint string
+}
+
+// NewFetcherPool creates a new FetcherPool instance
+func NewFetcherPool() *FetcherPool {
+	return &FetcherPool{
+		clients: make(map[tlsOptions]*http.Client),
+	}
+}
+
+// NewFetcher creates a new Fetcher instance that uses the pool's shared client
+func (p *FetcherPool) NewFetcher(options FetcherOptions) Fetcher {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	key := tlsOptions{
+		insecure:    options.InsecureSkipVerify,
+		fingerprint: options.PinnedFingerprint,
+	}
+
+	client, ok := p.clients[key]
+	if !ok {
+		client = newClient(options)
+		p.clients[key] = client
+	}
+
+	return newURLFetcher(client, options)
+}
+
+// NewFetcher creates a new Fetcher instance with a dedicated client
 func NewFetcher(options FetcherOptions) Fetcher {
+	return newURLFetcher(newClient(options), options)
+}
+
+// newClient creates an http.Client with keep-alives and HTTP/2 enabled
+func newClient(options FetcherOptions) *http.Client {
+	config := &tls.Config{
+		InsecureSkipVerify: options.InsecureSkipVerify,
+	}
+
+	if options.PinnedFingerprint != "" {
+		// the pin replaces the chain verification, which would fail for a self-signed certificate
+		pin, _ := NormalizeFingerprint(options.PinnedFingerprint)
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyFingerprint(rawCerts, pin)
+		}
+	}
+
 	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: options.InsecureSkipVerify,
-		},
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+		// a custom TLSClientConfig disables HTTP/2 unless explicitly requested
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Transport:     tr,
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// maxRedirects is the number of redirects a request follows, as with the default policy
+const maxRedirects = 10
+
+// checkRedirect keeps the Authorization header from being forwarded to another host. Registries
+// redirect the blob requests to a CDN with a pre-signed URL, which rejects the request if it
+// carries our credentials as well.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+	}
+
+	return nil
+}
+
+// NormalizeFingerprint returns the SHA-256 fingerprint in lower case hex without separators. Both
+// "AB:CD:..." as printed by openssl and plain hex are accepted.
+func NormalizeFingerprint(fingerprint string) (string, error) {
+	normalized := strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+
+	b, err := hex.DecodeString(normalized)
+	if err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%s is not a SHA-256 fingerprint", fingerprint)
+	}
+
+	return normalized, nil
+}
+
+// verifyFingerprint checks that the fingerprint of the leaf certificate matches the pinned one
+func verifyFingerprint(rawCerts [][]byte, pin string) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server didn't present a certificate")
+	}
+
+	sum := sha256.Sum256(rawCerts[0])
+	if fingerprint := hex.EncodeToString(sum[:]); fingerprint != pin {
+		return fmt.Errorf("certificate fingerprint %s doesn't match the pinned fingerprint %s", fingerprint, pin)
+	}
+
+	return nil
+}
+
+func newURLFetcher(client *http.Client, options FetcherOptions) *URLFetcher {
+	if options.Progress == nil {
+		options.Progress = discardOutput{}
 	}
-	client := &http.Client{Transport: tr}
 
 	return &URLFetcher{
 		client:  client,
@@ -95,9 +277,20 @@ func NewFetcher(options FetcherOptions) Fetcher {
 	}
 }
 
+// requestContext returns the context of a request, which ends with the timeout or with the
+// context of the options
+func (u *URLFetcher) requestContext() (context.Context, context.CancelFunc) {
+	parent := u.options.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+
+	return context.WithTimeout(parent, u.options.Timeout)
+}
+
 // Fetch fetches a web page from url and stores in a temporary file.
 func (u *URLFetcher) Fetch(url *url.URL) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), u.options.Timeout)
+	ctx, cancel := u.requestContext()
 	defer cancel()
 
 	return u.fetch(ctx, url, "")
@@ -105,12 +298,70 @@ func (u *URLFetcher) Fetch(url *url.URL) (string, error) {
 
 // FetchWithProgress fetches a web page from url and stores in a temporary file while showing a progress bar.
 func (u *URLFetcher) FetchWithProgress(url *url.URL, ID string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), u.options.Timeout)
+	ctx, cancel := u.requestContext()
 	defer cancel()
 
 	return u.fetch(ctx, url, ID)
 }
 
+// Head returns the Content-Length of url without downloading it, -1 if it's unknown
+func (u *URLFetcher) Head(url *url.URL) (int64, error) {
+	defer trace.End(trace.Begin(url.String()))
+
+	ctx, cancel := u.requestContext()
+	defer cancel()
+
+	req, err := http.NewRequest("HEAD", url.String(), nil)
+	if err != nil {
+		return -1, err
+	}
+
+	u.SetHeaders(req)
+
+	u.SetBasicAuth(req)
+
+	u.SetAuthToken(req)
+
+	res, err := ctxhttp.Do(ctx, u.client, req)
+	if err != nil {
+		return -1, err
+	}
+	res.Body.Close()
+
+	u.StatusCode = res.StatusCode
+	u.Header = res.Header
+
+	if u.IsStatusUnauthorized() {
+		return -1, u.unauthorized(url, res)
+	}
+
+	if !u.IsStatusOK() {
+		return -1, fmt.Errorf("Unexpected http code: %d, URL: %s", u.StatusCode, url)
+	}
+
+	return res.ContentLength, nil
+}
+
+// unauthorized returns the error for a 401 response, recording how the registry wants the
+// requests to be authenticated
+func (u *URLFetcher) unauthorized(url *url.URL, res *http.Response) error {
+	hdr := res.Header.Get("www-authenticate")
+	if hdr == "" {
+		return ErrUnauthorized{URL: url.String(), Message: "www-authenticate header is missing"}
+	}
+	// registries without a token service want the credentials on every request
+	if strings.HasPrefix(strings.ToLower(hdr), "basic") {
+		u.BasicAuth = true
+		return ErrUnauthorized{URL: url.String(), Message: "Basic authentication required"}
+	}
+
+	var err error
+	if u.OAuthEndpoint, err = u.ExtractQueryParams(hdr); err != nil {
+		return err
+	}
+	return ErrUnauthorized{URL: url.String(), Message: "Authentication required"}
+}
+
 func (u *URLFetcher) fetch(ctx context.Context, url *url.URL, ID string) (string, error) {
 	defer trace.End(trace.Begin(url.String()))
 
@@ -119,36 +370,92 @@ func (u *URLFetcher) fetch(ctx context.Context, url *url.URL, ID string) (string
 		return "", err
 	}
 
+	u.SetHeaders(req)
+
 	u.SetBasicAuth(req)
 
 	u.SetAuthToken(req)
 
+	for _, mediaType := range u.options.Accept {
+		req.Header.Add("Accept", mediaType)
+	}
+
+	// an explicit Accept-Encoding keeps the transport from decompressing the body
+	if u.options.DisableCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	// continue the interrupted download from where it stopped
+	var offset int64
+	if u.options.ResumeFile != "" {
+		if fi, serr := os.Stat(u.options.ResumeFile); serr == nil {
+			offset = fi.Size()
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+	}
+
 	res, err := ctxhttp.Do(ctx, u.client, req)
 	if err != nil {
 		return "", err
 	}
-	defer res.Body.Close()
+	defer func() {
+		// drain a little of what is left so that the connection can be reused - anything
+		// bigger isn't worth reading just for that
+		io.CopyN(ioutil.Discard, res.Body, 64<<10)
+		res.Body.Close()
+	}()
 
 	u.StatusCode = res.StatusCode
+	u.Header = res.Header
 
 	if u.IsStatusUnauthorized() {
-		hdr := res.Header.Get("www-authenticate")
-		if hdr == "" {
-			return "", fmt.Errorf("www-authenticate header is missing")
-		}
-		u.OAuthEndpoint, err = u.ExtractQueryParams(hdr, url)
-		if err != nil {
-			return "", err
-		}
-		return "", fmt.Errorf("Authentication required")
+		return "", u.unauthorized(url, res)
+	}
+
+	// the whole body is in the file already, whether it's the right one is for the caller to verify
+	if offset > 0 && u.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return u.options.ResumeFile, nil
+	}
+
+	resumed := offset > 0 && u.StatusCode == http.StatusPartialContent
+	if resumed && !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		return "", fmt.Errorf("Unexpected Content-Range %q resuming at %d, URL: %s", res.Header.Get("Content-Range"), offset, url)
+	}
+	if !resumed {
+		offset = 0
 	}
 
 	// FIXME: handle StatusTemporaryRedirect and StatusFound
-	if !u.IsStatusOK() {
+	if !u.IsStatusOK() && !resumed {
 		return "", fmt.Errorf("Unexpected http code: %d, URL: %s", u.StatusCode, url)
 	}
 
-	in := res.Body
+	var in io.ReadCloser = res.Body
+
+	// the Content-Length can't be trusted to be there or to be right, read one byte past the
+	// limit to tell if it's exceeded
+	max := u.options.MaxSize
+	if max > 0 {
+		if offset+res.ContentLength > max {
+			return "", ErrLayerTooLarge{Layer: url.String(), Limit: max}
+		}
+		in = ioutil.NopCloser(io.LimitReader(in, max-offset+1))
+	}
+
+	// throttle before the progress reader so that the progress reflects the limited rate
+	var limiter *RateLimiter
+	if u.options.RateLimit > 0 {
+		limiter = NewRateLimiter(u.options.RateLimit)
+	}
+	if limiter != nil || u.options.Limiter != nil {
+		in = ioutil.NopCloser(NewRateLimitedReader(ctx, in, limiter, u.options.Limiter))
+	}
+	if u.options.Meter != nil {
+		in = ioutil.NopCloser(NewMeteredReader(in, u.options.Meter))
+	}
+
 	// stream progress as json and body into a file - only if we have an ID and a Content-Length header
 	if hdr := res.Header.Get("Content-Length"); ID != "" && hdr != "" {
 		cl, cerr := strconv.ParseInt(hdr, 10, 64)
@@ -157,24 +464,37 @@ func (u *URLFetcher) fetch(ctx context.Context, url *url.URL, ID string) (string
 		}
 
 		in = progress.NewProgressReader(
-			ioutils.NewCancelReadCloser(ctx, res.Body), po, cl, ID, "Downloading",
+			ioutils.NewCancelReadCloser(ctx, in), u.options.Progress, cl, ID, "Downloading",
 		)
 		defer in.Close()
 	}
 
-	// Create a temporary file and stream the res.Body into it
-	out, err := ioutil.TempFile(os.TempDir(), ID)
+	// Create a temporary file, or open the one to resume, and stream the res.Body into it
+	var out *os.File
+	switch {
+	case resumed:
+		out, err = os.OpenFile(u.options.ResumeFile, os.O_WRONLY|os.O_APPEND, 0644)
+	case u.options.ResumeFile != "":
+		out, err = os.OpenFile(u.options.ResumeFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	default:
+		out, err = ioutil.TempFile(os.TempDir(), ID)
+	}
 	if err != nil {
 		return "", err
 	}
 	defer out.Close()
 
 	// Stream into it
-	_, err = io.Copy(out, in)
+	n, err := io.Copy(out, in)
 	if err != nil {
 		return "", err
 	}
 
+	if max > 0 && offset+n > max {
+		os.Remove(out.Name())
+		return "", ErrLayerTooLarge{Layer: url.String(), Limit: max}
+	}
+
 	// Return the temporary file name
 	return out.Name(), nil
 }
@@ -183,6 +503,14 @@ func (u *URLFetcher) AuthURL() *url.URL {
 	return u.OAuthEndpoint
 }
 
+func (u *URLFetcher) ResponseHeader() http.Header {
+	return u.Header
+}
+
+func (u *URLFetcher) IsBasicAuth() bool {
+	return u.BasicAuth
+}
+
 func (u *URLFetcher) IsStatusUnauthorized() bool {
 	return u.StatusCode == http.StatusUnauthorized
 }
@@ -195,6 +523,23 @@ func (u *URLFetcher) IsStatusNotFound() bool {
 	return u.StatusCode == http.StatusNotFound
 }
 
+func (u *URLFetcher) IsStatusNotModified() bool {
+	return u.StatusCode == http.StatusNotModified
+}
+
+// SetHeaders sets the User-Agent and the custom headers of the request
+func (u *URLFetcher) SetHeaders(req *http.Request) {
+	for name, value := range u.options.Headers {
+		req.Header.Set(name, value)
+	}
+
+	ua := u.options.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent()
+	}
+	req.Header.Set("User-Agent", ua)
+}
+
 func (u *URLFetcher) SetBasicAuth(req *http.Request) {
 	if u.options.Username != "" && u.options.Password != "" {
 		log.Debugf("Setting BasicAuth: %s", u.options.Username)
@@ -209,37 +554,22 @@ func (u *URLFetcher) SetAuthToken(req *http.Request) {
 	}
 }
 
-func (u *URLFetcher) ExtractQueryParams(hdr string, repository *url.URL) (*url.URL, error) {
-	tokens := strings.Split(hdr, " ")
-	if len(tokens) != 2 || strings.ToLower(tokens[0]) != "bearer" {
+// ExtractQueryParams returns the URL of the token service from the bearer auth challenge,
+// carrying over the service and scope the registry asked for
+func (u *URLFetcher) ExtractQueryParams(hdr string) (*url.URL, error) {
+	scheme, params := parseAuthChallenge(hdr)
+	if strings.ToLower(scheme) != "bearer" || params == nil {
 		return nil, fmt.Errorf("www-authenticate header is corrupted")
 	}
 
-	tokens = strings.Split(tokens[1], ",")
-
-	var realm, service, scope string
-	for _, token := range tokens {
-		if strings.HasPrefix(token, "realm") {
-			realm = strings.Trim(token[len("realm="):], "\"")
-		}
-		if strings.HasPrefix(token, "service") {
-			service = strings.Trim(token[len("service="):], "\"")
-		}
-		if strings.HasPrefix(token, "scope") {
-			scope = strings.Trim(token[len("scope="):], "\"")
-		}
-	}
-
+	realm := params["realm"]
 	if realm == "" {
 		return nil, fmt.Errorf("missing realm in bearer auth challenge")
 	}
+	service := params["service"]
 	if service == "" {
 		return nil, fmt.Errorf("missing service in bearer auth challenge")
 	}
-	// The scope can be empty if we're not getting a token for a specific repo
-	if scope == "" && repository != nil {
-		return nil, fmt.Errorf("missing scope in bearer auth challenge")
-	}
 
 	auth, err := url.Parse(realm)
 	if err != nil {
@@ -248,10 +578,62 @@ func (u *URLFetcher) ExtractQueryParams(hdr string, repository *url.URL) (*url.U
 
 	q := auth.Query()
 	q.Add("service", service)
-	if scope != "" {
+	// The scope can be empty, e.g. GitLab leaves it to the client to ask for the repository
+	if scope := params["scope"]; scope != "" {
 		q.Add("scope", scope)
 	}
 	auth.RawQuery = q.Encode()
 
 	return auth, nil
 }
+
+// parseAuthChallenge splits a www-authenticate header into its scheme and parameters. The values
+// can be quoted, and quoted values can contain commas, e.g. a scope with several actions.
+func parseAuthChallenge(hdr string) (string, map[string]string) {
+	hdr = strings.TrimSpace(hdr)
+
+	i := strings.IndexAny(hdr, " \t")
+	if i < 0 {
+		return hdr, nil
+	}
+	scheme, rest := hdr[:i], hdr[i+1:]
+
+	params := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " \t,")
+
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimLeft(rest[eq+1:], " \t")
+
+		var value []byte
+		if strings.HasPrefix(rest, "\"") {
+			// a backslash escapes the next character of a quoted value
+			j := 1
+			for ; j < len(rest) && rest[j] != '"'; j++ {
+				if rest[j] == '\\' && j+1 < len(rest) {
+					j++
+				}
+				value = append(value, rest[j])
+			}
+			if j < len(rest) {
+				j++
+			}
+			rest = rest[j:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value = []byte(strings.TrimSpace(rest[:end]))
+			rest = rest[end:]
+		}
+
+		params[key] = string(value)
+	}
+
+	return scheme, params
+}
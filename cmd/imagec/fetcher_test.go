@@ -0,0 +1,444 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFetcherPoolReusesConnections(t *testing.T) {
+	var conns int32
+
+	s := httptest.NewUnstartedServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				http.Error(w, "You shall not pass", http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(LayerContent))
+		}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := NewFetcherPool()
+	for i := 0; i < 3; i++ {
+		fetcher := pool.NewFetcher(FetcherOptions{
+			Timeout: 10 * time.Second,
+			Token:   &Token{Token: OAuthToken},
+		})
+
+		name, err := fetcher.Fetch(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(name)
+	}
+
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("Expected a single connection, got %d", n)
+	}
+}
+
+func TestFetcherRateLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 64*1024)
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(content)
+		}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := NewFetcher(FetcherOptions{
+		Timeout:   10 * time.Second,
+		RateLimit: 32 * 1024,
+	})
+
+	// the first second worth of data is let through at once, the rest takes another second
+	start := time.Now()
+	name, err := fetcher.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(name)
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Download wasn't throttled, took %s", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, content) {
+		t.Errorf("Downloaded %d bytes, expected %d", len(data), len(content))
+	}
+}
+
+func TestFetcherRateLimitMaxSize(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 64*1024)
+
+	// the body is streamed without a Content-Length, only reading it tells it's too large
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 32; i++ {
+				if _, err := w.Write(chunk); err != nil {
+					return
+				}
+				w.(http.Flusher).Flush()
+			}
+		}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetcher := NewFetcher(FetcherOptions{
+		Timeout:   time.Minute,
+		RateLimit: 64 * 1024,
+		MaxSize:   1024,
+	})
+
+	// the limit stops the download long before the whole body would get through the throttle
+	start := time.Now()
+	name, err := fetcher.Fetch(u)
+	if err == nil {
+		os.Remove(name)
+	}
+	if _, ok := err.(ErrLayerTooLarge); !ok {
+		t.Errorf("Expected ErrLayerTooLarge, got %#v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("The size limit was enforced after %s", elapsed)
+	}
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewRateLimiter(32 * 1024)
+
+	// two readers sharing the limiter are throttled to the aggregate rate
+	start := time.Now()
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r := NewRateLimitedReader(ctx, bytes.NewReader(make([]byte, 32*1024)), limiter)
+			_, err := ioutil.ReadAll(r)
+			done <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Readers weren't throttled to the aggregate rate, took %s", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	limiter := NewRateLimiter(1024)
+	r := NewRateLimitedReader(ctx, bytes.NewReader(make([]byte, 4096)), limiter)
+
+	if _, err := ioutil.ReadAll(r); err != context.Canceled {
+		t.Errorf("Expected the read to be canceled, got %v", err)
+	}
+}
+
+func TestFetcherPinnedFingerprint(t *testing.T) {
+	s := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(LayerContent))
+		}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(s.Certificate().Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	// the certificate is self-signed, without the pin it's rejected
+	fetcher := NewFetcher(FetcherOptions{Timeout: 10 * time.Second})
+	if _, err := fetcher.Fetch(u); err == nil {
+		t.Errorf("Expected the self-signed certificate to be rejected")
+	}
+
+	// openssl prints the fingerprint upper case with colons
+	var pairs []string
+	for i := 0; i < len(fingerprint); i += 2 {
+		pairs = append(pairs, strings.ToUpper(fingerprint[i:i+2]))
+	}
+
+	fetcher = NewFetcher(FetcherOptions{
+		Timeout:           10 * time.Second,
+		PinnedFingerprint: strings.Join(pairs, ":"),
+	})
+	name, err := fetcher.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(name)
+
+	// any other certificate is rejected
+	mismatch := sha256.Sum256([]byte("another certificate"))
+	fetcher = NewFetcher(FetcherOptions{
+		Timeout:           10 * time.Second,
+		PinnedFingerprint: hex.EncodeToString(mismatch[:]),
+	})
+	if _, err := fetcher.Fetch(u); err == nil || !strings.Contains(err.Error(), "doesn't match the pinned fingerprint") {
+		t.Errorf("Expected a fingerprint mismatch, got %v", err)
+	}
+
+	if _, err := NormalizeFingerprint("not a fingerprint"); err == nil {
+		t.Errorf("Expected an invalid fingerprint to be rejected")
+	}
+}
+
+func TestFetcherHeaders(t *testing.T) {
+	var requests, mismatches int32
+	var userAgent atomic.Value
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			userAgent.Store(r.UserAgent())
+
+			if r.UserAgent() != "custom/1.0" || r.Header.Get("X-Team") != "vic" {
+				atomic.AddInt32(&mismatches, 1)
+			}
+
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/token"):
+				w.Write([]byte(`{"token":"` + OAuthToken + `"}`))
+			case strings.Contains(r.URL.Path, "/manifests/"):
+				w.Write([]byte(`{"name":"` + Image + `","tag":"` + Tag + `"}`))
+			default:
+				w.Write([]byte(LayerContent))
+			}
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+	options.destination = dir
+	options.userAgent = "custom/1.0"
+	options.headers = map[string]string{"X-Team": "vic"}
+
+	u, err := url.Parse(s.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// token, manifest and blob requests
+	if options.token, err = FetchToken(options, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FetchImageManifest(options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = LayerSizes(options, []*ImageWithMeta{{layer: FSLayer{BlobSum: DigestSHA256LayerContent}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+	if n := atomic.LoadInt32(&mismatches); n != 0 {
+		t.Errorf("%d requests were missing the headers", n)
+	}
+
+	// without one the fetcher identifies imagec
+	fetcher := NewFetcher(FetcherOptions{Timeout: 10 * time.Second})
+	name, err := fetcher.Fetch(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(name)
+
+	if ua := userAgent.Load().(string); !strings.HasPrefix(ua, "vic-imagec/") {
+		t.Errorf("Unexpected default User-Agent %q", ua)
+	}
+}
+
+func TestFetcherDisableCompression(t *testing.T) {
+	// the blob is stored compressed, as layers are
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(LayerContent))
+	gz.Close()
+	blob := buf.Bytes()
+
+	sum := sha256.Sum256(blob)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	var encodings []string
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			encodings = append(encodings, r.Header.Get("Accept-Encoding"))
+
+			// some registries and proxies label gzip blobs as gzip encoded if the client accepts it
+			if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			w.Write(blob)
+		}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fetch := func(disable bool) string {
+		fetcher := NewFetcher(FetcherOptions{
+			Timeout:            10 * time.Second,
+			DisableCompression: disable,
+		})
+		name, err := fetcher.Fetch(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(name)
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	// the transport decompresses the body behind our back
+	if d := fetch(false); d == digest {
+		t.Errorf("Expected the transport to decompress the body")
+	}
+
+	if d := fetch(true); d != digest {
+		t.Errorf("Digest of the raw bytes is %s, expected %s", d, digest)
+	}
+	if encodings[1] != "identity" {
+		t.Errorf("Unexpected Accept-Encoding %q", encodings[1])
+	}
+}
+
+func TestFetcherRedirectAuthorization(t *testing.T) {
+	// the CDN rejects requests that carry the credentials of the registry
+	cdn := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "" {
+				http.Error(w, "Only one auth mechanism allowed", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(LayerContent))
+		}))
+	defer cdn.Close()
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				http.Error(w, "You shall not pass", http.StatusForbidden)
+				return
+			}
+
+			switch r.URL.Path {
+			case "/cdn":
+				http.Redirect(w, r, cdn.URL+"/blob?signature=x", http.StatusTemporaryRedirect)
+			case "/local":
+				http.Redirect(w, r, "/blob", http.StatusTemporaryRedirect)
+			default:
+				w.Write([]byte(LayerContent))
+			}
+		}))
+	defer s.Close()
+
+	for _, p := range []string{"/cdn", "/local"} {
+		u, err := url.Parse(s.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fetcher := NewFetcher(FetcherOptions{
+			Timeout: 10 * time.Second,
+			Token:   &Token{Token: OAuthToken},
+		})
+
+		name, err := fetcher.Fetch(u)
+		if err != nil {
+			t.Errorf("%s: %s", p, err)
+			continue
+		}
+		defer os.Remove(name)
+
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != LayerContent {
+			t.Errorf("%s: unexpected content %q", p, data)
+		}
+	}
+}
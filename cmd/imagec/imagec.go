@@ -23,15 +23,16 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"regexp"
 	"runtime/trace"
 	"strings"
-	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 
 	log "github.com/Sirupsen/logrus"
 
+	distreference "github.com/docker/distribution/reference"
 	docker "github.com/docker/docker/image"
 	dockerLayer "github.com/docker/docker/layer"
 	"github.com/docker/docker/pkg/ioutils"
@@ -39,18 +40,24 @@ import (
 	"github.com/docker/docker/pkg/streamformatter"
 	"github.com/docker/docker/pkg/stringid"
 	"github.com/docker/docker/reference"
+	"github.com/docker/go-units"
 
 	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+	"github.com/vmware/vic/pkg/flags"
 	"github.com/vmware/vic/pkg/i18n"
 
 	"github.com/pkg/profile"
 )
 
 var (
+	// Version is set at build time with -ldflags "-X main.Version=..."
+	Version = "dev"
+
 	options = ImageCOptions{}
 
-	// https://raw.githubusercontent.com/docker/docker/master/distribution/pull_v2.go
-	po = streamformatter.NewJSONStreamFormatter().NewProgressOutput(os.Stdout, false)
+	totalRateLimit int64
+
+	bearerToken string
 )
 
 // ImageCOptions wraps the cli arguments
@@ -61,6 +68,20 @@ type ImageCOptions struct {
 	image    string
 	digest   string
 
+	// rewrites send the requests for the repositories they match to another registry
+	rewrites []RegistryRewrite
+
+	// tag is the tag a name:tag@digest reference gives along with the digest, which is what
+	// the manifest is fetched by
+	tag string
+
+	// correlationID tells the log lines of a pull from those of the pulls running alongside it
+	correlationID string
+
+	// digestPrefix is the partial manifest digest the reference names instead of a tag, it's
+	// resolved to one of the tags of the repository before the pull
+	digestPrefix string
+
 	destination string
 
 	host string
@@ -71,17 +92,120 @@ type ImageCOptions struct {
 	password string
 
 	token *Token
+	// tokens shares the token across the concurrent layer downloads, nil if they don't share one
+	tokens *TokenCache
 
 	timeout time.Duration
+	// manifestTimeout bounds the manifest fetches and the other small requests, such as tag lists
+	// and layer sizes, separately from the blob downloads
+	manifestTimeout time.Duration
 
 	stdout     bool
 	debug      bool
 	insecure   bool
 	standalone bool
 	resolv     bool
+	inspect    bool
+	allTags    bool
+
+	// userAgent replaces the default User-Agent of the requests, headers are added to them
+	userAgent string
+	headers   map[string]string
+
+	// fingerprint pins the SHA-256 fingerprint of the registry certificate
+	fingerprint string
+
+	// maxLayerSize limits the size of each layer in bytes, both compressed and uncompressed,
+	// 0 is unlimited
+	maxLayerSize int64
+
+	// keepLayers keeps the compressed layers under the destination by their digest, so that they
+	// outlive the pull
+	keepLayers bool
+	// cacheMaxSize bounds the size in bytes of the kept layers, the least recently used layers no
+	// image uses are evicted after a pull. 0 is unlimited.
+	cacheMaxSize int64
+
+	// rootfs is the directory the layers are extracted into in addition to being stored, empty
+	// disables the extraction
+	rootfs string
+
+	// fsync flushes the layers to disk before they're moved into place, so that a crash leaves
+	// either a complete layer or none
+	fsync bool
+
+	// sharedLayers stores the layers once by chainID under the destination and references them
+	// from the images using them, standalone only
+	sharedLayers bool
+	// releaseLayers drops the reference from the shared layers instead of pulling it
+	releaseLayers bool
+
+	// skipSpaceCheck disables the free space check before the download, for registries
+	// that don't report the layer sizes
+	skipSpaceCheck bool
 
 	profiling string
 	tracing   bool
+
+	// events receives the structured progress updates, nil discards them
+	events chan<- ProgressEvent
+
+	// pool shares the http connections across the fetches of a pull, nil disables sharing
+	pool *FetcherPool
+
+	// rateLimit is the per-connection download limit in bytes per second, 0 is unlimited
+	rateLimit int64
+	// limiter limits the aggregate download rate across the parallel downloads, nil is unlimited
+	limiter *RateLimiter
+
+	// maxInFlight limits the total size of the layers downloaded at the same time, 0 is unlimited
+	maxInFlight int64
+	// budget enforces maxInFlight across the parallel downloads of a pull, nil is unlimited
+	budget *ByteBudget
+
+	// onThroughput receives the throughput of the layer downloads every throughputInterval,
+	// nil disables the measurement
+	onThroughput       ThroughputFunc
+	throughputInterval time.Duration
+	// meter measures the throughput across the parallel downloads of a pull
+	meter *ThroughputMeter
+
+	// resume keeps the state of the pull in the destination, so that an interrupted pull
+	// continues where it stopped
+	resume bool
+	// pullState records the layers completed by the pull, nil unless resume is set
+	pullState *PullState
+
+	// failFast cancels the layer downloads of a pull once one of them fails, otherwise every
+	// layer is attempted and the failures are reported together
+	failFast bool
+	// ctx cancels the requests of the fetchers, nil never cancels them
+	ctx context.Context
+}
+
+// newFetcher returns a Fetcher from the pool if there's one, a standalone one otherwise. The
+// Fetcher sends the User-Agent and headers of the options, and is cancelled by their context,
+// unless fo sets its own.
+func (o ImageCOptions) newFetcher(fo FetcherOptions) Fetcher {
+	if fo.UserAgent == "" {
+		fo.UserAgent = o.userAgent
+	}
+	if fo.Headers == nil {
+		fo.Headers = o.headers
+	}
+	if fo.Context == nil {
+		fo.Context = o.ctx
+	}
+
+	if o.pool != nil {
+		return o.pool.NewFetcher(fo)
+	}
+	return NewFetcher(fo)
+}
+
+// progressOutput returns the progress.Output that feeds the events channel
+func (o ImageCOptions) progressOutput() progress.Output {
+	return NewProgressOutput(o.events)
 }
 
 // ImageWithMeta wraps the models.Image with some additional metadata
@@ -91,6 +215,16 @@ type ImageWithMeta struct {
 	diffID  string
 	layer   FSLayer
 	history History
+
+	// size of the compressed layer as reported by the registry, 0 until it's known and -1 if
+	// the registry doesn't report it
+	size int64
+
+	// below is the layer that's applied to the rootfs before this one, nil for the base layer
+	below *ImageWithMeta
+	// applied is closed once applying the layer to the rootfs is over, extracted tells if it succeeded
+	applied   chan struct{}
+	extracted bool
 }
 
 func (i *ImageWithMeta) String() string {
@@ -113,6 +247,9 @@ const (
 	// DefaultHTTPTimeout specifies the default HTTP timeout
 	DefaultHTTPTimeout = 3600 * time.Second
 
+	// DefaultManifestTimeout specifies the default HTTP timeout of the manifest fetches
+	DefaultManifestTimeout = 10 * time.Second
+
 	// DefaultTokenExpirationDuration specifies the default token expiration
 	DefaultTokenExpirationDuration = 60 * time.Second
 )
@@ -135,17 +272,40 @@ func init() {
 
 	flag.StringVar(&options.logfile, "logfile", DefaultLogfile, i18n.T("Path of the imagec log file"))
 
-	flag.StringVar(&options.username, "username", "", i18n.T("Username"))
-	flag.StringVar(&options.password, "password", "", i18n.T("Password"))
+	flag.StringVar(&options.username, "username", "", i18n.T("Username, read from REGISTRY_USERNAME_<HOST> or REGISTRY_USERNAME if unset"))
+	flag.StringVar(&options.password, "password", "", i18n.T("Password, read from REGISTRY_PASSWORD_<HOST> or REGISTRY_PASSWORD if unset"))
+	flag.StringVar(&bearerToken, "token", "", i18n.T("Bearer token for the registry, obtained out of band"))
 
 	flag.DurationVar(&options.timeout, "timeout", DefaultHTTPTimeout, i18n.T("HTTP timeout"))
+	flag.DurationVar(&options.manifestTimeout, "manifest-timeout", DefaultManifestTimeout, i18n.T("HTTP timeout of the manifest fetches"))
 
 	flag.BoolVar(&options.stdout, "stdout", false, i18n.T("Enable writing to stdout"))
 	flag.BoolVar(&options.debug, "debug", false, i18n.T("Show debug logging"))
 	flag.BoolVar(&options.insecure, "insecure", false, i18n.T("Skip certificate verification checks"))
+	flag.StringVar(&options.userAgent, "user-agent", DefaultUserAgent(), i18n.T("User-Agent of the registry requests"))
+	flag.Var(flags.NewHeaders(&options.headers), "header", i18n.T("Header to add to the registry requests, as \"Name: value\", can be repeated"))
+	flag.Var(newRegistryRewrites(&options.rewrites), "registry-rewrite", i18n.T("Pull the repositories matching from=to from another registry, as \"docker.io=mirror.example.com/hub\" or \"~regexp=replacement\", can be repeated"))
+	flag.StringVar(&options.fingerprint, "fingerprint", "", i18n.T("SHA-256 fingerprint of the registry certificate, accepted without verifying its chain"))
 	flag.BoolVar(&options.standalone, "standalone", false, i18n.T("Disable port-layer integration"))
 
 	flag.BoolVar(&options.resolv, "resolv", false, i18n.T("Return the name of the vmdk from given reference"))
+	flag.BoolVar(&options.inspect, "inspect", false, i18n.T("Print the manifest and config of the reference as JSON without pulling it"))
+	flag.BoolVar(&options.allTags, "all-tags", false, i18n.T("Pull every tag of the repository"))
+	flag.Int64Var(&options.maxLayerSize, "max-layer-size", 0, i18n.T("Maximum size of a layer in bytes, compressed and uncompressed, 0 is unlimited"))
+	flag.BoolVar(&options.keepLayers, "keep-layers", false, i18n.T("Keep the compressed layers under <destination>/blobs/sha256 by their digest"))
+	flag.Int64Var(&options.cacheMaxSize, "cache-max-size", 0, i18n.T("Maximum total size in bytes of the kept layers, the least recently used unreferenced ones are evicted, 0 is unlimited"))
+	flag.StringVar(&options.rootfs, "rootfs", "", i18n.T("Directory to extract the layers into as they're downloaded"))
+	flag.BoolVar(&options.fsync, "fsync", false, i18n.T("Flush the layers to disk before moving them into place"))
+	flag.BoolVar(&options.resume, "resume", false, i18n.T("Keep the pull state in the destination so that an interrupted pull resumes where it stopped"))
+	flag.BoolVar(&options.sharedLayers, "shared-layers", false, i18n.T("Store the layers once under <destination>/layers, shared by the images using them (standalone only)"))
+	flag.BoolVar(&options.releaseLayers, "release-layers", false, i18n.T("Release the shared layers of the reference, removing those no other image uses, instead of pulling it"))
+	flag.BoolVar(&options.failFast, "fail-fast", true, i18n.T("Stop the pull on the first failed layer download, otherwise attempt every layer and report all the failures"))
+	flag.BoolVar(&options.skipSpaceCheck, "skip-space-check", false, i18n.T("Skip checking for free space before downloading the layers"))
+
+	flag.Int64Var(&options.rateLimit, "rate-limit", 0, i18n.T("Per-connection download limit in bytes per second, 0 is unlimited"))
+	flag.Int64Var(&options.maxInFlight, "max-in-flight", 0, i18n.T("Maximum total size in bytes of the layers downloaded at the same time, 0 is unlimited"))
+	flag.Int64Var(&totalRateLimit, "total-rate-limit", 0, i18n.T("Total download limit in bytes per second across parallel downloads, 0 is unlimited"))
+	flag.DurationVar(&options.throughputInterval, "throughput-interval", 0, i18n.T("Interval of the download throughput log lines, 0 disables them"))
 
 	flag.StringVar(&options.profiling, "profile.mode", "", i18n.T("Enable profiling mode, one of [cpu, mem, block]"))
 	flag.BoolVar(&options.tracing, "tracing", false, i18n.T("Enable runtime tracing"))
@@ -153,19 +313,46 @@ func init() {
 	flag.Parse()
 }
 
+// digestPrefixPattern matches a partial sha256 digest, the full one is left to the reference parser
+var digestPrefixPattern = regexp.MustCompile("^(sha256:)?[0-9a-f]{1,63}$")
+
+// splitDigestPrefix splits a name@prefix reference into the name and the hex digest prefix.
+// The prefix is empty if the reference doesn't end in a partial digest.
+func splitDigestPrefix(ref string) (string, string) {
+	i := strings.LastIndex(ref, "@")
+	if i < 0 || !digestPrefixPattern.MatchString(ref[i+1:]) {
+		return ref, ""
+	}
+
+	return ref[:i], strings.TrimPrefix(ref[i+1:], "sha256:")
+}
+
 // ParseReference parses the -reference parameter and populate options struct
 func ParseReference() error {
+	name, prefix := splitDigestPrefix(options.reference)
+	options.digestPrefix = prefix
+
 	// Validate and parse reference name
-	ref, err := reference.ParseNamed(options.reference)
+	ref, err := reference.ParseNamed(name)
 	if err != nil {
 		return err
 	}
 
 	options.digest = reference.DefaultTag
-	if !reference.IsNameOnly(ref) {
-		if tagged, ok := ref.(reference.NamedTagged); ok {
-			options.digest = tagged.Tag()
+	options.tag = ""
+	switch r := ref.(type) {
+	case reference.Canonical:
+		// the digest is authoritative, a tag given along with it only names the pull in the index
+		options.digest = r.Digest().String()
+
+		// the docker reference drops the tag of a name:tag@digest reference
+		if named, err := distreference.ParseNamed(name); err == nil {
+			if tagged, ok := named.(distreference.Tagged); ok {
+				options.tag = tagged.Tag()
+			}
 		}
+	case reference.NamedTagged:
+		options.digest = r.Tag()
 	}
 
 	options.registry = DefaultDockerURL
@@ -178,8 +365,112 @@ func ParseReference() error {
 	return nil
 }
 
+// dockerHubHosts holds the hostnames that serve the official Docker Hub registry
+var dockerHubHosts = map[string]bool{
+	"registry-1.docker.io": true,
+	"index.docker.io":      true,
+	"docker.io":            true,
+}
+
+// NormalizeRepository returns the repository path the registry expects for image.
+// Docker Hub keeps its official images under library/, so single segment names
+// get that prefix there. Any other name or registry is returned as is.
+func NormalizeRepository(registry string, image string) string {
+	if strings.Contains(image, "/") {
+		return image
+	}
+
+	u, err := url.Parse(registry)
+	if err != nil || !dockerHubHosts[u.Host] {
+		return image
+	}
+	return path.Join("library", image)
+}
+
+// repository returns the normalized repository path of the image
+func (o ImageCOptions) repository() string {
+	return NormalizeRepository(o.registry, o.image)
+}
+
+// logger returns a logger that annotates the lines with the image and reference of the pull
+func (o ImageCOptions) logger() *log.Entry {
+	fields := log.Fields{
+		"image":     o.image,
+		"reference": o.digest,
+	}
+	if o.tag != "" {
+		fields["tag"] = o.tag
+	}
+	if o.correlationID != "" {
+		fields["correlationID"] = o.correlationID
+	}
+
+	return log.WithFields(fields)
+}
+
+// byDigest returns true if the manifest is referenced by its digest instead of a tag
+func (o ImageCOptions) byDigest() bool {
+	return strings.HasPrefix(o.digest, "sha256:")
+}
+
+// indexTag returns the tag the image is indexed under - the tag given along with the digest
+// if there's one, the tag or digest the manifest is fetched by otherwise
+func (o ImageCOptions) indexTag() string {
+	if o.tag != "" {
+		return o.tag
+	}
+	return o.digest
+}
+
+// displayName returns the image name with the tag and digest it was referenced by
+func (o ImageCOptions) displayName() string {
+	switch {
+	case !o.byDigest():
+		return o.image + ":" + o.digest
+	case o.tag != "":
+		return o.image + ":" + o.tag + "@" + o.digest
+	default:
+		return o.image + "@" + o.digest
+	}
+}
+
+// repositoryName returns the name the repository is indexed under - qualified with the
+// registry host unless it's from Docker Hub
+func (o ImageCOptions) repositoryName() string {
+	u, err := url.Parse(o.registry)
+	if err != nil || dockerHubHosts[u.Host] {
+		return o.repository()
+	}
+	return path.Join(u.Host, o.repository())
+}
+
+// registryURL returns the URL of the /v2/ base endpoint of the registry, rewritten by the first
+// matching rewrite rule
+func (o ImageCOptions) registryURL() (*url.URL, error) {
+	u, _, err := o.remote()
+	if err != nil {
+		return nil, err
+	}
+	if path.Base(u.Path) != "v2" {
+		u.Path = path.Join(u.Path, "v2")
+	}
+	u.Path += "/"
+	return u, nil
+}
+
+// repositoryURL returns the registry URL of the given resource within the repository, rewritten
+// by the first matching rewrite rule
+func (o ImageCOptions) repositoryURL(elem ...string) (*url.URL, error) {
+	u, repository, err := o.remote()
+	if err != nil {
+		return nil, err
+	}
+	u.Path = path.Join(append([]string{u.Path, repository}, elem...)...)
+	return u, nil
+}
+
 // DestinationDirectory returns the path of the output directory
-func DestinationDirectory() string {
+func DestinationDirectory(options ImageCOptions) string {
 	u, _ := url.Parse(options.registry)
 
 	// Use a hierachy like following so that we can support multiple schemes, registries and versions
@@ -211,13 +502,13 @@ func DestinationDirectory() string {
 		u.Scheme,
 		u.Host,
 		u.Path,
-		options.image,
+		options.repository(),
 		options.digest,
 	)
 }
 
 // ImagesToDownload creates a slice of ImageWithMeta for the images that needs to be downloaded
-func ImagesToDownload(manifest *Manifest, hostname string) ([]*ImageWithMeta, error) {
+func ImagesToDownload(options ImageCOptions, manifest *Manifest, hostname string) ([]*ImageWithMeta, error) {
 	images := make([]*ImageWithMeta, len(manifest.FSLayers))
 
 	v1 := docker.V1Image{}
@@ -247,8 +538,9 @@ func ImagesToDownload(manifest *Manifest, hostname string) ([]*ImageWithMeta, er
 			history: history,
 			layer:   layer,
 			diffID:  "",
+			size:    layer.Size,
 		}
-		log.Debugf("Manifest image: %#v", images[i])
+		options.logger().Debugf("Manifest image: %#v", images[i])
 	}
 
 	// return early if -standalone set
@@ -257,18 +549,18 @@ func ImagesToDownload(manifest *Manifest, hostname string) ([]*ImageWithMeta, er
 	}
 
 	// Create the image store just in case
-	err := CreateImageStore(hostname)
+	err := CreateImageStore(options, hostname)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to create image store: %s", err)
 	}
 
 	// Get the list of known images from the storage layer
-	existingImages, err := ListImages(hostname, images)
+	existingImages, err := ListImages(options, hostname, images)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to obtain list of images: %s", err)
 	}
 	for i := range existingImages {
-		log.Debugf("Existing image: %#v", existingImages[i])
+		options.logger().Debugf("Existing image: %#v", existingImages[i])
 	}
 
 	// iterate from parent to children
@@ -278,9 +570,9 @@ func ImagesToDownload(manifest *Manifest, hostname string) ([]*ImageWithMeta, er
 		ID := images[i].ID
 		// Check whether storage layer knows this image ID
 		if _, ok := existingImages[ID]; ok {
-			log.Debugf("%s already exists", ID)
+			options.logger().Debugf("%s already exists", ID)
 			// update the progress before deleting it from the slice
-			progress.Update(po, images[i].String(), "Already exists")
+			progress.Update(options.progressOutput(), images[i].String(), "Already exists")
 
 			// delete existing image from images
 			images = append(images[:i], images[i+1:]...)
@@ -290,44 +582,8 @@ func ImagesToDownload(manifest *Manifest, hostname string) ([]*ImageWithMeta, er
 	return images, nil
 }
 
-// DownloadImageBlobs downloads the image blobs concurrently
-func DownloadImageBlobs(images []*ImageWithMeta) error {
-	var wg sync.WaitGroup
-
-	wg.Add(len(images))
-
-	// iterate from parent to children
-	// so that portlayer can extract each layer
-	// on top of previous one
-	results := make(chan error, len(images))
-	for i := len(images) - 1; i >= 0; i-- {
-		go func(image *ImageWithMeta) {
-			defer wg.Done()
-
-			diffID, err := FetchImageBlob(options, image)
-			if err != nil {
-				results <- fmt.Errorf("%s/%s returned %s", options.image, image.layer.BlobSum, err)
-			} else {
-				image.diffID = diffID
-				results <- nil
-			}
-		}(images[i])
-	}
-	wg.Wait()
-	close(results)
-
-	// iterate over results chan to see whether we have a failed download
-	for err := range results {
-		if err != nil {
-			return fmt.Errorf("Failed to fetch image blob: %s", err)
-		}
-	}
-
-	return nil
-}
-
 // WriteImageBlobs writes the image blob to the storage layer
-func WriteImageBlobs(images []*ImageWithMeta) error {
+func WriteImageBlobs(options ImageCOptions, images []*ImageWithMeta) error {
 	if options.standalone {
 		return nil
 	}
@@ -335,7 +591,7 @@ func WriteImageBlobs(images []*ImageWithMeta) error {
 	// iterate from parent to children
 	// so that portlayer can extract each layer
 	// on top of previous one
-	destination := DestinationDirectory()
+	destination := DestinationDirectory(options)
 	for i := len(images) - 1; i >= 0; i-- {
 		image := images[i]
 
@@ -354,7 +610,7 @@ func WriteImageBlobs(images []*ImageWithMeta) error {
 		in := progress.NewProgressReader(
 			ioutils.NewCancelReadCloser(
 				context.Background(), f),
-			po,
+			options.progressOutput(),
 			fi.Size(),
 			image.String(),
 			"Extracting",
@@ -363,11 +619,11 @@ func WriteImageBlobs(images []*ImageWithMeta) error {
 
 		// Write the image
 		// FIXME: send metadata when portlayer supports it
-		err = WriteImage(image, in)
+		err = WriteImage(options, image, in)
 		if err != nil {
 			return fmt.Errorf("Failed to write to image store: %s", err)
 		}
-		progress.Update(po, image.String(), "Pull complete")
+		progress.Update(options.progressOutput(), image.String(), "Pull complete")
 	}
 	if err := os.RemoveAll(destination); err != nil {
 		return fmt.Errorf("Failed to remove download directory: %s", err)
@@ -375,8 +631,8 @@ func WriteImageBlobs(images []*ImageWithMeta) error {
 	return nil
 }
 
-// CreateImageConfig constructs the image metadata from layers that compose the image
-func CreateImageConfig(images []*ImageWithMeta) error {
+// CreateImageConfig constructs the image metadata from layers that compose the image and returns the image ID
+func CreateImageConfig(images []*ImageWithMeta) (string, error) {
 
 	image := docker.Image{}
 	rootFS := docker.NewRootFS()
@@ -386,7 +642,7 @@ func CreateImageConfig(images []*ImageWithMeta) error {
 	for i := len(images) - 1; i >= 0; i-- {
 		layer := images[i]
 		if err := json.Unmarshal([]byte(layer.history.V1Compatibility), &image); err != nil {
-			return fmt.Errorf("Failed to unmarshall layer history: %s", err)
+			return "", fmt.Errorf("Failed to unmarshall layer history: %s", err)
 		}
 		h := docker.History{
 			Created:   image.Created,
@@ -417,16 +673,16 @@ func CreateImageConfig(images []*ImageWithMeta) error {
 
 	bytes, err := result.MarshalJSON()
 	if err != nil {
-		return fmt.Errorf("Failed to marshall image metadata: %s", err)
+		return "", fmt.Errorf("Failed to marshall image metadata: %s", err)
 	}
 
 	// calculate image ID
 	sum := sha256.Sum256(bytes)
-	imageID := fmt.Sprintf("%x", sum)
+	imageID := fmt.Sprintf("sha256:%x", sum)
 
-	log.Infof("Image ID: sha256:%s", imageID)
+	log.Infof("Image ID: %s", imageID)
 
-	return nil
+	return imageID, nil
 }
 
 func main() {
@@ -477,10 +733,105 @@ func main() {
 		log.SetOutput(io.MultiWriter(os.Stdout, f))
 	}
 
+	// The docker style output is just one consumer of the structured progress events
+	// https://raw.githubusercontent.com/docker/docker/master/distribution/pull_v2.go
+	events := make(chan ProgressEvent, 64)
+	rendered := make(chan struct{})
+	out := NewSyncProgressOutput(streamformatter.NewJSONStreamFormatter().NewProgressOutput(os.Stdout, false))
+	go func() {
+		RenderProgress(events, out)
+		out.Flush()
+		close(rendered)
+	}()
+	options.events = events
+
+	// reuse the connections to the registry for the whole pull
+	options.pool = NewFetcherPool()
+
+	if totalRateLimit > 0 {
+		options.limiter = NewRateLimiter(totalRateLimit)
+	}
+
+	// the samples are logged as fields so that they can be picked up by the log collectors
+	if options.throughputInterval > 0 {
+		options.onThroughput = func(s ThroughputSample) {
+			log.WithFields(log.Fields{
+				"bytes":          s.Bytes,
+				"bytesPerSecond": int64(s.BytesPerSecond),
+				"elapsed":        s.Elapsed.String(),
+			}).Infof("Download throughput %s/s", units.HumanSize(s.BytesPerSecond))
+		}
+	}
+
+	if options.fingerprint != "" {
+		if options.fingerprint, err = NormalizeFingerprint(options.fingerprint); err != nil {
+			log.Fatalf("Failed to parse -fingerprint: %s", err)
+		}
+	}
+
+	if bearerToken != "" {
+		options.token = &Token{
+			Token:   bearerToken,
+			Expires: time.Now().Add(DefaultTokenExpirationDuration),
+		}
+	}
+
 	if err = ParseReference(); err != nil {
 		log.Fatalf("Failed to parse -reference: %s", err)
 	}
 
+	if len(options.rewrites) > 0 {
+		u, repository, err := options.remote()
+		if err != nil {
+			log.Fatalf("Failed to apply -registry-rewrite: %s", err)
+		}
+		log.Infof("Pulling %s from %s/%s", options.repository(), u.Host, repository)
+	}
+
+	var sources []string
+	if options.username, options.password, sources = EnvCredentials(options, os.Getenv); len(sources) > 0 {
+		log.Debugf("Using the credentials from %s: username %q, password %q", strings.Join(sources, ", "), options.username, redact(options.password))
+	}
+
+	// inspecting only talks to the registry
+	if options.inspect {
+		inspect, err := Inspect(options)
+		if err != nil {
+			log.Fatalf("Failed to inspect %s: %s", options.reference, err)
+		}
+
+		out, err := json.MarshalIndent(inspect, "", "    ")
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
+		fmt.Printf("%s\n", out)
+		os.Exit(0)
+	}
+
+	if options.releaseLayers {
+		removed, err := ReleaseImageLayers(options)
+		if err != nil {
+			log.Fatalf("Failed to release the layers of %s: %s", options.reference, err)
+		}
+		// the kept layers of the reference are left for the cache to evict
+		if options.keepLayers {
+			if err = ReferenceCachedLayers(options, options.repositoryName()+":"+options.indexTag()); err != nil {
+				log.Fatalf("Failed to release the kept layers of %s: %s", options.reference, err)
+			}
+		}
+		log.Infof("Released %s, removed %d layers", options.displayName(), len(removed))
+		os.Exit(0)
+	}
+
+	// the chain of layers is only complete if the port layer doesn't skip the ones it has
+	if options.sharedLayers && !options.standalone {
+		log.Fatalf("-shared-layers requires -standalone")
+	}
+
+	if options.cacheMaxSize > 0 && !options.keepLayers {
+		log.Fatalf("-cache-max-size requires -keep-layers")
+	}
+
 	// Hostname is our storename
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -491,7 +842,7 @@ func main() {
 		log.Debugf("Running with portlayer")
 
 		// Ping the server to ensure it's at least running
-		ok, err2 := PingPortLayer()
+		ok, err2 := PingPortLayer(options)
 		if err2 != nil || !ok {
 			log.Fatalf("Failed to ping portlayer: %s", err2)
 		}
@@ -499,38 +850,32 @@ func main() {
 		log.Debugf("Running standalone")
 	}
 
-	// Get the URL of the OAuth endpoint
-	url, err := LearnAuthURL(options)
-	if err != nil {
-		log.Fatalf("Failed to obtain OAuth endpoint: %s", err)
+	// the flags only configure the puller, it doesn't look at them afterwards
+	puller := NewPuller(options)
+
+	if err = puller.Authenticate(); err != nil {
+		log.Fatalf(err.Error())
 	}
 
-	// Get the OAuth token - if only we have a URL
-	if url != nil {
-		token, err2 := FetchToken(url)
+	if options.digestPrefix != "" {
+		tag, err := ResolveDigestPrefix(puller.options, options.digestPrefix)
 		if err != nil {
-			log.Fatalf("Failed to fetch OAuth token: %s", err2)
+			log.Fatalf("Failed to resolve %s: %s", options.reference, err)
 		}
-		options.token = token
-	}
-
-	// Get the manifest
-	manifest, err := FetchImageManifest(options)
-	if err != nil {
-		log.Fatalf("Failed to fetch image manifest: %s", err)
+		puller.options.digest = tag
 	}
 
-	if !options.resolv {
-		progress.Message(po, options.digest, "Pulling from "+options.image)
-	}
+	if options.resolv {
+		manifest, err := FetchImageManifest(puller.options)
+		if err != nil {
+			log.Fatalf("Failed to fetch image manifest: %s", err)
+		}
 
-	// Create the ImageWithMeta slice to hold Image structs
-	images, err := ImagesToDownload(manifest, hostname)
-	if err != nil {
-		log.Fatalf(err.Error())
-	}
+		images, err := ImagesToDownload(puller.options, manifest, hostname)
+		if err != nil {
+			log.Fatalf(err.Error())
+		}
 
-	if options.resolv {
 		if len(images) > 0 {
 			fmt.Printf("%s", images[0].history.V1Compatibility)
 			os.Exit(0)
@@ -538,25 +883,17 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Fetch the blobs from registry
-	if err := DownloadImageBlobs(images); err != nil {
-		log.Fatalf(err.Error())
+	if options.allTags {
+		err = puller.PullAll(hostname)
+	} else {
+		err = puller.PullImage(hostname)
 	}
 
-	if err := CreateImageConfig(images); err != nil {
-		log.Fatalf(err.Error())
-	}
+	// flush the remaining progress events, the terminal one included, before exiting
+	close(events)
+	<-rendered
 
-	// Write blobs to the storage layer
-	if err := WriteImageBlobs(images); err != nil {
+	if err != nil {
 		log.Fatalf(err.Error())
 	}
-
-	// FIXME: Dump the digest
-	//progress.Message(po, "", "Digest: 0xDEAD:BEEF")
-	if len(images) > 0 {
-		progress.Message(po, "", "Status: Downloaded newer image for "+options.image+":"+options.digest)
-	} else {
-		progress.Message(po, "", "Status: Image is up to date for "+options.image+":"+options.digest)
-	}
 }
@@ -15,14 +15,23 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/vmware/vic/lib/apiservers/portlayer/models"
 )
@@ -49,6 +58,22 @@ const (
 	DigestSHA256EmptyTar = "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
 )
 
+// TestMain points the default destination at a temporary directory, so that a test that doesn't
+// set its own doesn't leave images behind in the source tree
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	options.destination = dir
+
+	retCode := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(retCode)
+}
+
 func TestLearnAuthURL(t *testing.T) {
 	s := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -72,6 +97,249 @@ func TestLearnAuthURL(t *testing.T) {
 	}
 }
 
+func TestLearnAuthURLV1Registry(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// a registry that only speaks the v1 API
+			if r.URL.Path == "/v1/_ping" {
+				w.Header().Set("X-Docker-Registry-Version", "0.9.1")
+				w.Write([]byte("true"))
+				return
+			}
+			http.NotFound(w, r)
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+
+	_, err := LearnAuthURL(opts)
+	if _, ok := err.(ErrUnsupportedAPI); !ok {
+		t.Errorf("Expected an ErrUnsupportedAPI, got %#v", err)
+	}
+}
+
+func TestLearnAuthURLChallenges(t *testing.T) {
+	challenges := []struct {
+		name      string
+		challenge string
+		expected  string
+	}{
+		{
+			"ghcr",
+			`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:library/photon:pull"`,
+			"https://ghcr.io/token?scope=repository%3Alibrary%2Fphoton%3Apull&service=ghcr.io",
+		},
+		{
+			// the scope is up to the client
+			"gitlab",
+			`Bearer realm="https://gitlab.example.com/jwt/auth",service="container_registry"`,
+			"https://gitlab.example.com/jwt/auth?scope=repository%3Alibrary%2Fphoton%3Apull&service=container_registry",
+		},
+		{
+			// whitespace between the parameters and a comma within the scope
+			"spaced",
+			`Bearer realm="https://auth.example.com/token", service="registry", scope="repository:library/photon:pull,push"`,
+			"https://auth.example.com/token?scope=repository%3Alibrary%2Fphoton%3Apull%2Cpush&service=registry",
+		},
+		{
+			// a scope for another repository doesn't grant the pull
+			"other",
+			`Bearer realm="https://auth.example.com/token",service="registry",scope="registry:catalog:*"`,
+			"https://auth.example.com/token?scope=registry%3Acatalog%3A%2A&scope=repository%3Alibrary%2Fphoton%3Apull&service=registry",
+		},
+	}
+
+	for _, c := range challenges {
+		challenge := c.challenge
+		s := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("www-authenticate", challenge)
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+			}))
+
+		opts := options
+		opts.registry = s.URL
+		opts.image = Image
+		opts.digest = Tag
+
+		url, err := LearnAuthURL(opts)
+		s.Close()
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+
+		if url.String() != c.expected {
+			t.Errorf("%s: returned url %s, expected %s", c.name, url, c.expected)
+		}
+	}
+}
+
+func TestAuthenticateScopedToken(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/jwt/auth" {
+				// the token only grants what was asked for
+				q := r.URL.Query()
+				if q.Get("service") != "container_registry" || q.Get("scope") != "repository:library/photon:pull" {
+					w.Write([]byte(`{"token":"useless"}`))
+					return
+				}
+				w.Write([]byte(`{"token":"` + OAuthToken + `"}`))
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				w.Header().Set("www-authenticate", `Bearer realm="`+s.URL+`/jwt/auth",service="container_registry"`)
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("{}"))
+		}))
+	defer s.Close()
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+	options.token = nil
+
+	puller := NewPuller(options)
+	if err := puller.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateToken(puller.options); err != nil {
+		t.Errorf("Token wasn't scoped to the repository: %s", err)
+	}
+}
+
+func TestAuthenticateSuppliedToken(t *testing.T) {
+	var tokenRequests int32
+
+	var s *httptest.Server
+	s = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				atomic.AddInt32(&tokenRequests, 1)
+				w.Write([]byte(`{"token":"` + OAuthToken + `"}`))
+				return
+			}
+
+			auth := r.Header.Get("Authorization")
+			if auth != "Bearer "+OAuthToken && auth != "Bearer preminted" {
+				w.Header().Set("www-authenticate",
+					"Bearer realm=\""+s.URL+"/token\",service=\"registry\",scope=\"repository:library/photon:pull\"")
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("{}"))
+		}))
+	defer s.Close()
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+
+	// an accepted token skips the auth round trips
+	options.token = &Token{Token: "preminted"}
+	puller := NewPuller(options)
+	if err := puller.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if puller.options.token.Token != "preminted" || atomic.LoadInt32(&tokenRequests) != 0 {
+		t.Errorf("Supplied token wasn't used as is, got %s", puller.options.token.Token)
+	}
+
+	// a rejected one falls back to fetching a token
+	options.token = &Token{Token: "expired"}
+	puller = NewPuller(options)
+	if err := puller.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+	if puller.options.token.Token != OAuthToken || atomic.LoadInt32(&tokenRequests) != 1 {
+		t.Errorf("Expected a fetched token, got %s", puller.options.token.Token)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "user" || password != "secret" {
+				w.Header().Set("www-authenticate", "Basic realm=\"Registry Realm\"")
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+
+			manifest := &Manifest{
+				Name:     Image,
+				Tag:      Tag,
+				FSLayers: []FSLayer{FSLayer{BlobSum: DigestSHA256EmptyTar}},
+			}
+
+			body, err := json.Marshal(manifest)
+			if err != nil {
+				t.Errorf(err.Error())
+			}
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.token = nil
+
+	// no credentials, no way in
+	if _, err = LearnAuthURL(opts); err == nil {
+		t.Errorf("Expected an error without credentials")
+	} else if _, ok := err.(ErrUnauthorized); !ok {
+		t.Errorf("Expected an ErrUnauthorized, got %#v", err)
+	}
+
+	opts.username = "user"
+	opts.password = "secret"
+
+	url, err := LearnAuthURL(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != nil {
+		t.Errorf("Expected no token service, got %s", url)
+	}
+
+	manifest, err := FetchImageManifest(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Name != Image {
+		t.Errorf("Returned manifest name %s is different than expected", manifest.Name)
+	}
+}
+
 func TestFetchToken(t *testing.T) {
 	s := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -92,7 +360,7 @@ func TestFetchToken(t *testing.T) {
 	}
 	url.Path = path.Join(url.Path, "token?scope=repository%3Alibrary%2Fphoton%3Apull&service=registry.docker.io")
 
-	token, err := FetchToken(url)
+	token, err := FetchToken(options, url)
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -102,6 +370,98 @@ func TestFetchToken(t *testing.T) {
 	}
 }
 
+// TestFetchTokenBasicAuth mirrors GHCR, whose token service only mints a token for a private
+// repository if the username and personal access token come along as basic auth
+func TestFetchTokenBasicAuth(t *testing.T) {
+	const pat = "ghp_personal_access_token"
+	token := base64.StdEncoding.EncodeToString([]byte("user:" + pat))
+
+	var s *httptest.Server
+	s = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				if r.URL.Query().Get("scope") != "repository:"+Image+":pull" {
+					t.Errorf("Unexpected scope %q", r.URL.Query().Get("scope"))
+				}
+
+				username, password, ok := r.BasicAuth()
+				if !ok || username != "user" || password != pat {
+					// anonymous tokens aren't scoped to private repositories
+					w.Header().Set("Content-Type", "application/json")
+					w.Write([]byte(`{"token":"anonymous"}`))
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"token":"` + token + `"}`))
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer "+token {
+				w.Header().Set("www-authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="ghcr.io",scope="repository:%s:pull"`, s.URL, Image))
+				http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`, http.StatusUnauthorized)
+				return
+			}
+
+			body, err := json.Marshal(&Manifest{
+				Name:     Image,
+				Tag:      Tag,
+				FSLayers: []FSLayer{{BlobSum: DigestSHA256EmptyTar}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.token = nil
+
+	pull := func() error {
+		url, err := LearnAuthURL(opts)
+		if err != nil {
+			return err
+		}
+		if url == nil {
+			t.Fatal("Expected a token service")
+		}
+
+		if opts.token, err = FetchToken(opts, url); err != nil {
+			return err
+		}
+
+		_, err = FetchImageManifest(opts)
+		return err
+	}
+
+	// the anonymous token doesn't get past the registry
+	if err = pull(); err == nil {
+		t.Errorf("Expected an error pulling a private repository anonymously")
+	}
+
+	opts.username = "user"
+	opts.password = pat
+
+	if err = pull(); err != nil {
+		t.Fatal(err)
+	}
+	if opts.token.Token != token {
+		t.Errorf("Unexpected token %s", opts.token.Token)
+	}
+}
+
 func TestFetchImageManifest(t *testing.T) {
 	s := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -145,6 +505,99 @@ func TestFetchImageManifest(t *testing.T) {
 	}
 }
 
+func TestFetchImageManifestNotModified(t *testing.T) {
+	var full, notModified int32
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			atomic.AddInt32(&full, 1)
+
+			body, err := json.Marshal(&Manifest{
+				Name:     Image,
+				Tag:      Tag,
+				FSLayers: []FSLayer{{BlobSum: DigestSHA256EmptyTar}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.token = &Token{Token: OAuthToken}
+
+	for i := 0; i < 2; i++ {
+		manifest, err := FetchImageManifest(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(manifest.FSLayers) != 1 || manifest.FSLayers[0].BlobSum != DigestSHA256EmptyTar {
+			t.Errorf("Unexpected manifest %#v", manifest)
+		}
+	}
+
+	if n, m := atomic.LoadInt32(&full), atomic.LoadInt32(&notModified); n != 1 || m != 1 {
+		t.Errorf("Expected the manifest to be downloaded once, got %d downloads and %d 304s", n, m)
+	}
+
+	// without the manifest on disk the ETag isn't sent
+	if err = os.Remove(path.Join(DestinationDirectory(opts), "manifest.json")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = FetchImageManifest(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, m := atomic.LoadInt32(&full), atomic.LoadInt32(&notModified); n != 2 || m != 1 {
+		t.Errorf("Expected the manifest to be downloaded again, got %d downloads and %d 304s", n, m)
+	}
+}
+
+func TestFetchImageManifestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	defer s.Close()
+	defer close(release)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.token = &Token{Token: OAuthToken}
+	opts.timeout = time.Hour
+	opts.manifestTimeout = 100 * time.Millisecond
+
+	// the manifest gives up on its own budget, not the blob one
+	start := time.Now()
+	if _, err := FetchImageManifest(opts); err == nil {
+		t.Errorf("Expected the manifest fetch to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Manifest fetch took %s", elapsed)
+	}
+}
+
 func TestFetchImageBlob(t *testing.T) {
 	s := httptest.NewServer(
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -186,7 +639,7 @@ func TestFetchImageBlob(t *testing.T) {
 		t.Errorf("Expected a diffID, got nil.")
 	}
 
-	tar, err := ioutil.ReadFile(path.Join(DestinationDirectory(), LayerID, LayerID+".tar"))
+	tar, err := ioutil.ReadFile(path.Join(DestinationDirectory(options), LayerID, LayerID+".tar"))
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -195,7 +648,7 @@ func TestFetchImageBlob(t *testing.T) {
 		t.Errorf(err.Error())
 	}
 
-	hist, err := ioutil.ReadFile(path.Join(DestinationDirectory(), LayerID, LayerID+".json"))
+	hist, err := ioutil.ReadFile(path.Join(DestinationDirectory(options), LayerID, LayerID+".json"))
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -204,3 +657,619 @@ func TestFetchImageBlob(t *testing.T) {
 		t.Errorf(err.Error())
 	}
 }
+
+func TestFetchImageBlobCompression(t *testing.T) {
+	// a tar layer, served as is and gzip compressed
+	var raw bytes.Buffer
+	tw := tar.NewWriter(&raw)
+	content := []byte(LayerContent)
+	if err := tw.WriteHeader(&tar.Header{Name: "file", Mode: 0644, Size: int64(len(content))}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Write(content)
+	tw.Close()
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	gw.Write(raw.Bytes())
+	gw.Close()
+
+	digest := func(b []byte) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256(b))
+	}
+
+	var blob []byte
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write(blob)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+
+	tests := []struct {
+		blob      []byte
+		mediaType string
+		diffID    string
+		fail      bool
+	}{
+		{raw.Bytes(), "", digest(raw.Bytes()), false},
+		{raw.Bytes(), MediaTypeUncompressedLayer, digest(raw.Bytes()), false},
+		{raw.Bytes(), MediaTypeLayer, "", true},
+		{compressed.Bytes(), MediaTypeOCILayer, digest(raw.Bytes()), false},
+		{compressed.Bytes(), MediaTypeOCIUncompressedLayer, "", true},
+	}
+
+	for _, test := range tests {
+		blob = test.blob
+
+		parent := "scratch"
+		image := ImageWithMeta{
+			Image: &models.Image{
+				ID:     LayerID,
+				Parent: &parent,
+				Store:  Storename,
+			},
+			history: History{V1Compatibility: LayerHistory},
+			layer:   FSLayer{BlobSum: digest(test.blob), MediaType: test.mediaType},
+		}
+
+		diffID, err := FetchImageBlob(opts, &image)
+		if test.fail {
+			if err == nil {
+				t.Errorf("Expected an error for a %d byte layer with media type %s", len(test.blob), test.mediaType)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Unexpected error for media type %q: %s", test.mediaType, err)
+			continue
+		}
+
+		if diffID != test.diffID {
+			t.Errorf("Expected diffID %s, got %s", test.diffID, diffID)
+		}
+	}
+}
+
+func TestFetchImageBlobMaxLayerSize(t *testing.T) {
+	// a megabyte of zeros compresses to about a kilobyte
+	var bomb bytes.Buffer
+	gw := gzip.NewWriter(&bomb)
+	gw.Write(make([]byte, 1024*1024))
+	gw.Close()
+
+	blobSum := fmt.Sprintf("sha256:%x", sha256.Sum256(bomb.Bytes()))
+
+	var chunked bool
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// flushing before the body is written leaves out the Content-Length
+			if chunked {
+				w.(http.Flusher).Flush()
+			}
+			w.Write(bomb.Bytes())
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+
+	tests := []struct {
+		max     int64
+		chunked bool
+		fail    bool
+	}{
+		{0, false, false},
+		{2 * 1024 * 1024, false, false},
+		// the uncompressed layer is too large
+		{64 * 1024, false, true},
+		// so is the compressed one, with and without a Content-Length
+		{100, false, true},
+		{100, true, true},
+	}
+
+	for _, test := range tests {
+		opts.maxLayerSize = test.max
+		chunked = test.chunked
+
+		parent := "scratch"
+		image := ImageWithMeta{
+			Image: &models.Image{
+				ID:     LayerID,
+				Parent: &parent,
+				Store:  Storename,
+			},
+			history: History{V1Compatibility: LayerHistory},
+			layer:   FSLayer{BlobSum: blobSum},
+		}
+
+		_, err := FetchImageBlob(opts, &image)
+		if !test.fail {
+			if err != nil {
+				t.Errorf("Unexpected error with a limit of %d bytes: %s", test.max, err)
+			}
+			continue
+		}
+
+		if e, ok := err.(ErrLayerTooLarge); !ok || e.Layer != blobSum || e.Limit != test.max {
+			t.Errorf("Expected an ErrLayerTooLarge with a limit of %d bytes, got %#v", test.max, err)
+		}
+	}
+}
+
+func TestTypedErrors(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/manifests/missing"):
+				http.NotFound(w, r)
+			case strings.HasSuffix(r.URL.Path, "/manifests/private"):
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+			case strings.Contains(r.URL.Path, "/manifests/"):
+				// a manifest for some other image
+				body, err := json.Marshal(&Manifest{Name: "library/other", Tag: Tag})
+				if err != nil {
+					t.Errorf(err.Error())
+				}
+				w.Write(body)
+			default:
+				// a layer that doesn't match its digest
+				w.Write([]byte(LayerContent + "corrupted"))
+			}
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.destination = dir
+	opts.token = &Token{Token: OAuthToken}
+
+	opts.digest = "missing"
+	_, err = FetchImageManifest(opts)
+	if _, ok := err.(ErrImageNotFound); !ok {
+		t.Errorf("Expected an ErrImageNotFound, got %#v", err)
+	}
+
+	opts.digest = "private"
+	_, err = FetchImageManifest(opts)
+	if _, ok := err.(ErrUnauthorized); !ok {
+		t.Errorf("Expected an ErrUnauthorized, got %#v", err)
+	}
+
+	opts.digest = Tag
+	_, err = FetchImageManifest(opts)
+	if e, ok := err.(ErrManifestMismatch); !ok || e.Field != "name" {
+		t.Errorf("Expected an ErrManifestMismatch for the name, got %#v", err)
+	}
+
+	parent := "scratch"
+	image := ImageWithMeta{
+		Image: &models.Image{
+			ID:     LayerID,
+			Parent: &parent,
+			Store:  Storename,
+		},
+		history: History{V1Compatibility: LayerHistory},
+		layer:   FSLayer{BlobSum: DigestSHA256LayerContent},
+	}
+	_, err = FetchImageBlob(opts, &image)
+	if e, ok := err.(Error); !ok || !e.Temporary() {
+		t.Errorf("Expected a temporary error, got %#v", err)
+	}
+	if e, ok := err.(ErrChecksum); !ok || e.Expected != DigestSHA256LayerContent {
+		t.Errorf("Expected an ErrChecksum, got %#v", err)
+	}
+}
+
+func TestNormalizeRepository(t *testing.T) {
+	tests := []struct {
+		registry string
+		image    string
+		expected string
+	}{
+		{DefaultDockerURL, "ubuntu", "library/ubuntu"},
+		{DefaultDockerURL, "library/ubuntu", "library/ubuntu"},
+		{DefaultDockerURL, "myorg/myimage", "myorg/myimage"},
+		{"https://192.168.218.5:5000/v2/", "ubuntu", "ubuntu"},
+	}
+
+	for _, test := range tests {
+		if repo := NormalizeRepository(test.registry, test.image); repo != test.expected {
+			t.Errorf("%s at %s normalized to %s, expected %s", test.image, test.registry, repo, test.expected)
+		}
+	}
+
+	opts := options
+	opts.registry = DefaultDockerURL
+	opts.image = "ubuntu"
+	opts.digest = Tag
+
+	url, err := opts.repositoryURL("manifests", opts.digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url.String() != "https://registry-1.docker.io/v2/library/ubuntu/manifests/latest" {
+		t.Errorf("Returned url %s is different than expected", url)
+	}
+}
+
+func TestListTags(t *testing.T) {
+	pages := map[string]Tags{
+		"":       Tags{Name: Image, Tags: []string{"1.0", "latest"}},
+		"latest": Tags{Name: Image, Tags: []string{"2.0"}},
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+				return
+			}
+			if r.URL.Path != "/v2/"+Image+"/tags/list" {
+				http.NotFound(w, r)
+				return
+			}
+
+			last := r.URL.Query().Get("last")
+			if last == "" {
+				w.Header().Set("Link", "</v2/"+Image+"/tags/list?n=2&last=latest>; rel=\"next\"")
+			}
+			w.Header().Set("Content-Type", "application/json")
+
+			body, err := json.Marshal(pages[last])
+			if err != nil {
+				t.Errorf(err.Error())
+			}
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL + "/v2/"
+	opts.image = Image
+	opts.token = &Token{Token: OAuthToken}
+
+	tags, err := ListTags(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tags) != 3 || tags[0] != "1.0" || tags[1] != "latest" || tags[2] != "2.0" {
+		t.Errorf("Returned tags %#v are different than expected", tags)
+	}
+}
+
+func TestListTagsTimeout(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte(`{"name":"` + Image + `","tags":["latest"]}`))
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL + "/v2/"
+	opts.image = Image
+	opts.token = &Token{Token: OAuthToken}
+	opts.manifestTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	if _, err := ListTags(opts); err == nil {
+		t.Errorf("Expected the tag list to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Listing the tags took %s", elapsed)
+	}
+}
+
+func TestResolveDigestPrefix(t *testing.T) {
+	manifest := func(n int) string {
+		return fmt.Sprintf(`{"schemaVersion":2,"n":%d}`, n)
+	}
+	digestOf := func(content string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+	}
+
+	// find two manifests whose digests share a prefix, and a third that doesn't
+	first, second := 0, 1
+	for digestOf(manifest(first))[:9] != digestOf(manifest(second))[:9] {
+		if second++; second > 1000 {
+			first, second = first+1, first+2
+		}
+	}
+	third := second + 1
+	for digestOf(manifest(third))[:9] == digestOf(manifest(first))[:9] {
+		third++
+	}
+
+	// 1.0 and latest are the same image
+	manifests := map[string]string{
+		"1.0":    manifest(first),
+		"latest": manifest(first),
+		"2.0":    manifest(second),
+		"3.0":    manifest(third),
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/v2/"+Image+"/tags/list" {
+				w.Write([]byte(`{"name":"` + Image + `","tags":["1.0","latest","2.0","3.0"]}`))
+				return
+			}
+
+			content, ok := manifests[path.Base(r.URL.Path)]
+			if !ok || !strings.Contains(r.URL.Path, "/manifests/") {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", MediaTypeManifest)
+			w.Header().Set("Docker-Content-Digest", digestOf(content))
+			w.Write([]byte(content))
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL + "/v2/"
+	opts.image = Image
+
+	unique := []string{
+		digestOf(manifests["1.0"])[7:20],
+		digestOf(manifests["3.0"])[7:9],
+	}
+	for _, prefix := range unique {
+		tag, err := ResolveDigestPrefix(opts, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest := digestOf(manifests[tag]); !strings.HasPrefix(digest, "sha256:"+prefix) {
+			t.Errorf("%s resolved to %s with digest %s", prefix, tag, digest)
+		}
+	}
+
+	_, err := ResolveDigestPrefix(opts, digestOf(manifests["2.0"])[7:9])
+	if e, ok := err.(ErrAmbiguousDigest); !ok || len(e.Digests) != 2 {
+		t.Errorf("Expected an ambiguous digest, got %#v", err)
+	}
+
+	// a prefix none of them has
+	missing := "0000"
+	for _, content := range manifests {
+		if strings.HasPrefix(digestOf(content), "sha256:"+missing) {
+			missing = "ffff"
+		}
+	}
+	if _, err = ResolveDigestPrefix(opts, missing); err == nil {
+		t.Errorf("Expected no match")
+	} else if _, ok := err.(ErrImageNotFound); !ok {
+		t.Errorf("Expected no match, got %#v", err)
+	}
+}
+
+func TestSplitDigestPrefix(t *testing.T) {
+	full := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		ref, name, prefix string
+	}{
+		{"busybox@abc123", "busybox", "abc123"},
+		{"registry:5000/busybox@sha256:abc123", "registry:5000/busybox", "abc123"},
+		// tags and complete digests are left to the reference parser
+		{"busybox:abc123", "busybox:abc123", ""},
+		{"busybox", "busybox", ""},
+		{"busybox@" + full, "busybox@" + full, ""},
+		{"busybox@xyz", "busybox@xyz", ""},
+	}
+
+	for _, test := range tests {
+		if name, prefix := splitDigestPrefix(test.ref); name != test.name || prefix != test.prefix {
+			t.Errorf("%s split into %q and %q, expected %q and %q", test.ref, name, prefix, test.name, test.prefix)
+		}
+	}
+}
+
+func TestParseReferenceTagAndDigest(t *testing.T) {
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	digest := "sha256:" + strings.Repeat("a", 64)
+
+	tests := []struct {
+		ref, digest, tag, index, display string
+	}{
+		{"busybox", "latest", "", "latest", "library/busybox:latest"},
+		{"busybox:1.25", "1.25", "", "1.25", "library/busybox:1.25"},
+		{"busybox@" + digest, digest, "", digest, "library/busybox@" + digest},
+		{"busybox:1.25@" + digest, digest, "1.25", "1.25", "library/busybox:1.25@" + digest},
+	}
+
+	for _, test := range tests {
+		options.reference = test.ref
+		if err := ParseReference(); err != nil {
+			t.Fatal(err)
+		}
+
+		if options.digest != test.digest || options.tag != test.tag {
+			t.Errorf("%s parsed into %q and tag %q, expected %q and %q", test.ref, options.digest, options.tag, test.digest, test.tag)
+		}
+		if tag := options.indexTag(); tag != test.index {
+			t.Errorf("%s is indexed as %q, expected %q", test.ref, tag, test.index)
+		}
+		if name := options.displayName(); name != test.display {
+			t.Errorf("%s is displayed as %q, expected %q", test.ref, name, test.display)
+		}
+	}
+}
+
+func TestFetchImageManifestByDigest(t *testing.T) {
+	// the manifest was pushed with a tag other than the one given along with the digest
+	body, err := json.Marshal(&Manifest{
+		Name:     Image,
+		Tag:      "pushed",
+		FSLayers: []FSLayer{{BlobSum: DigestSHA256EmptyTar}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+
+	var requested string
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = path.Base(r.URL.Path)
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = digest
+	opts.tag = Tag
+	opts.destination = dir
+
+	if _, err = FetchImageManifest(opts); err != nil {
+		t.Fatal(err)
+	}
+	if requested != digest {
+		t.Errorf("Manifest was fetched by %s, expected the digest", requested)
+	}
+
+	// the registry returned some other manifest
+	opts.digest = "sha256:" + strings.Repeat("a", 64)
+	opts.destination = path.Join(dir, "other")
+	_, err = FetchImageManifest(opts)
+	if e, ok := err.(ErrManifestMismatch); !ok || e.Field != "digest" || e.Got != digest {
+		t.Errorf("Expected a digest mismatch, got %#v", err)
+	}
+}
+
+func TestLoggerFields(t *testing.T) {
+	opts := options
+	opts.image = Image
+	opts.digest = "sha256:" + strings.Repeat("a", 64)
+	opts.tag = Tag
+	opts.correlationID = "0123456789ab"
+
+	fields := opts.logger().WithField("layer", LayerID).Data
+	expected := map[string]interface{}{
+		"image":         Image,
+		"reference":     opts.digest,
+		"tag":           Tag,
+		"correlationID": "0123456789ab",
+		"layer":         LayerID,
+	}
+	for name, value := range expected {
+		if fields[name] != value {
+			t.Errorf("Field %s is %v, expected %v", name, fields[name], value)
+		}
+	}
+
+	// the fields without a value are left out
+	opts.tag = ""
+	opts.correlationID = ""
+	fields = opts.logger().Data
+	if _, ok := fields["tag"]; ok {
+		t.Errorf("Unexpected tag field")
+	}
+	if _, ok := fields["correlationID"]; ok {
+		t.Errorf("Unexpected correlationID field")
+	}
+}
+
+func TestFetchImageManifestContentDigest(t *testing.T) {
+	// a signed schema 1 manifest, the signatures are cut out of the payload the digest is over
+	payload := "{\n   \"name\": \"" + Image + "\",\n   \"tag\": \"" + Tag + "\"\n}"
+	formatLength := len(payload) - 2
+	protected := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"formatLength":%d,"formatTail":"%s"}`,
+		formatLength, base64.RawURLEncoding.EncodeToString([]byte(payload[formatLength:])))))
+	signed := payload[:formatLength] + ",\n   \"signatures\": [{\"protected\": \"" + protected + "\", \"signature\": \"c2ln\"}]" + payload[formatLength:]
+
+	unsigned := `{"name":"` + Image + `","tag":"` + Tag + `"}`
+
+	tests := []struct {
+		body, reported, digest string
+	}{
+		{unsigned, "", fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(unsigned)))},
+		{unsigned, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(unsigned))), fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(unsigned)))},
+		{signed, fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(payload))), fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(payload)))},
+		// the registry reports the digest of another manifest
+		{unsigned, "sha256:" + strings.Repeat("a", 64), ""},
+	}
+
+	for _, test := range tests {
+		s := httptest.NewServer(
+			http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.reported != "" {
+					w.Header().Set("Docker-Content-Digest", test.reported)
+				}
+				w.Write([]byte(test.body))
+			}))
+
+		dir, err := ioutil.TempDir("", "imagec")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		opts := options
+		opts.registry = s.URL
+		opts.image = Image
+		opts.digest = Tag
+		opts.destination = dir
+
+		manifest, err := FetchImageManifest(opts)
+		s.Close()
+		os.RemoveAll(dir)
+
+		if test.digest == "" {
+			if e, ok := err.(ErrManifestMismatch); !ok || e.Field != "Docker-Content-Digest" {
+				t.Errorf("Expected a digest mismatch, got %#v", err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if manifest.Digest != test.digest {
+			t.Errorf("Manifest digest is %s, expected %s", manifest.Digest, test.digest)
+		}
+	}
+}
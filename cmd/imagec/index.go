@@ -0,0 +1,75 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"syscall"
+)
+
+// updateIndex replaces the JSON index file name in dir under an exclusive lock on name.lock, so
+// that concurrent pulls sharing dir don't lose each other's updates. update is called with the
+// lock held to read the current index and apply its change, the value it returns is written to
+// a temporary file that's renamed over the index, which is left untouched if update fails.
+func updateIndex(dir, name string, update func() (interface{}, error)) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	lock, err := os.OpenFile(path.Join(dir, name+".lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	index, err := update()
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(content)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path.Join(dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
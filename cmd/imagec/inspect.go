@@ -0,0 +1,322 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// Media types of the manifests that reference a manifest per platform, and of the signed
+// schema 1 manifest
+const (
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifestV1   = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// MediaTypeBuildkitCacheConfig is the config media type of the cache manifests buildkit exports
+// to registries, they look like artifacts but hold no usable content
+const MediaTypeBuildkitCacheConfig = "application/vnd.buildkit.cacheconfig.v0"
+
+// manifestTypes are the manifest media types imagec understands
+var manifestTypes = map[string]bool{
+	MediaTypeManifestList: true,
+	MediaTypeOCIIndex:     true,
+	MediaTypeManifestV1:   true,
+	MediaTypeManifest:     true,
+	MediaTypeOCIManifest:  true,
+	// unsigned schema 1
+	"application/vnd.docker.distribution.manifest.v1+json": true,
+}
+
+// genericTypes are the content types registries send when they don't know better, the manifest
+// isn't rejected for them
+var genericTypes = map[string]bool{
+	"":                         true,
+	"application/json":         true,
+	"application/octet-stream": true,
+	"text/plain":               true,
+}
+
+// Platform describes the platform an image runs on
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// ManifestDescriptor references the manifest of one platform of a manifest list
+type ManifestDescriptor struct {
+	Descriptor
+	Platform *Platform `json:"platform,omitempty"`
+}
+
+// ManifestList represents a manifest list or an OCI index
+type ManifestList struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType,omitempty"`
+	Manifests     []ManifestDescriptor `json:"manifests"`
+	Annotations   map[string]string    `json:"annotations,omitempty"`
+}
+
+// ImageInspect describes a remote image as the registry serves it. Either Manifests is set for
+// a manifest list, or the remaining fields describe a single image.
+type ImageInspect struct {
+	Name      string `json:"name"`
+	Reference string `json:"reference"`
+	MediaType string `json:"mediaType"`
+	Digest    string `json:"digest"`
+
+	// Annotations of the manifest or index, such as org.opencontainers.image.source
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	Manifests []ManifestDescriptor `json:"manifests,omitempty"`
+
+	Platform *Platform        `json:"platform,omitempty"`
+	Config   *Descriptor      `json:"config,omitempty"`
+	Layers   []Descriptor     `json:"layers,omitempty"`
+	Size     int64            `json:"size,omitempty"`
+	Runtime  *ContainerConfig `json:"runtime,omitempty"`
+}
+
+// inspectAccept are the manifest media types Inspect accepts, in order of preference
+var inspectAccept = []string{
+	MediaTypeManifestList,
+	MediaTypeOCIIndex,
+	MediaTypeOCIManifest,
+	MediaTypeManifest,
+	MediaTypeManifestV1,
+}
+
+// Inspect fetches the manifest of the reference and, for a single image, its config blob and
+// describes them without downloading any layers. A token is obtained first unless options
+// already carries one.
+func Inspect(options ImageCOptions) (*ImageInspect, error) {
+	defer trace.End(trace.Begin(options.image + "/" + options.digest))
+
+	if options.token == nil {
+		url, err := LearnAuthURL(options)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to obtain OAuth endpoint: %s", err)
+		}
+		if url != nil {
+			if options.token, err = FetchToken(options, url); err != nil {
+				return nil, fmt.Errorf("Failed to fetch OAuth token: %s", err)
+			}
+		}
+	}
+
+	content, mediaType, digest, err := fetchManifest(options, inspectAccept)
+	if err != nil {
+		return nil, err
+	}
+
+	inspect := &ImageInspect{
+		Name:      options.repository(),
+		Reference: options.digest,
+		Digest:    digest,
+	}
+
+	// registries don't always send a meaningful content type, the manifest names its own
+	var header struct {
+		SchemaVersion int    `json:"schemaVersion"`
+		MediaType     string `json:"mediaType"`
+	}
+	if err = json.Unmarshal(content, &header); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshall manifest: %s", err)
+	}
+	if header.MediaType != "" {
+		mediaType = header.MediaType
+	}
+
+	switch {
+	case mediaType == MediaTypeManifestList || mediaType == MediaTypeOCIIndex:
+		list := &ManifestList{}
+		if err = json.Unmarshal(content, list); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshall manifest list: %s", err)
+		}
+		inspect.MediaType = mediaType
+		inspect.Manifests = list.Manifests
+		inspect.Annotations = list.Annotations
+	case header.SchemaVersion == 1:
+		inspect.MediaType = MediaTypeManifestV1
+		err = inspectManifestV1(inspect, content)
+	default:
+		inspect.MediaType = mediaType
+		err = inspectManifest(options, inspect, content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return inspect, nil
+}
+
+// inspectManifest fills in the image described by a schema 2 or OCI manifest
+func inspectManifest(options ImageCOptions, inspect *ImageInspect, content []byte) error {
+	manifest := &ArtifactManifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return fmt.Errorf("Failed to unmarshall manifest: %s", err)
+	}
+
+	inspect.Annotations = manifest.Annotations
+	inspect.Config = &manifest.Config
+	inspect.Layers = manifest.Layers
+	for _, layer := range manifest.Layers {
+		inspect.Size += layer.Size
+	}
+
+	// artifacts don't have a platform or runtime config to report
+	if manifest.IsArtifact() {
+		return nil
+	}
+
+	config, err := FetchImageConfig(options, manifest)
+	if err != nil {
+		return err
+	}
+
+	inspect.Platform = &config.Platform
+	inspect.Runtime = config.Config
+
+	return nil
+}
+
+// inspectManifestV1 fills in the image described by a schema 1 manifest, which carries the
+// config inline and doesn't record the layer sizes
+func inspectManifestV1(inspect *ImageInspect, content []byte) error {
+	manifest := &Manifest{}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return fmt.Errorf("Failed to unmarshall manifest: %s", err)
+	}
+
+	// the layers are ordered from the topmost down, report them base first like schema 2
+	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
+		inspect.Layers = append(inspect.Layers, Descriptor{Digest: manifest.FSLayers[i].BlobSum})
+	}
+
+	if len(manifest.History) == 0 {
+		return nil
+	}
+
+	platform := &Platform{}
+	if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), platform); err != nil {
+		return fmt.Errorf("Failed to unmarshall image config: %s", err)
+	}
+	inspect.Platform = platform
+
+	var err error
+	inspect.Runtime, err = ManifestImageConfig(manifest)
+	return err
+}
+
+// fetchManifest fetches the manifest of the reference accepting the given media types and returns
+// its content, media type and digest. The digest is computed from the content and checked against
+// the one the registry reports, and the one the manifest is fetched by.
+func fetchManifest(options ImageCOptions, accept []string) ([]byte, string, string, error) {
+	url, err := options.repositoryURL("manifests", options.digest)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	options.logger().Debugf("URL: %s", url)
+
+	fetcher := options.newFetcher(FetcherOptions{
+		Timeout:            options.manifestTimeout,
+		Username:           options.username,
+		Password:           options.password,
+		Token:              options.token,
+		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+		Accept:             accept,
+	})
+	manifestFileName, err := fetcher.Fetch(url)
+	if err != nil {
+		if fetcher.IsStatusNotFound() {
+			return nil, "", "", ErrImageNotFound{Image: options.image, Reference: options.digest, Registry: options.registry}
+		}
+		return nil, "", "", err
+	}
+	defer os.Remove(manifestFileName)
+
+	content, err := ioutil.ReadFile(manifestFileName)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	header := fetcher.ResponseHeader()
+
+	if err = checkManifestMediaType(options, header.Get("Content-Type"), content); err != nil {
+		return nil, "", "", err
+	}
+
+	// the digest the registry reports, if it does, has to be that of the manifest it sent
+	digest, err := manifestDigest(content)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if reported := header.Get("Docker-Content-Digest"); reported != "" && reported != digest {
+		return nil, "", "", ErrManifestMismatch{Field: "Docker-Content-Digest", Expected: reported, Got: digest}
+	}
+
+	// a manifest fetched by digest, such as that of a manifest list entry, has to be the one named
+	if options.byDigest() && digest != options.digest {
+		return nil, "", "", ErrManifestMismatch{Field: "digest", Expected: options.digest, Got: digest}
+	}
+
+	return content, header.Get("Content-Type"), digest, nil
+}
+
+// checkManifestMediaType fails with ErrUnsupportedMediaType unless the manifest is one imagec
+// understands, so that pulling a reference to something else fails early instead of on the
+// first field that doesn't parse. The media type the manifest names takes precedence over the
+// content type the registry sent. Manifests of buildkit caches are rejected by their config.
+func checkManifestMediaType(options ImageCOptions, contentType string, content []byte) error {
+	var header struct {
+		MediaType string `json:"mediaType"`
+		Config    struct {
+			MediaType string `json:"mediaType"`
+		} `json:"config"`
+	}
+	// content that isn't JSON at all is for the caller to report
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil
+	}
+
+	mediaType := header.MediaType
+	if mediaType == "" {
+		if parsed, _, err := mime.ParseMediaType(contentType); err == nil {
+			mediaType = parsed
+		}
+	}
+
+	unsupported := ErrUnsupportedMediaType{Image: options.image, Reference: options.digest}
+	switch {
+	case header.Config.MediaType == MediaTypeBuildkitCacheConfig:
+		unsupported.MediaType = header.Config.MediaType
+	case !genericTypes[mediaType] && !manifestTypes[mediaType]:
+		unsupported.MediaType = mediaType
+	default:
+		return nil
+	}
+
+	return unsupported
+}
@@ -0,0 +1,279 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	config := `{"architecture":"amd64","os":"linux","config":{"Cmd":["/bin/bash"]}}`
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config)))
+
+	manifest := `{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `",` +
+		`"config":{"mediaType":"` + MediaTypeImageConfig + `","digest":"` + configDigest + `","size":` + fmt.Sprint(len(config)) + `},` +
+		`"layers":[{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":"sha256:aaaa","size":100},` +
+		`{"mediaType":"application/vnd.docker.image.rootfs.diff.tar.gzip","digest":"sha256:bbbb","size":20}]}`
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(manifest)))
+
+	list := `{"schemaVersion":2,"mediaType":"` + MediaTypeManifestList + `","manifests":[` +
+		`{"mediaType":"` + MediaTypeManifest + `","digest":"sha256:cccc","size":500,"platform":{"architecture":"amd64","os":"linux"}},` +
+		`{"mediaType":"` + MediaTypeManifest + `","digest":"sha256:dddd","size":500,"platform":{"architecture":"arm","os":"linux","variant":"v7"}}]}`
+
+	var layerFetches int
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/manifests/"+Tag):
+				w.Header().Set("Content-Type", MediaTypeManifest)
+				w.Header().Set("Docker-Content-Digest", digest)
+				w.Write([]byte(manifest))
+			case strings.HasSuffix(r.URL.Path, "/manifests/other"):
+				// the registry reports the digest of another manifest
+				w.Header().Set("Content-Type", MediaTypeManifest)
+				w.Header().Set("Docker-Content-Digest", "sha256:eeee")
+				w.Write([]byte(manifest))
+			case strings.HasSuffix(r.URL.Path, "/manifests/multi"):
+				w.Header().Set("Content-Type", MediaTypeManifestList)
+				w.Write([]byte(list))
+			case strings.HasSuffix(r.URL.Path, "/blobs/"+configDigest):
+				w.Write([]byte(config))
+			default:
+				layerFetches++
+				http.NotFound(w, r)
+			}
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.token = &Token{Token: OAuthToken}
+
+	inspect, err := Inspect(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inspect.MediaType != MediaTypeManifest || inspect.Digest != digest {
+		t.Errorf("Unexpected manifest %s %s", inspect.MediaType, inspect.Digest)
+	}
+	if inspect.Config == nil || inspect.Config.Digest != configDigest {
+		t.Errorf("Unexpected config %#v", inspect.Config)
+	}
+	if len(inspect.Layers) != 2 || inspect.Size != 120 {
+		t.Errorf("Unexpected layers %#v totalling %d", inspect.Layers, inspect.Size)
+	}
+	if inspect.Platform == nil || *inspect.Platform != (Platform{Architecture: "amd64", OS: "linux"}) {
+		t.Errorf("Unexpected platform %#v", inspect.Platform)
+	}
+	if inspect.Runtime == nil || len(inspect.Runtime.Cmd) != 1 || inspect.Runtime.Cmd[0] != "/bin/bash" {
+		t.Errorf("Unexpected runtime config %#v", inspect.Runtime)
+	}
+	if layerFetches != 0 {
+		t.Errorf("Inspect fetched %d layers", layerFetches)
+	}
+
+	// a manifest list reports the platforms without fetching any of their manifests
+	opts.digest = "multi"
+	inspect, err = Inspect(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if inspect.MediaType != MediaTypeManifestList || len(inspect.Manifests) != 2 {
+		t.Fatalf("Unexpected manifest list %#v", inspect)
+	}
+	if p := inspect.Manifests[1].Platform; p == nil || p.Architecture != "arm" || p.Variant != "v7" {
+		t.Errorf("Unexpected platform %#v", p)
+	}
+	if inspect.Digest != fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(list))) {
+		t.Errorf("Unexpected digest %s", inspect.Digest)
+	}
+	if inspect.Config != nil || layerFetches != 0 {
+		t.Errorf("Manifest list inspect fetched more than the list")
+	}
+
+	opts.digest = "other"
+	_, err = Inspect(opts)
+	if e, ok := err.(ErrManifestMismatch); !ok || e.Field != "Docker-Content-Digest" || e.Got != digest {
+		t.Errorf("Expected a digest mismatch, got %#v", err)
+	}
+
+	opts.digest = "missing"
+	if _, err = Inspect(opts); err == nil {
+		t.Errorf("Expected an error for a missing reference")
+	}
+}
+
+func TestInspectAnnotations(t *testing.T) {
+	config := `{"architecture":"amd64","os":"linux","config":{}}`
+	configDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(config)))
+
+	manifest := `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIManifest + `",` +
+		`"config":{"mediaType":"` + MediaTypeOCIImageConfig + `","digest":"` + configDigest + `","size":` + fmt.Sprint(len(config)) + `},` +
+		`"layers":[{"mediaType":"` + MediaTypeOCILayer + `","digest":"sha256:aaaa","size":100}],` +
+		`"annotations":{"org.opencontainers.image.source":"https://github.com/vmware/vic","org.opencontainers.image.revision":"abc123"}}`
+
+	index := `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIIndex + `","manifests":[` +
+		`{"mediaType":"` + MediaTypeOCIManifest + `","digest":"sha256:cccc","size":500,"platform":{"architecture":"amd64","os":"linux"}}],` +
+		`"annotations":{"org.opencontainers.image.created":"2016-09-01T00:00:00Z"}}`
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/manifests/"+Tag):
+				w.Header().Set("Content-Type", MediaTypeOCIManifest)
+				w.Write([]byte(manifest))
+			case strings.HasSuffix(r.URL.Path, "/manifests/index"):
+				w.Header().Set("Content-Type", MediaTypeOCIIndex)
+				w.Write([]byte(index))
+			case strings.HasSuffix(r.URL.Path, "/blobs/"+configDigest):
+				w.Write([]byte(config))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.token = &Token{Token: OAuthToken}
+
+	inspect, err := Inspect(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inspect.Annotations) != 2 || inspect.Annotations["org.opencontainers.image.source"] != "https://github.com/vmware/vic" ||
+		inspect.Annotations["org.opencontainers.image.revision"] != "abc123" {
+		t.Errorf("Unexpected manifest annotations %#v", inspect.Annotations)
+	}
+	// the annotations don't change how the image is described
+	if inspect.Platform == nil || len(inspect.Layers) != 1 || inspect.Size != 100 {
+		t.Errorf("Unexpected image %#v", inspect)
+	}
+
+	opts.digest = "index"
+	if inspect, err = Inspect(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inspect.Annotations) != 1 || inspect.Annotations["org.opencontainers.image.created"] != "2016-09-01T00:00:00Z" {
+		t.Errorf("Unexpected index annotations %#v", inspect.Annotations)
+	}
+}
+
+func TestUnsupportedMediaType(t *testing.T) {
+	cache := `{"schemaVersion":2,"mediaType":"` + MediaTypeOCIManifest + `",` +
+		`"config":{"mediaType":"` + MediaTypeBuildkitCacheConfig + `","digest":"sha256:aaaa","size":100},` +
+		`"layers":[{"mediaType":"application/vnd.buildkit.cacheconfig.v0","digest":"sha256:bbbb","size":20}]}`
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch {
+			case strings.HasSuffix(r.URL.Path, "/manifests/cache"):
+				w.Header().Set("Content-Type", MediaTypeOCIManifest)
+				w.Write([]byte(cache))
+			case strings.HasSuffix(r.URL.Path, "/manifests/unknown"):
+				// only the content type tells what it is
+				w.Header().Set("Content-Type", "application/vnd.example.thing.v1+json; charset=utf-8")
+				w.Write([]byte(`{"schemaVersion":2,"things":[]}`))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.destination = dir
+	opts.standalone = true
+	opts.token = &Token{Token: OAuthToken}
+
+	for tag, mediaType := range map[string]string{
+		"cache":   MediaTypeBuildkitCacheConfig,
+		"unknown": "application/vnd.example.thing.v1+json",
+	} {
+		opts.digest = tag
+
+		err := NewPuller(opts).PullImage(Storename)
+		if e, ok := err.(ErrUnsupportedMediaType); !ok || e.MediaType != mediaType {
+			t.Errorf("Expected pulling %s to fail with the unsupported media type %s, got %#v", tag, mediaType, err)
+		}
+
+		if _, err = FetchImageManifest(opts); err == nil {
+			t.Errorf("Expected fetching the manifest of %s to fail", tag)
+		} else if _, ok := err.(ErrUnsupportedMediaType); !ok {
+			t.Errorf("Expected an ErrUnsupportedMediaType for %s, got %#v", tag, err)
+		}
+
+		if _, err = Inspect(opts); err == nil {
+			t.Errorf("Expected inspecting %s to fail", tag)
+		}
+	}
+}
+
+func TestInspectByDigest(t *testing.T) {
+	child := `{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `","config":{},"layers":[]}`
+	childDigest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(child)))
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// the registry serves the same manifest whatever digest it was asked for
+			w.Header().Set("Content-Type", MediaTypeManifest)
+			w.Header().Set("Docker-Content-Digest", childDigest)
+			w.Write([]byte(child))
+		}))
+	defer s.Close()
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = childDigest
+	opts.token = &Token{Token: OAuthToken}
+
+	content, _, digest, err := fetchManifest(opts, inspectAccept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != child || digest != childDigest {
+		t.Errorf("Unexpected manifest %s %s", digest, content)
+	}
+
+	// a manifest list entry names a different manifest than the content served for it
+	opts.digest = "sha256:" + strings.Repeat("d", 64)
+	_, err = Inspect(opts)
+	if e, ok := err.(ErrManifestMismatch); !ok || e.Field != "digest" || e.Expected != opts.digest || e.Got != childDigest {
+		t.Errorf("Expected a digest mismatch, got %#v", err)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// DefaultLayerDirectory is the directory under the destination that holds the layers shared by
+// the images, by chainID
+const DefaultLayerDirectory = "layers"
+
+// LayersFile is the name of the index of the shared layers
+const LayersFile = "layers.json"
+
+// StoredLayer is a layer of the shared store
+type StoredLayer struct {
+	// DiffID is the digest of the uncompressed layer
+	DiffID string `json:"diffID"`
+	// Parent is the chainID of the layer below, empty for a base layer
+	Parent string `json:"parent,omitempty"`
+	// References are the repository:tag references of the images using the layer, the layer is
+	// removed along with the last one
+	References []string `json:"references"`
+}
+
+// LayerStore is the content of the index, mapping chainID -> layer
+type LayerStore struct {
+	Layers map[string]*StoredLayer `json:"layers"`
+}
+
+// ChainID returns the chainID of the layer with the given diffID on top of the parent chain,
+// as defined by the OCI image spec. The chainID of a base layer is its diffID.
+func ChainID(parent, diffID string) string {
+	if parent == "" {
+		return diffID
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(parent+" "+diffID)))
+}
+
+// layerStoreDirectory returns the directory of the shared layers
+func layerStoreDirectory(options ImageCOptions) string {
+	return path.Join(options.destination, DefaultLayerDirectory)
+}
+
+// storedLayerPath returns where the layer with the given chainID is stored under dir
+func storedLayerPath(dir, chainID string) (string, error) {
+	name, err := digestPath(dir, chainID)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(name, "layer.tar"), nil
+}
+
+// ReadLayerStore reads the index from dir, returning an empty one if there's none yet
+func ReadLayerStore(dir string) (*LayerStore, error) {
+	store := &LayerStore{
+		Layers: make(map[string]*StoredLayer),
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, LayersFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return store, nil
+		}
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, store); err != nil {
+		return nil, err
+	}
+
+	if store.Layers == nil {
+		store.Layers = make(map[string]*StoredLayer)
+	}
+
+	return store, nil
+}
+
+// updateLayerStore applies update to the index in dir under an exclusive lock and replaces the
+// index atomically through updateIndex. The lock also covers the layer files, so that a
+// layer isn't removed while another pull references it.
+func updateLayerStore(dir string, update func(store *LayerStore) error) error {
+	return updateIndex(dir, LayersFile, func() (interface{}, error) {
+		store, err := ReadLayerStore(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return store, update(store)
+	})
+}
+
+// StoreImageLayers moves the downloaded layers of the images into the shared store and references
+// them from the pulled reference. A layer that's stored already, for another image, isn't stored
+// again - the downloaded copy is replaced by a link to the stored one. images are ordered from
+// child to parent and must include the base layer.
+func StoreImageLayers(options ImageCOptions, images []*ImageWithMeta) error {
+	reference := options.repositoryName() + ":" + options.indexTag()
+	defer trace.End(trace.Begin(reference))
+
+	dir := layerStoreDirectory(options)
+	destination := DestinationDirectory(options)
+
+	return updateLayerStore(dir, func(store *LayerStore) error {
+		var chainID string
+		// iterate from parent to children, the chainID of a layer depends on those below it
+		for i := len(images) - 1; i >= 0; i-- {
+			image := images[i]
+
+			parent := chainID
+			chainID = ChainID(parent, image.diffID)
+
+			stored, err := storedLayerPath(dir, chainID)
+			if err != nil {
+				return err
+			}
+
+			layerFile := path.Join(destination, image.ID, image.ID+".tar")
+			if _, err = os.Stat(stored); os.IsNotExist(err) {
+				if err = os.MkdirAll(path.Dir(stored), 0755); err != nil {
+					return err
+				}
+				if err = linkOrCopy(layerFile, stored); err != nil {
+					return err
+				}
+			} else {
+				options.logger().Debugf("Layer %s is stored already", chainID)
+
+				if err = os.Remove(layerFile); err != nil {
+					return err
+				}
+				if err = linkOrCopy(stored, layerFile); err != nil {
+					return err
+				}
+			}
+
+			layer, ok := store.Layers[chainID]
+			if !ok {
+				layer = &StoredLayer{
+					DiffID: image.diffID,
+					Parent: parent,
+				}
+				store.Layers[chainID] = layer
+			}
+			if !containsString(layer.References, reference) {
+				layer.References = append(layer.References, reference)
+			}
+		}
+
+		return nil
+	})
+}
+
+// ReleaseImageLayers drops the reference from the shared layers and removes the layers no other
+// reference uses, returning their chainIDs
+func ReleaseImageLayers(options ImageCOptions) ([]string, error) {
+	reference := options.repositoryName() + ":" + options.indexTag()
+	defer trace.End(trace.Begin(reference))
+
+	dir := layerStoreDirectory(options)
+
+	var removed []string
+	err := updateLayerStore(dir, func(store *LayerStore) error {
+		for chainID, layer := range store.Layers {
+			for i := range layer.References {
+				if layer.References[i] == reference {
+					layer.References = append(layer.References[:i], layer.References[i+1:]...)
+					break
+				}
+			}
+			if len(layer.References) > 0 {
+				continue
+			}
+
+			stored, err := storedLayerPath(dir, chainID)
+			if err != nil {
+				return err
+			}
+			if err = os.RemoveAll(path.Dir(stored)); err != nil {
+				return err
+			}
+
+			delete(store.Layers, chainID)
+			removed = append(removed, chainID)
+
+			options.logger().Debugf("Removed layer %s", chainID)
+		}
+
+		return nil
+	})
+	sort.Strings(removed)
+
+	return removed, err
+}
+
+// containsString returns true if s is one of values
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestSharedLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.destination = dir
+	opts.sharedLayers = true
+
+	base := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("base")))
+
+	// pull writes the layers of an image on top of the shared base layer and stores them,
+	// returning the downloaded base layer
+	pull := func(image, top string) string {
+		opts.image = image
+		opts.digest = "latest"
+
+		var images []*ImageWithMeta
+		var layerFile string
+		for _, content := range []string{top, "base"} {
+			id := fmt.Sprintf("%x", sha256.Sum256([]byte(image+content)))
+			if err := os.MkdirAll(path.Join(DestinationDirectory(opts), id), 0755); err != nil {
+				t.Fatal(err)
+			}
+			layerFile = path.Join(DestinationDirectory(opts), id, id+".tar")
+			if err := ioutil.WriteFile(layerFile, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			images = append(images, &ImageWithMeta{
+				Image:  &models.Image{ID: id},
+				diffID: fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content))),
+			})
+		}
+
+		if err := StoreImageLayers(opts, images); err != nil {
+			t.Fatal(err)
+		}
+		// storing again is a no-op
+		if err := StoreImageLayers(opts, images); err != nil {
+			t.Fatal(err)
+		}
+
+		return layerFile
+	}
+
+	downloaded := []string{
+		pull("library/one", "one"),
+		pull("library/two", "two"),
+	}
+
+	store, err := ReadLayerStore(layerStoreDirectory(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(store.Layers) != 3 {
+		t.Fatalf("Expected 3 stored layers, got %d", len(store.Layers))
+	}
+	if refs := store.Layers[base].References; len(refs) != 2 {
+		t.Errorf("Expected the base layer to be referenced twice, got %v", refs)
+	}
+
+	stored, err := storedLayerPath(layerStoreDirectory(opts), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the downloaded copies are links to the stored layer
+	fi, err := os.Stat(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range downloaded {
+		di, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(fi, di) {
+			t.Errorf("%s isn't the stored base layer", name)
+		}
+	}
+
+	opts.image = "library/one"
+	removed, err := ReleaseImageLayers(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 {
+		t.Errorf("Expected only the top layer of library/one to be removed, got %v", removed)
+	}
+	if _, err = os.Stat(stored); err != nil {
+		t.Errorf("The base layer was removed while library/two uses it: %s", err)
+	}
+
+	opts.image = "library/two"
+	removed, err = ReleaseImageLayers(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Expected the remaining 2 layers to be removed, got %v", removed)
+	}
+	if _, err = os.Stat(stored); !os.IsNotExist(err) {
+		t.Errorf("Expected the base layer to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/go-units"
+)
+
+// ProgressEvent is a machine readable progress update.
+// Layer related updates carry the layer ID, overall messages have an empty ID.
+type ProgressEvent struct {
+	// ID of the layer the event refers to
+	ID string `json:"id,omitempty"`
+	// Status describes the current action, e.g. "Downloading"
+	Status string `json:"status,omitempty"`
+	// Message is a free form message not bound to an action
+	Message string `json:"message,omitempty"`
+	// Current is the number of bytes processed so far
+	Current int64 `json:"current,omitempty"`
+	// Total is the number of bytes expected, 0 if unknown
+	Total int64 `json:"total,omitempty"`
+	// Done marks the terminal event of a pull, sent once it's over whether it succeeded or not
+	Done bool `json:"done,omitempty"`
+	// Error is what the pull failed with, set on the terminal event only
+	Error string `json:"error,omitempty"`
+}
+
+// eventOutput is a progress.Output that converts docker progress updates into ProgressEvents
+type eventOutput struct {
+	events chan<- ProgressEvent
+}
+
+// WriteProgress implements the progress.Output interface
+func (o *eventOutput) WriteProgress(p progress.Progress) error {
+	o.events <- ProgressEvent{
+		ID:      p.ID,
+		Status:  p.Action,
+		Message: p.Message,
+		Current: p.Current,
+		Total:   p.Total,
+	}
+	return nil
+}
+
+// discardOutput is a progress.Output that drops every update
+type discardOutput struct{}
+
+// WriteProgress implements the progress.Output interface
+func (discardOutput) WriteProgress(progress.Progress) error {
+	return nil
+}
+
+// NewProgressOutput returns a progress.Output that sends structured events to the given channel.
+// A nil channel results in an output that discards every update.
+func NewProgressOutput(events chan<- ProgressEvent) progress.Output {
+	if events == nil {
+		return discardOutput{}
+	}
+	return &eventOutput{events: events}
+}
+
+// completeProgress sends the terminal event of a pull to the events channel, if there's one
+func completeProgress(events chan<- ProgressEvent, err error) {
+	if events == nil {
+		return
+	}
+
+	e := ProgressEvent{Done: true}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	events <- e
+}
+
+// RenderProgress consumes the events until the channel is closed and writes them to out.
+// This is how the docker style CLI output is produced.
+func RenderProgress(events <-chan ProgressEvent, out progress.Output) {
+	for e := range events {
+		// the status line has been written already unless the pull failed
+		if e.Done {
+			if e.Error != "" {
+				out.WriteProgress(progress.Progress{Message: "Error: " + e.Error})
+			}
+			continue
+		}
+
+		out.WriteProgress(progress.Progress{
+			ID:      e.ID,
+			Action:  e.Status,
+			Message: e.Message,
+			Current: e.Current,
+			Total:   e.Total,
+		})
+	}
+}
+
+// SyncProgressOutput is a progress.Output that serializes the writes to the wrapped output, so that the
+// updates of the concurrent layer downloads are written whole, one line per layer as with docker. It
+// keeps track of the layers so that it can write an aggregate line once the pull is done.
+type SyncProgressOutput struct {
+	m   sync.Mutex
+	out progress.Output
+
+	// layers holds the number of bytes downloaded per layer, in the order the downloads started
+	layers map[string]int64
+	order  []string
+}
+
+// NewSyncProgressOutput returns a SyncProgressOutput that writes to out
+func NewSyncProgressOutput(out progress.Output) *SyncProgressOutput {
+	return &SyncProgressOutput{
+		out:    out,
+		layers: make(map[string]int64),
+	}
+}
+
+// WriteProgress implements the progress.Output interface
+func (o *SyncProgressOutput) WriteProgress(p progress.Progress) error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	// only the layers that transfer data count as downloaded
+	if p.ID != "" && p.Current > 0 {
+		if _, ok := o.layers[p.ID]; !ok {
+			o.order = append(o.order, p.ID)
+		}
+		if p.Current > o.layers[p.ID] {
+			o.layers[p.ID] = p.Current
+		}
+	}
+
+	return o.out.WriteProgress(p)
+}
+
+// Flush writes the aggregate line for the layers seen so far
+func (o *SyncProgressOutput) Flush() error {
+	o.m.Lock()
+	defer o.m.Unlock()
+
+	if len(o.order) == 0 {
+		return nil
+	}
+
+	var total int64
+	for _, id := range o.order {
+		total += o.layers[id]
+	}
+
+	return o.out.WriteProgress(progress.Progress{
+		Message: fmt.Sprintf("Downloaded %d layers, %s", len(o.order), units.HumanSize(float64(total))),
+	})
+}
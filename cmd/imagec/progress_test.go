@@ -0,0 +1,211 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/docker/docker/pkg/progress"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestProgressEvents(t *testing.T) {
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/x-gzip")
+
+			w.Write([]byte(LayerContent))
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := make(chan ProgressEvent, 64)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.events = events
+
+	parent := "scratch"
+	image := ImageWithMeta{
+		Image: &models.Image{
+			ID:     LayerID,
+			Parent: &parent,
+			Store:  Storename,
+		},
+		history: History{V1Compatibility: LayerHistory},
+		layer:   FSLayer{BlobSum: DigestSHA256LayerContent},
+	}
+
+	if _, err = FetchImageBlob(opts, &image); err != nil {
+		t.Fatal(err)
+	}
+	close(events)
+
+	var statuses []string
+	for e := range events {
+		if e.ID != image.String() {
+			t.Errorf("Unexpected event ID %s", e.ID)
+		}
+		statuses = append(statuses, e.Status)
+	}
+
+	if len(statuses) == 0 || statuses[len(statuses)-1] != "Download complete" {
+		t.Errorf("Unexpected progress statuses %#v", statuses)
+	}
+}
+
+func TestProgressOutputNil(t *testing.T) {
+	// a nil channel must not block the caller
+	progress.Update(NewProgressOutput(nil), "id", "Downloading")
+}
+
+// recordingOutput records the updates and counts the writes that overlapped
+type recordingOutput struct {
+	active  int32
+	overlap int32
+
+	updates []progress.Progress
+}
+
+func (o *recordingOutput) WriteProgress(p progress.Progress) error {
+	if atomic.AddInt32(&o.active, 1) > 1 {
+		atomic.AddInt32(&o.overlap, 1)
+	}
+	defer atomic.AddInt32(&o.active, -1)
+
+	o.updates = append(o.updates, p)
+	return nil
+}
+
+func TestSyncProgressOutput(t *testing.T) {
+	rec := &recordingOutput{}
+	out := NewSyncProgressOutput(rec)
+
+	var wg sync.WaitGroup
+	for _, id := range []string{"layer1", "layer2", "layer3"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+
+			for i := int64(1); i <= 100; i++ {
+				out.WriteProgress(progress.Progress{ID: id, Action: "Downloading", Current: i * 1024, Total: 100 * 1024})
+			}
+			progress.Update(out, id, "Download complete")
+		}(id)
+	}
+	wg.Wait()
+
+	// layers that are already there don't count
+	progress.Update(out, "layer4", "Already exists")
+
+	if err := out.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.overlap != 0 {
+		t.Errorf("%d writes overlapped", rec.overlap)
+	}
+
+	if n := len(rec.updates); n != 3*101+2 {
+		t.Fatalf("Expected %d updates, got %d", 3*101+2, n)
+	}
+
+	if last := rec.updates[len(rec.updates)-1]; last.ID != "" || last.Message != "Downloaded 3 layers, 307.2 kB" {
+		t.Errorf("Unexpected aggregate line %#v", last)
+	}
+}
+
+func TestProgressTerminalEvent(t *testing.T) {
+	s := newRegistry(t, Tag)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// pull returns the events of a pull of the reference
+	pull := func(reference string) ([]ProgressEvent, error) {
+		events := make(chan ProgressEvent, 64)
+
+		opts := options
+		opts.registry = s.URL
+		opts.image = Image
+		opts.digest = reference
+		opts.destination = dir
+		opts.standalone = true
+		opts.events = events
+
+		err := NewPuller(opts).PullImage(Storename)
+		close(events)
+
+		var received []ProgressEvent
+		for e := range events {
+			received = append(received, e)
+		}
+		return received, err
+	}
+
+	events, err := pull(Tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := events[len(events)-1]; !last.Done || last.Error != "" {
+		t.Errorf("Expected a successful terminal event, got %#v", last)
+	}
+
+	events, err = pull("missing")
+	if err == nil {
+		t.Fatal("Expected pulling a missing tag to fail")
+	}
+	last := events[len(events)-1]
+	if !last.Done || last.Error != err.Error() {
+		t.Errorf("Expected a terminal event with the error, got %#v", last)
+	}
+
+	// the failure is the last line of the rendered output
+	rendered := make(chan ProgressEvent, len(events))
+	for _, e := range events {
+		rendered <- e
+	}
+	close(rendered)
+
+	rec := &recordingOutput{}
+	RenderProgress(rendered, rec)
+	if n := len(rec.updates); n == 0 || rec.updates[n-1].Message != "Error: "+err.Error() {
+		t.Errorf("Unexpected rendered output %#v", rec.updates)
+	}
+	for _, e := range events[:len(events)-1] {
+		if e.Done {
+			t.Errorf("Unexpected terminal event before the last one %#v", e)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/docker/docker/pkg/progress"
+	"github.com/docker/docker/pkg/stringid"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// pullAccept are the manifests a pull asks for. An OCI manifest is that of an artifact or of an
+// image. Schema 2 isn't asked for so that the registry converts the manifests of images to schema
+// 1, which is what images are pulled from.
+var pullAccept = []string{MediaTypeOCIManifest, MediaTypeManifestV1}
+
+// Puller pulls images with the options it was created with. The progress of its pulls goes to
+// the events channel of the options. Pullers don't share any state, so several of them can run
+// with different configurations in the same process.
+type Puller struct {
+	options ImageCOptions
+}
+
+// NewPuller returns a Puller for the given options
+func NewPuller(options ImageCOptions) *Puller {
+	return &Puller{options: options}
+}
+
+// Authenticate obtains the token for the pull from the OAuth endpoint of the registry. A token
+// supplied up front is used as is, unless the registry rejects it.
+func (p *Puller) Authenticate() error {
+	if p.options.token != nil {
+		err := ValidateToken(p.options)
+		if err == nil {
+			p.options.logger().Debugf("Using the supplied token")
+			return nil
+		}
+
+		if _, ok := err.(ErrUnauthorized); !ok {
+			return fmt.Errorf("Failed to validate the supplied token: %s", err)
+		}
+
+		p.options.logger().Infof("The supplied token was rejected, requesting a new one")
+		p.options.token = nil
+	}
+
+	// Get the URL of the OAuth endpoint
+	url, err := LearnAuthURL(p.options)
+	if err != nil {
+		return fmt.Errorf("Failed to obtain OAuth endpoint: %s", err)
+	}
+
+	// Get the OAuth token - if only we have a URL
+	if url != nil {
+		token, err := FetchToken(p.options, url)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch OAuth token: %s", err)
+		}
+		p.options.token = token
+	}
+
+	return nil
+}
+
+// DownloadImageBlobs downloads the image blobs concurrently
+func (p *Puller) DownloadImageBlobs(images []*ImageWithMeta) error {
+	// the layers share the token so that it's refreshed only once if it expires mid-pull
+	opts := p.options
+	opts.tokens = NewTokenCache(p.options.token)
+	defer func() {
+		p.options.token = opts.tokens.Token()
+	}()
+
+	// fail before downloading anything if the layers can't be stored
+	if err := CheckDestination(opts, images); err != nil {
+		return err
+	}
+
+	if opts.rootfs != "" {
+		sequenceLayers(images)
+	}
+
+	// the sizes are known already unless the space check was skipped
+	if opts.maxInFlight > 0 {
+		opts.budget = NewByteBudget(opts.maxInFlight)
+		if err := fetchLayerSizes(opts, images); err != nil {
+			return err
+		}
+	}
+
+	// the samples cover the layer downloads of this pull only
+	if opts.onThroughput != nil {
+		opts.meter = NewThroughputMeter(opts.throughputInterval, opts.onThroughput)
+		defer opts.meter.Stop()
+	}
+
+	// failing fast cancels the downloads still running, otherwise their failures are collected
+	cancel := func() {}
+	if opts.failFast {
+		opts.ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+	}
+
+	var m sync.Mutex
+	failed := ErrLayerDownloads{Image: opts.image, Errors: make(map[string]error)}
+
+	var wg sync.WaitGroup
+
+	wg.Add(len(images))
+
+	// iterate from parent to children
+	// so that portlayer can extract each layer
+	// on top of previous one
+	results := make(chan error, len(images))
+	for i := len(images) - 1; i >= 0; i-- {
+		go func(image *ImageWithMeta) {
+			defer wg.Done()
+
+			diffID, err := FetchImageBlob(opts, image)
+
+			// what was downloaded before the pull was interrupted may be corrupt, the failed
+			// download is dropped so the layer is downloaded again in whole. A layer that's
+			// extracted to the rootfs is done with once it fails.
+			if _, ok := err.(ErrChecksum); ok && opts.pullState != nil && image.applied == nil {
+				opts.logger().Warnf("Downloading layer %s again: %s", image.layer.BlobSum, err)
+				diffID, err = FetchImageBlob(opts, image)
+			}
+
+			if err != nil {
+				// leave the layer in its final state rather than mid-download
+				progress.Update(opts.progressOutput(), image.String(), "Download failed")
+
+				m.Lock()
+				failed.Errors[image.layer.BlobSum] = err
+				m.Unlock()
+
+				// the failure is reported before the downloads it cancels
+				results <- fmt.Errorf("%s/%s returned %s", opts.image, image.layer.BlobSum, err)
+				cancel()
+			} else {
+				image.diffID = diffID
+				results <- nil
+			}
+		}(images[i])
+	}
+	wg.Wait()
+	close(results)
+
+	if !opts.failFast {
+		if len(failed.Errors) != 0 {
+			return failed
+		}
+		return nil
+	}
+
+	// iterate over results chan to see whether we have a failed download
+	for err := range results {
+		if err != nil {
+			return fmt.Errorf("Failed to fetch image blob: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// PullImage pulls the image referenced by the options and writes it to the storage layer. The
+// last progress event of the pull is the terminal one, whether the pull succeeded or not.
+func (p *Puller) PullImage(hostname string) error {
+	err := p.pullImage(hostname)
+	completeProgress(p.options.events, err)
+
+	return err
+}
+
+func (p *Puller) pullImage(hostname string) error {
+	p.options.correlationID = stringid.TruncateID(stringid.GenerateRandomID())
+
+	// Get the manifest the reference resolves to
+	manifest, artifact, content, err := fetchImageManifest(p.options, pullAccept)
+	if _, ok := err.(ErrUnsupportedMediaType); ok {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to fetch image manifest: %s", err)
+	}
+
+	var digest string
+	if artifact != nil {
+		digest = artifact.Digest
+	} else {
+		digest = manifest.Digest
+	}
+
+	// nothing to do if the reference still resolves to the manifest the image was pulled from
+	if present, err := pulledFrom(p.options, digest); err != nil {
+		p.options.logger().Debugf("Failed to check whether %s is present: %s", p.options.displayName(), err)
+	} else if present {
+		progress.Message(p.options.progressOutput(), "", "Status: Image is up to date for "+p.options.displayName())
+		return nil
+	}
+
+	// Artifacts share the OCI manifest format with images, tell them apart by the config media type.
+	// Images are pulled from their schema 1 manifest.
+	if artifact != nil {
+		if artifact.IsArtifact() {
+			return PullArtifact(p.options, artifact, content)
+		}
+
+		manifest, err = FetchImageManifest(p.options)
+		if err != nil {
+			return fmt.Errorf("Failed to fetch image manifest: %s", err)
+		}
+		manifest.SetLayerSizes(artifact.Layers)
+	}
+
+	po := p.options.progressOutput()
+
+	progress.Message(po, p.options.indexTag(), "Pulling from "+p.options.image)
+
+	// the layers kept by an earlier pull are in use again
+	if p.options.keepLayers {
+		if err := TouchCachedLayers(p.options, manifest.BlobSums()...); err != nil {
+			return fmt.Errorf("Failed to update %s: %s", CacheFile, err)
+		}
+	}
+
+	// Create the ImageWithMeta slice to hold Image structs
+	images, err := ImagesToDownload(p.options, manifest, hostname)
+	if err != nil {
+		return err
+	}
+
+	// the layers a previous, interrupted pull completed aren't downloaded again. Layers extracted
+	// to the rootfs are, the rootfs is built from scratch.
+	download := images
+	if p.options.resume {
+		state, err := LoadPullState(p.options, manifest.Digest)
+		if err != nil {
+			return fmt.Errorf("Failed to load the pull state: %s", err)
+		}
+		if p.options.rootfs == "" {
+			download = state.Pending(p.options, images)
+		}
+
+		p.options.pullState = state
+		defer func() {
+			p.options.pullState = nil
+		}()
+	}
+
+	// Fetch the blobs from registry
+	if err := p.DownloadImageBlobs(download); err != nil {
+		return err
+	}
+
+	if p.options.sharedLayers {
+		if err := StoreImageLayers(p.options, images); err != nil {
+			return fmt.Errorf("Failed to store the shared layers: %s", err)
+		}
+	}
+
+	imageID, err := CreateImageConfig(images)
+	if err != nil {
+		return err
+	}
+
+	// Write blobs to the storage layer
+	if err := WriteImageBlobs(p.options, images); err != nil {
+		return err
+	}
+
+	// Let the image store resolve the reference to what was just pulled
+	if len(images) > 0 {
+		entry := RepositoryEntry{
+			ImageID:        imageID,
+			TopLayer:       images[0].ID,
+			ManifestDigest: digest,
+		}
+		if artifact != nil {
+			entry.Annotations = artifact.Annotations
+		}
+		if err := UpdateRepositories(p.options.destination, p.options.repositoryName(), p.options.indexTag(), entry); err != nil {
+			return fmt.Errorf("Failed to update %s: %s", RepositoriesFile, err)
+		}
+	}
+
+	if p.options.keepLayers && len(images) > 0 {
+		if err := p.pruneLayers(manifest); err != nil {
+			return err
+		}
+	}
+
+	// the pull is over, the next one starts afresh
+	if p.options.pullState != nil {
+		if err := p.options.pullState.Remove(); err != nil {
+			p.options.logger().Warnf("Failed to remove the pull state: %s", err)
+		}
+	}
+
+	progress.Message(po, "", "Digest: "+digest)
+	if len(images) > 0 {
+		progress.Message(po, "", "Status: Downloaded newer image for "+p.options.displayName())
+	} else {
+		progress.Message(po, "", "Status: Image is up to date for "+p.options.displayName())
+	}
+
+	return nil
+}
+
+// pruneLayers moves the reference over to the kept layers of the image just pulled and evicts the
+// least recently used layers nothing references once the kept layers outgrow the cache size
+func (p *Puller) pruneLayers(manifest *Manifest) error {
+	if err := ReferenceCachedLayers(p.options, p.options.repositoryName()+":"+p.options.indexTag(), manifest.BlobSums()...); err != nil {
+		return fmt.Errorf("Failed to update %s: %s", CacheFile, err)
+	}
+
+	if p.options.cacheMaxSize <= 0 {
+		return nil
+	}
+
+	evicted, err := Prune(p.options, p.options.cacheMaxSize)
+	if err != nil {
+		return fmt.Errorf("Failed to prune the kept layers: %s", err)
+	}
+	if len(evicted) > 0 {
+		p.options.logger().Infof("Evicted %d kept layers", len(evicted))
+	}
+
+	return nil
+}
+
+// ImagePresent returns true if the image the reference resolves to has been pulled already - its
+// entry in the index was pulled from the manifest the registry has for the reference now. A tag
+// that moved to another manifest since has to be pulled again.
+func ImagePresent(options ImageCOptions) (bool, error) {
+	defer trace.End(trace.Begin(options.displayName()))
+
+	repos, err := ReadRepositories(options.destination)
+	if err != nil {
+		return false, err
+	}
+
+	entry, ok := repos.Lookup(options.repositoryName(), options.indexTag())
+	if !ok || entry.ManifestDigest == "" {
+		return false, nil
+	}
+
+	// the manifest a digest refers to never changes
+	if options.byDigest() {
+		return entry.ManifestDigest == options.digest, nil
+	}
+
+	// ask for the manifest the pull gets
+	_, _, digest, err := fetchManifest(options, pullAccept)
+	if err != nil {
+		return false, err
+	}
+
+	options.logger().Debugf("%s resolves to %s, %s was pulled", options.displayName(), digest, entry.ManifestDigest)
+
+	return entry.ManifestDigest == digest, nil
+}
+
+// pulledFrom returns true if the entry of the reference in the index was pulled from the manifest
+// with the given digest
+func pulledFrom(options ImageCOptions, digest string) (bool, error) {
+	repos, err := ReadRepositories(options.destination)
+	if err != nil {
+		return false, err
+	}
+
+	entry, ok := repos.Lookup(options.repositoryName(), options.indexTag())
+	return ok && entry.ManifestDigest == digest, nil
+}
+
+// PullAll pulls every tag of the repository, reusing the token obtained for it. A single
+// terminal progress event is sent once all of them are pulled or one of them failed.
+func (p *Puller) PullAll(hostname string) error {
+	err := p.pullAll(hostname)
+	completeProgress(p.options.events, err)
+
+	return err
+}
+
+func (p *Puller) pullAll(hostname string) error {
+	tags, err := ListTags(p.options)
+	if err != nil {
+		return fmt.Errorf("Failed to list tags: %s", err)
+	}
+
+	digest := p.options.digest
+	defer func() {
+		p.options.digest = digest
+	}()
+
+	for _, tag := range tags {
+		p.options.digest = tag
+		if err := p.pullImage(hostname); err != nil {
+			return fmt.Errorf("%s:%s: %s", p.options.image, tag, err)
+		}
+	}
+
+	return nil
+}
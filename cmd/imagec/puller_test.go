@@ -0,0 +1,377 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+// newRegistry returns a registry that serves a single layer image under the given tag
+func newRegistry(t *testing.T, tag string) *httptest.Server {
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.URL.Path, "/manifests/") {
+				w.Write([]byte(LayerContent))
+				return
+			}
+
+			if !strings.HasSuffix(r.URL.Path, "/"+tag) {
+				http.NotFound(w, r)
+				return
+			}
+
+			body, err := json.Marshal(&Manifest{
+				Name:     Image,
+				Tag:      tag,
+				FSLayers: []FSLayer{{BlobSum: DigestSHA256LayerContent}},
+				History:  []History{{V1Compatibility: LayerHistory}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+}
+
+func TestPullersAreIndependent(t *testing.T) {
+	tags := []string{"latest", "edge"}
+
+	pullers := make([]*Puller, len(tags))
+	events := make([]chan ProgressEvent, len(tags))
+	for i, tag := range tags {
+		s := newRegistry(t, tag)
+		defer s.Close()
+
+		dir, err := ioutil.TempDir("", "imagec")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		events[i] = make(chan ProgressEvent, 64)
+
+		opts := options
+		opts.registry = s.URL
+		opts.image = Image
+		opts.digest = tag
+		opts.destination = dir
+		opts.standalone = true
+		opts.events = events[i]
+
+		pullers[i] = NewPuller(opts)
+	}
+
+	results := make(chan error, len(pullers))
+	for _, puller := range pullers {
+		go func(puller *Puller) {
+			results <- puller.PullImage(Storename)
+		}(puller)
+	}
+	for range pullers {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, puller := range pullers {
+		close(events[i])
+
+		var messages []string
+		for e := range events[i] {
+			if e.Message != "" {
+				messages = append(messages, e.Message)
+			}
+		}
+		expected := "Status: Downloaded newer image for " + Image + ":" + tags[i]
+		if len(messages) == 0 || messages[len(messages)-1] != expected {
+			t.Errorf("Unexpected progress for %s: %#v", tags[i], messages)
+		}
+
+		repositories, err := ReadRepositories(puller.options.destination)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the digest the reference resolved to is reported along with the status
+		entry, _ := repositories.Lookup(puller.options.repositoryName(), tags[i])
+		if len(messages) < 2 || entry.ManifestDigest == "" || messages[len(messages)-2] != "Digest: "+entry.ManifestDigest {
+			t.Errorf("Expected the digest %s in the progress of %s: %#v", entry.ManifestDigest, tags[i], messages)
+		}
+
+		for _, tag := range tags {
+			if _, ok := repositories.Lookup(puller.options.repositoryName(), tag); ok != (tag == tags[i]) {
+				t.Errorf("Unexpected %s entry in the repositories of %s", tag, tags[i])
+			}
+		}
+	}
+}
+
+func TestImagePresent(t *testing.T) {
+	var moved atomic.Value
+	moved.Store(false)
+
+	var manifests, blobs int32
+	registry := newRegistry(t, Tag)
+	defer registry.Close()
+
+	// the manifest the tag moves to
+	other, err := json.Marshal(&Manifest{
+		Name:     Image,
+		Tag:      Tag,
+		FSLayers: []FSLayer{{BlobSum: DigestSHA256EmptyTar}},
+		History:  []History{{V1Compatibility: LayerHistory}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.URL.Path, "/manifests/") {
+				atomic.AddInt32(&blobs, 1)
+			} else if atomic.AddInt32(&manifests, 1); moved.Load().(bool) {
+				w.Write(other)
+				return
+			}
+			registry.Config.Handler.ServeHTTP(w, r)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	events := make(chan ProgressEvent, 64)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.standalone = true
+	opts.events = events
+
+	// nothing is there before the first pull
+	if present, err := ImagePresent(opts); err != nil || present {
+		t.Fatalf("Expected the image to be missing, got %t, %v", present, err)
+	}
+
+	if err = NewPuller(opts).PullImage(Storename); err != nil {
+		t.Fatal(err)
+	}
+
+	repositories, err := ReadRepositories(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := repositories.Lookup(opts.repositoryName(), Tag)
+	if !strings.HasPrefix(entry.ManifestDigest, "sha256:") {
+		t.Errorf("Unexpected manifest digest %q recorded", entry.ManifestDigest)
+	}
+
+	// pulling again is a no-op
+	atomic.StoreInt32(&blobs, 0)
+	puller := NewPuller(opts)
+	if err = puller.PullImage(Storename); err != nil {
+		t.Fatal(err)
+	}
+	first := puller.options.correlationID
+	if err = puller.PullImage(Storename); err != nil {
+		t.Fatal(err)
+	}
+	if first == "" || first == puller.options.correlationID {
+		t.Errorf("Expected a new correlation ID for each pull, got %q and %q", first, puller.options.correlationID)
+	}
+	if n := atomic.LoadInt32(&blobs); n != 0 {
+		t.Errorf("Expected no blobs to be fetched, got %d", n)
+	}
+
+	close(events)
+	var last string
+	for e := range events {
+		if e.Message != "" {
+			last = e.Message
+		}
+	}
+	if expected := "Status: Image is up to date for " + Image + ":" + Tag; last != expected {
+		t.Errorf("Unexpected status %q", last)
+	}
+
+	// a reference by the digest it was pulled from doesn't need to ask the registry
+	byDigest := opts
+	byDigest.digest = entry.ManifestDigest
+	byDigest.tag = Tag
+
+	atomic.StoreInt32(&manifests, 0)
+	if present, err := ImagePresent(byDigest); err != nil || !present {
+		t.Errorf("Expected the image to be present by digest, got %t, %v", present, err)
+	}
+	if n := atomic.LoadInt32(&manifests); n != 0 {
+		t.Errorf("Expected no manifest requests, got %d", n)
+	}
+
+	// the tag moved to another manifest
+	moved.Store(true)
+	if present, err := ImagePresent(opts); err != nil || present {
+		t.Errorf("Expected the moved tag to be pulled again, got %t, %v", present, err)
+	}
+}
+
+func TestPullFetchesManifestOnce(t *testing.T) {
+	var manifests int32
+	registry := newRegistry(t, Tag)
+	defer registry.Close()
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/manifests/") {
+				atomic.AddInt32(&manifests, 1)
+			}
+			registry.Config.Handler.ServeHTTP(w, r)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.standalone = true
+
+	// the same manifest tells whether the image is there already, what it is and what to pull
+	for _, pull := range []string{"first", "repeated"} {
+		atomic.StoreInt32(&manifests, 0)
+		if err = NewPuller(opts).PullImage(Storename); err != nil {
+			t.Fatal(err)
+		}
+		if n := atomic.LoadInt32(&manifests); n != 1 {
+			t.Errorf("Expected a single manifest request for the %s pull, got %d", pull, n)
+		}
+	}
+}
+
+func TestDownloadImageBlobsFailFast(t *testing.T) {
+	var images []*ImageWithMeta
+	blobs := make(map[string][]byte)
+	for i, content := range []string{"good", "missing", "corrupt"} {
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(content)))
+		if content != "missing" {
+			blobs[digest] = []byte(content)
+		}
+
+		images = append(images, &ImageWithMeta{
+			Image:   &models.Image{ID: fmt.Sprintf("layer%d", i), Store: Storename},
+			history: History{V1Compatibility: LayerHistory},
+			layer:   FSLayer{BlobSum: digest},
+		})
+	}
+	good, missing, corrupt := images[0], images[1], images[2]
+
+	var slow int32
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			digest := path.Base(r.URL.Path)
+			content, ok := blobs[digest]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			switch {
+			case digest == corrupt.layer.BlobSum:
+				w.Write([]byte("not what was asked for"))
+			case atomic.LoadInt32(&slow) != 0:
+				// only finishes if the download isn't cancelled
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+					w.Write(content)
+				}
+			default:
+				w.Write(content)
+			}
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.standalone = true
+	opts.skipSpaceCheck = true
+
+	// every layer is attempted and both failures are reported
+	opts.failFast = false
+	err = NewPuller(opts).DownloadImageBlobs(images)
+
+	e, ok := err.(ErrLayerDownloads)
+	if !ok {
+		t.Fatalf("Expected the failures of the layers, got %#v", err)
+	}
+	if len(e.Errors) != 2 || e.Errors[missing.layer.BlobSum] == nil || e.Errors[corrupt.layer.BlobSum] == nil {
+		t.Errorf("Unexpected failures %#v", e.Errors)
+	}
+	if _, ok = e.Errors[corrupt.layer.BlobSum].(ErrChecksum); !ok {
+		t.Errorf("Expected a checksum error, got %#v", e.Errors[corrupt.layer.BlobSum])
+	}
+	if good.diffID == "" {
+		t.Errorf("The good layer wasn't downloaded")
+	}
+	if !strings.Contains(err.Error(), missing.layer.BlobSum) || !strings.Contains(err.Error(), corrupt.layer.BlobSum) {
+		t.Errorf("Unexpected error %s", err)
+	}
+
+	// the first failure cancels the download of the good layer
+	good.diffID = ""
+	atomic.StoreInt32(&slow, 1)
+	opts.failFast = true
+	err = NewPuller(opts).DownloadImageBlobs(images)
+
+	if _, ok = err.(ErrLayerDownloads); ok || err == nil {
+		t.Fatalf("Expected the first failure, got %#v", err)
+	}
+	if good.diffID != "" {
+		t.Errorf("The good layer was downloaded")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// RateLimiter is a token bucket that limits the throughput of the readers sharing it to
+// a number of bytes per second
+type RateLimiter struct {
+	m sync.Mutex
+
+	rate  float64
+	burst float64
+
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter for the given number of bytes per second. The bucket
+// holds up to a second worth of tokens so short bursts aren't penalized.
+func NewRateLimiter(rate int64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// Burst returns the largest number of bytes that can be taken at once
+func (l *RateLimiter) Burst() int {
+	return int(l.burst)
+}
+
+// reserve takes n tokens from the bucket, returning how long the caller has to wait
+// before they're available
+func (l *RateLimiter) reserve(n int) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// WaitN blocks until n bytes may pass, or the context is done
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	wait := l.reserve(n)
+	if wait == 0 {
+		return nil
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedReader throttles reads from r by all of the limiters
+type rateLimitedReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*RateLimiter
+}
+
+// NewRateLimitedReader returns a reader that doesn't exceed the rate of any of the limiters.
+// nil limiters are ignored.
+func NewRateLimitedReader(ctx context.Context, r io.Reader, limiters ...*RateLimiter) io.Reader {
+	rl := &rateLimitedReader{
+		ctx: ctx,
+		r:   r,
+	}
+
+	for _, l := range limiters {
+		if l != nil {
+			rl.limiters = append(rl.limiters, l)
+		}
+	}
+
+	if len(rl.limiters) == 0 {
+		return r
+	}
+
+	return rl
+}
+
+func (rl *rateLimitedReader) Read(p []byte) (int, error) {
+	// never read more than a limiter can let through at once
+	for _, l := range rl.limiters {
+		if burst := l.Burst(); burst > 0 && len(p) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := rl.r.Read(p)
+	if n > 0 {
+		for _, l := range rl.limiters {
+			if werr := l.WaitN(rl.ctx, n); werr != nil {
+				return n, werr
+			}
+		}
+	}
+
+	return n, err
+}
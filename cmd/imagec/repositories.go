@@ -0,0 +1,105 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// RepositoriesFile is the name of the index that maps the pulled references to images
+const RepositoriesFile = "repositories.json"
+
+// RepositoryEntry identifies the image a reference resolves to
+type RepositoryEntry struct {
+	// ImageID is the digest of the image config
+	ImageID string `json:"imageID"`
+	// TopLayer is the ID of the topmost layer of the image
+	TopLayer string `json:"topLayer"`
+	// Annotations are those of the OCI manifest the image was pulled from, if any
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// ManifestDigest is the digest of the manifest the image was pulled from
+	ManifestDigest string `json:"manifestDigest,omitempty"`
+}
+
+// Repositories is the content of the index, mapping repository -> repository:tag -> image
+type Repositories struct {
+	Repositories map[string]map[string]RepositoryEntry `json:"Repositories"`
+}
+
+// Lookup returns the image the repository:tag reference resolves to
+func (r *Repositories) Lookup(repository, tag string) (RepositoryEntry, bool) {
+	entry, ok := r.Repositories[repository][repository+":"+tag]
+	return entry, ok
+}
+
+// ReadRepositories reads the index from dir, returning an empty one if there's none yet
+func ReadRepositories(dir string) (*Repositories, error) {
+	repos := &Repositories{
+		Repositories: make(map[string]map[string]RepositoryEntry),
+	}
+
+	content, err := ioutil.ReadFile(path.Join(dir, RepositoriesFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return repos, nil
+		}
+		return nil, err
+	}
+
+	if err = json.Unmarshal(content, repos); err != nil {
+		return nil, err
+	}
+
+	if repos.Repositories == nil {
+		repos.Repositories = make(map[string]map[string]RepositoryEntry)
+	}
+
+	return repos, nil
+}
+
+// UpdateRepositories records that repository:tag resolves to entry in the index in dir, keeping
+// the existing entries. The update holds an exclusive lock on the index and replaces it
+// atomically, so concurrent pulls neither lose entries nor see a partially written index.
+func UpdateRepositories(dir, repository, tag string, entry RepositoryEntry) error {
+	defer trace.End(trace.Begin(repository + ":" + tag))
+
+	err := updateIndex(dir, RepositoriesFile, func() (interface{}, error) {
+		repos, err := ReadRepositories(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		if repos.Repositories[repository] == nil {
+			repos.Repositories[repository] = make(map[string]RepositoryEntry)
+		}
+		repos.Repositories[repository][repository+":"+tag] = entry
+
+		return repos, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("%s:%s resolves to %s", repository, tag, entry.ImageID)
+
+	return nil
+}
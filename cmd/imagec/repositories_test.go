@@ -0,0 +1,77 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestUpdateRepositories(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// concurrent pulls must not lose each other's entries
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			entry := RepositoryEntry{
+				ImageID:  fmt.Sprintf("sha256:%d", i),
+				TopLayer: fmt.Sprintf("layer%d", i),
+			}
+			if err := UpdateRepositories(dir, Image, fmt.Sprintf("tag%d", i), entry); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// an existing tag is replaced
+	if err = UpdateRepositories(dir, Image, "tag0", RepositoryEntry{ImageID: "sha256:new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	repos, err := ReadRepositories(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(repos.Repositories[Image]); n != 10 {
+		t.Errorf("Expected 10 tags, got %d", n)
+	}
+
+	entry, ok := repos.Lookup(Image, "tag0")
+	if !ok || entry.ImageID != "sha256:new" {
+		t.Errorf("Unexpected entry for tag0: %#v", entry)
+	}
+
+	entry, ok = repos.Lookup(Image, "tag9")
+	if !ok || entry.TopLayer != "layer9" {
+		t.Errorf("Unexpected entry for tag9: %#v", entry)
+	}
+
+	if _, ok = repos.Lookup(Image, "missing"); ok {
+		t.Error("Unexpected entry for a tag that was never pulled")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/docker/docker/pkg/progress"
+)
+
+// PullStateFile is the name of the file that records the progress of a pull in its destination
+// directory, so that a pull that was interrupted resumes where it stopped
+const PullStateFile = "pull-state.json"
+
+// PullState is the progress of the pull of a manifest. Only the completed layers are recorded,
+// a partially downloaded layer is kept in its partial file and the size of that file is where
+// its download resumes.
+type PullState struct {
+	// ManifestDigest is the digest of the manifest pulled, the state of another one is discarded
+	ManifestDigest string `json:"manifestDigest"`
+	// Layers maps the ID of the completed layers to their diffID
+	Layers map[string]string `json:"layers"`
+
+	m     sync.Mutex
+	name  string
+	fsync bool
+}
+
+// partialLayerPath returns where the layer is downloaded to before it's verified
+func partialLayerPath(options ImageCOptions, id string) string {
+	return path.Join(DestinationDirectory(options), id, id+".tar.partial")
+}
+
+// LoadPullState returns the state of the pull of the manifest from the destination of the
+// options, an empty one if there's none or it's for another manifest
+func LoadPullState(options ImageCOptions, digest string) (*PullState, error) {
+	state := &PullState{
+		ManifestDigest: digest,
+		Layers:         make(map[string]string),
+		name:           path.Join(DestinationDirectory(options), PullStateFile),
+		fsync:          options.fsync,
+	}
+
+	content, err := ioutil.ReadFile(state.name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+
+	var saved PullState
+	if err = json.Unmarshal(content, &saved); err != nil {
+		// the state is rewritten as the layers complete
+		options.logger().Warnf("Discarding the unreadable pull state %s: %s", state.name, err)
+		return state, nil
+	}
+
+	if saved.ManifestDigest != digest {
+		options.logger().Debugf("Discarding the pull state of manifest %s", saved.ManifestDigest)
+		return state, nil
+	}
+
+	for id, diffID := range saved.Layers {
+		state.Layers[id] = diffID
+	}
+
+	return state, nil
+}
+
+// Pending returns the images whose layers still have to be downloaded. The layers of the others
+// were completed by a previous pull and are still there, their diffID is taken from the state.
+func (s *PullState) Pending(options ImageCOptions, images []*ImageWithMeta) []*ImageWithMeta {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var pending []*ImageWithMeta
+	for _, image := range images {
+		diffID, ok := s.Layers[image.ID]
+		if ok {
+			destination := path.Join(DestinationDirectory(options), image.ID)
+			for _, name := range []string{image.ID + ".tar", image.ID + ".json"} {
+				if _, err := os.Stat(path.Join(destination, name)); err != nil {
+					ok = false
+				}
+			}
+		}
+
+		if !ok {
+			pending = append(pending, image)
+			continue
+		}
+
+		image.diffID = diffID
+		progress.Update(options.progressOutput(), image.String(), "Already exists")
+	}
+
+	return pending
+}
+
+// Complete records that the layer of the image is downloaded
+func (s *PullState) Complete(id, diffID string) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.Layers[id] = diffID
+
+	content, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(path.Dir(s.name), 0755); err != nil {
+		return err
+	}
+
+	// written aside and renamed, so that a crash doesn't leave a truncated state
+	tmp := s.name + ".tmp"
+	if err = writeFile(tmp, content, 0644, s.fsync); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.name)
+}
+
+// Remove drops the state once the pull is over
+func (s *PullState) Remove() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if err := os.Remove(s.name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
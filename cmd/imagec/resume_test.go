@@ -0,0 +1,150 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPullResume(t *testing.T) {
+	var m sync.Mutex
+	var ranges []string
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.URL.Path, "/manifests/") {
+				if r.Method == "GET" {
+					m.Lock()
+					ranges = append(ranges, r.Header.Get("Range"))
+					m.Unlock()
+				}
+
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(LayerContent))
+				return
+			}
+
+			body, err := json.Marshal(&Manifest{
+				Name:     Image,
+				Tag:      Tag,
+				FSLayers: []FSLayer{{BlobSum: DigestSHA256LayerContent}},
+				History:  []History{{V1Compatibility: LayerHistory}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	// pull pulls the image into a new destination, after prepare left what an interrupted
+	// pull would have. It returns the Range headers of the layer requests.
+	pull := func(prepare func(opts ImageCOptions)) []string {
+		dir, err := ioutil.TempDir("", "imagec")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		opts := options
+		opts.registry = s.URL
+		opts.image = Image
+		opts.digest = Tag
+		opts.destination = dir
+		opts.standalone = true
+		opts.resume = true
+
+		if err = os.MkdirAll(path.Join(DestinationDirectory(opts), LayerID), 0755); err != nil {
+			t.Fatal(err)
+		}
+		prepare(opts)
+
+		m.Lock()
+		ranges = nil
+		m.Unlock()
+
+		if err = NewPuller(opts).PullImage(Storename); err != nil {
+			t.Fatal(err)
+		}
+
+		layer, err := ioutil.ReadFile(path.Join(DestinationDirectory(opts), LayerID, LayerID+".tar"))
+		if err != nil || string(layer) != LayerContent {
+			t.Errorf("Unexpected layer %q: %v", layer, err)
+		}
+
+		for _, name := range []string{partialLayerPath(opts, LayerID), path.Join(DestinationDirectory(opts), PullStateFile)} {
+			if _, err = os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("Expected %s to be removed once the pull is over, got %v", name, err)
+			}
+		}
+
+		m.Lock()
+		defer m.Unlock()
+		return ranges
+	}
+
+	// partial writes the start of the layer as an interrupted download leaves it
+	partial := func(content string) func(opts ImageCOptions) {
+		return func(opts ImageCOptions) {
+			if err := ioutil.WriteFile(partialLayerPath(opts, LayerID), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// the download continues from the end of the partial layer
+	if r := pull(partial(LayerContent[:10])); len(r) != 1 || r[0] != "bytes=10-" {
+		t.Errorf("Expected the layer download to resume, got %#v", r)
+	}
+
+	// a corrupt partial layer fails the checksum, the layer is downloaded again in whole
+	if r := pull(partial("XXXXXXXXXX")); len(r) != 2 || r[0] != "bytes=10-" || r[1] != "" {
+		t.Errorf("Expected the layer to be downloaded again, got %#v", r)
+	}
+
+	// a completed layer isn't downloaded again
+	complete := func(opts ImageCOptions) {
+		destination := path.Join(DestinationDirectory(opts), LayerID)
+		if err := ioutil.WriteFile(path.Join(destination, LayerID+".tar"), []byte(LayerContent), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(destination, LayerID+".json"), []byte(LayerHistory), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		manifest, err := FetchImageManifest(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := LoadPullState(opts, manifest.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = state.Complete(LayerID, DigestSHA256LayerContent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r := pull(complete); len(r) != 0 {
+		t.Errorf("Expected the completed layer to be skipped, got %#v", r)
+	}
+}
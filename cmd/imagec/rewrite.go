@@ -0,0 +1,168 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// dockerHubName is the registry part of the name Docker Hub repositories are matched against
+const dockerHubName = "docker.io"
+
+// RegistryRewrite maps the repositories matching it to another registry and repository, so that
+// they can be pulled through a mirror or proxy. The rule matches the fully qualified name of the
+// repository, "docker.io/library/nginx" for Docker Hub.
+type RegistryRewrite struct {
+	// Prefix matches the name if it's the name itself or one of its parent paths
+	Prefix string
+	// Pattern matches the name instead of Prefix, the replacement can refer to its submatches
+	Pattern *regexp.Regexp
+	// Replacement is the name that replaces the matched part, it can start with a scheme
+	Replacement string
+}
+
+// ParseRegistryRewrite parses a "from=to" rule. A from starting with ~ is a regular expression
+// and to can refer to its submatches as $1, otherwise from is a name prefix that's replaced by to.
+func ParseRegistryRewrite(s string) (RegistryRewrite, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 || i == len(s)-1 {
+		return RegistryRewrite{}, fmt.Errorf("%q is not of the form \"from=to\"", s)
+	}
+
+	from, to := s[:i], s[i+1:]
+	if !strings.HasPrefix(from, "~") {
+		return RegistryRewrite{Prefix: strings.TrimSuffix(from, "/"), Replacement: to}, nil
+	}
+
+	pattern, err := regexp.Compile(from[1:])
+	if err != nil {
+		return RegistryRewrite{}, fmt.Errorf("%q has an invalid pattern: %s", s, err)
+	}
+
+	return RegistryRewrite{Pattern: pattern, Replacement: to}, nil
+}
+
+// Rewrite returns the name with the rule applied and whether the rule matched it
+func (r RegistryRewrite) Rewrite(name string) (string, bool) {
+	if r.Pattern != nil {
+		if !r.Pattern.MatchString(name) {
+			return name, false
+		}
+		return r.Pattern.ReplaceAllString(name, r.Replacement), true
+	}
+
+	if name != r.Prefix && !strings.HasPrefix(name, r.Prefix+"/") {
+		return name, false
+	}
+	return strings.TrimSuffix(r.Replacement, "/") + name[len(r.Prefix):], true
+}
+
+// String returns the rule as it's given on the command line
+func (r RegistryRewrite) String() string {
+	if r.Pattern != nil {
+		return "~" + r.Pattern.String() + "=" + r.Replacement
+	}
+	return r.Prefix + "=" + r.Replacement
+}
+
+type registryRewrites struct {
+	val *[]RegistryRewrite
+}
+
+func (r *registryRewrites) Set(s string) error {
+	rule, err := ParseRegistryRewrite(s)
+	if err != nil {
+		return err
+	}
+
+	*r.val = append(*r.val, rule)
+	return nil
+}
+
+func (r *registryRewrites) Get() interface{} {
+	return *r.val
+}
+
+func (r *registryRewrites) String() string {
+	if r.val == nil {
+		return ""
+	}
+
+	var rules []string
+	for _, rule := range *r.val {
+		rules = append(rules, rule.String())
+	}
+
+	return strings.Join(rules, ", ")
+}
+
+// newRegistryRewrites returns a flag.Value implementation that appends a rule per occurrence of
+// the flag, the rules are tried in that order
+func newRegistryRewrites(rules *[]RegistryRewrite) flag.Value {
+	return &registryRewrites{rules}
+}
+
+// remote returns the registry URL and repository the requests of the pull are sent to, that is
+// the registry and repository of the reference unless a rewrite rule matches them. The first
+// matching rule wins.
+func (o ImageCOptions) remote() (*url.URL, string, error) {
+	u, err := url.Parse(o.registry)
+	if err != nil {
+		return nil, "", err
+	}
+
+	repository := o.repository()
+	if len(o.rewrites) == 0 {
+		return u, repository, nil
+	}
+
+	host := u.Host
+	if dockerHubHosts[host] {
+		host = dockerHubName
+	}
+
+	name := host + "/" + repository
+	for _, rule := range o.rewrites {
+		rewritten, ok := rule.Rewrite(name)
+		if !ok {
+			continue
+		}
+
+		// the rewritten name keeps the scheme and API path of the registry unless it sets a scheme
+		if i := strings.Index(rewritten, "://"); i > 0 {
+			u.Scheme, rewritten = rewritten[:i], rewritten[i+3:]
+		}
+
+		parts := strings.SplitN(rewritten, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, "", fmt.Errorf("Rewriting %s with %s gives %q, which isn't a registry host and repository", name, rule, rewritten)
+		}
+
+		u.Host = parts[0]
+		return u, parts[1], nil
+	}
+
+	return u, repository, nil
+}
+
+// isRemoteRepository returns true if name is the repository a rewrite rule sends the requests to
+func (o ImageCOptions) isRemoteRepository(name string) bool {
+	_, repository, err := o.remote()
+	return err == nil && repository == name
+}
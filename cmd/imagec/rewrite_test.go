@@ -0,0 +1,178 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestParseRegistryRewrite(t *testing.T) {
+	for _, s := range []string{"", "docker.io", "=mirror.example.com", "docker.io=", "~(=mirror.example.com"} {
+		if _, err := ParseRegistryRewrite(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+
+	for _, s := range []string{"docker.io=mirror.example.com/hub", `~^docker\.io/library/(.*)$=mirror.example.com/official/$1`} {
+		rule, err := ParseRegistryRewrite(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rule.String() != s {
+			t.Errorf("%q is printed as %q", s, rule.String())
+		}
+	}
+}
+
+func TestRegistryRewrite(t *testing.T) {
+	tests := []struct {
+		registry string
+		image    string
+		rules    []string
+		url      string
+	}{
+		// no rules
+		{DefaultDockerURL, "library/nginx", nil, "https://registry-1.docker.io/v2/library/nginx/manifests/latest"},
+		// Docker Hub is matched as docker.io
+		{DefaultDockerURL, "library/nginx", []string{"docker.io=registry.internal/docker-proxy"}, "https://registry.internal/v2/docker-proxy/library/nginx/manifests/latest"},
+		// a prefix only matches whole path elements
+		{DefaultDockerURL, "library/nginx", []string{"docker.io/lib=registry.internal/lib"}, "https://registry-1.docker.io/v2/library/nginx/manifests/latest"},
+		{DefaultDockerURL, "library/nginx", []string{"docker.io/library/nginx=registry.internal/nginx"}, "https://registry.internal/v2/nginx/manifests/latest"},
+		// the first matching rule wins
+		{DefaultDockerURL, "library/nginx", []string{"quay.io=registry.internal/quay", "docker.io/library=registry.internal/official", "docker.io=registry.internal/hub"}, "https://registry.internal/v2/official/nginx/manifests/latest"},
+		// patterns can move the repository around
+		{DefaultDockerURL, "library/nginx", []string{`~^docker\.io/([^/]+)/(.*)$=registry.internal/$2-$1`}, "https://registry.internal/v2/nginx-library/manifests/latest"},
+		{"https://quay.io", "coreos/etcd", []string{`~^docker\.io/(.*)$=registry.internal/hub/$1`}, "https://quay.io/coreos/etcd/manifests/latest"},
+		// the replacement can change the scheme
+		{"https://quay.io", "coreos/etcd", []string{"quay.io=http://localhost:5000/quay"}, "http://localhost:5000/quay/coreos/etcd/manifests/latest"},
+	}
+
+	for _, test := range tests {
+		opts := options
+		opts.registry = test.registry
+		opts.image = test.image
+		opts.digest = Tag
+		opts.rewrites = nil
+		for _, s := range test.rules {
+			rule, err := ParseRegistryRewrite(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.rewrites = append(opts.rewrites, rule)
+		}
+
+		u, err := opts.repositoryURL("manifests", opts.digest)
+		if err != nil {
+			t.Errorf("%s with %v: %s", test.image, test.rules, err)
+			continue
+		}
+		if u.String() != test.url {
+			t.Errorf("%s with %v gave %s, expected %s", test.image, test.rules, u, test.url)
+		}
+
+		// the index keeps the name of the reference
+		name := opts.repositoryName()
+		opts.rewrites = nil
+		if name != opts.repositoryName() {
+			t.Errorf("%s is indexed as %s instead of %s", test.image, name, opts.repositoryName())
+		}
+	}
+
+	// the rewritten name has to have a host and a repository
+	opts := options
+	opts.registry = DefaultDockerURL
+	opts.image = "library/nginx"
+	opts.rewrites = []RegistryRewrite{{Prefix: "docker.io/library/nginx", Replacement: "registry.internal"}}
+	if _, err := opts.repositoryURL("manifests", Tag); err == nil {
+		t.Errorf("A rewrite without a repository was accepted")
+	}
+}
+
+func TestRegistryRewriteAuth(t *testing.T) {
+	var s *httptest.Server
+	s = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/jwt/auth" {
+				// the token has to be for the repository of the mirror
+				if r.URL.Query().Get("scope") != "repository:proxy/"+Image+":pull" {
+					w.Write([]byte(`{"token":"useless"}`))
+					return
+				}
+				w.Write([]byte(`{"token":"` + OAuthToken + `"}`))
+				return
+			}
+
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				w.Header().Set("www-authenticate", `Bearer realm="`+s.URL+`/jwt/auth",service="mirror"`)
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+				return
+			}
+
+			if r.URL.Path != "/v2/proxy/"+Image+"/manifests/"+Tag {
+				http.NotFound(w, r)
+				return
+			}
+
+			// mirrors may name the manifest after their own repository
+			body, err := json.Marshal(&Manifest{
+				Name:     "proxy/" + Image,
+				Tag:      Tag,
+				FSLayers: []FSLayer{{BlobSum: DigestSHA256EmptyTar}},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rule, err := ParseRegistryRewrite("docker.io=" + s.URL + "/proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options
+	opts.registry = DefaultDockerURL
+	opts.image = Image
+	opts.digest = Tag
+	opts.token = nil
+	opts.destination = dir
+	opts.rewrites = []RegistryRewrite{rule}
+
+	puller := NewPuller(opts)
+	if err = puller.Authenticate(); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := FetchImageManifest(puller.options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FSLayers[0].BlobSum != DigestSHA256EmptyTar {
+		t.Errorf("Returned manifest %#v is different than expected", manifest)
+	}
+}
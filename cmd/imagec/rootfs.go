@@ -0,0 +1,89 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/docker/pkg/archive"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// ApplyLayer extracts the layer in layerFile on top of the rootfs directory. The whiteouts of the
+// layer remove the paths of the layers below, and opaque directories replace their contents. The
+// ownership of the files is only preserved when running as root.
+func ApplyLayer(rootfs, layerFile string) error {
+	defer trace.End(trace.Begin(layerFile))
+
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.Open(layerFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tar, err := archive.DecompressStream(f)
+	if err != nil {
+		return err
+	}
+	defer tar.Close()
+
+	size, err := archive.ApplyUncompressedLayer(rootfs, tar, &archive.TarOptions{
+		NoLchown: os.Geteuid() != 0,
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to extract %s to %s: %s", layerFile, rootfs, err)
+	}
+
+	log.Debugf("Extracted %d bytes from %s to %s", size, layerFile, rootfs)
+
+	return nil
+}
+
+// sequenceLayers orders the application of the images to the rootfs, parent first, while
+// they're downloaded concurrently. The images are ordered from the topmost layer down.
+func sequenceLayers(images []*ImageWithMeta) {
+	for i := range images {
+		images[i].applied = make(chan struct{})
+	}
+	for i := 0; i < len(images)-1; i++ {
+		images[i].below = images[i+1]
+	}
+}
+
+// applyImageLayer applies the downloaded layer of the image to the rootfs once the layer
+// below it has been applied
+func applyImageLayer(rootfs string, image *ImageWithMeta, layerFile string) error {
+	if image.below != nil {
+		<-image.below.applied
+		if !image.below.extracted {
+			return fmt.Errorf("Layer %s wasn't extracted, can't extract %s on top of it", image.below.String(), image.String())
+		}
+	}
+
+	if err := ApplyLayer(rootfs, layerFile); err != nil {
+		return err
+	}
+	image.extracted = true
+
+	return nil
+}
@@ -0,0 +1,233 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+type tarEntry struct {
+	name    string
+	mode    int64
+	content string
+}
+
+// layerTar returns a gzipped layer with the entries, names ending in / are directories
+func layerTar(t *testing.T, entries ...tarEntry) []byte {
+	var raw bytes.Buffer
+
+	tw := tar.NewWriter(&raw)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: e.mode, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(e.name, "/") {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	if _, err := gw.Write(raw.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return compressed.Bytes()
+}
+
+var (
+	baseLayer = []tarEntry{
+		{"etc/", 0755, ""},
+		{"etc/passwd", 0600, "root:x:0:0::/root:/bin/sh\n"},
+		{"etc/hosts", 0644, "127.0.0.1 localhost\n"},
+		{"var/", 0755, ""},
+		{"var/cache/", 0755, ""},
+		{"var/cache/old", 0644, "stale"},
+	}
+
+	// removes etc/hosts and replaces the contents of var/cache
+	topLayer = []tarEntry{
+		{"etc/", 0755, ""},
+		{"etc/.wh.hosts", 0644, ""},
+		{"var/", 0755, ""},
+		{"var/cache/", 0755, ""},
+		{"var/cache/.wh..wh..opq", 0644, ""},
+		{"var/cache/new", 0644, "fresh"},
+	}
+)
+
+// checkRootfs verifies that the rootfs holds base with top applied on top of it
+func checkRootfs(t *testing.T, rootfs string) {
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/hosts")); !os.IsNotExist(err) {
+		t.Errorf("Whited out file is still there: %v", err)
+	}
+
+	fi, err := os.Stat(filepath.Join(rootfs, "etc/passwd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected etc/passwd to be 0600, got %s", fi.Mode())
+	}
+
+	names, err := ioutil.ReadDir(filepath.Join(rootfs, "var/cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0].Name() != "new" {
+		t.Errorf("Expected only the contents of the opaque directory, got %d entries", len(names))
+	}
+
+	// the whiteouts themselves aren't extracted
+	if _, err := os.Stat(filepath.Join(rootfs, "etc/.wh.hosts")); !os.IsNotExist(err) {
+		t.Errorf("Whiteout was extracted: %v", err)
+	}
+}
+
+func TestApplyLayerWhiteouts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rootfs := filepath.Join(dir, "rootfs")
+	for i, layer := range [][]tarEntry{baseLayer, topLayer} {
+		name := filepath.Join(dir, fmt.Sprintf("%d.tar", i))
+		if err = ioutil.WriteFile(name, layerTar(t, layer...), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = ApplyLayer(rootfs, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkRootfs(t, rootfs)
+}
+
+func TestFetchImageBlobRootfs(t *testing.T) {
+	blobs := map[string][]byte{}
+	var digests []string
+	for _, layer := range [][]tarEntry{topLayer, baseLayer} {
+		blob := layerTar(t, layer...)
+		blobs[digest(blob)] = blob
+		digests = append(digests, digest(blob))
+	}
+
+	release := make(chan struct{})
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			d := filepath.Base(r.URL.Path)
+			// hold the base layer back so that the top one is downloaded first
+			if d == digests[1] {
+				<-release
+			}
+			w.Write(blobs[d])
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+	options.destination = dir
+	options.rootfs = filepath.Join(dir, "rootfs")
+
+	var images []*ImageWithMeta
+	for i, d := range digests {
+		images = append(images, &ImageWithMeta{
+			Image:   &models.Image{ID: d[len("sha256:"):], Store: Storename},
+			history: History{V1Compatibility: "{}"},
+			layer:   FSLayer{BlobSum: d},
+		})
+		if i > 0 {
+			images[i-1].Parent = &images[i].ID
+		}
+	}
+	sequenceLayers(images)
+
+	results := make(chan error, len(images))
+	for _, image := range images {
+		go func(image *ImageWithMeta) {
+			_, err := FetchImageBlob(options, image)
+			results <- err
+		}(image)
+	}
+
+	// the top layer is downloaded but waits for the base one to be extracted
+	top := filepath.Join(DestinationDirectory(options), images[0].ID, images[0].ID+".tar")
+	for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err = os.Stat(top); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Top layer wasn't downloaded: %s", err)
+		}
+	}
+
+	select {
+	case err = <-results:
+		t.Fatalf("Top layer didn't wait for the base layer: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	for range images {
+		if err = <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkRootfs(t, options.rootfs)
+
+	// the tars are stored as well
+	if _, err = os.Stat(filepath.Join(DestinationDirectory(options), images[1].ID, images[1].ID+".tar")); err != nil {
+		t.Error(err)
+	}
+}
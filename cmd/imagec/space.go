@@ -0,0 +1,177 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/vmware/vic/pkg/trace"
+)
+
+// checkWritable verifies that files can be created in dir, creating it if needed
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+
+	f, err := ioutil.TempFile(dir, ".imagec")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %s", dir, err)
+	}
+	f.Close()
+
+	return os.Remove(f.Name())
+}
+
+// availableSpace returns the space available to unprivileged users in the filesystem of dir
+// and the device it's on
+func availableSpace(dir string) (uint64, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, err
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, 0, err
+	}
+
+	return fs.Bavail * uint64(fs.Bsize), uint64(st.Dev), nil
+}
+
+// LayerSizes returns the total size of the layers. The sizes the manifest doesn't have are
+// asked from the registry, unknown sizes are an error as the estimate would be off.
+func LayerSizes(options ImageCOptions, images []*ImageWithMeta) (uint64, error) {
+	if err := fetchLayerSizes(options, images); err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for _, image := range images {
+		if image.size < 0 {
+			return 0, fmt.Errorf("Size of layer %s is unknown, use -skip-space-check to pull anyway", image.layer.BlobSum)
+		}
+
+		total += uint64(image.size)
+	}
+
+	return total, nil
+}
+
+// fetchLayerSizes asks the registry for the sizes of the layers that aren't known yet, all at once
+func fetchLayerSizes(options ImageCOptions, images []*ImageWithMeta) error {
+	var wg sync.WaitGroup
+	results := make(chan error, len(images))
+
+	for _, image := range images {
+		if image.size != 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(image *ImageWithMeta) {
+			defer wg.Done()
+
+			if _, err := layerSize(options, image); err != nil {
+				results <- fmt.Errorf("Failed to get the size of layer %s: %s", image.layer.BlobSum, err)
+			}
+		}(image)
+	}
+	wg.Wait()
+	close(results)
+
+	// any of the failures will do
+	return <-results
+}
+
+// layerSize asks the registry for the size of the layer and records it in the image, -1 if
+// the registry doesn't report it
+func layerSize(options ImageCOptions, image *ImageWithMeta) (int64, error) {
+	url, err := options.repositoryURL("blobs", image.layer.BlobSum)
+	if err != nil {
+		return 0, err
+	}
+
+	fo := FetcherOptions{
+		Timeout:            options.manifestTimeout,
+		Username:           options.username,
+		Password:           options.password,
+		Token:              options.currentToken(),
+		InsecureSkipVerify: options.insecure,
+		PinnedFingerprint:  options.fingerprint,
+	}
+
+	var size int64
+	_, err = options.fetchWithRefresh(fo, func(fetcher Fetcher) (err error) {
+		size, err = fetcher.Head(url)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	image.size = size
+	return size, nil
+}
+
+// CheckDestination verifies that the layers can be written before downloading them. The
+// layers are downloaded in parallel to the temp directory and then moved to the destination,
+// so both need room for all of them - unless they share a filesystem.
+func CheckDestination(options ImageCOptions, images []*ImageWithMeta) error {
+	defer trace.End(trace.Begin(options.image + "/" + options.digest))
+
+	dirs := []string{os.TempDir(), DestinationDirectory(options)}
+
+	for _, dir := range dirs {
+		if err := checkWritable(dir); err != nil {
+			return err
+		}
+	}
+
+	if options.skipSpaceCheck || len(images) == 0 {
+		return nil
+	}
+
+	required, err := LayerSizes(options, images)
+	if err != nil {
+		return err
+	}
+
+	options.logger().Debugf("%d bytes required for %d layers", required, len(images))
+
+	// the tars stay on the filesystem they were downloaded to when the directories share it
+	checked := make(map[uint64]bool)
+	for _, dir := range dirs {
+		available, dev, err := availableSpace(dir)
+		if err != nil {
+			return err
+		}
+
+		if checked[dev] {
+			continue
+		}
+		checked[dev] = true
+
+		if available < required {
+			return ErrInsufficientSpace{Path: dir, Required: required, Available: available}
+		}
+	}
+
+	return nil
+}
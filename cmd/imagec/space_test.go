@@ -0,0 +1,124 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestCheckDestination(t *testing.T) {
+	size := int64(len(LayerContent))
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "HEAD" {
+				t.Errorf("Unexpected %s request, the layers must not be downloaded", r.Method)
+			}
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+	options.destination = dir
+	options.token = &Token{Token: OAuthToken}
+
+	images := []*ImageWithMeta{
+		{
+			Image: &models.Image{ID: LayerID},
+			layer: FSLayer{BlobSum: DigestSHA256LayerContent},
+		},
+	}
+
+	if err = CheckDestination(options, images); err != nil {
+		t.Fatal(err)
+	}
+
+	total, err := LayerSizes(options, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != uint64(size) {
+		t.Errorf("Expected %d bytes, got %d", size, total)
+	}
+
+	// more than any disk can hold, forget the size recorded by the first HEAD
+	size = 1 << 62
+	images[0].size = 0
+	err = CheckDestination(options, images)
+	if e, ok := err.(ErrInsufficientSpace); !ok || e.Required != uint64(size) {
+		t.Errorf("Expected an ErrInsufficientSpace, got %#v", err)
+	}
+
+	// the size from the manifest is used as is
+	s.Close()
+	images[0].size = 1
+	if total, err = LayerSizes(options, images); err != nil || total != 1 {
+		t.Errorf("Expected the manifest size, got %d: %v", total, err)
+	}
+
+	options.skipSpaceCheck = true
+	if err = CheckDestination(options, images); err != nil {
+		t.Errorf("Unexpected error with the space check skipped: %s", err)
+	}
+}
+
+func TestCheckDestinationReadOnly(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("permissions aren't enforced for root")
+	}
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.destination = dir
+	options.skipSpaceCheck = true
+
+	if err = CheckDestination(options, nil); err == nil {
+		t.Error("Expected an error for a read-only destination")
+	}
+}
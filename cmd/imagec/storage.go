@@ -32,7 +32,7 @@ import (
 const HistoryKey = "v1Compatibility"
 
 // PingPortLayer calls the _ping endpoint of the portlayer
-func PingPortLayer() (bool, error) {
+func PingPortLayer(options ImageCOptions) (bool, error) {
 	defer trace.End(trace.Begin(options.host))
 
 	transport := httptransport.New(options.host, "/", []string{"http"})
@@ -46,7 +46,7 @@ func PingPortLayer() (bool, error) {
 }
 
 // CreateImageStore creates an image store
-func CreateImageStore(storename string) error {
+func CreateImageStore(options ImageCOptions, storename string) error {
 	defer trace.End(trace.Begin(storename))
 
 	transport := httptransport.New(options.host, "/", []string{"http"})
@@ -74,7 +74,7 @@ func CreateImageStore(storename string) error {
 }
 
 // ListImages lists the images from given image store
-func ListImages(storename string, images []*ImageWithMeta) (map[string]*models.Image, error) {
+func ListImages(options ImageCOptions, storename string, images []*ImageWithMeta) (map[string]*models.Image, error) {
 	defer trace.End(trace.Begin(storename))
 
 	transport := httptransport.New(options.host, "/", []string{"http"})
@@ -102,7 +102,7 @@ func ListImages(storename string, images []*ImageWithMeta) (map[string]*models.I
 }
 
 // WriteImage writes the image to given image store
-func WriteImage(image *ImageWithMeta, data io.ReadCloser) error {
+func WriteImage(options ImageCOptions, image *ImageWithMeta, data io.ReadCloser) error {
 	defer trace.End(trace.Begin(image.ID))
 
 	transport := httptransport.New(options.host, "/", []string{"http"})
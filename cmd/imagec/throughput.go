@@ -0,0 +1,147 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultThroughputInterval is the sampling interval of a ThroughputMeter created without one
+const DefaultThroughputInterval = time.Second
+
+// ThroughputSample is a measurement of the download rate of a pull
+type ThroughputSample struct {
+	// Bytes is the number of bytes downloaded since the meter was started
+	Bytes int64
+	// BytesPerSecond is the download rate over the last interval
+	BytesPerSecond float64
+	// Elapsed is the time since the meter was started
+	Elapsed time.Duration
+}
+
+// ThroughputFunc receives the samples of a ThroughputMeter
+type ThroughputFunc func(ThroughputSample)
+
+// ThroughputMeter counts the bytes read by the readers sharing it and reports the aggregate
+// throughput to a ThroughputFunc at a fixed interval
+type ThroughputMeter struct {
+	bytes int64
+
+	interval time.Duration
+	report   ThroughputFunc
+
+	start time.Time
+	stop  chan struct{}
+	done  sync.WaitGroup
+	once  sync.Once
+}
+
+// NewThroughputMeter starts a ThroughputMeter that calls report every interval until it's stopped
+func NewThroughputMeter(interval time.Duration, report ThroughputFunc) *ThroughputMeter {
+	if interval <= 0 {
+		interval = DefaultThroughputInterval
+	}
+
+	m := &ThroughputMeter{
+		interval: interval,
+		report:   report,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+	}
+
+	m.done.Add(1)
+	go m.run()
+
+	return m
+}
+
+// Add counts n more bytes
+func (m *ThroughputMeter) Add(n int64) {
+	atomic.AddInt64(&m.bytes, n)
+}
+
+// Bytes returns the number of bytes counted so far
+func (m *ThroughputMeter) Bytes() int64 {
+	return atomic.LoadInt64(&m.bytes)
+}
+
+// Stop stops the sampling after reporting a last sample for the time since the previous one
+func (m *ThroughputMeter) Stop() {
+	m.once.Do(func() {
+		close(m.stop)
+		m.done.Wait()
+	})
+}
+
+func (m *ThroughputMeter) run() {
+	defer m.done.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	last := m.start
+	var lastBytes int64
+
+	sample := func(now time.Time) {
+		bytes := m.Bytes()
+
+		s := ThroughputSample{
+			Bytes:   bytes,
+			Elapsed: now.Sub(m.start),
+		}
+		if d := now.Sub(last).Seconds(); d > 0 {
+			s.BytesPerSecond = float64(bytes-lastBytes) / d
+		}
+		m.report(s)
+
+		last, lastBytes = now, bytes
+	}
+
+	for {
+		select {
+		case now := <-ticker.C:
+			sample(now)
+		case <-m.stop:
+			sample(time.Now())
+			return
+		}
+	}
+}
+
+// meteredReader counts the bytes read from r
+type meteredReader struct {
+	r io.Reader
+	m *ThroughputMeter
+}
+
+// NewMeteredReader returns a reader that counts the bytes read from r with the meter. A nil
+// meter returns r itself, so that unmetered downloads don't pay for it.
+func NewMeteredReader(r io.Reader, m *ThroughputMeter) io.Reader {
+	if m == nil {
+		return r
+	}
+	return &meteredReader{r: r, m: m}
+}
+
+func (mr *meteredReader) Read(p []byte) (int, error) {
+	n, err := mr.r.Read(p)
+	if n > 0 {
+		mr.m.Add(int64(n))
+	}
+	return n, err
+}
@@ -0,0 +1,151 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestThroughputMeter(t *testing.T) {
+	var m sync.Mutex
+	var samples []ThroughputSample
+
+	meter := NewThroughputMeter(20*time.Millisecond, func(s ThroughputSample) {
+		m.Lock()
+		samples = append(samples, s)
+		m.Unlock()
+	})
+
+	// readers sharing the meter are counted together
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ioutil.ReadAll(NewMeteredReader(bytes.NewReader(make([]byte, 1024)), meter))
+		}()
+	}
+	wg.Wait()
+
+	time.Sleep(50 * time.Millisecond)
+	meter.Stop()
+	// stopping twice is harmless
+	meter.Stop()
+
+	m.Lock()
+	defer m.Unlock()
+
+	if len(samples) < 2 {
+		t.Fatalf("Expected periodic samples, got %d", len(samples))
+	}
+
+	last := samples[len(samples)-1]
+	if last.Bytes != 4*1024 {
+		t.Errorf("Counted %d bytes, expected %d", last.Bytes, 4*1024)
+	}
+
+	var total float64
+	for i, s := range samples {
+		if i > 0 && s.Bytes < samples[i-1].Bytes {
+			t.Errorf("Cumulative bytes went down from %d to %d", samples[i-1].Bytes, s.Bytes)
+		}
+		total += s.BytesPerSecond
+	}
+	if total <= 0 {
+		t.Errorf("No throughput reported in %#v", samples)
+	}
+
+	// without a meter the reader is left alone
+	r := bytes.NewReader(nil)
+	if NewMeteredReader(r, nil) != r {
+		t.Errorf("Expected an unmetered reader to be returned as is")
+	}
+}
+
+func TestDownloadImageBlobsThroughput(t *testing.T) {
+	blobs := make(map[string][]byte)
+	var images []*ImageWithMeta
+	var size int64
+	for i := 0; i < 3; i++ {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 1024*(i+1))
+		digest := fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+		blobs[digest] = content
+		size += int64(len(content))
+
+		images = append(images, &ImageWithMeta{
+			Image:   &models.Image{ID: fmt.Sprintf("layer%d", i), Store: Storename},
+			history: History{V1Compatibility: LayerHistory},
+			layer:   FSLayer{BlobSum: digest},
+		})
+	}
+
+	s := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			content, ok := blobs[path.Base(r.URL.Path)]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			w.Write(content)
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var samples []ThroughputSample
+
+	opts := options
+	opts.registry = s.URL
+	opts.image = Image
+	opts.digest = Tag
+	opts.destination = dir
+	opts.standalone = true
+	opts.skipSpaceCheck = true
+	opts.throughputInterval = time.Hour
+	opts.onThroughput = func(s ThroughputSample) {
+		samples = append(samples, s)
+	}
+
+	if err = NewPuller(opts).DownloadImageBlobs(images); err != nil {
+		t.Fatal(err)
+	}
+
+	// the last sample is taken when the downloads are done
+	if len(samples) != 1 {
+		t.Fatalf("Expected a single sample, got %#v", samples)
+	}
+	if samples[0].Bytes != size {
+		t.Errorf("Counted %d bytes across the layers, expected %d", samples[0].Bytes, size)
+	}
+}
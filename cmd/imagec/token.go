@@ -0,0 +1,107 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// TokenCache holds the bearer token shared by the concurrent layer downloads of a pull, so that
+// a token refreshed by one of them is reused by the rest
+type TokenCache struct {
+	m     sync.Mutex
+	token *Token
+}
+
+// NewTokenCache returns a TokenCache seeded with token
+func NewTokenCache(token *Token) *TokenCache {
+	return &TokenCache{token: token}
+}
+
+// Token returns the current token
+func (c *TokenCache) Token() *Token {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.token
+}
+
+// Refresh replaces the stale token that the registry rejected with one obtained from fetch. If
+// another download already replaced it the newer token is returned without fetching one.
+func (c *TokenCache) Refresh(stale *Token, fetch func() (*Token, error)) (*Token, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.token != nil && c.token != stale {
+		return c.token, nil
+	}
+
+	token, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	c.token = token
+
+	return token, nil
+}
+
+// currentToken returns the token to send with the requests
+func (o ImageCOptions) currentToken() *Token {
+	if o.tokens != nil {
+		return o.tokens.Token()
+	}
+	return o.token
+}
+
+// refreshToken runs the token acquisition again after the registry rejected stale, going through
+// the token cache if there's one
+func (o ImageCOptions) refreshToken(stale *Token) (*Token, error) {
+	fetch := func() (*Token, error) {
+		o.logger().Infof("Token for %s was rejected, requesting a new one", o.image)
+
+		url, err := LearnAuthURL(o)
+		if err != nil {
+			return nil, err
+		}
+		if url == nil {
+			return nil, fmt.Errorf("%s doesn't have a token service", o.registry)
+		}
+		return FetchToken(o, url)
+	}
+
+	if o.tokens == nil {
+		return fetch()
+	}
+	return o.tokens.Refresh(stale, fetch)
+}
+
+// fetchWithRefresh runs fetch with a fetcher for fo and, if the registry rejects the token, once
+// more with a refreshed one. The fetcher of the last attempt is returned.
+func (o ImageCOptions) fetchWithRefresh(fo FetcherOptions, fetch func(Fetcher) error) (Fetcher, error) {
+	fetcher := o.newFetcher(fo)
+	err := fetch(fetcher)
+
+	// the token can expire while the previous requests of the pull run, refresh it and retry once
+	if _, ok := err.(ErrUnauthorized); ok && !fetcher.IsBasicAuth() {
+		if fo.Token, err = o.refreshToken(fo.Token); err != nil {
+			return fetcher, fmt.Errorf("Failed to refresh OAuth token: %s", err)
+		}
+		fetcher = o.newFetcher(fo)
+		err = fetch(fetcher)
+	}
+
+	return fetcher, err
+}
@@ -0,0 +1,176 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/vmware/vic/lib/apiservers/portlayer/models"
+)
+
+func TestFetchImageBlobExpiredToken(t *testing.T) {
+	var tokenRequests int32
+
+	var s *httptest.Server
+	s = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				atomic.AddInt32(&tokenRequests, 1)
+				w.Write([]byte(`{"token":"` + OAuthToken + `"}`))
+				return
+			}
+
+			// only the freshly issued token is accepted
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				w.Header().Set("www-authenticate",
+					"Bearer realm=\""+s.URL+"/token\",service=\"registry\",scope=\"repository:library/photon:pull\"")
+				http.Error(w, "You shall not pass", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-gzip")
+			w.Write([]byte(LayerContent))
+		}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "imagec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+	options.destination = dir
+
+	expired := &Token{Token: "expired"}
+
+	opts := options
+	opts.token = expired
+	opts.tokens = NewTokenCache(expired)
+
+	parent := "scratch"
+	image := ImageWithMeta{
+		Image: &models.Image{
+			ID:     LayerID,
+			Parent: &parent,
+			Store:  Storename,
+		},
+		history: History{V1Compatibility: LayerHistory},
+		layer:   FSLayer{BlobSum: DigestSHA256LayerContent},
+	}
+
+	// the rejected token is refreshed and the layer fetched again
+	if _, err := FetchImageBlob(opts, &image); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Errorf("Expected a single token request, got %d", n)
+	}
+	if token := opts.tokens.Token(); token.Token != OAuthToken {
+		t.Errorf("Expected the refreshed token in the cache, got %s", token.Token)
+	}
+
+	// the remaining layers pick up the refreshed token
+	if _, err := FetchImageBlob(opts, &image); err != nil {
+		t.Fatal(err)
+	}
+
+	// as do the downloads that were rejected with the expired token concurrently
+	token, err := opts.refreshToken(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Token != OAuthToken {
+		t.Errorf("Expected the refreshed token, got %s", token.Token)
+	}
+
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Errorf("Expected the refreshed token to be reused, got %d token requests", n)
+	}
+}
+
+func TestLayerSizesExpiredToken(t *testing.T) {
+	var tokenRequests int32
+
+	var s *httptest.Server
+	s = httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				atomic.AddInt32(&tokenRequests, 1)
+				w.Write([]byte(`{"token":"` + OAuthToken + `"}`))
+				return
+			}
+
+			// only the freshly issued token is accepted
+			if r.Header.Get("Authorization") != "Bearer "+OAuthToken {
+				w.Header().Set("www-authenticate",
+					"Bearer realm=\""+s.URL+"/token\",service=\"registry\",scope=\"repository:library/photon:pull\"")
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(LayerContent)))
+		}))
+	defer s.Close()
+
+	saved := options
+	defer func() {
+		options = saved
+	}()
+
+	options.registry = s.URL
+	options.image = Image
+	options.digest = Tag
+
+	expired := &Token{Token: "expired"}
+
+	opts := options
+	opts.token = expired
+	opts.tokens = NewTokenCache(expired)
+
+	images := []*ImageWithMeta{
+		{
+			Image: &models.Image{ID: LayerID},
+			layer: FSLayer{BlobSum: DigestSHA256LayerContent},
+		},
+		{
+			Image: &models.Image{ID: LayerID + "2"},
+			layer: FSLayer{BlobSum: DigestSHA256LayerContent},
+		},
+	}
+
+	// the rejected token is refreshed once for the concurrent HEADs
+	total, err := LayerSizes(opts, images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != uint64(2*len(LayerContent)) {
+		t.Errorf("Expected %d bytes, got %d", 2*len(LayerContent), total)
+	}
+	if n := atomic.LoadInt32(&tokenRequests); n != 1 {
+		t.Errorf("Expected a single token request, got %d", n)
+	}
+}
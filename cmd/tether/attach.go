@@ -18,11 +18,11 @@ import (
 	"errors"
 	"fmt"
 	"net"
-	"os"
 	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/vmware/vic/lib/portlayer/attach"
+	"github.com/vmware/vic/pkg/dio"
 	"github.com/vmware/vic/pkg/trace"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/context"
@@ -224,7 +224,7 @@ func (t *attachServerSSH) run() error {
 		}
 		log.Debugf("reader/writers bound for channel for %s", sessionid)
 
-		go t.channelMux(requests, session.Cmd.Process, session.pty, detach)
+		go t.channelMux(requests, session, detach)
 	}
 
 	log.Info("incoming attach channel closed")
@@ -253,12 +253,41 @@ func (t *attachServerSSH) globalMux(reqchan <-chan *ssh.Request) {
 			msg := attach.ContainersMsg{IDs: keys}
 			payload = msg.Marshal()
 
+		case attach.LogsReq:
+			msg := attach.LogsMsg{}
+			if err := msg.Unmarshal(req.Payload); err != nil {
+				ok = false
+				payload = []byte(err.Error())
+				break
+			}
+
+			var buffer *dio.RingBuffer
+			config.pidMutex.Lock()
+			if session, found := config.Sessions[msg.ID]; found {
+				buffer = session.buffer
+			}
+			config.pidMutex.Unlock()
+
+			if buffer == nil {
+				ok = false
+				payload = []byte("no output available for session: " + msg.ID)
+				break
+			}
+
+			msg.Data = buffer.Bytes()
+			payload = msg.Marshal()
+
 		default:
 			ok = false
 			payload = []byte("unknown global request type: " + req.Type)
 		}
 
-		log.Debugf("Returning payload: %s", string(payload))
+		// the session output is of no use in the tether log
+		if req.Type == attach.LogsReq {
+			log.Debugf("Returning payload of %d bytes", len(payload))
+		} else {
+			log.Debugf("Returning payload: %s", string(payload))
+		}
 
 		// make sure that errors get send back if we failed
 		if req.WantReply {
@@ -274,7 +303,7 @@ func (t *attachServerSSH) globalMux(reqchan <-chan *ssh.Request) {
 	}
 }
 
-func (t *attachServerSSH) channelMux(in <-chan *ssh.Request, process *os.Process, pty *os.File, detach func()) {
+func (t *attachServerSSH) channelMux(in <-chan *ssh.Request, session *SessionConfig, detach func()) {
 	defer trace.End(trace.Begin("start attach server channel request handler"))
 
 	var err error
@@ -282,6 +311,11 @@ func (t *attachServerSSH) channelMux(in <-chan *ssh.Request, process *os.Process
 		var pendingFn func()
 		ok := true
 
+		// the session may have been relaunched since the channel was bound
+		config.pidMutex.Lock()
+		process, pty := session.Cmd.Process, session.pty
+		config.pidMutex.Unlock()
+
 		switch req.Type {
 		case attach.WindowChangeReq:
 			msg := attach.WindowChangeMsg{}
@@ -20,7 +20,9 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"sync"
 	"testing"
@@ -156,6 +158,122 @@ func TestAttach(t *testing.T) {
 //
 /////////////////////////////////////////////////////////////////////////////////////
 
+/////////////////////////////////////////////////////////////////////////////////////
+// TestAttachRestart restarts the session of an attached client - the client has to stay
+// bound to the relaunched process
+//
+func TestAttachRestart(t *testing.T) {
+	testSetup(t)
+	defer testTeardown(t)
+
+	testServer, _ := server.(*testAttachServer)
+
+	// only the relaunched process produces output
+	marker := pathPrefix + "/launched"
+	script := fmt.Sprintf("if [ -f %[1]s ]; then echo restarted; else touch %[1]s; fi; exec sleep 30", marker)
+
+	cfg := metadata.ExecutorConfig{
+		Common: metadata.Common{
+			ID:   "attach",
+			Name: "tether_test_executor",
+		},
+
+		Sessions: map[string]metadata.SessionConfig{
+			"attach": metadata.SessionConfig{
+				Common: metadata.Common{
+					ID:   "attach",
+					Name: "tether_test_session",
+				},
+				Tty:    false,
+				Attach: true,
+				Cmd: metadata.Cmd{
+					Path: "/bin/sh",
+					Args: []string{"/bin/sh", "-c", script},
+					Env:  []string{},
+					Dir:  "/",
+				},
+			},
+		},
+		Key: genKey(),
+	}
+
+	startTether(t, &cfg)
+
+	// wait for updates to occur
+	<-testServer.updated
+
+	if !testServer.enabled {
+		t.Error("attach server was not enabled")
+		return
+	}
+
+	// create client on the mock pipe
+	conn, err := mockBackChannel(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	containerConfig := &ssh.ClientConfig{
+		User: "daemon",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+	}
+
+	// create the SSH client from the mocked connection
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, "notappliable", containerConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sshConn.Close()
+
+	attachClient := ssh.NewClient(sshConn, chans, reqs)
+
+	sshSession, err := attach.SSHAttach(attachClient, cfg.ID)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// a window change is refused for a non-tty session, but the reply means the channel is bound
+	sshSession.Resize(80, 24, 0, 0)
+
+	config.pidMutex.Lock()
+	session := config.Sessions["attach"]
+	config.pidMutex.Unlock()
+
+	restartSession(session)
+
+	stdout := sshSession.Stdout()
+	buf := make([]byte, len("restarted\n"))
+	if _, err = io.ReadFull(stdout, buf); !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "restarted\n", string(buf))
+
+	// signals have to reach the relaunched process, the channel is closed once it exits
+	if !assert.NoError(t, sshSession.Signal(ssh.SIGTERM)) {
+		return
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := ioutil.ReadAll(stdout)
+		done <- err
+	}()
+
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Error("relaunched session did not exit on signal")
+	}
+}
+
+//
+/////////////////////////////////////////////////////////////////////////////////////
+
 /////////////////////////////////////////////////////////////////////////////////////
 // TestAttachTTYConfig sets up the config for attach testing
 //
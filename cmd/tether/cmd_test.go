@@ -19,9 +19,11 @@ import (
 	"io/ioutil"
 	"os/exec"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/vmware/vic/lib/metadata"
+	"github.com/vmware/vic/lib/portlayer/attach"
 	"github.com/vmware/vic/pkg/vsphere/extraconfig"
 )
 
@@ -149,6 +151,15 @@ func TestAbsPath(t *testing.T) {
 		return
 	}
 
+	// check the process was recorded as started and then stopped
+	session := cfg.Sessions["abspath"]
+	if session.Started != "true" || session.Pid == 0 || session.StartTime == 0 {
+		t.Errorf("process launch wasn't recorded: started=%q pid=%d start=%d", session.Started, session.Pid, session.StartTime)
+	}
+	if session.StopTime < session.StartTime {
+		t.Errorf("process exit wasn't recorded: start=%d stop=%d", session.StartTime, session.StopTime)
+	}
+
 	// read the output from the session
 	log, err := ioutil.ReadFile(pathPrefix + "/ttyS2")
 	if err != nil {
@@ -278,3 +289,63 @@ func TestMissingRelativeBinary(t *testing.T) {
 
 //
 /////////////////////////////////////////////////////////////////////////////////////
+func TestLogBuffer(t *testing.T) {
+	testSetup(t)
+	defer testTeardown(t)
+
+	cfg := metadata.ExecutorConfig{
+		Common: metadata.Common{
+			ID:   "logbuffer",
+			Name: "tether_test_executor",
+		},
+
+		Sessions: map[string]metadata.SessionConfig{
+			"logbuffer": metadata.SessionConfig{
+				Common: metadata.Common{
+					ID:   "logbuffer",
+					Name: "tether_test_session",
+				},
+				Tty: false,
+				Cmd: metadata.Cmd{
+					Path: "/bin/echo",
+					Args: []string{"echo", "0123456789"},
+					Env:  []string{},
+					Dir:  "/",
+				},
+				LogBufferSize: 8,
+			},
+		},
+	}
+
+	_, err := runTether(t, &cfg)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the exit can be handled before the output has been copied
+	buffer := config.Sessions["logbuffer"].buffer
+	for i := 0; i < 100 && buffer.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// only the tail of the output is retained
+	assert.Equal(t, "3456789\n", string(buffer.Bytes()))
+}
+
+func TestLogBufferSize(t *testing.T) {
+	tests := []struct {
+		in, out int
+	}{
+		{0, DefaultLogBufferSize},
+		{-1, DefaultLogBufferSize},
+		{8, 8},
+		{attach.MaxLogsData, attach.MaxLogsData},
+		// the buffer has to fit in the reply to a logs request
+		{1024 * 1024, attach.MaxLogsData},
+	}
+
+	for _, test := range tests {
+		session := &SessionConfig{LogBufferSize: test.in}
+		assert.Equal(t, test.out, logBufferSize(session), "size %d", test.in)
+	}
+}
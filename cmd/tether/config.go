@@ -64,15 +64,45 @@ type SessionConfig struct {
 
 	Started string `vic:"0.1" scope:"read-write" key:"started"`
 
+	// Pid is the process ID of the primary process, set when it has been launched
+	Pid int `vic:"0.1" scope:"read-write" key:"pid"`
+
+	// StartTime is when the process was launched, in seconds since the epoch
+	StartTime int64 `vic:"0.1" scope:"read-write" key:"starttime"`
+
+	// StopTime is when the process exited, in seconds since the epoch - zero while it's running
+	StopTime int64 `vic:"0.1" scope:"read-write" key:"stoptime"`
+
+	// HealthCheck describes how the health of the session is probed, if at all
+	HealthCheck *metadata.HealthCheck `vic:"0.1" scope:"read-only" key:"healthcheck"`
+
+	// Health is the latest result of the health check
+	Health string `vic:"0.1" scope:"read-write" key:"health"`
+
+	// Limits are the resource limits of the session process
+	Limits []metadata.Rlimit `vic:"0.1" scope:"read-only" key:"limits"`
+
 	// Allow attach
 	Attach bool `vic:"0.1" scope:"read-only" key:"attach"`
 
 	// Allocate a tty or not
 	Tty bool `vic:"0.1" scope:"read-only" key:"tty"`
 
+	// LogBufferSize is the number of bytes of recent output kept for retrieval without attach,
+	// it's capped at attach.MaxLogsData
+	LogBufferSize int `vic:"0.1" scope:"read-only" key:"logbuffer"`
+
 	// if there's a pty then we need additional management data
 	pty       *os.File
 	outwriter dio.DynamicMultiWriter
 	errwriter dio.DynamicMultiWriter
 	reader    dio.DynamicMultiReader
+
+	// buffer retains the tail of the session output
+	buffer *dio.RingBuffer
+
+	// closing healthStop stops the health check runner
+	healthStop chan struct{}
+	// restart is set when the session should be relaunched once it exits
+	restart bool
 }
@@ -84,3 +84,12 @@ func TestToExtraConfig(t *testing.T) {
 	assert.Equal(t, expected.Cmd.Dir, actual.Cmd.Dir)
 	assert.Equal(t, expected.Cmd.Env, actual.Cmd.Env)
 }
+
+func TestConfigSchema(t *testing.T) {
+	// the portlayer records the schema of metadata package's ExecutorConfig
+	encoded := map[string]string{}
+	extraconfig.EncodeSchema(extraconfig.MapSink(encoded), metadata.ExecutorConfig{})
+
+	// this package's ExecutorConfig has to be compatible with it
+	assert.NoError(t, extraconfig.CheckSchema(extraconfig.MapSource(encoded), ExecutorConfig{}))
+}
@@ -0,0 +1,243 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/vmware/vic/lib/metadata"
+	"github.com/vmware/vic/pkg/trace"
+	"github.com/vmware/vic/pkg/vsphere/extraconfig"
+)
+
+const (
+	// HealthStarting is reported until the first probe completes
+	HealthStarting = "starting"
+	// HealthHealthy is reported while the probes succeed
+	HealthHealthy = "healthy"
+	// HealthUnhealthy is reported once Retries consecutive probes have failed
+	HealthUnhealthy = "unhealthy"
+
+	// defaults for unset health check values
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 30 * time.Second
+	defaultHealthRetries  = 3
+)
+
+// probes maps the pids of running probe commands to the channel that receives their exit status.
+// The child reaper may collect a probe before exec.Cmd.Wait does, so it has to be able to hand
+// the status over.
+var probes = struct {
+	sync.Mutex
+	pids map[int]chan int
+}{pids: make(map[int]chan int)}
+
+// RemoveProbePid removes the pid from the probe table and returns the channel for its exit status
+func RemoveProbePid(pid int) (chan int, bool) {
+	probes.Lock()
+	defer probes.Unlock()
+
+	status, ok := probes.pids[pid]
+	delete(probes.pids, pid)
+	return status, ok
+}
+
+// startHealthCheck starts the health check runner for the session if it has a health check
+// configured and it's not already running
+func startHealthCheck(session *SessionConfig) {
+	config.pidMutex.Lock()
+	defer config.pidMutex.Unlock()
+
+	if session.HealthCheck == nil || session.healthStop != nil {
+		return
+	}
+
+	session.healthStop = make(chan struct{})
+	go runHealthCheck(session, *session.HealthCheck, session.healthStop)
+}
+
+// stopHealthCheck stops the health check runner for the session if there's one
+func stopHealthCheck(session *SessionConfig) {
+	config.pidMutex.Lock()
+	defer config.pidMutex.Unlock()
+
+	if session.healthStop != nil {
+		close(session.healthStop)
+		session.healthStop = nil
+	}
+}
+
+// runHealthCheck probes the session on schedule until stop is closed, recording the state
+// transitions in the data sink
+func runHealthCheck(session *SessionConfig, check metadata.HealthCheck, stop chan struct{}) {
+	defer trace.End(trace.Begin("health check for session " + session.ID))
+
+	if check.Interval <= 0 {
+		check.Interval = defaultHealthInterval
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = defaultHealthTimeout
+	}
+	if check.Retries <= 0 {
+		check.Retries = defaultHealthRetries
+	}
+
+	setHealth(session, HealthStarting)
+
+	ticker := time.NewTicker(check.Interval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := probe(check)
+		if err == nil {
+			failures = 0
+			setHealth(session, HealthHealthy)
+			continue
+		}
+
+		failures++
+		log.Warnf("Health check %d/%d for session %s failed: %s", failures, check.Retries, session.ID, err)
+		if failures < check.Retries {
+			continue
+		}
+
+		setHealth(session, HealthUnhealthy)
+		if check.Restart {
+			restartSession(session)
+			failures = 0
+		}
+	}
+}
+
+// setHealth records the health of the session if it changed
+func setHealth(session *SessionConfig, health string) {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+
+	if session.Health == health {
+		return
+	}
+
+	log.Infof("Session %s is %s", session.ID, health)
+	session.Health = health
+
+	// FIXME: shares the embedded knowledge of the extraconfig encoding pattern with handleSessionExit
+	extraconfig.EncodeWithPrefix(dataSink, session.Health, fmt.Sprintf("guestinfo..sessions|%s.health", session.ID))
+}
+
+// probe runs a single health check, returning nil if the session is healthy
+func probe(check metadata.HealthCheck) error {
+	if len(check.Cmd) > 0 {
+		return probeCmd(check.Cmd, check.Timeout)
+	}
+
+	if check.Address != "" {
+		conn, err := net.DialTimeout("tcp", check.Address, check.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	return errors.New("health check has neither command nor address")
+}
+
+// probeCmd runs the command and reports an error unless it exits with zero within the timeout
+func probeCmd(args []string, timeout time.Duration) error {
+	cmd := exec.Command(args[0], args[1:]...)
+
+	status := make(chan int, 2)
+
+	// register under the lock so the reaper can't collect the probe before it's known
+	err := func() error {
+		probes.Lock()
+		defer probes.Unlock()
+
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		probes.pids[cmd.Process.Pid] = status
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		err := cmd.Wait()
+		if err == nil {
+			status <- 0
+			return
+		}
+		if exit, ok := err.(*exec.ExitError); ok {
+			status <- exitCode(exit)
+		}
+		// otherwise the reaper got there first and delivers the status
+	}()
+
+	defer RemoveProbePid(cmd.Process.Pid)
+
+	select {
+	case code := <-status:
+		if code != 0 {
+			return fmt.Errorf("%s exited with %d", args[0], code)
+		}
+		return nil
+	case <-time.After(timeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("%s timed out after %s", args[0], timeout)
+	}
+}
+
+// exitCode extracts the exit code from the exit error, -1 if it isn't available
+func exitCode(exit *exec.ExitError) int {
+	if ws, ok := exit.Sys().(interface {
+		ExitStatus() int
+	}); ok {
+		return ws.ExitStatus()
+	}
+	return -1
+}
+
+// restartSession kills the session process and flags it so that it's relaunched once
+// it has been reaped
+func restartSession(session *SessionConfig) {
+	config.pidMutex.Lock()
+	defer config.pidMutex.Unlock()
+
+	if session.Cmd.Process == nil {
+		return
+	}
+
+	log.Infof("Restarting unhealthy session %s", session.ID)
+	session.restart = true
+	if err := session.Cmd.Process.Kill(); err != nil {
+		log.Errorf("Failed to kill unhealthy session %s: %s", session.ID, err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/vic/lib/metadata"
+	"github.com/vmware/vic/pkg/vsphere/extraconfig"
+)
+
+func TestHealthCheck(t *testing.T) {
+	testSetup(t)
+	defer testTeardown(t)
+
+	cfg := metadata.ExecutorConfig{
+		Common: metadata.Common{
+			ID:   "healthy",
+			Name: "tether_test_executor",
+		},
+
+		Sessions: map[string]metadata.SessionConfig{
+			"healthy": metadata.SessionConfig{
+				Common: metadata.Common{
+					ID:   "healthy",
+					Name: "tether_test_session",
+				},
+				Cmd: metadata.Cmd{
+					Path: "/bin/sleep",
+					Args: []string{"sleep", "1"},
+					Env:  []string{},
+					Dir:  "/",
+				},
+				HealthCheck: &metadata.HealthCheck{
+					Cmd:      []string{"/bin/true"},
+					Interval: 100 * time.Millisecond,
+					Timeout:  time.Second,
+				},
+			},
+			"unhealthy": metadata.SessionConfig{
+				Common: metadata.Common{
+					ID:   "unhealthy",
+					Name: "tether_test_session",
+				},
+				Cmd: metadata.Cmd{
+					Path: "/bin/sleep",
+					Args: []string{"sleep", "1"},
+					Env:  []string{},
+					Dir:  "/",
+				},
+				HealthCheck: &metadata.HealthCheck{
+					Cmd:      []string{"/bin/false"},
+					Interval: 100 * time.Millisecond,
+					Timeout:  time.Second,
+					Retries:  2,
+				},
+			},
+		},
+	}
+
+	src, err := runTether(t, &cfg)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// refresh the cfg with current data
+	extraconfig.Decode(src, &cfg)
+
+	assert.Equal(t, HealthHealthy, cfg.Sessions["healthy"].Health)
+	assert.Equal(t, HealthUnhealthy, cfg.Sessions["unhealthy"].Health)
+}
+
+func TestProbe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+
+	check := metadata.HealthCheck{
+		Address: addr,
+		Timeout: time.Second,
+	}
+	assert.NoError(t, probe(check), "Listening address should be healthy")
+
+	l.Close()
+	assert.Error(t, probe(check), "Closed address should be unhealthy")
+
+	check = metadata.HealthCheck{
+		Cmd:     []string{"/bin/sleep", "5"},
+		Timeout: 100 * time.Millisecond,
+	}
+	assert.Error(t, probe(check), "Probe exceeding the timeout should be unhealthy")
+}
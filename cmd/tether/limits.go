@@ -0,0 +1,36 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/vmware/vic/lib/metadata"
+)
+
+// clampLimit returns the limit with a soft limit above the hard limit lowered to it. Setting
+// such a limit fails, so it's corrected rather than failing the launch.
+func clampLimit(limit metadata.Rlimit) metadata.Rlimit {
+	if limit.Hard < 0 {
+		return limit
+	}
+
+	if limit.Soft < 0 || limit.Soft > limit.Hard {
+		log.Warnf("Soft %s limit %d exceeds the hard limit %d, lowering it", limit.Type, limit.Soft, limit.Hard)
+		limit.Soft = limit.Hard
+	}
+
+	return limit
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/vic/lib/metadata"
+)
+
+// commandLimits runs the command through limitCommand and returns the soft and hard limits it
+// reads from /proc, by the name they're listed under
+func commandLimits(t *testing.T, limits []metadata.Rlimit) map[string][2]string {
+	cmd := exec.Command("/bin/cat", "/proc/self/limits")
+
+	utils := &osopsLinux{}
+	utils.limitCommand(cmd, limits)
+
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s: %s", err, b)
+	}
+
+	parsed := make(map[string][2]string)
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		// the name is padded to 26 characters
+		if len(line) < 26 {
+			continue
+		}
+		fields := strings.Fields(line[26:])
+		parsed[strings.TrimSpace(line[:26])] = [2]string{fields[0], fields[1]}
+	}
+
+	return parsed
+}
+
+func TestLimitCommand(t *testing.T) {
+	limits := commandLimits(t, []metadata.Rlimit{
+		{Type: "nofile", Soft: 512, Hard: 1024},
+		// the soft limit is lowered to the hard one
+		{Type: "core", Soft: 8192, Hard: 4096},
+		{Type: "nproc", Soft: 100, Hard: 200},
+		// and unknown limits are skipped
+		{Type: "bogus", Soft: 1, Hard: 1},
+	})
+
+	assert.Equal(t, [2]string{"512", "1024"}, limits["Max open files"])
+	assert.Equal(t, [2]string{"4096", "4096"}, limits["Max core file size"])
+	assert.Equal(t, [2]string{"100", "200"}, limits["Max processes"])
+
+	// the limits aren't left on tether
+	own := commandLimits(t, nil)
+	assert.NotEqual(t, [2]string{"512", "1024"}, own["Max open files"])
+}
+
+func TestExecWithLimits(t *testing.T) {
+	for _, args := range [][]string{
+		{"nofile"},
+		{"nofile=1", "--", "/bin/true", "true"},
+		{"nofile=1:2"},
+		// the helper doesn't skip what checkLimits would have dropped
+		{"bogus=1:1", "--", "/bin/true", "true"},
+	} {
+		assert.Error(t, execWithLimits(args), "%v", args)
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	limits := checkLimits([]metadata.Rlimit{
+		{Type: "bogus", Soft: 1, Hard: 1},
+		{Type: "core", Soft: 8192, Hard: 4096},
+	})
+
+	assert.Equal(t, []metadata.Rlimit{{Type: "core", Soft: 4096, Hard: 4096}}, limits)
+
+	// without any limit left the command isn't touched
+	cmd := exec.Command("/bin/true")
+	utils := &osopsLinux{}
+	utils.limitCommand(cmd, []metadata.Rlimit{{Type: "bogus", Soft: 1, Hard: 1}})
+	assert.Equal(t, "/bin/true", cmd.Path)
+}
+
+func TestClampLimit(t *testing.T) {
+	tests := []struct {
+		in, out metadata.Rlimit
+	}{
+		{metadata.Rlimit{Type: "nofile", Soft: 1, Hard: 2}, metadata.Rlimit{Type: "nofile", Soft: 1, Hard: 2}},
+		{metadata.Rlimit{Type: "nofile", Soft: 3, Hard: 2}, metadata.Rlimit{Type: "nofile", Soft: 2, Hard: 2}},
+		{metadata.Rlimit{Type: "nofile", Soft: -1, Hard: 2}, metadata.Rlimit{Type: "nofile", Soft: 2, Hard: 2}},
+		{metadata.Rlimit{Type: "nofile", Soft: 3, Hard: -1}, metadata.Rlimit{Type: "nofile", Soft: 3, Hard: -1}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.out, clampLimit(test.in))
+	}
+}
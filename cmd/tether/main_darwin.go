@@ -63,6 +63,13 @@ func main() {
 		return
 	}
 
+	// refuse config laid out differently from what we decode into - it would decode into garbage
+	err = extraconfig.CheckSchema(src, ExecutorConfig{})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
 	sink, err := extraconfig.GuestInfoSink()
 	if err != nil {
 		log.Error(err)
@@ -18,16 +18,39 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/docker/pkg/stringid"
+	"github.com/vmware/vic/lib/portlayer/attach"
 	"github.com/vmware/vic/pkg/dio"
 	"github.com/vmware/vic/pkg/trace"
 	"github.com/vmware/vic/pkg/vsphere/extraconfig"
 )
 
+// DefaultLogBufferSize is the amount of session output retained if the session doesn't specify it
+const DefaultLogBufferSize = 64 * 1024
+
+// logBufferSize returns the amount of output to retain for the session, which has to fit in the
+// reply to a logs request
+func logBufferSize(session *SessionConfig) int {
+	size := session.LogBufferSize
+	if size <= 0 {
+		return DefaultLogBufferSize
+	}
+
+	if size > attach.MaxLogsData {
+		log.Warnf("Log buffer size %d of session %s exceeds %d, lowering it", size, session.ID, attach.MaxLogsData)
+		return attach.MaxLogsData
+	}
+
+	return size
+}
+
 // pathPrefix is used for testing - it allows for creating and manupulating files outside of
 // a full containerVM environment
 var pathPrefix string
@@ -44,6 +67,18 @@ var config *ExecutorConfig
 var dataSource extraconfig.DataSource
 var dataSink extraconfig.DataSink
 
+// sinkMutex serializes the writes to the dataSink, they're made from the main loop, the child
+// reaper and the health checks
+var sinkMutex sync.Mutex
+
+// encodeWithPrefix writes the value to the dataSink under the prefix
+func encodeWithPrefix(src interface{}, prefix string) {
+	sinkMutex.Lock()
+	defer sinkMutex.Unlock()
+
+	extraconfig.EncodeWithPrefix(dataSink, src, prefix)
+}
+
 // RemoveChildPid is a synchronized accessor for the pid map the deletes the entry and returns the value
 func RemoveChildPid(pid int) (*SessionConfig, bool) {
 	config.pidMutex.Lock()
@@ -89,11 +124,17 @@ func run(src extraconfig.DataSource, sink extraconfig.DataSink) error {
 
 	defer func() {
 		// perform basic cleanup
+		config.pidMutex.Lock()
 		reload = nil
+		config.pidMutex.Unlock()
 		// FIXME: Cannot clean up sessions until we are persisting exit status elsewhere for test validation
 		//    also referenced in handleSessionExit
 		// config = nil
 
+		for _, session := range config.Sessions {
+			stopHealthCheck(session)
+		}
+
 		utils.cleanup()
 	}()
 
@@ -167,6 +208,8 @@ func run(src extraconfig.DataSource, sink extraconfig.DataSink) error {
 				// TODO: decide how to handle restart - probably needs to glue into the child reaping
 			}
 
+			startHealthCheck(session)
+
 			// handle exited session
 			// TODO
 		}
@@ -185,6 +228,22 @@ func run(src extraconfig.DataSource, sink extraconfig.DataSink) error {
 func handleSessionExit(session *SessionConfig) error {
 	defer trace.End(trace.Begin("handling exit of session " + session.ID))
 
+	// record exit status
+	// FIXME: we cannot have this embedded knowledge of the extraconfig encoding pattern, but not
+	// currently sure how to expose it neatly via a utility function
+	encodeWithPrefix(session.ExitStatus, fmt.Sprintf("guestinfo..sessions|%s.status", session.ID))
+	log.Infof("%s exit code: %d", session.ID, session.ExitStatus)
+
+	// the stop time is written after the status so that it's valid once the stop time is seen
+	session.StopTime = time.Now().Unix()
+	encodeWithPrefix(session.StopTime, fmt.Sprintf("guestinfo..sessions|%s.stoptime", session.ID))
+
+	// the health check asked for a restart of the session - the IO is left open for it
+	if relaunch(session) {
+		return nil
+	}
+	stopHealthCheck(session)
+
 	// close down the IO
 	session.reader.Close()
 	// live.outwriter.Close()
@@ -192,19 +251,14 @@ func handleSessionExit(session *SessionConfig) error {
 
 	// flush session log output
 
-	// record exit status
-	// FIXME: we cannot have this embedded knowledge of the extraconfig encoding pattern, but not
-	// currently sure how to expose it neatly via a utility function
-	extraconfig.EncodeWithPrefix(dataSink, session.ExitStatus, fmt.Sprintf("guestinfo..sessions|%s.status", session.ID))
-	log.Infof("%s exit code: %d", session.ID, session.ExitStatus)
-
 	// check for executor behaviour
-	if LenChildPid() == 0 {
-		// let the main loop exit if there's no more sessions to wait on
-		if reload != nil {
-			close(reload)
-			reload = nil
-		}
+	config.pidMutex.Lock()
+	defer config.pidMutex.Unlock()
+
+	// let the main loop exit if there's no more sessions to wait on
+	if len(config.pids) == 0 && reload != nil {
+		close(reload)
+		reload = nil
 	}
 
 	return nil
@@ -217,23 +271,37 @@ func launch(session *SessionConfig) error {
 
 	// encode the result whether success or error
 	defer func() {
-		extraconfig.EncodeWithPrefix(dataSink, session.Started, fmt.Sprintf("guestinfo..sessions|%s.started", session.ID))
+		encodeWithPrefix(session.Started, fmt.Sprintf("guestinfo..sessions|%s.started", session.ID))
 	}()
 
-	logwriter, err := utils.sessionLogWriter()
-	if err != nil {
-		detail := fmt.Sprintf("failed to get log writer for session: %s", err)
-		log.Error(detail)
-		session.Started = detail
+	// we store these outside of the session.Cmd struct so that there's consistent
+	// handling between tty & non-tty paths. They survive restarts of the session so that
+	// attached clients stay bound to it
+	if session.outwriter == nil {
+		logwriter, err := utils.sessionLogWriter()
+		if err != nil {
+			detail := fmt.Sprintf("failed to get log writer for session: %s", err)
+			log.Error(detail)
+			session.Started = detail
 
-		return errors.New(detail)
+			return errors.New(detail)
+		}
+
+		session.outwriter = logwriter
+		session.errwriter = logwriter
+
+		// keep the recent output for non-interactive retrieval, it's read by the attach server
+		config.pidMutex.Lock()
+		if session.buffer == nil {
+			session.buffer = dio.NewRingBuffer(logBufferSize(session))
+		}
+		config.pidMutex.Unlock()
+		session.outwriter.Add(session.buffer)
 	}
 
-	// we store these outside of the session.Cmd struct so that there's consistent
-	// handling between tty & non-tty paths
-	session.outwriter = logwriter
-	session.errwriter = logwriter
-	session.reader = dio.MultiReader()
+	if session.reader == nil {
+		session.reader = dio.MultiReader()
+	}
 
 	session.Cmd.Env = utils.processEnvOS(session.Cmd.Env)
 	session.Cmd.Stdout = session.outwriter
@@ -258,6 +326,17 @@ func launch(session *SessionConfig) error {
 		defer config.pidMutex.Unlock()
 
 		log.Infof("Launching command %#v\n", session.Cmd.Args)
+
+		// the limits are applied by the process itself before it execs the command, the
+		// session keeps reporting the command it was configured with
+		if len(session.Limits) > 0 {
+			path, args := session.Cmd.Path, session.Cmd.Args
+			utils.limitCommand(&session.Cmd, session.Limits)
+			defer func() {
+				session.Cmd.Path, session.Cmd.Args = path, args
+			}()
+		}
+
 		if !session.Tty {
 			err = session.Cmd.Start()
 		} else {
@@ -284,13 +363,48 @@ func launch(session *SessionConfig) error {
 		return errors.New(detail)
 	}
 
+	// record the process before the Started key so that it's valid once the launch is seen
+	session.Pid = session.Cmd.Process.Pid
+	session.StartTime = time.Now().Unix()
+	session.StopTime = 0
+	encodeWithPrefix(session.Pid, fmt.Sprintf("guestinfo..sessions|%s.pid", session.ID))
+	encodeWithPrefix(session.StartTime, fmt.Sprintf("guestinfo..sessions|%s.starttime", session.ID))
+	encodeWithPrefix(session.StopTime, fmt.Sprintf("guestinfo..sessions|%s.stoptime", session.ID))
+
 	// Set the Started key to "true" - this indicates a successful launch
 	session.Started = "true"
-	log.Debugf("Launched command with pid %d", session.Cmd.Process.Pid)
+	log.Debugf("Launched command with pid %d", session.Pid)
 
 	return nil
 }
 
+// relaunch launches the session again if it was flagged for restart, returning true if it did
+func relaunch(session *SessionConfig) bool {
+	config.pidMutex.Lock()
+	restart := session.restart
+	session.restart = false
+	config.pidMutex.Unlock()
+
+	if !restart {
+		return false
+	}
+
+	// an exec.Cmd cannot be reused once started
+	session.Cmd = exec.Cmd{
+		Path: session.Cmd.Path,
+		Args: session.Cmd.Args,
+		Env:  session.Cmd.Env,
+		Dir:  session.Cmd.Dir,
+	}
+
+	log.Infof("Relaunching process for session %s", session.ID)
+	if err := launch(session); err != nil {
+		log.Errorf("Failed to relaunch session %s: %s", session.ID, err)
+		return false
+	}
+	return true
+}
+
 func logConfig(config *ExecutorConfig) {
 	// just pretty print the json for now
 	log.Info("Loaded executor config")
@@ -18,8 +18,12 @@ import (
 	"errors"
 	"net"
 	"os"
+	"os/exec"
 	"strings"
 
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/vmware/vic/lib/metadata"
 	"github.com/vmware/vic/lib/portlayer/attach"
 	"github.com/vmware/vic/pkg/dio"
 
@@ -75,6 +79,10 @@ func lookPath(file string, env []string) (string, error) {
 	return "", errors.New("unimplemented on OSX")
 }
 
+func (t *osopsOSX) limitCommand(cmd *exec.Cmd, limits []metadata.Rlimit) {
+	log.Warnf("Resource limits are unimplemented on OSX, ignoring %d limits", len(limits))
+}
+
 func (t *osopsOSX) establishPty(session *SessionConfig) error {
 	return errors.New("unimplemented on OSX")
 }
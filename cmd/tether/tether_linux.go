@@ -19,12 +19,15 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,6 +39,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/kr/pty"
+	"github.com/vmware/vic/lib/metadata"
 	"github.com/vmware/vic/lib/portlayer/attach"
 	"github.com/vmware/vic/pkg/dio"
 	"github.com/vmware/vic/pkg/serial"
@@ -45,6 +49,13 @@ import (
 // allow us to pick up some of the osops implementations when mocking
 // allowing it to be less all or nothing
 func init() {
+	// run as the resource limits helper, nothing else in tether is wanted in that case
+	if len(os.Args) > 0 && os.Args[0] == limitsHelper {
+		err := execWithLimits(os.Args[1:])
+		fmt.Fprintf(os.Stderr, "failed to launch with resource limits: %s\n", err)
+		os.Exit(127)
+	}
+
 	ops = &osopsLinux{}
 	utils = &osopsLinux{}
 }
@@ -84,7 +95,7 @@ func childReaper() {
 						break
 					}
 					if err == nil {
-						if !status.Exited() {
+						if !status.Exited() && !status.Signaled() {
 							log.Debugf("Received notifcation about non-exit status change for %d:", pid)
 							// no reaping or exit handling required
 							continue
@@ -96,6 +107,9 @@ func childReaper() {
 						if ok {
 							session.ExitStatus = status.ExitStatus()
 							handleSessionExit(session)
+						} else if probe, ok := RemoveProbePid(pid); ok {
+							// a health check probe that exec.Cmd.Wait didn't collect
+							probe <- status.ExitStatus()
 						} else {
 							// This is an adopted zombie. The Wait4 call
 							// already clean it up from the kernel
@@ -320,6 +334,180 @@ func (t *osopsLinux) establishPty(session *SessionConfig) error {
 	return err
 }
 
+// Resource limits that the syscall package doesn't name, from asm-generic/resource.h
+const (
+	rlimitRSS        = 5
+	rlimitNPROC      = 6
+	rlimitMEMLOCK    = 8
+	rlimitLOCKS      = 10
+	rlimitSIGPENDING = 11
+	rlimitMSGQUEUE   = 12
+	rlimitNICE       = 13
+	rlimitRTPRIO     = 14
+	rlimitRTTIME     = 15
+)
+
+// rlimitResources maps the names of the resource limits to their resource number
+var rlimitResources = map[string]int{
+	"cpu":        syscall.RLIMIT_CPU,
+	"fsize":      syscall.RLIMIT_FSIZE,
+	"data":       syscall.RLIMIT_DATA,
+	"stack":      syscall.RLIMIT_STACK,
+	"core":       syscall.RLIMIT_CORE,
+	"rss":        rlimitRSS,
+	"nproc":      rlimitNPROC,
+	"nofile":     syscall.RLIMIT_NOFILE,
+	"memlock":    rlimitMEMLOCK,
+	"as":         syscall.RLIMIT_AS,
+	"locks":      rlimitLOCKS,
+	"sigpending": rlimitSIGPENDING,
+	"msgqueue":   rlimitMSGQUEUE,
+	"nice":       rlimitNICE,
+	"rtprio":     rlimitRTPRIO,
+	"rttime":     rlimitRTTIME,
+}
+
+// limitsHelper is the argv[0] tether is re-executed with to apply resource limits to itself
+// before it execs the session command
+const limitsHelper = "tether-limits"
+
+// selfExe is the path tether re-executes itself through
+var selfExe = "/proc/self/exe"
+
+// nrOpenFile holds the ceiling of the nofile limit
+var nrOpenFile = "/proc/sys/fs/nr_open"
+
+// rlimitValue converts a limit value to the kernel's, negative values are unlimited
+func rlimitValue(v int64) uint64 {
+	if v < 0 {
+		return ^uint64(0)
+	}
+	return uint64(v)
+}
+
+// limitCommand arranges for the command to start with the resource limits. Go can't run code
+// between the fork and the exec, and limits set on tether itself would also apply to tether, so
+// the command is run through tether re-executed as limitsHelper, which sets the limits on itself
+// and then execs the command in place:
+//
+//	tether-limits nofile=512:1024 ... -- /resolved/path argv0 args...
+//
+// The limits are checked here rather than in the helper, whose output goes to the session.
+func (t *osopsLinux) limitCommand(cmd *exec.Cmd, limits []metadata.Rlimit) {
+	limits = checkLimits(limits)
+	if len(limits) == 0 {
+		return
+	}
+
+	args := []string{limitsHelper}
+	for _, limit := range limits {
+		args = append(args, fmt.Sprintf("%s=%d:%d", limit.Type, limit.Soft, limit.Hard))
+	}
+	args = append(args, "--", cmd.Path)
+
+	cmd.Args = append(args, cmd.Args...)
+	cmd.Path = selfExe
+}
+
+// checkLimits returns the limits corrected so that they can be applied. A limit that can't be
+// corrected is logged and dropped, it doesn't fail the launch.
+func checkLimits(limits []metadata.Rlimit) []metadata.Rlimit {
+	var checked []metadata.Rlimit
+
+	for _, limit := range limits {
+		resource, ok := rlimitResources[limit.Type]
+		if !ok {
+			log.Warnf("Ignoring unknown resource limit %q", limit.Type)
+			continue
+		}
+
+		limit = clampLimit(limit)
+
+		// the kernel rejects a nofile limit above nr_open
+		if resource == syscall.RLIMIT_NOFILE {
+			if b, err := ioutil.ReadFile(nrOpenFile); err == nil {
+				if max, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil {
+					if limit.Hard < 0 || limit.Hard > max {
+						log.Warnf("Hard nofile limit %d exceeds %d, lowering it", limit.Hard, max)
+						limit.Hard = max
+					}
+					limit = clampLimit(limit)
+				}
+			}
+		}
+
+		// only root can raise a hard limit
+		if os.Geteuid() != 0 {
+			var current syscall.Rlimit
+			if err := syscall.Getrlimit(resource, &current); err != nil {
+				log.Warnf("Ignoring %s limit, failed to read the current one: %s", limit.Type, err)
+				continue
+			}
+
+			if rlimitValue(limit.Hard) > current.Max {
+				log.Warnf("Hard %s limit %d exceeds the current %d, lowering it", limit.Type, limit.Hard, current.Max)
+				limit.Hard = int64(current.Max)
+				limit = clampLimit(limit)
+			}
+		}
+
+		checked = append(checked, limit)
+	}
+
+	return checked
+}
+
+// execWithLimits is the body of the limitsHelper, it applies the limits in args and execs the
+// command following them. It only returns if either failed.
+func execWithLimits(args []string) error {
+	var limits []metadata.Rlimit
+	for len(args) > 0 && args[0] != "--" {
+		var limit metadata.Rlimit
+		parts := strings.SplitN(args[0], "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed resource limit %q", args[0])
+		}
+		limit.Type = parts[0]
+		if _, err := fmt.Sscanf(parts[1], "%d:%d", &limit.Soft, &limit.Hard); err != nil {
+			return fmt.Errorf("malformed resource limit %q: %s", args[0], err)
+		}
+		limits = append(limits, limit)
+		args = args[1:]
+	}
+	if len(args) < 3 {
+		return errors.New("no command to execute")
+	}
+
+	if err := setLimits(limits); err != nil {
+		return err
+	}
+
+	return syscall.Exec(args[1], args[2:], os.Environ())
+}
+
+// setLimits applies the resource limits to the calling process. The limits have been through
+// checkLimits so a failure is unexpected, and the helper has nowhere to log it but the session.
+func setLimits(limits []metadata.Rlimit) error {
+	for _, limit := range limits {
+		resource, ok := rlimitResources[limit.Type]
+		if !ok {
+			return fmt.Errorf("unknown resource limit %q", limit.Type)
+		}
+
+		rlimit := syscall.Rlimit{
+			Cur: rlimitValue(limit.Soft),
+			Max: rlimitValue(limit.Hard),
+		}
+
+		// Setrlimit also stops the runtime restoring its original nofile limit on exec
+		if err := syscall.Setrlimit(resource, &rlimit); err != nil {
+			return fmt.Errorf("failed to set %s limit to %d/%d: %s", limit.Type, limit.Soft, limit.Hard, err)
+		}
+	}
+
+	return nil
+}
+
 // The syscall struct
 type winsize struct {
 	wsRow    uint16
@@ -21,6 +21,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path"
 	"runtime"
 	"sync"
@@ -94,6 +95,10 @@ func (t *mocker) establishPty(session *SessionConfig) error {
 	return t.utils.establishPty(session)
 }
 
+func (t *mocker) limitCommand(cmd *exec.Cmd, limits []metadata.Rlimit) {
+	t.utils.limitCommand(cmd, limits)
+}
+
 func (t *mocker) resizePty(pty uintptr, winSize *attach.WindowChangeMsg) error {
 	t.windowCol = winSize.Columns
 	t.windowRow = winSize.Rows
@@ -253,6 +258,8 @@ func (t *testAttachServer) stop() {
 // TestMain simply so we have control of debugging level and somewhere to call package wide test setup
 func TestMain(m *testing.M) {
 	log.SetLevel(log.DebugLevel)
+	extraconfig.DecodeLogLevel = log.DebugLevel
+	extraconfig.EncodeLogLevel = log.DebugLevel
 
 	// save the base os specific structures
 	specificOps = ops
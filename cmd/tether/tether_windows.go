@@ -22,6 +22,7 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/exec"
 	"strings"
 	"time"
 
@@ -30,6 +31,7 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	winserial "github.com/tarm/serial"
+	"github.com/vmware/vic/lib/metadata"
 	"github.com/vmware/vic/lib/portlayer/attach"
 	"github.com/vmware/vic/pkg/dio"
 	"github.com/vmware/vic/pkg/serial"
@@ -220,6 +222,10 @@ func (t *osopsWin) signalProcess(process *os.Process, sig ssh.Signal) error {
 	return errors.New("unimplemented on windows")
 }
 
+func (t *osopsWin) limitCommand(cmd *exec.Cmd, limits []metadata.Rlimit) {
+	log.Warnf("Resource limits are unimplemented on windows, ignoring %d limits", len(limits))
+}
+
 func (t *osopsWin) establishPty(session *SessionConfig) error {
 	return errors.New("unimplemented on windows")
 }
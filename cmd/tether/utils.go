@@ -17,6 +17,7 @@ package main
 import (
 	"net"
 	"os"
+	"os/exec"
 
 	"github.com/vmware/vic/lib/metadata"
 	"github.com/vmware/vic/lib/portlayer/attach"
@@ -42,6 +43,7 @@ type utilities interface {
 	sessionLogWriter() (dio.DynamicMultiWriter, error)
 	processEnvOS(env []string) []string
 	establishPty(session *SessionConfig) error
+	limitCommand(cmd *exec.Cmd, limits []metadata.Rlimit)
 	resizePty(pty uintptr, winSize *attach.WindowChangeMsg) error
 	signalProcess(process *os.Process, sig ssh.Signal) error
 	backchannel(ctx context.Context) (net.Conn, error)
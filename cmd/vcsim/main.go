@@ -15,7 +15,10 @@
 package main
 
 import (
+	"crypto/tls"
 	"flag"
+	"fmt"
+	"log"
 	"os"
 	"runtime"
 
@@ -28,6 +31,7 @@ import (
 
 func main() {
 	kind := flag.String("s", "esx", "simulator service (esx,vc)")
+	secure := flag.Bool("tls", false, "serve https using a generated self-signed certificate")
 	flag.Parse()
 
 	f := flag.Lookup("httptest.serve")
@@ -57,5 +61,19 @@ func main() {
 	esx.HostSystem.Summary.Hardware.Vendor += tag
 
 	service := simulator.NewServiceInstance(*content, *folder)
-	simulator.New(service).NewServer()
+	s := simulator.New(service)
+
+	if *secure {
+		cert, err := simulator.NewSelfSignedCertificate()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		// the server blocks once started, so report the thumbprint up front
+		fmt.Printf("certificate thumbprint: %s\n", simulator.Thumbprint(cert.Leaf))
+
+		s.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	s.NewServer()
 }
@@ -14,7 +14,10 @@
 
 package metadata
 
-import "net/url"
+import (
+	"net/url"
+	"time"
+)
 
 // Common data between managed entities, across execution environments
 type Common struct {
@@ -108,6 +111,42 @@ type Cmd struct {
 	Dir string `vic:"0.1" scope:"read-only" key:"Dir"`
 }
 
+// HealthCheck defines a probe that is run periodically to determine whether a session is healthy.
+// If Cmd is set the command is executed and a zero exit code is healthy, otherwise a TCP connection
+// is attempted to Address.
+type HealthCheck struct {
+	// Cmd is the probe command including the command in Cmd[0]
+	Cmd []string `vic:"0.1" scope:"read-only" key:"cmd"`
+
+	// Address is the host:port to probe with a TCP connection
+	Address string `vic:"0.1" scope:"read-only" key:"address"`
+
+	// Interval is the time between two probes
+	Interval time.Duration `vic:"0.1" scope:"read-only" key:"interval"`
+
+	// Timeout is the time a single probe may take before it's considered failed
+	Timeout time.Duration `vic:"0.1" scope:"read-only" key:"timeout"`
+
+	// Retries is the number of consecutive failures before the session is unhealthy
+	Retries int `vic:"0.1" scope:"read-only" key:"retries"`
+
+	// Restart the session once it becomes unhealthy
+	Restart bool `vic:"0.1" scope:"read-only" key:"restart"`
+}
+
+// Rlimit is a resource limit of the session process, as with setrlimit(2). A negative value is
+// unlimited.
+type Rlimit struct {
+	// Type is the name of the resource, e.g. nofile or nproc
+	Type string `vic:"0.1" scope:"read-only" key:"type"`
+
+	// Soft is the limit the kernel enforces
+	Soft int64 `vic:"0.1" scope:"read-only" key:"soft"`
+
+	// Hard is the ceiling the process can raise the soft limit to
+	Hard int64 `vic:"0.1" scope:"read-only" key:"hard"`
+}
+
 // SessionConfig defines the content of a session - this maps to the root of a process tree
 // inside an executor
 // This is close to but not perfectly aligned with the new docker/docker/daemon/execdriver/driver:CommonProcessConfig
@@ -124,16 +163,37 @@ type SessionConfig struct {
 	// Allocate a tty or not
 	Tty bool `vic:"0.1" scope:"read-only" key:"tty"`
 
+	// LogBufferSize is the number of bytes of recent output kept for retrieval without attach,
+	// it's capped at attach.MaxLogsData
+	LogBufferSize int `vic:"0.1" scope:"read-only" key:"logbuffer"`
+
 	ExitStatus int `vic:"0.1" scope:"read-write" key:"status"`
 
 	Started string `vic:"0.1" scope:"read-write" key:"started"`
 
+	// Pid is the process ID of the session's primary process, set when it has been launched
+	Pid int `vic:"0.1" scope:"read-write" key:"pid"`
+
+	// StartTime is when the process was launched, in seconds since the epoch
+	StartTime int64 `vic:"0.1" scope:"read-write" key:"starttime"`
+
+	// StopTime is when the process exited, in seconds since the epoch - zero while it's running
+	StopTime int64 `vic:"0.1" scope:"read-write" key:"stoptime"`
+
+	// HealthCheck describes how the health of the session is probed, if at all
+	HealthCheck *HealthCheck `vic:"0.1" scope:"read-only" key:"healthcheck"`
+
+	// Health is the latest result of the health check, one of starting, healthy or unhealthy
+	Health string `vic:"0.1" scope:"read-write" key:"health"`
+
+	// Limits are the resource limits of the session process
+	Limits []Rlimit `vic:"0.1" scope:"read-only" key:"limits"`
+
 	// Maps the intent to the signal for this specific app
 	// Signals map[int]int
 
 	// Use struct composition to add in the guest specific portions
 	// http://attilaolah.eu/2014/09/10/json-and-struct-composition-in-go/
-	// ulimits
 	// user
 	// rootfs - within the container context
 }
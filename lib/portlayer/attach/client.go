@@ -64,6 +64,26 @@ func SSHls(client *ssh.Client) ([]string, error) {
 	return ids.IDs, nil
 }
 
+// SSHLogs returns the buffered output of the requested session, even if nothing is attached to it
+func SSHLogs(client *ssh.Client, id string) ([]byte, error) {
+	msg := LogsMsg{ID: id}
+	ok, reply, err := client.SendRequest(LogsReq, true, msg.Marshal())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get logs of %s from remote: %s", id, err)
+	}
+	if !ok {
+		// the remote explains the refusal in the reply
+		return nil, fmt.Errorf("failed to get logs of %s from remote: %s", id, reply)
+	}
+
+	logs := LogsMsg{}
+	if err = logs.Unmarshal(reply); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal logs from remote: %s", err)
+	}
+
+	return logs.Data, nil
+}
+
 // SSHAttach returns a stream connection to the requested session
 // The ssh client is assumed to be connected to the Executor hosting the session
 func SSHAttach(client *ssh.Client, id string) (SessionInteraction, error) {
@@ -111,3 +111,27 @@ func (s *ContainersMsg) Marshal() []byte {
 func (s *ContainersMsg) Unmarshal(payload []byte) error {
 	return ssh.Unmarshal(payload, s)
 }
+
+// LogsMsg requests the buffered output of a session, the reply carries the data
+const LogsReq = "logs"
+
+// MaxLogsData is the most output a LogsMsg reply carries. The reply is sent as a single SSH
+// packet, which is capped at 256KB, so it's kept well below that.
+const MaxLogsData = 128 * 1024
+
+type LogsMsg struct {
+	ID   string
+	Data []byte
+}
+
+func (s *LogsMsg) RequestType() string {
+	return LogsReq
+}
+
+func (s *LogsMsg) Marshal() []byte {
+	return ssh.Marshal(*s)
+}
+
+func (s *LogsMsg) Unmarshal(payload []byte) error {
+	return ssh.Unmarshal(payload, s)
+}
@@ -55,3 +55,15 @@ func TestContainers(t *testing.T) {
 
 	assert.Equal(t, s, out)
 }
+
+func TestLogs(t *testing.T) {
+	s := &LogsMsg{ID: "foo", Data: []byte("some output\n")}
+
+	assert.Equal(t, s.RequestType(), LogsReq)
+
+	tmp := s.Marshal()
+	out := &LogsMsg{}
+	out.Unmarshal(tmp)
+
+	assert.Equal(t, s, out)
+}
@@ -147,6 +147,7 @@ func (h *Handle) Commit(ctx context.Context, sess *session.Session) error {
 	h.SetSpec(nil)
 	cfg := make(map[string]string)
 	extraconfig.Encode(extraconfig.MapSink(cfg), h.ExecConfig)
+	extraconfig.EncodeSchema(extraconfig.MapSink(cfg), h.ExecConfig)
 	s := h.Spec.Spec()
 	s.ExtraConfig = append(s.ExtraConfig, extraconfig.OptionValueFromMap(cfg)...)
 
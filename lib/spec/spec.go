@@ -131,6 +131,7 @@ func NewVirtualMachineConfigSpec(ctx context.Context, session *session.Session,
 	// encode the config as optionvalues
 	cfg := map[string]string{}
 	extraconfig.Encode(extraconfig.MapSink(cfg), config.Metadata)
+	extraconfig.EncodeSchema(extraconfig.MapSink(cfg), config.Metadata)
 	metaCfg := extraconfig.OptionValueFromMap(cfg)
 
 	// merge it with the sec
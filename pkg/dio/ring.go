@@ -0,0 +1,90 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dio
+
+import (
+	"sync"
+)
+
+// RingBuffer is an io.Writer that retains the most recent bytes written to it, evicting the
+// oldest data once the capacity is reached
+type RingBuffer struct {
+	mutex sync.Mutex
+
+	data []byte
+	// start is the index of the oldest byte
+	start int
+	// size is the number of valid bytes
+	size int
+}
+
+// NewRingBuffer creates a RingBuffer that holds at most capacity bytes
+func NewRingBuffer(capacity int) *RingBuffer {
+	return &RingBuffer{
+		data: make([]byte, capacity),
+	}
+}
+
+// Write appends p to the buffer, evicting the oldest data as needed. It never fails.
+func (r *RingBuffer) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	n := len(p)
+	capacity := len(r.data)
+	if capacity == 0 {
+		return n, nil
+	}
+
+	// only the tail of p can survive
+	if len(p) > capacity {
+		p = p[len(p)-capacity:]
+	}
+
+	// evict whatever doesn't fit
+	if overflow := r.size + len(p) - capacity; overflow > 0 {
+		r.start = (r.start + overflow) % capacity
+		r.size -= overflow
+	}
+
+	end := (r.start + r.size) % capacity
+	copied := copy(r.data[end:], p)
+	copy(r.data, p[copied:])
+	r.size += len(p)
+
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered data, oldest first
+func (r *RingBuffer) Bytes() []byte {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	out := make([]byte, r.size)
+	copied := copy(out, r.data[r.start:])
+	if copied < r.size {
+		copy(out[copied:], r.data)
+	}
+
+	return out
+}
+
+// Len returns the number of buffered bytes
+func (r *RingBuffer) Len() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.size
+}
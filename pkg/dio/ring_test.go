@@ -0,0 +1,60 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dio
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingBuffer(t *testing.T) {
+	ring := NewRingBuffer(8)
+
+	if len(ring.Bytes()) != 0 {
+		t.Errorf("Expected empty buffer, got %q", ring.Bytes())
+	}
+
+	ring.Write([]byte("abc"))
+	if string(ring.Bytes()) != "abc" {
+		t.Errorf("Expected abc, got %q", ring.Bytes())
+	}
+
+	// wraps around, evicting the oldest bytes
+	ring.Write([]byte("defghij"))
+	if string(ring.Bytes()) != "cdefghij" {
+		t.Errorf("Expected cdefghij, got %q", ring.Bytes())
+	}
+
+	// a write larger than the buffer keeps only its tail
+	n, err := ring.Write([]byte("0123456789"))
+	if n != 10 || err != nil {
+		t.Errorf("Expected full write, got %d, %s", n, err)
+	}
+	if string(ring.Bytes()) != "23456789" || ring.Len() != 8 {
+		t.Errorf("Expected 23456789, got %q", ring.Bytes())
+	}
+}
+
+func TestRingBufferSmallWrites(t *testing.T) {
+	ring := NewRingBuffer(5)
+
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(ring, "%d", i%10)
+	}
+
+	if string(ring.Bytes()) != "78901" {
+		t.Errorf("Expected 78901, got %q", ring.Bytes())
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flags
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type headers struct {
+	val *map[string]string
+}
+
+func (h *headers) Set(s string) error {
+	i := strings.Index(s, ":")
+	if i <= 0 {
+		return fmt.Errorf("%q is not of the form \"Name: value\"", s)
+	}
+
+	if *h.val == nil {
+		*h.val = make(map[string]string)
+	}
+	(*h.val)[strings.TrimSpace(s[:i])] = strings.TrimSpace(s[i+1:])
+	return nil
+}
+
+func (h *headers) Get() interface{} {
+	return *h.val
+}
+
+func (h *headers) String() string {
+	if h.val == nil {
+		return ""
+	}
+
+	var pairs []string
+	for name, value := range *h.val {
+		pairs = append(pairs, name+": "+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ", ")
+}
+
+// NewHeaders returns a flag.Value implementation that collects "Name: value" pairs, one per
+// occurrence of the flag, into the map
+func NewHeaders(h *map[string]string) flag.Value {
+	return &headers{h}
+}
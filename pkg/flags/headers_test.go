@@ -0,0 +1,43 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package flags
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestHeaders(t *testing.T) {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	var val map[string]string
+
+	fs.Var(NewHeaders(&val), "header", "headers")
+
+	if err := fs.Parse([]string{"-header", "X-Forwarded-For: 10.0.0.1", "-header", "X-Team:vic"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(val) != 2 || val["X-Forwarded-For"] != "10.0.0.1" || val["X-Team"] != "vic" {
+		t.Errorf("unexpected headers %#v", val)
+	}
+
+	if s := fs.Lookup("header").Value.String(); s != "X-Forwarded-For: 10.0.0.1, X-Team: vic" {
+		t.Errorf("unexpected string %q", s)
+	}
+
+	if fs.Lookup("header").Value.Set("no separator") == nil {
+		t.Error("expected error")
+	}
+}
@@ -16,7 +16,9 @@ package extraconfig
 
 import (
 	"encoding/base64"
+	"fmt"
 	"net"
+	"os"
 	"testing"
 	"time"
 
@@ -238,6 +240,82 @@ func TestStructSlice(t *testing.T) {
 	assert.Equal(t, StructSlice, decoded, "Encoded and decoded does not match")
 }
 
+func TestStructPointerSlice(t *testing.T) {
+	type Endpoint struct {
+		Name    string `vic:"0.1" scope:"read-only" key:"name"`
+		Address string `vic:"0.1" scope:"read-only" key:"address"`
+	}
+
+	type Type struct {
+		Endpoints []*Endpoint `vic:"0.1" scope:"read-only" key:"endpoints"`
+	}
+
+	Endpoints := Type{
+		[]*Endpoint{
+			&Endpoint{
+				Name:    "external",
+				Address: "10.17.109.12",
+			},
+			&Endpoint{
+				Name:    "bridge",
+				Address: "172.16.0.2",
+			},
+		},
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), Endpoints)
+
+	expected := map[string]string{
+		visibleRO("endpoints"):           "1",
+		visibleRO("endpoints|0/name"):    "external",
+		visibleRO("endpoints|0/address"): "10.17.109.12",
+		visibleRO("endpoints|1/name"):    "bridge",
+		visibleRO("endpoints|1/address"): "172.16.0.2",
+	}
+	assert.Equal(t, expected, encoded, "Encoded and expected does not match")
+
+	var decoded Type
+	Decode(MapSource(encoded), &decoded)
+
+	assert.Equal(t, Endpoints, decoded, "Encoded and decoded does not match")
+
+	// decoding into a shorter slice grows it and updates the existing elements
+	existing := Type{
+		[]*Endpoint{
+			&Endpoint{
+				Name: "stale",
+			},
+		},
+	}
+	Decode(MapSource(encoded), &existing)
+
+	assert.Equal(t, Endpoints, existing, "Encoded and decoded into existing does not match")
+
+	// the length is authoritative, an element without data keeps its index
+	sparse := map[string]string{
+		visibleRO("endpoints"):           "2",
+		visibleRO("endpoints|2/address"): "172.16.0.3",
+		visibleRO("endpoints|0/name"):    "external",
+	}
+
+	decoded = Type{}
+	Decode(MapSource(sparse), &decoded)
+
+	expectedSparse := Type{
+		[]*Endpoint{
+			&Endpoint{
+				Name: "external",
+			},
+			nil,
+			&Endpoint{
+				Address: "172.16.0.3",
+			},
+		},
+	}
+	assert.Equal(t, expectedSparse, decoded, "Sparse data was not decoded by index")
+}
+
 func TestMultipleScope(t *testing.T) {
 	MultipleScope := struct {
 		MultipleScope string `vic:"0.1" scope:"read-only,hidden,non-persistent" key:"multiscope"`
@@ -496,3 +574,243 @@ func TestInsideOutside(t *testing.T) {
 	assert.Equal(t, outside, decoded, "Encoded and decoded does not match")
 
 }
+
+func TestOptionalPointer(t *testing.T) {
+	type Optional struct {
+		Path  string    `vic:"0.1" scope:"read-only" key:"path"`
+		Count int       `vic:"0.1" scope:"read-only" key:"count"`
+		When  time.Time `vic:"0.1" scope:"read-only" key:"when"`
+	}
+
+	type Type struct {
+		Name     string    `vic:"0.1" scope:"read-only" key:"name"`
+		Optional *Optional `vic:"0.1" scope:"read-only" key:"optional"`
+	}
+
+	set := Type{
+		Name: "set",
+		Optional: &Optional{
+			Path:  "/bin/sh",
+			Count: 3,
+			When:  time.Date(2016, 7, 1, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), set)
+
+	var decoded Type
+	Decode(MapSource(encoded), &decoded)
+
+	assert.Equal(t, set, decoded, "Encoded and decoded does not match")
+
+	unset := Type{
+		Name: "unset",
+	}
+
+	encoded = map[string]string{}
+	Encode(MapSink(encoded), unset)
+
+	expected := map[string]string{
+		visibleRO("name"): "unset",
+	}
+	assert.Equal(t, expected, encoded, "Encoded and expected does not match")
+
+	decoded = Type{}
+	Decode(MapSource(encoded), &decoded)
+
+	assert.Equal(t, unset, decoded, "Encoded and decoded does not match")
+	assert.Nil(t, decoded.Optional, "Optional pointer should not have been allocated")
+}
+
+func TestDecodeReload(t *testing.T) {
+	type Optional struct {
+		Path string `vic:"0.1" scope:"read-only" key:"path"`
+	}
+
+	type Type struct {
+		Name     string    `vic:"0.1" scope:"read-only" key:"name"`
+		Notes    string    `vic:"0.1" scope:"read-only" key:"notes"`
+		Optional *Optional `vic:"0.1" scope:"read-only" key:"optional"`
+	}
+
+	// decoding into the current config, as tether does on reload, replaces the strings that
+	// are no longer there with the empty string
+	current := Type{
+		Name:     "old",
+		Notes:    "stale",
+		Optional: &Optional{Path: "/bin/sh"},
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), Type{Name: "new"})
+
+	Decode(MapSource(encoded), &current)
+
+	assert.Equal(t, "new", current.Name)
+	assert.Equal(t, "", current.Notes)
+	if assert.NotNil(t, current.Optional, "Allocated pointer should be kept") {
+		assert.Equal(t, "", current.Optional.Path)
+	}
+}
+
+func TestDecodeField(t *testing.T) {
+	reference := ExecutorConfig{
+		Common: Common{
+			ID:   "deadbeef",
+			Name: "Executor",
+		},
+		Sessions: map[string]SessionConfig{
+			"Session1": SessionConfig{
+				Common: Common{
+					ID: "SessionID",
+				},
+				Cmd: Cmd{
+					Path: "/vmware",
+					Args: []string{"/bin/imagec", "-standalone"},
+					Env:  []string{"PATH=/bin"},
+				},
+			},
+		},
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), reference)
+
+	// record the keys that are looked up
+	var lookups []string
+	src := func(key string) (string, error) {
+		lookups = append(lookups, key)
+		return MapSource(encoded)(key)
+	}
+
+	// promoted field
+	var decoded ExecutorConfig
+	err := DecodeField(src, &decoded, "Name")
+	assert.NoError(t, err)
+	assert.Equal(t, reference.Name, decoded.Name)
+	assert.Equal(t, []string{visibleRO("common/name")}, lookups, "Only the key of the field should be read")
+	assert.Empty(t, decoded.ID, "Other fields should be untouched")
+	assert.Nil(t, decoded.Sessions, "Other fields should be untouched")
+
+	// explicit path to a nested value
+	err = DecodeField(src, &decoded, "Common", "ID")
+	assert.NoError(t, err)
+	assert.Equal(t, reference.ID, decoded.ID)
+
+	// composite field
+	err = DecodeField(src, &decoded, "Sessions")
+	assert.NoError(t, err)
+	assert.Equal(t, reference.Sessions, decoded.Sessions)
+
+	// no data
+	delete(encoded, visibleRO("common/notes"))
+	err = DecodeField(src, &decoded, "Notes")
+	assert.Equal(t, os.ErrNotExist, err)
+
+	// not a field
+	err = DecodeField(src, &decoded, "Missing")
+	assert.Error(t, err)
+
+	// skipped by the encoder
+	err = DecodeField(src, &decoded, "ExecutionEnvironment")
+	assert.Error(t, err)
+}
+
+func TestDecodeFieldPointer(t *testing.T) {
+	type Optional struct {
+		Path string `vic:"0.1" scope:"read-only" key:"path"`
+		Dir  string `vic:"0.1" scope:"read-only" key:"dir"`
+	}
+
+	type Type struct {
+		Name     string    `vic:"0.1" scope:"read-only" key:"name"`
+		Optional *Optional `vic:"0.1" scope:"read-only" key:"optional"`
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), Type{Optional: &Optional{Path: "/bin/sh"}})
+	delete(encoded, visibleRO("optional/dir"))
+
+	// the pointer isn't allocated when there's nothing to decode into it
+	var decoded Type
+	err := DecodeField(MapSource(encoded), &decoded, "Optional", "Dir")
+	assert.Equal(t, os.ErrNotExist, err)
+	assert.Nil(t, decoded.Optional, "Pointer should not have been allocated")
+
+	err = DecodeField(MapSource(encoded), &decoded, "Optional", "Missing")
+	assert.Error(t, err)
+	assert.Nil(t, decoded.Optional, "Pointer should not have been allocated")
+
+	// but is when there is
+	err = DecodeField(MapSource(encoded), &decoded, "Optional", "Path")
+	assert.NoError(t, err)
+	if assert.NotNil(t, decoded.Optional) {
+		assert.Equal(t, "/bin/sh", decoded.Optional.Path)
+	}
+
+	// and kept for the following fields
+	optional := decoded.Optional
+	encoded[visibleRO("optional/dir")] = "/"
+	err = DecodeField(MapSource(encoded), &decoded, "Optional", "Dir")
+	assert.NoError(t, err)
+	assert.True(t, optional == decoded.Optional, "Allocated pointer should be kept")
+	assert.Equal(t, Optional{Path: "/bin/sh", Dir: "/"}, *decoded.Optional)
+}
+
+func benchmarkConfig() map[string]string {
+	reference := ExecutorConfig{
+		Common: Common{
+			ID:   "deadbeef",
+			Name: "Executor",
+		},
+		Sessions: make(map[string]SessionConfig),
+	}
+
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("Session%d", i)
+		reference.Sessions[id] = SessionConfig{
+			Common: Common{
+				ID:   id,
+				Name: "Session",
+			},
+			Cmd: Cmd{
+				Path: "/bin/sh",
+				Args: []string{"/bin/sh", "-c", "true"},
+				Env:  []string{"PATH=/bin", "HOME=/"},
+				Dir:  "/",
+			},
+		}
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), reference)
+
+	return encoded
+}
+
+func BenchmarkDecode(b *testing.B) {
+	defer func(level log.Level) { DecodeLogLevel = level }(DecodeLogLevel)
+	DecodeLogLevel = log.InfoLevel
+
+	src := MapSource(benchmarkConfig())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var decoded ExecutorConfig
+		Decode(src, &decoded)
+	}
+}
+
+func BenchmarkDecodeField(b *testing.B) {
+	defer func(level log.Level) { DecodeLogLevel = level }(DecodeLogLevel)
+	DecodeLogLevel = log.InfoLevel
+
+	src := MapSource(benchmarkConfig())
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var decoded ExecutorConfig
+		DecodeField(src, &decoded, "Name")
+	}
+}
@@ -38,20 +38,21 @@ var intfDecoders map[reflect.Type]decoder
 
 func init() {
 	kindDecoders = map[reflect.Kind]decoder{
-		reflect.String:  decodeString,
-		reflect.Struct:  decodeStruct,
-		reflect.Slice:   decodeSlice,
-		reflect.Array:   decodeSlice,
-		reflect.Map:     decodeMap,
-		reflect.Ptr:     decodePtr,
-		reflect.Int:     decodePrimitive,
-		reflect.Int8:    decodePrimitive,
-		reflect.Int16:   decodePrimitive,
-		reflect.Int32:   decodePrimitive,
-		reflect.Int64:   decodePrimitive,
-		reflect.Bool:    decodePrimitive,
-		reflect.Float32: decodePrimitive,
-		reflect.Float64: decodePrimitive,
+		reflect.String:    decodeString,
+		reflect.Struct:    decodeStruct,
+		reflect.Slice:     decodeSlice,
+		reflect.Array:     decodeSlice,
+		reflect.Map:       decodeMap,
+		reflect.Ptr:       decodePtr,
+		reflect.Interface: decodeInterface,
+		reflect.Int:       decodePrimitive,
+		reflect.Int8:      decodePrimitive,
+		reflect.Int16:     decodePrimitive,
+		reflect.Int32:     decodePrimitive,
+		reflect.Int64:     decodePrimitive,
+		reflect.Bool:      decodePrimitive,
+		reflect.Float32:   decodePrimitive,
+		reflect.Float64:   decodePrimitive,
 	}
 
 	intfDecoders = map[reflect.Type]decoder{
@@ -128,29 +129,28 @@ func decodePtr(src DataSource, dest reflect.Value, prefix string, depth recursio
 	// value representing the run-time data
 	log.Debugf("Decoding pointer into object: %#v", dest)
 
-	// if the pointer is nil we need to create the destination type
-	var target reflect.Value
+	// a nil pointer is only allocated if there's data for what it points to, otherwise
+	// it remains nil
 	if dest.IsNil() {
-		target = reflect.New(dest.Type().Elem())
-	} else {
-		target = dest.Elem()
-	}
+		var found bool
+		target := reflect.New(dest.Type().Elem())
+
+		result := decode(probe(src, &found), target.Elem(), prefix, depth)
+		if !found || !result.IsValid() {
+			return dest
+		}
+		log.Debugf("target is now %#v, %+q ", result, result.Type())
 
-	// check to see if the resulting object is not nil
-	// If it is nil, then there was nothing to decode and the pointer remains nil
-	result := decode(src, target, prefix, depth)
-	log.Debugf("target is now %#v, %+q ", target, target.Type())
-	kind := result.Kind()
-	if kind == reflect.Ptr {
-		return result
+		target.Elem().Set(result)
+		return target
 	}
 
-	if result == reflect.Zero(dest.Type()) || !result.IsValid() {
-		// leave the pointer as nil if the result is zero type or invalid
+	result := decode(src, dest.Elem(), prefix, depth)
+	if !result.IsValid() {
 		return dest
 	}
+	log.Debugf("target is now %#v, %+q ", result, result.Type())
 
-	// neither pointer, nor zero
 	// NOTE: if the returned result is not addressable this can panic - that generally
 	// indicates an incorrect implementation of a decodeX method... those should always
 	// return addressable Values. See decodeByteSlice as an example - this uses make([]byte)
@@ -160,6 +160,17 @@ func decodePtr(src DataSource, dest reflect.Value, prefix string, depth recursio
 	return dest
 }
 
+// probe wraps the data source so that found records whether any key was found in it
+func probe(src DataSource, found *bool) DataSource {
+	return func(key string) (string, error) {
+		value, err := src(key)
+		if err == nil {
+			*found = true
+		}
+		return value, err
+	}
+}
+
 var typeType = reflect.TypeOf((*reflect.Type)(nil)).Elem()
 
 func decodeStruct(src DataSource, dest reflect.Value, prefix string, depth recursion) reflect.Value {
@@ -261,18 +272,17 @@ func decodeSlice(src DataSource, dest reflect.Value, prefix string, depth recurs
 		length = int(lengthValue.Int()) + 1
 	}
 
-	var this reflect.Value
-	if !dest.IsValid() || dest.IsNil() {
-		log.Debugf("Making new slice for %s", prefix)
-		this = reflect.MakeSlice(dest.Type(), length, length)
-	} else {
-		this = dest
-		this.SetLen(length)
-		curLen = this.Len()
+	log.Debugf("Making new slice for %s", prefix)
+	this := reflect.MakeSlice(dest.Type(), length, length)
+	if dest.IsValid() && !dest.IsNil() {
+		// the existing elements are the current values for the decode
+		curLen = reflect.Copy(this, dest)
 	}
 
 	// determine the key given the array type
-	if kind == reflect.Struct {
+	if indexedElem(dest.Type().Elem()) {
+		// the length is authoritative, elements without any data decode as zero values
+		// so that the indices of the others are preserved
 		for i := 0; i < length; i++ {
 			// convert key to name|index format
 			key := fmt.Sprintf("%s|%d", prefix, i)
@@ -433,25 +443,137 @@ type DataSource func(string) (string, error)
 
 // Decode populates a destination with data from the supplied data source
 func Decode(src DataSource, dest interface{}) interface{} {
-	defer log.SetLevel(log.GetLevel())
-	log.SetLevel(DecodeLogLevel)
+	defer setLogLevel(DecodeLogLevel)()
 
 	value := decode(src, reflect.ValueOf(dest), DefaultPrefix, Unbounded)
 
+	// nothing was decoded, leave the destination untouched
+	if !value.IsValid() {
+		return dest
+	}
+
 	return value.Interface()
 }
 
 // DecodeWithPrefix populates a destination with data from the supplied data source, using
 // the specified prefix - this allows for decode into substructres.
 func DecodeWithPrefix(src DataSource, dest interface{}, prefix string) interface{} {
-	defer log.SetLevel(log.GetLevel())
-	log.SetLevel(DecodeLogLevel)
+	defer setLogLevel(DecodeLogLevel)()
 
 	value := decode(src, reflect.ValueOf(dest), prefix, Unbounded)
 
+	// nothing was decoded, leave the destination untouched
+	if !value.IsValid() {
+		return dest
+	}
+
 	return value.Interface()
 }
 
+// indirect follows pointers, allocating the targets of nil ones
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// DecodeField populates just the field of dest identified by path, a sequence of struct field
+// names, with data from the supplied data source. The keys are calculated exactly as Decode
+// does, so only the keys that a full decode would read for that field are consulted.
+// dest must be a non-nil pointer, nil pointers along the path are allocated only if there is
+// data for the field and dest is left untouched on error.
+// os.ErrNotExist is returned if there was no data for the field.
+func DecodeField(src DataSource, dest interface{}, path ...string) error {
+	defer setLogLevel(DecodeLogLevel)()
+
+	this := reflect.ValueOf(dest)
+	if this.Kind() != reflect.Ptr || this.IsNil() {
+		return fmt.Errorf("destination must be a non-nil pointer, got %T", dest)
+	}
+	this = this.Elem()
+
+	// the path is resolved on the types so that dest is left untouched if there's no data
+	prefix := DefaultPrefix
+	depth := Unbounded
+	t := this.Type()
+	var fields []int
+	for _, name := range path {
+		t = indirectType(t)
+		if t.Kind() != reflect.Struct {
+			return fmt.Errorf("cannot look up field %s in %s", name, t)
+		}
+
+		sf, ok := t.FieldByName(name)
+		if !ok {
+			return fmt.Errorf("no field %s in %s", name, t)
+		}
+
+		// promoted fields are reached through their embedding fields
+		for _, i := range sf.Index {
+			if t.Kind() == reflect.Ptr && !depth.follow {
+				return fmt.Errorf("field %s is not encoded", name)
+			}
+			t = indirectType(t)
+
+			field := t.Field(i)
+			prefix, depth = calculateKeyFromField(field, prefix, depth)
+			if prefix == "" || depth.depth == 0 {
+				return fmt.Errorf("field %s is not encoded", field.Name)
+			}
+			t = field.Type
+			fields = append(fields, i)
+		}
+	}
+
+	log.Debugf("Decoding field %s from key %s", strings.Join(path, "."), prefix)
+
+	// as with pointers in decodePtr, the existing field is decoded into if it's there and
+	// the nil pointers on the way to it are only allocated once there's data
+	target, ok := fieldByIndex(this, fields)
+	if !ok {
+		target = reflect.New(t).Elem()
+	}
+
+	var found bool
+	result := decode(probe(src, &found), target, prefix, depth)
+	if !found || !result.IsValid() {
+		return os.ErrNotExist
+	}
+
+	for _, i := range fields {
+		this = indirect(this).Field(i)
+	}
+	this.Set(result)
+	return nil
+}
+
+// indirectType returns the type that t points to through any number of pointers
+func indirectType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t
+}
+
+// fieldByIndex returns the field reached through the field indices, following pointers as
+// indirect does. It's false if a nil pointer is in the way.
+func fieldByIndex(v reflect.Value, fields []int) (reflect.Value, bool) {
+	for _, i := range fields {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
 // MapSource takes a key/value map and uses that as the datasource for decoding into
 // target structures
 func MapSource(src map[string]string) DataSource {
@@ -44,4 +44,8 @@ type Example struct {
 	Time time.Time `vic:"0.1" scope:"volatile" key:"time,omitnested"`
 }
 
+Interface fields are encoded along with the name of the concrete type they hold, under the key of the field
+with TypeKeySuffix appended. The concrete types have to be registered with RegisterType so that the decoder
+can instantiate them - values of unregistered types are skipped.
+
 */
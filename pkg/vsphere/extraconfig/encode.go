@@ -33,6 +33,21 @@ var (
 	EncodeLogLevel = log.InfoLevel
 )
 
+// setLogLevel sets the log level for the duration of an encode or decode and returns the function
+// that restores the previous one. The level is left alone if it's already the one wanted so that
+// concurrent calls don't race on it.
+func setLogLevel(level log.Level) func() {
+	previous := log.GetLevel()
+	if previous == level {
+		return func() {}
+	}
+
+	log.SetLevel(level)
+	return func() {
+		log.SetLevel(previous)
+	}
+}
+
 type encoder func(sink DataSink, src reflect.Value, prefix string, depth recursion)
 
 var kindEncoders map[reflect.Kind]encoder
@@ -40,20 +55,21 @@ var intfEncoders map[reflect.Type]encoder
 
 func init() {
 	kindEncoders = map[reflect.Kind]encoder{
-		reflect.String:  encodeString,
-		reflect.Struct:  encodeStruct,
-		reflect.Slice:   encodeSlice,
-		reflect.Array:   encodeSlice,
-		reflect.Map:     encodeMap,
-		reflect.Ptr:     encodePtr,
-		reflect.Int:     encodePrimitive,
-		reflect.Int8:    encodePrimitive,
-		reflect.Int16:   encodePrimitive,
-		reflect.Int32:   encodePrimitive,
-		reflect.Int64:   encodePrimitive,
-		reflect.Bool:    encodePrimitive,
-		reflect.Float32: encodePrimitive,
-		reflect.Float64: encodePrimitive,
+		reflect.String:    encodeString,
+		reflect.Struct:    encodeStruct,
+		reflect.Slice:     encodeSlice,
+		reflect.Array:     encodeSlice,
+		reflect.Map:       encodeMap,
+		reflect.Ptr:       encodePtr,
+		reflect.Interface: encodeInterface,
+		reflect.Int:       encodePrimitive,
+		reflect.Int8:      encodePrimitive,
+		reflect.Int16:     encodePrimitive,
+		reflect.Int32:     encodePrimitive,
+		reflect.Int64:     encodePrimitive,
+		reflect.Bool:      encodePrimitive,
+		reflect.Float32:   encodePrimitive,
+		reflect.Float64:   encodePrimitive,
 	}
 
 	intfEncoders = map[reflect.Type]encoder{
@@ -156,7 +172,7 @@ func encodeSlice(sink DataSink, src reflect.Value, prefix string, depth recursio
 		encode(sink, reflect.ValueOf(str), prefix, depth)
 		return
 
-	} else if kind != reflect.Struct {
+	} else if !indexedElem(src.Type().Elem()) {
 		// else assume it's primitive - we'll panic/recover and continue it not
 		defer func() {
 			if err := recover(); err != nil {
@@ -191,6 +207,17 @@ func encodeSlice(sink DataSink, src reflect.Value, prefix string, depth recursio
 	}
 }
 
+// indexedElem reports whether the slice elements of type t are encoded under their own name|index
+// prefixed keys rather than joined into a single value. That's the case for structs, pointers to
+// them and interfaces.
+func indexedElem(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	return t.Kind() == reflect.Struct || t.Kind() == reflect.Interface
+}
+
 func encodeMap(sink DataSink, src reflect.Value, prefix string, depth recursion) {
 	log.Debugf("Encoding object: %#v", src)
 
@@ -250,8 +277,7 @@ type DataSink func(string, string) error
 
 // Encode serializes the given type to the supplied data sink
 func Encode(sink DataSink, src interface{}) {
-	defer log.SetLevel(log.GetLevel())
-	log.SetLevel(EncodeLogLevel)
+	defer setLogLevel(EncodeLogLevel)()
 
 	encode(sink, reflect.ValueOf(src), DefaultPrefix, Unbounded)
 }
@@ -260,8 +286,7 @@ func Encode(sink DataSink, src interface{}) {
 // the supplied prefix - this allows for serialization of subsections of a
 // struct
 func EncodeWithPrefix(sink DataSink, src interface{}, prefix string) {
-	defer log.SetLevel(log.GetLevel())
-	log.SetLevel(EncodeLogLevel)
+	defer setLogLevel(EncodeLogLevel)()
 
 	encode(sink, reflect.ValueOf(src), prefix, Unbounded)
 }
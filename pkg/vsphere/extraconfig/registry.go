@@ -0,0 +1,137 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extraconfig
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TypeKeySuffix is appended to the key of an interface field to form the key that records the
+// registered name of the concrete type it holds
+const TypeKeySuffix = "~type"
+
+// registry maps the registered names to the factories of the concrete types and back
+var registry = struct {
+	sync.RWMutex
+
+	factories map[string]func() interface{}
+	names     map[reflect.Type]string
+}{
+	factories: make(map[string]func() interface{}),
+	names:     make(map[reflect.Type]string),
+}
+
+// RegisterType makes the concrete type returned by factory available to interface fields under
+// name. The name is encoded next to the value so that the decoder can instantiate the same type
+// with factory, which must return a new zero value each time. Registering the same name or type
+// twice panics as the encoded data would be ambiguous.
+func RegisterType(name string, factory func() interface{}) {
+	t := reflect.TypeOf(factory())
+	if t == nil {
+		panic(fmt.Sprintf("extraconfig: factory for %s returns nil", name))
+	}
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	if _, ok := registry.factories[name]; ok {
+		panic(fmt.Sprintf("extraconfig: type name %s registered twice", name))
+	}
+	if other, ok := registry.names[t]; ok {
+		panic(fmt.Sprintf("extraconfig: type %s registered as %s and %s", t, other, name))
+	}
+
+	registry.factories[name] = factory
+	registry.names[t] = name
+}
+
+// registeredName returns the name the concrete type is registered under
+func registeredName(t reflect.Type) (string, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	name, ok := registry.names[t]
+	return name, ok
+}
+
+// registeredFactory returns the factory registered under name
+func registeredFactory(name string) (func() interface{}, bool) {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	factory, ok := registry.factories[name]
+	return factory, ok
+}
+
+// encodeInterface records the registered name of the concrete type before encoding the value
+// itself under the same prefix
+func encodeInterface(sink DataSink, src reflect.Value, prefix string, depth recursion) {
+	if src.IsNil() {
+		return
+	}
+
+	elem := src.Elem()
+	name, ok := registeredName(elem.Type())
+	if !ok {
+		log.Debugf("Skipping field with unregistered type %s for key %s", elem.Type(), prefix)
+		return
+	}
+
+	key := prefix + TypeKeySuffix
+	if err := sink(key, name); err != nil {
+		log.Errorf("Failed to encode type name for key %s: %s", key, err)
+		return
+	}
+
+	encode(sink, elem, prefix, depth)
+}
+
+// decodeInterface instantiates the registered type recorded for the prefix and decodes into it.
+// The current value is decoded into instead if it's already of that type.
+func decodeInterface(src DataSource, dest reflect.Value, prefix string, depth recursion) reflect.Value {
+	key := prefix + TypeKeySuffix
+	name, err := src(key)
+	if err != nil || name == "" {
+		log.Debugf("No type name found in data source for interface at key \"%s\"", key)
+		return reflect.Value{}
+	}
+
+	factory, ok := registeredFactory(name)
+	if !ok {
+		log.Errorf("Unable to decode key %s: type %s isn't registered", prefix, name)
+		return reflect.Value{}
+	}
+
+	this := reflect.ValueOf(factory())
+	if !this.Type().AssignableTo(dest.Type()) {
+		log.Errorf("Unable to decode key %s: type %s (%s) doesn't implement %s", prefix, name, this.Type(), dest.Type())
+		return reflect.Value{}
+	}
+
+	if dest.IsValid() && !dest.IsNil() && dest.Elem().Type() == this.Type() {
+		this = dest.Elem()
+	}
+
+	// the type name alone is enough for a value without any data of its own
+	if result := decode(src, this, prefix, depth); result.IsValid() {
+		this = result
+	}
+
+	return this
+}
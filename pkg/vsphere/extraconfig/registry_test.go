@@ -0,0 +1,119 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extraconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type Endpoint interface {
+	Address() string
+}
+
+type StaticEndpoint struct {
+	IP string `vic:"0.1" scope:"read-only" key:"ip"`
+}
+
+func (e StaticEndpoint) Address() string {
+	return e.IP
+}
+
+type DHCPEndpoint struct {
+	Hostname string `vic:"0.1" scope:"read-only" key:"hostname"`
+	Lease    int    `vic:"0.1" scope:"read-only" key:"lease"`
+}
+
+func (e *DHCPEndpoint) Address() string {
+	return e.Hostname
+}
+
+type Endpoints struct {
+	Primary Endpoint            `vic:"0.1" scope:"read-only" key:"primary"`
+	Missing Endpoint            `vic:"0.1" scope:"read-only" key:"missing"`
+	Others  []Endpoint          `vic:"0.1" scope:"read-only" key:"others"`
+	ByName  map[string]Endpoint `vic:"0.1" scope:"read-only" key:"byname"`
+}
+
+func init() {
+	RegisterType("static", func() interface{} { return StaticEndpoint{} })
+	RegisterType("dhcp", func() interface{} { return &DHCPEndpoint{} })
+}
+
+func TestInterfaceRoundTrip(t *testing.T) {
+	src := Endpoints{
+		Primary: StaticEndpoint{IP: "10.0.0.1"},
+		Others: []Endpoint{
+			&DHCPEndpoint{Hostname: "foo", Lease: 3600},
+			StaticEndpoint{IP: "10.0.0.2"},
+		},
+		ByName: map[string]Endpoint{
+			"bar": &DHCPEndpoint{Hostname: "bar"},
+		},
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), src)
+
+	assert.Equal(t, "static", encoded["guestinfo./primary"+TypeKeySuffix], "the concrete type is recorded")
+	assert.NotContains(t, encoded, "guestinfo./missing"+TypeKeySuffix, "nil interfaces aren't encoded")
+
+	var dest Endpoints
+	Decode(MapSource(encoded), &dest)
+
+	assert.Equal(t, src, dest, "Encoded and decoded does not match")
+}
+
+func TestInterfaceDecodeExisting(t *testing.T) {
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), Endpoints{Primary: &DHCPEndpoint{Hostname: "foo"}})
+
+	// a value of the recorded type is decoded into
+	current := &DHCPEndpoint{Hostname: "old", Lease: 60}
+	dest := Endpoints{Primary: current}
+	Decode(MapSource(encoded), &dest)
+
+	assert.True(t, dest.Primary == Endpoint(current), "the current value was replaced")
+	assert.Equal(t, &DHCPEndpoint{Hostname: "foo"}, dest.Primary)
+
+	// a value of another type is replaced
+	dest = Endpoints{Primary: StaticEndpoint{IP: "10.0.0.1"}}
+	Decode(MapSource(encoded), &dest)
+
+	assert.Equal(t, &DHCPEndpoint{Hostname: "foo"}, dest.Primary)
+}
+
+func TestInterfaceUnregistered(t *testing.T) {
+	type unregistered struct {
+		StaticEndpoint
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), Endpoints{Primary: unregistered{}})
+
+	assert.Empty(t, encoded, "a value of an unregistered type is skipped")
+
+	encoded["guestinfo./primary"+TypeKeySuffix] = "unknown"
+
+	var dest Endpoints
+	Decode(MapSource(encoded), &dest)
+
+	assert.Nil(t, dest.Primary, "an unknown type name isn't decoded")
+
+	assert.Panics(t, func() {
+		RegisterType("static", func() interface{} { return &StaticEndpoint{} })
+	}, "a name can't be registered twice")
+}
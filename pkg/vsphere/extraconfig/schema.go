@@ -0,0 +1,168 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extraconfig
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SchemaKey is the key that holds the schema of the encoded type. It's visible to the guest
+// so that it can be checked before decoding.
+var SchemaKey = calculateKey([]string{"read-only"}, DefaultPrefix, "schema")
+
+// Schema returns the layout of the data that encoding src produces - every key, with map keys
+// and slice indices replaced by *, and the kind of value stored under it. It's derived from
+// the definition of the type alone, so any change to the layout of the encoded data shows up.
+func Schema(src interface{}) string {
+	defer setLogLevel(EncodeLogLevel)()
+
+	layout := schemaLayout(src)
+
+	entries := make([]string, 0, len(layout))
+	for key, kind := range layout {
+		entries = append(entries, key+"="+kind)
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, ",")
+}
+
+// schemaLayout maps the keys that encoding src produces to the kind of value stored under them
+func schemaLayout(src interface{}) map[string]string {
+	layout := make(map[string]string)
+	writeSchema(layout, reflect.TypeOf(src), DefaultPrefix, Unbounded, make(map[reflect.Type]bool))
+
+	return layout
+}
+
+// writeSchema records the keys that the encoder produces for type t under prefix, following
+// the same recursion rules as encode
+func writeSchema(layout map[string]string, t reflect.Type, prefix string, depth recursion, seen map[reflect.Type]bool) {
+	if depth.depth == 0 {
+		return
+	}
+	depth.depth--
+
+	// types with a dedicated encoder are opaque
+	if _, ok := intfEncoders[t]; ok {
+		layout[prefix] = t.String()
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		if depth.follow {
+			writeSchema(layout, t.Elem(), prefix, depth, seen)
+		}
+	case reflect.Slice, reflect.Array:
+		elem := t.Elem()
+		if elem.Kind() == reflect.Uint8 {
+			layout[prefix] = "bytes"
+			return
+		}
+
+		if indexedElem(elem) {
+			writeSchema(layout, elem, prefix+"|*", depth, seen)
+		} else {
+			layout[prefix+"~"] = "[]" + wireKind(elem.Kind())
+		}
+		layout[prefix] = "length"
+	case reflect.Map:
+		layout[prefix] = "keys"
+		writeSchema(layout, t.Elem(), prefix+"|*", depth, seen)
+	case reflect.Interface:
+		// the concrete type is only known from the data
+		layout[prefix+TypeKeySuffix] = "type"
+	case reflect.Struct:
+		// recursive types can only be encoded as deep as the data goes
+		if seen[t] {
+			return
+		}
+		seen[t] = true
+		defer delete(seen, t)
+
+		for i := 0; i < t.NumField(); i++ {
+			key, fdepth := calculateKeyFromField(t.Field(i), prefix, depth)
+			if key == "" {
+				continue
+			}
+
+			writeSchema(layout, t.Field(i).Type, key, fdepth, seen)
+		}
+	default:
+		if _, ok := kindEncoders[t.Kind()]; ok {
+			layout[prefix] = wireKind(t.Kind())
+		}
+	}
+}
+
+// wireKind returns the kind of value as it's represented in the encoded data, where the
+// sizes of numbers make no difference
+func wireKind(kind reflect.Kind) string {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	default:
+		return kind.String()
+	}
+}
+
+// EncodeSchema records the schema of src in the sink, so that the decoding side can verify
+// that the data is laid out as it expects
+func EncodeSchema(sink DataSink, src interface{}) error {
+	return sink(SchemaKey, Schema(src))
+}
+
+// CheckSchema verifies that the data in src can be decoded into the type of expected. Keys
+// that are only known to one side are tolerated so that fields can be added, but an error is
+// returned if a key is encoded as a different kind of value than the decoder expects. Data
+// without a schema predates it and is accepted with a warning.
+func CheckSchema(src DataSource, expected interface{}) error {
+	encoded, err := src(SchemaKey)
+	if err != nil || encoded == "" {
+		log.Warnf("No schema found under %s, assuming %T was encoded by an older version", SchemaKey, expected)
+		return nil
+	}
+
+	defer setLogLevel(DecodeLogLevel)()
+
+	layout := schemaLayout(expected)
+
+	var mismatched []string
+	for _, entry := range strings.Split(encoded, ",") {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		if kind, ok := layout[parts[0]]; ok && kind != parts[1] {
+			mismatched = append(mismatched, fmt.Sprintf("%s (encoded as %s, expected %s)", parts[0], parts[1], kind))
+		}
+	}
+
+	if len(mismatched) > 0 {
+		return fmt.Errorf("schema mismatch for %T - encoder and decoder are built from different versions: %s", expected, strings.Join(mismatched, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package extraconfig
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchema(t *testing.T) {
+	type Type struct {
+		ID   string `vic:"0.1" scope:"read-only" key:"id"`
+		Name string `vic:"0.1" scope:"read-only" key:"name"`
+	}
+
+	type Renamed struct {
+		ID   string `vic:"0.1" scope:"read-only" key:"id"`
+		Name string `vic:"0.1" scope:"read-only" key:"title"`
+	}
+
+	assert.Equal(t, Schema(Type{}), Schema(Type{ID: "different values"}), "Schema should only depend on the definition")
+	assert.NotEqual(t, Schema(Type{}), Schema(Renamed{}), "Schema should change with the keys")
+
+	// recursive and complex types must not loop forever
+	assert.NotEmpty(t, Schema(ExecutorConfigPointers{}))
+}
+
+func TestCheckSchema(t *testing.T) {
+	type Type struct {
+		ID   string `vic:"0.1" scope:"read-only" key:"id"`
+		Name string `vic:"0.1" scope:"read-only" key:"name"`
+	}
+
+	type Extended struct {
+		ID    string   `vic:"0.1" scope:"read-only" key:"id"`
+		Name  string   `vic:"0.1" scope:"read-only" key:"name"`
+		Added []string `vic:"0.1" scope:"read-only" key:"added"`
+	}
+
+	type Retyped struct {
+		ID   string `vic:"0.1" scope:"read-only" key:"id"`
+		Name int    `vic:"0.1" scope:"read-only" key:"name"`
+	}
+
+	encoded := map[string]string{}
+	Encode(MapSink(encoded), Type{})
+	EncodeSchema(MapSink(encoded), Type{})
+
+	assert.NoError(t, CheckSchema(MapSource(encoded), Type{}))
+	assert.NoError(t, CheckSchema(MapSource(encoded), Extended{}), "Added fields should be accepted")
+	assert.Error(t, CheckSchema(MapSource(encoded), Retyped{}), "Retyped fields should be rejected")
+
+	delete(encoded, SchemaKey)
+	assert.NoError(t, CheckSchema(MapSource(encoded), Retyped{}), "Data without a schema should be accepted")
+}
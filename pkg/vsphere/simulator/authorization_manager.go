@@ -0,0 +1,317 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"sync"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// The ids of the system roles, as assigned by vSphere
+const (
+	AdminRoleID    = int32(-1)
+	ReadOnlyRoleID = int32(-2)
+	ViewRoleID     = int32(-3)
+	NoAccessRoleID = int32(-5)
+)
+
+// AuthorizationManager keeps the permissions set on the entities. The permissions are only
+// enforced by the CheckPrivileges middleware, without it every method is allowed.
+type AuthorizationManager struct {
+	mo.AuthorizationManager
+
+	// Strict denies the privileges to a user without a permission on the entity. By default
+	// such a user is granted everything, so that only the users with a permission are limited.
+	Strict bool
+
+	m           sync.Mutex
+	permissions map[types.ManagedObjectReference][]types.Permission
+}
+
+func NewAuthorizationManager(ref types.ManagedObjectReference) object.Reference {
+	m := &AuthorizationManager{
+		permissions: make(map[types.ManagedObjectReference][]types.Permission),
+	}
+	m.Self = ref
+
+	role := func(id int32, name string, privileges ...string) types.AuthorizationRole {
+		return types.AuthorizationRole{
+			RoleId:    id,
+			System:    true,
+			Name:      name,
+			Info:      &types.Description{Label: name, Summary: name},
+			Privilege: privileges,
+		}
+	}
+
+	m.RoleList = []types.AuthorizationRole{
+		role(AdminRoleID, "Admin"),
+		role(ReadOnlyRoleID, "ReadOnly", "System.Anonymous", "System.Read", "System.View"),
+		role(ViewRoleID, "View", "System.Anonymous", "System.View"),
+		role(NoAccessRoleID, "NoAccess"),
+	}
+
+	return m
+}
+
+func (m *AuthorizationManager) AddAuthorizationRole(req *types.AddAuthorizationRole) soap.HasFault {
+	body := &methods.AddAuthorizationRoleBody{}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	id := int32(1)
+	for _, role := range m.RoleList {
+		if role.Name == req.Name {
+			body.Fault_ = Fault("", &types.AlreadyExists{Name: req.Name})
+			return body
+		}
+		if role.RoleId >= id {
+			id = role.RoleId + 1
+		}
+	}
+
+	m.RoleList = append(m.RoleList, types.AuthorizationRole{
+		RoleId:    id,
+		Name:      req.Name,
+		Info:      &types.Description{Label: req.Name, Summary: req.Name},
+		Privilege: req.PrivIds,
+	})
+
+	body.Res = &types.AddAuthorizationRoleResponse{
+		Returnval: id,
+	}
+
+	return body
+}
+
+// roleExists returns true if there's a role with the id, m.m must be held
+func (m *AuthorizationManager) roleExists(id int32) bool {
+	for _, role := range m.RoleList {
+		if role.RoleId == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetEntityPermissions sets the permissions on the entity, replacing those of the same principals
+func (m *AuthorizationManager) SetEntityPermissions(req *types.SetEntityPermissions) soap.HasFault {
+	body := &methods.SetEntityPermissionsBody{}
+
+	if Map.Get(req.Entity) == nil {
+		body.Fault_ = Fault("", &types.ManagedObjectNotFound{Obj: req.Entity})
+		return body
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	for _, p := range req.Permission {
+		if !m.roleExists(p.RoleId) {
+			body.Fault_ = Fault("", &types.NotFound{})
+			return body
+		}
+	}
+
+	permissions := m.permissions[req.Entity]
+	for _, p := range req.Permission {
+		p.Entity = &req.Entity
+		permissions = append(removePermission(permissions, p.Principal, p.Group), p)
+	}
+	m.permissions[req.Entity] = permissions
+
+	body.Res = &types.SetEntityPermissionsResponse{}
+
+	return body
+}
+
+// removePermission returns a copy of permissions without the one for the principal
+func removePermission(permissions []types.Permission, principal string, group bool) []types.Permission {
+	var res []types.Permission
+
+	for _, p := range permissions {
+		if p.Principal != principal || p.Group != group {
+			res = append(res, p)
+		}
+	}
+
+	return res
+}
+
+func (m *AuthorizationManager) RemoveEntityPermission(req *types.RemoveEntityPermission) soap.HasFault {
+	body := &methods.RemoveEntityPermissionBody{}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	permissions := m.permissions[req.Entity]
+	remaining := removePermission(permissions, req.User, req.IsGroup)
+	if len(remaining) == len(permissions) {
+		body.Fault_ = Fault("", &types.NotFound{})
+		return body
+	}
+	m.permissions[req.Entity] = remaining
+
+	body.Res = &types.RemoveEntityPermissionResponse{}
+
+	return body
+}
+
+// RetrieveEntityPermissions returns the permissions set on the entity and, if inherited is set,
+// those propagated to it from its ancestors
+func (m *AuthorizationManager) RetrieveEntityPermissions(req *types.RetrieveEntityPermissions) soap.HasFault {
+	body := &methods.RetrieveEntityPermissionsBody{}
+
+	if Map.Get(req.Entity) == nil {
+		body.Fault_ = Fault("", &types.ManagedObjectNotFound{Obj: req.Entity})
+		return body
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	permissions := append([]types.Permission(nil), m.permissions[req.Entity]...)
+
+	if req.Inherited {
+		for ref := entityParent(req.Entity); ref != nil; ref = entityParent(*ref) {
+			for _, p := range m.permissions[*ref] {
+				if p.Propagate {
+					permissions = append(permissions, p)
+				}
+			}
+		}
+	}
+
+	body.Res = &types.RetrieveEntityPermissionsResponse{
+		Returnval: permissions,
+	}
+
+	return body
+}
+
+func (m *AuthorizationManager) RetrieveAllPermissions(*types.RetrieveAllPermissions) soap.HasFault {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	var permissions []types.Permission
+	for _, p := range m.permissions {
+		permissions = append(permissions, p...)
+	}
+
+	return &methods.RetrieveAllPermissionsBody{
+		Res: &types.RetrieveAllPermissionsResponse{
+			Returnval: permissions,
+		},
+	}
+}
+
+// HasPrivilegeOnEntity checks the privileges of the user of the session on the entity. Only the
+// current session is known to the simulator, the privileges of any other are denied.
+func (m *AuthorizationManager) HasPrivilegeOnEntity(req *types.HasPrivilegeOnEntity) soap.HasFault {
+	session := currentSession()
+
+	res := make([]bool, len(req.PrivId))
+	if session != nil && session.Key == req.SessionId {
+		for i, id := range req.PrivId {
+			res[i] = m.HasPrivilege(session.UserName, req.Entity, id)
+		}
+	}
+
+	return &methods.HasPrivilegeOnEntityBody{
+		Res: &types.HasPrivilegeOnEntityResponse{
+			Returnval: res,
+		},
+	}
+}
+
+// HasPrivilege returns true if the principal holds the privilege on the entity, by a permission
+// on the entity itself or one propagated from the closest ancestor with a permission for it
+func (m *AuthorizationManager) HasPrivilege(principal string, entity types.ManagedObjectReference, privilege string) bool {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	id, ok := m.effectiveRole(principal, entity)
+	if !ok {
+		return !m.Strict
+	}
+
+	if id == AdminRoleID {
+		return true
+	}
+
+	for _, role := range m.RoleList {
+		if role.RoleId != id {
+			continue
+		}
+		for _, p := range role.Privilege {
+			if p == privilege {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// effectiveRole returns the role of the principal on the entity, m.m must be held
+func (m *AuthorizationManager) effectiveRole(principal string, entity types.ManagedObjectReference) (int32, bool) {
+	ref := &entity
+
+	for inherited := false; ref != nil; inherited = true {
+		for _, p := range m.permissions[*ref] {
+			if p.Principal == principal && !p.Group && (p.Propagate || !inherited) {
+				return p.RoleId, true
+			}
+		}
+
+		ref = entityParent(*ref)
+	}
+
+	return 0, false
+}
+
+// entityParent returns the parent of the entity, nil if it has none or isn't an entity
+func entityParent(ref types.ManagedObjectReference) *types.ManagedObjectReference {
+	if e, ok := Map.Get(ref).(mo.Entity); ok {
+		return e.Entity().Parent
+	}
+
+	return nil
+}
+
+// currentSession returns the session of the user that logged in last, nil if there's none
+func currentSession() *types.UserSession {
+	si, ok := Map.Get(serviceInstance).(*ServiceInstance)
+	if !ok || si.Content.SessionManager == nil {
+		return nil
+	}
+
+	sm, ok := Map.Get(*si.Content.SessionManager).(*SessionManager)
+	if !ok {
+		return nil
+	}
+
+	sm.m.Lock()
+	defer sm.m.Unlock()
+
+	return sm.CurrentSession
+}
@@ -0,0 +1,150 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestAuthorizationManager(t *testing.T) {
+	content := esx.ServiceContent
+	s := New(NewServiceInstance(content, esx.RootFolder))
+	s.Use(CheckPrivileges(MethodPrivileges))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ts.URL.User = url.UserPassword("user", "pass")
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the fault detail isn't typed on the wire, the denial is told by its message
+	denied := func(err error) bool {
+		return err != nil && strings.Contains(err.Error(), "Permission to perform this operation was denied")
+	}
+
+	// without permissions everything is allowed
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{Name: "foo"})
+
+	am := object.NewAuthorizationManager(client.Client)
+
+	err = am.SetEntityPermissions(ctx, vm.Reference(), []types.Permission{
+		{Principal: "user", RoleId: ReadOnlyRoleID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = vm.PowerOn(ctx); !denied(err) {
+		t.Errorf("expected PowerOn to be denied, got %v", err)
+	}
+
+	// the fault names the privilege that's missing
+	res := s.handler()(ctx, &Method{
+		Name: "PowerOnVM_Task",
+		This: vm.Reference(),
+		Body: &types.PowerOnVM_Task{This: vm.Reference()},
+	})
+	if f, ok := res.Fault().Detail.Fault.(*types.NoPermission); !ok || f.PrivilegeId != "VirtualMachine.Interact.PowerOn" || f.Object != vm.Reference() {
+		t.Errorf("unexpected fault %#v", res.Fault().Detail.Fault)
+	}
+
+	// a custom role granted on the datacenter propagates to the VM once its own permission is gone
+	role, err := methods.AddAuthorizationRole(ctx, client.Client, &types.AddAuthorizationRole{
+		This:    *content.AuthorizationManager,
+		Name:    "operator",
+		PrivIds: []string{"VirtualMachine.Interact.PowerOn"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = am.SetEntityPermissions(ctx, esx.Datacenter.Self, []types.Permission{
+		{Principal: "user", RoleId: role.Returnval, Propagate: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = am.RemoveEntityPermission(ctx, vm.Reference(), "user", false); err != nil {
+		t.Fatal(err)
+	}
+
+	permissions, err := am.RetrieveEntityPermissions(ctx, vm.Reference(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(permissions) != 1 || *permissions[0].Entity != esx.Datacenter.Self {
+		t.Errorf("expected the permission inherited from the datacenter, got %#v", permissions)
+	}
+
+	task, err := vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err := client.SessionManager.UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the false results are dropped by the encoding, so check them in process
+	authz := Map.Get(*content.AuthorizationManager).(*AuthorizationManager)
+	check := authz.HasPrivilegeOnEntity(&types.HasPrivilegeOnEntity{
+		This:      *content.AuthorizationManager,
+		Entity:    vm.Reference(),
+		SessionId: session.Key,
+		PrivId:    []string{"VirtualMachine.Interact.PowerOn", "VirtualMachine.Interact.PowerOff"},
+	}).(*methods.HasPrivilegeOnEntityBody).Res.Returnval
+	if len(check) != 2 || !check[0] || check[1] {
+		t.Errorf("unexpected privileges %v", check)
+	}
+
+	// without any permission the user is only limited in strict mode
+	if err = am.RemoveEntityPermission(ctx, esx.Datacenter.Self, "user", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if task, err = vm.PowerOff(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	authz.Strict = true
+
+	if _, err = vm.PowerOn(ctx); !denied(err) {
+		t.Errorf("expected PowerOn to be denied, got %v", err)
+	}
+}
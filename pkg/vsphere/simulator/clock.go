@@ -0,0 +1,96 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the simulator: CurrentTime, session login times and task timestamps
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock = struct {
+	sync.Mutex
+	Clock
+}{Clock: systemClock{}}
+
+// SetClock replaces the simulator clock, returning the previous one so that it can be restored.
+// A nil clock restores the system clock.
+func SetClock(c Clock) Clock {
+	clock.Lock()
+	defer clock.Unlock()
+
+	if c == nil {
+		c = systemClock{}
+	}
+
+	prev := clock.Clock
+	clock.Clock = c
+
+	return prev
+}
+
+// now returns the current time according to the simulator clock
+func now() time.Time {
+	clock.Lock()
+	c := clock.Clock
+	clock.Unlock()
+
+	return c.Now()
+}
+
+// FakeClock is a Clock that only moves when told to
+type FakeClock struct {
+	m   sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock set to the given time
+func NewFakeClock(t time.Time) *FakeClock {
+	return &FakeClock{now: t}
+}
+
+// Now returns the current fake time
+func (c *FakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *FakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t
+func (c *FakeClock) Set(t time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.now = t
+}
@@ -0,0 +1,88 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2016, time.August, 1, 12, 0, 0, 0, time.UTC)
+	fake := NewFakeClock(start)
+
+	defer SetClock(SetClock(fake))
+
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := methods.GetCurrentTime(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !current.Equal(start) {
+		t.Errorf("expected %s, got %s", start, current)
+	}
+
+	fake.Advance(time.Hour)
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{Name: "foo"})
+
+	task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{NumCPUs: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := start.Add(time.Hour)
+	for _, stamp := range []time.Time{info.QueueTime, *info.StartTime, *info.CompleteTime} {
+		if !stamp.Equal(expect) {
+			t.Errorf("expected %s, got %s", expect, stamp)
+		}
+	}
+
+	// restoring the system clock
+	SetClock(nil)
+
+	current, err = methods.GetCurrentTime(ctx, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current.Year() == start.Year() && current.Month() == start.Month() {
+		t.Errorf("expected system time, got %s", current)
+	}
+}
@@ -54,3 +54,19 @@ func createDatacenterFolders(dc *mo.Datacenter, isVC bool) {
 		}
 	}
 }
+
+// findDatacenter returns the Datacenter that ref is, or is contained in
+func findDatacenter(ref *types.ManagedObjectReference) *mo.Datacenter {
+	for ref != nil {
+		switch e := Map.Get(*ref).(type) {
+		case *mo.Datacenter:
+			return e
+		case mo.Entity:
+			ref = e.Entity().Parent
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
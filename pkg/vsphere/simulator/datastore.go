@@ -0,0 +1,299 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// datastoreFile is an entry of the in-memory file tree of a Datastore
+type datastoreFile struct {
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+// Datastore keeps the files created on the datastore in memory, so that they can be found
+// with the datastore browser. The size of the files is accounted for in the free space of
+// the datastore.
+type Datastore struct {
+	mo.Datastore
+
+	m sync.Mutex
+	// files are keyed by their path relative to the datastore root
+	files map[string]datastoreFile
+}
+
+// NewDatastore returns a Datastore with an empty file tree and a browser of its own
+func NewDatastore(ds mo.Datastore) *Datastore {
+	d := &Datastore{
+		Datastore: ds,
+		files:     make(map[string]datastoreFile),
+	}
+
+	// the free space is updated in place, so the info can't be shared with the template
+	switch info := ds.Info.(type) {
+	case *types.VmfsDatastoreInfo:
+		c := *info
+		d.Info = &c
+	case types.BaseDatastoreInfo:
+		c := *info.GetDatastoreInfo()
+		d.Info = &c
+	}
+
+	if d.Self.Type == "" {
+		d.Self = Map.CreateReference(d)
+	}
+
+	browser := &HostDatastoreBrowser{}
+	browser.Self = Map.CreateReference(browser)
+	browser.Datastore = []types.ManagedObjectReference{d.Self}
+	Map.Put(browser)
+
+	d.Browser = browser.Self
+
+	return d
+}
+
+// parseDatastorePath splits a path of the form "[datastore] dir/file" into the datastore name
+// and the path relative to its root
+func parseDatastorePath(p string) (string, string, bool) {
+	if !strings.HasPrefix(p, "[") {
+		return "", "", false
+	}
+
+	i := strings.Index(p, "]")
+	if i < 0 {
+		return "", "", false
+	}
+
+	return p[1:i], strings.Trim(strings.TrimSpace(p[i+1:]), "/"), true
+}
+
+// Path returns the datastore path of the file
+func (ds *Datastore) Path(name string) string {
+	return "[" + ds.Name + "] " + name
+}
+
+// SetCapacity sets the capacity of the datastore. The free space is what's left of it after
+// the files on the datastore.
+func (ds *Datastore) SetCapacity(capacity int64) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+
+	used := int64(0)
+	for _, f := range ds.files {
+		used += f.size
+	}
+
+	ds.Summary.Capacity = capacity
+	ds.setFreeSpaceLocked(capacity - used)
+}
+
+// setFreeSpaceLocked updates the free space in both the summary and the info of the datastore
+func (ds *Datastore) setFreeSpaceLocked(free int64) {
+	ds.Summary.FreeSpace = free
+	if ds.Info != nil {
+		ds.Info.GetDatastoreInfo().FreeSpace = free
+	}
+}
+
+// exists reports whether there's a file or directory with the given name
+func (ds *Datastore) exists(name string) bool {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+
+	_, ok := ds.files[name]
+	return ok || name == ""
+}
+
+// mkdir creates the directory and its parents, existing ones are left as they are
+func (ds *Datastore) mkdir(dir string) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+
+	ds.mkdirLocked(dir)
+}
+
+func (ds *Datastore) mkdirLocked(dir string) {
+	for ; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+		if _, ok := ds.files[dir]; !ok {
+			ds.files[dir] = datastoreFile{modified: now(), dir: true}
+		}
+	}
+}
+
+// createFile creates the file and its parent directories, faulting if it already exists or
+// if there isn't enough free space left for it
+func (ds *Datastore) createFile(name string, size int64) types.BaseMethodFault {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+
+	if _, ok := ds.files[name]; ok {
+		return &types.FileAlreadyExists{FileFault: types.FileFault{File: ds.Path(name)}}
+	}
+
+	if size > ds.Summary.FreeSpace {
+		return &types.NoDiskSpace{FileFault: types.FileFault{File: ds.Path(name)}, Datastore: ds.Name}
+	}
+
+	ds.mkdirLocked(path.Dir(name))
+	ds.files[name] = datastoreFile{size: size, modified: now()}
+	ds.setFreeSpaceLocked(ds.Summary.FreeSpace - size)
+
+	return nil
+}
+
+// remove removes the file and gives back the space it took, its parent directories are left in place
+func (ds *Datastore) remove(name string) {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+
+	if f, ok := ds.files[name]; ok {
+		delete(ds.files, name)
+		ds.setFreeSpaceLocked(ds.Summary.FreeSpace + f.size)
+	}
+}
+
+// list returns the entries of the directory whose names match one of the patterns, all
+// of them if there are no patterns
+func (ds *Datastore) list(dir string, patterns []string) []types.BaseFileInfo {
+	ds.m.Lock()
+	defer ds.m.Unlock()
+
+	var names []string
+	for name := range ds.files {
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if parent == dir {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var infos []types.BaseFileInfo
+	for _, name := range names {
+		base := path.Base(name)
+		if !matchAny(base, patterns) {
+			continue
+		}
+
+		f := ds.files[name]
+		modified := f.modified
+		info := types.FileInfo{
+			Path:         base,
+			FileSize:     f.size,
+			Modification: &modified,
+		}
+
+		if f.dir {
+			infos = append(infos, &types.FolderFileInfo{FileInfo: info})
+		} else {
+			infos = append(infos, &info)
+		}
+	}
+
+	return infos
+}
+
+func matchAny(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findDatastore returns the datastore of the datacenter with the given name
+func findDatastore(dc *mo.Datacenter, name string) *Datastore {
+	if dc == nil {
+		return nil
+	}
+
+	for _, ref := range dc.Datastore {
+		if ds, ok := Map.Get(ref).(*Datastore); ok && ds.Name == name {
+			return ds
+		}
+	}
+
+	return nil
+}
+
+type HostDatastoreBrowser struct {
+	mo.HostDatastoreBrowser
+}
+
+// SearchDatastore_Task lists the contents of a directory of the datastore, filtered by the
+// match patterns of the search spec
+func (b *HostDatastoreBrowser) SearchDatastore_Task(req *types.SearchDatastore_Task) soap.HasFault {
+	body := &methods.SearchDatastore_TaskBody{}
+
+	name, dir, ok := parseDatastorePath(req.DatastorePath)
+	if !ok {
+		body.Fault_ = Fault("", &types.InvalidDatastorePath{DatastorePath: req.DatastorePath})
+		return body
+	}
+
+	var ds *Datastore
+	for _, ref := range b.Datastore {
+		if d, ok := Map.Get(ref).(*Datastore); ok && d.Name == name {
+			ds = d
+		}
+	}
+	if ds == nil {
+		body.Fault_ = Fault("", &types.InvalidDatastorePath{DatastorePath: req.DatastorePath})
+		return body
+	}
+
+	task := NewTask(ds, "HostDatastoreBrowser.search", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		if !ds.exists(dir) {
+			return nil, &types.FileNotFound{FileFault: types.FileFault{File: req.DatastorePath}}
+		}
+
+		var patterns []string
+		if req.SearchSpec != nil {
+			patterns = req.SearchSpec.MatchPattern
+		}
+
+		return types.HostDatastoreBrowserSearchResults{
+			Datastore:  &ds.Self,
+			FolderPath: req.DatastorePath,
+			File:       ds.list(dir, patterns),
+		}, nil
+	})
+
+	body.Res = &types.SearchDatastore_TaskResponse{
+		Returnval: task.Run(),
+	}
+
+	return body
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestDatastoreFreeSpace(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const capacity = 10 * 1024 * 1024
+
+	ds := Map.Get(esx.Datastore.Self).(*Datastore)
+	ds.SetCapacity(capacity)
+
+	summary := func() types.DatastoreSummary {
+		var mds mo.Datastore
+		err := object.NewDatastore(client.Client, ds.Self).Properties(ctx, ds.Self, []string{"summary", "info"}, &mds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mds.Info.GetDatastoreInfo().FreeSpace != mds.Summary.FreeSpace {
+			t.Errorf("info.freeSpace %d doesn't match summary.freeSpace %d", mds.Info.GetDatastoreInfo().FreeSpace, mds.Summary.FreeSpace)
+		}
+		return mds.Summary
+	}
+
+	if sum := summary(); sum.Capacity != capacity || sum.FreeSpace != capacity {
+		t.Errorf("unexpected capacity %d and free space %d", sum.Capacity, sum.FreeSpace)
+	}
+
+	spec := func(name string, kb int64) types.VirtualMachineConfigSpec {
+		controller := &types.VirtualLsiLogicController{}
+		controller.Key = -1
+		disk := &types.VirtualDisk{CapacityInKB: kb}
+		disk.Key = -2
+		disk.ControllerKey = -1
+		disk.Backing = &types.VirtualDiskFlatVer2BackingInfo{
+			DiskMode: string(types.VirtualDiskModePersistent),
+		}
+
+		add, _ := object.VirtualDeviceList{controller, disk}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+		add[1].GetVirtualDeviceConfigSpec().FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+
+		return types.VirtualMachineConfigSpec{
+			Name:         name,
+			GuestId:      "otherGuest64",
+			Files:        &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+			DeviceChange: add,
+		}
+	}
+
+	createVM(ctx, t, client, spec("foo", 4*1024))
+
+	if sum := summary(); sum.FreeSpace != capacity-4*1024*1024 {
+		t.Errorf("expected the disk to take 4MB, free space is %d", sum.FreeSpace)
+	}
+
+	// a disk that doesn't fit fails the creation without taking any space
+	folder := Map.Get(esx.Datacenter.VmFolder).(*Folder)
+	res := folder.CreateVM_Task(&types.CreateVM_Task{
+		This:   folder.Self,
+		Config: spec("bar", 8*1024),
+		Pool:   esx.ResourcePool.Self,
+	})
+	task := Map.Get(res.(*methods.CreateVM_TaskBody).Res.Returnval).(*Task)
+	if task.Info.Error == nil {
+		t.Fatal("expected the creation to fail")
+	}
+	if _, ok := task.Info.Error.Fault.(*types.NoDiskSpace); !ok {
+		t.Errorf("expected NoDiskSpace, got %#v", task.Info.Error.Fault)
+	}
+	if ds.exists("bar/bar.vmx") {
+		t.Error("the files of the failed creation weren't removed")
+	}
+
+	if sum := summary(); sum.FreeSpace != capacity-4*1024*1024 {
+		t.Errorf("failed creation changed the free space to %d", sum.FreeSpace)
+	}
+
+	// deleting the disk gives its space back
+	ds.remove("foo/foo.vmdk")
+
+	if sum := summary(); sum.FreeSpace != capacity {
+		t.Errorf("expected the space of the disk back, free space is %d", sum.FreeSpace)
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type VmwareDistributedVirtualSwitch struct {
+	mo.VmwareDistributedVirtualSwitch
+
+	// ports of all the portgroups on the switch, in the order they were created
+	ports []types.DistributedVirtualPort
+
+	m sync.Mutex
+}
+
+type DistributedVirtualPortgroup struct {
+	mo.DistributedVirtualPortgroup
+}
+
+// NewVmwareDistributedVirtualSwitch returns a switch without portgroups configured by the given spec
+func NewVmwareDistributedVirtualSwitch(spec types.BaseDVSConfigSpec) (*VmwareDistributedVirtualSwitch, types.BaseMethodFault) {
+	if spec == nil || spec.GetDVSConfigSpec().Name == "" {
+		return nil, &types.InvalidArgument{InvalidProperty: "spec.configSpec.name"}
+	}
+
+	config := spec.GetDVSConfigSpec()
+
+	s := &VmwareDistributedVirtualSwitch{}
+	s.Self = Map.CreateReference(s)
+	s.Name = config.Name
+	s.Uuid = newSwitchUUID()
+
+	info := &types.VMwareDVSConfigInfo{
+		DVSConfigInfo: types.DVSConfigInfo{
+			Uuid:             s.Uuid,
+			Name:             s.Name,
+			MaxPorts:         config.MaxPorts,
+			Description:      config.Description,
+			ConfigVersion:    "1",
+			CreateTime:       now(),
+			UplinkPortPolicy: config.UplinkPortPolicy,
+		},
+		LacpApiVersion: string(types.VMwareDvsLacpApiVersionSingleLag),
+	}
+
+	// vCenter names the uplinks of a switch created without them
+	if info.UplinkPortPolicy == nil {
+		info.UplinkPortPolicy = &types.DVSNameArrayUplinkPortPolicy{
+			UplinkPortName: []string{"dvUplink1", "dvUplink2", "dvUplink3", "dvUplink4"},
+		}
+	}
+
+	if vspec, ok := spec.(*types.VMwareDVSConfigSpec); ok && vspec.LacpApiVersion != "" {
+		info.LacpApiVersion = vspec.LacpApiVersion
+	}
+
+	s.Config = info
+
+	s.Summary = types.DVSSummary{
+		Name:        s.Name,
+		Uuid:        s.Uuid,
+		Description: config.Description,
+	}
+
+	return s, nil
+}
+
+// newSwitchUUID returns a random uuid in the format vSphere uses for switches
+func newSwitchUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	hex := make([]string, len(b))
+	for i := range b {
+		hex[i] = fmt.Sprintf("%02x", b[i])
+	}
+
+	return strings.Join(hex[:8], " ") + "-" + strings.Join(hex[8:], " ")
+}
+
+func (s *VmwareDistributedVirtualSwitch) AddDVPortgroup_Task(req *types.AddDVPortgroup_Task) soap.HasFault {
+	task := NewTask(s, "DistributedVirtualSwitch.addPortgroups", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		s.m.Lock()
+		defer s.m.Unlock()
+
+		folder, ok := Map.Get(*s.Parent).(*Folder)
+		if !ok {
+			return nil, &types.InvalidState{}
+		}
+
+		// validate all the specs up front so that none are added if one is invalid
+		names := make(map[string]bool)
+		for _, name := range s.Summary.PortgroupName {
+			names[name] = true
+		}
+
+		for _, spec := range req.Spec {
+			if spec.Name == "" {
+				return nil, &types.InvalidArgument{InvalidProperty: "spec.name"}
+			}
+			if names[spec.Name] {
+				return nil, &types.DuplicateName{Name: spec.Name, Object: s.Self}
+			}
+			names[spec.Name] = true
+		}
+
+		for _, spec := range req.Spec {
+			pg := &DistributedVirtualPortgroup{}
+			pg.Self = Map.CreateReference(pg)
+			pg.Key = pg.Self.Value
+
+			// mo.Network shadows the ManagedEntity name
+			pg.Name = spec.Name
+			pg.Entity().Name = spec.Name
+
+			pg.Config = types.DVPortgroupConfigInfo{
+				Key:                      pg.Key,
+				Name:                     spec.Name,
+				DistributedVirtualSwitch: &s.Self,
+				Description:              spec.Description,
+				Type:                     spec.Type,
+				AutoExpand:               spec.AutoExpand,
+				ConfigVersion:            "1",
+			}
+
+			if pg.Config.Type == "" {
+				pg.Config.Type = string(types.DistributedVirtualPortgroupPortgroupTypeEarlyBinding)
+			}
+
+			// portgroups live in the folder of their switch
+			folder.putChild(pg)
+
+			for i := int32(0); i < spec.NumPorts; i++ {
+				s.addPort(pg)
+			}
+
+			s.Portgroup = append(s.Portgroup, pg.Self)
+			s.Summary.PortgroupName = append(s.Summary.PortgroupName, spec.Name)
+		}
+
+		return nil, nil
+	})
+
+	return &methods.AddDVPortgroup_TaskBody{
+		Res: &types.AddDVPortgroup_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// SetUplinkPortPolicy sets the uplinks of the switch, such as a DVSNameArrayUplinkPortPolicy
+func (s *VmwareDistributedVirtualSwitch) SetUplinkPortPolicy(policy types.BaseDVSUplinkPortPolicy) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.Config.GetDVSConfigInfo().UplinkPortPolicy = policy
+	s.reconfigured()
+}
+
+// SetLacpGroupConfig sets the link aggregation groups of the switch, which switches it to the
+// multipleLag LACP API. The groups are reported as given, the simulator doesn't aggregate links.
+func (s *VmwareDistributedVirtualSwitch) SetLacpGroupConfig(groups ...types.VMwareDvsLacpGroupConfig) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	info := s.Config.(*types.VMwareDVSConfigInfo)
+	info.LacpGroupConfig = groups
+	info.LacpApiVersion = string(types.VMwareDvsLacpApiVersionMultipleLag)
+	s.reconfigured()
+}
+
+// reconfigured increments the config version of the switch, as every change to its config does
+func (s *VmwareDistributedVirtualSwitch) reconfigured() {
+	info := s.Config.GetDVSConfigInfo()
+
+	version, _ := strconv.Atoi(info.ConfigVersion)
+	info.ConfigVersion = strconv.Itoa(version + 1)
+}
+
+// addPort adds a port to the portgroup, keyed uniquely across the switch
+func (s *VmwareDistributedVirtualSwitch) addPort(pg *DistributedVirtualPortgroup) *types.DistributedVirtualPort {
+	s.ports = append(s.ports, types.DistributedVirtualPort{
+		Key:          strconv.Itoa(len(s.ports)),
+		DvsUuid:      s.Uuid,
+		PortgroupKey: pg.Key,
+	})
+	port := &s.ports[len(s.ports)-1]
+
+	pg.PortKeys = append(pg.PortKeys, port.Key)
+	pg.Config.NumPorts = int32(len(pg.PortKeys))
+
+	s.Summary.NumPorts = int32(len(s.ports))
+	s.Config.GetDVSConfigInfo().NumPorts = s.Summary.NumPorts
+
+	return port
+}
+
+// findPort returns the port with the given key, nil if there's no such port
+func (s *VmwareDistributedVirtualSwitch) findPort(key string) *types.DistributedVirtualPort {
+	for i := range s.ports {
+		if s.ports[i].Key == key {
+			return &s.ports[i]
+		}
+	}
+
+	return nil
+}
+
+// connect connects the NIC of vm to the port of the connection, allocating a free port of the
+// portgroup if the connection doesn't name one. Like portgroups with autoExpand set, the portgroup
+// grows if all its ports are taken.
+func (s *VmwareDistributedVirtualSwitch) connect(pg *DistributedVirtualPortgroup, c *types.DistributedVirtualSwitchPortConnection, vm types.ManagedObjectReference, nic int32) types.BaseMethodFault {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	connectee := &types.DistributedVirtualSwitchPortConnectee{
+		ConnectedEntity: &vm,
+		NicKey:          strconv.Itoa(int(nic)),
+		Type:            "vmVnic",
+	}
+
+	var port *types.DistributedVirtualPort
+
+	if c.PortKey != "" {
+		port = s.findPort(c.PortKey)
+		if port == nil || port.PortgroupKey != pg.Key {
+			return &types.InvalidArgument{InvalidProperty: "virtualDeviceSpec.device.backing.port.portKey"}
+		}
+
+		if port.Connectee != nil && (*port.Connectee.ConnectedEntity != vm || port.Connectee.NicKey != connectee.NicKey) {
+			return &types.InvalidArgument{InvalidProperty: "virtualDeviceSpec.device.backing.port.portKey"}
+		}
+	} else {
+		for _, key := range pg.PortKeys {
+			if p := s.findPort(key); p.Connectee == nil {
+				port = p
+				break
+			}
+		}
+
+		if port == nil {
+			port = s.addPort(pg)
+		}
+	}
+
+	port.Connectee = connectee
+	c.PortKey = port.Key
+
+	return nil
+}
+
+// disconnect releases the port with the given key
+func (s *VmwareDistributedVirtualSwitch) disconnect(key string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if port := s.findPort(key); port != nil {
+		port.Connectee = nil
+	}
+}
+
+// matchPort reports whether the port meets the criteria
+func matchPort(port *types.DistributedVirtualPort, criteria *types.DistributedVirtualSwitchPortCriteria) bool {
+	if criteria == nil {
+		return true
+	}
+
+	if criteria.Connected != nil && *criteria.Connected != (port.Connectee != nil) {
+		return false
+	}
+
+	if len(criteria.PortKey) > 0 && !containsString(criteria.PortKey, port.Key) {
+		return false
+	}
+
+	// portgroupKey selects the ports inside the portgroups, or outside of them if inside is false
+	outside := criteria.Inside != nil && !*criteria.Inside
+	if len(criteria.PortgroupKey) > 0 && containsString(criteria.PortgroupKey, port.PortgroupKey) == outside {
+		return false
+	}
+
+	return true
+}
+
+// containsString reports whether s is one of the values
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *VmwareDistributedVirtualSwitch) FetchDVPorts(req *types.FetchDVPorts) soap.HasFault {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var ports []types.DistributedVirtualPort
+
+	for i := range s.ports {
+		if matchPort(&s.ports[i], req.Criteria) {
+			ports = append(ports, s.ports[i])
+		}
+	}
+
+	return &methods.FetchDVPortsBody{
+		Res: &types.FetchDVPortsResponse{
+			Returnval: ports,
+		},
+	}
+}
+
+// dvPortConnection returns the port connection of the device if it's a NIC backed by a distributed port
+func dvPortConnection(device types.BaseVirtualDevice) *types.DistributedVirtualSwitchPortConnection {
+	card, ok := device.(types.BaseVirtualEthernetCard)
+	if !ok {
+		return nil
+	}
+
+	backing, ok := card.GetVirtualEthernetCard().Backing.(*types.VirtualEthernetCardDistributedVirtualPortBackingInfo)
+	if !ok {
+		return nil
+	}
+
+	return &backing.Port
+}
+
+// findPortgroup returns the portgroup the connection refers to along with its switch
+func findPortgroup(c *types.DistributedVirtualSwitchPortConnection) (*DistributedVirtualPortgroup, *VmwareDistributedVirtualSwitch, types.BaseMethodFault) {
+	ref := types.ManagedObjectReference{Type: "DistributedVirtualPortgroup", Value: c.PortgroupKey}
+
+	pg, ok := Map.Get(ref).(*DistributedVirtualPortgroup)
+	if !ok {
+		return nil, nil, &types.InvalidArgument{InvalidProperty: "virtualDeviceSpec.device.backing.port.portgroupKey"}
+	}
+
+	s, ok := Map.Get(*pg.Config.DistributedVirtualSwitch).(*VmwareDistributedVirtualSwitch)
+	if !ok || s.Uuid != c.SwitchUuid {
+		return nil, nil, &types.InvalidArgument{InvalidProperty: "virtualDeviceSpec.device.backing.port.switchUuid"}
+	}
+
+	return pg, s, nil
+}
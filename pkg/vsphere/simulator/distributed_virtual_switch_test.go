@@ -0,0 +1,282 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestDistributedVirtualPortgroup(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// switches are a vCenter feature, allow them in the network folder as vCenter does
+	nf := Map.Get(esx.Datacenter.NetworkFolder).(*Folder)
+	nf.ChildType = append(nf.ChildType, "DistributedVirtualSwitch")
+
+	folders, err := object.NewDatacenter(client.Client, esx.Datacenter.Self).Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := folders.NetworkFolder.CreateDVS(ctx, types.DVSCreateSpec{
+		ConfigSpec: &types.DVSConfigSpec{Name: "dvs0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dvs := object.NewDistributedVirtualSwitch(client.Client, info.Result.(types.ManagedObjectReference))
+
+	task, err = dvs.AddPortgroup(ctx, []types.DVPortgroupConfigSpec{{Name: "pg0", NumPorts: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var so mo.VmwareDistributedVirtualSwitch
+	if err = dvs.Properties(ctx, dvs.Reference(), []string{"portgroup"}, &so); err != nil {
+		t.Fatal(err)
+	}
+	if len(so.Portgroup) != 1 {
+		t.Fatalf("expected a portgroup, got %d", len(so.Portgroup))
+	}
+
+	pg := object.NewDistributedVirtualPortgroup(client.Client, so.Portgroup[0])
+
+	backing, err := pg.EthernetCardBackingInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nic := func() *types.VirtualE1000 {
+		nic := &types.VirtualE1000{}
+		nic.Key = -1
+		nic.Backing = backing
+		return nic
+	}
+
+	add, _ := object.VirtualDeviceList{nic()}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		DeviceChange: add,
+	})
+
+	// the portgroup grows once its only port is taken
+	if err = vm.AddDevice(ctx, nic()); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cards := devices.SelectByType((*types.VirtualEthernetCard)(nil))
+	if len(cards) != 2 {
+		t.Fatalf("expected 2 NICs, got %d", len(cards))
+	}
+
+	var keys []string
+	for _, card := range cards {
+		port := card.(types.BaseVirtualEthernetCard).GetVirtualEthernetCard().Backing.(*types.VirtualEthernetCardDistributedVirtualPortBackingInfo).Port
+		keys = append(keys, port.PortKey)
+	}
+
+	var po mo.DistributedVirtualPortgroup
+	if err = pg.Properties(ctx, pg.Reference(), []string{"config", "portKeys"}, &po); err != nil {
+		t.Fatal(err)
+	}
+
+	if po.Config.Name != "pg0" || po.Config.NumPorts != 2 || *po.Config.DistributedVirtualSwitch != dvs.Reference() {
+		t.Errorf("unexpected config %#v", po.Config)
+	}
+
+	if !reflect.DeepEqual(po.PortKeys, keys) {
+		t.Errorf("expected port keys %v, got %v", keys, po.PortKeys)
+	}
+
+	connected := func() []types.DistributedVirtualPort {
+		res, err := methods.FetchDVPorts(ctx, client.Client, &types.FetchDVPorts{
+			This: dvs.Reference(),
+			Criteria: &types.DistributedVirtualSwitchPortCriteria{
+				Connected:    types.NewBool(true),
+				PortgroupKey: []string{po.Key},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.Returnval
+	}
+
+	ports := connected()
+	if len(ports) != 2 {
+		t.Fatalf("expected 2 connected ports, got %d", len(ports))
+	}
+
+	for i, port := range ports {
+		if port.Key != keys[i] || *port.Connectee.ConnectedEntity != vm.Reference() {
+			t.Errorf("unexpected port %#v", port)
+		}
+	}
+
+	// removing the NIC releases its port
+	if err = vm.RemoveDevice(ctx, false, cards[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	ports = connected()
+	if len(ports) != 1 || ports[0].Key != keys[1] {
+		t.Errorf("expected port %s to be connected, got %#v", keys[1], ports)
+	}
+
+	// a NIC can't be attached to a portgroup that doesn't exist
+	bad := nic()
+	bad.Backing = &types.VirtualEthernetCardDistributedVirtualPortBackingInfo{
+		Port: types.DistributedVirtualSwitchPortConnection{
+			SwitchUuid:   backing.(*types.VirtualEthernetCardDistributedVirtualPortBackingInfo).Port.SwitchUuid,
+			PortgroupKey: "no-such-portgroup",
+		},
+	}
+	if err = vm.AddDevice(ctx, bad); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestDistributedVirtualSwitchUplinks(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nf := Map.Get(esx.Datacenter.NetworkFolder).(*Folder)
+	nf.ChildType = append(nf.ChildType, "DistributedVirtualSwitch")
+
+	folders, err := object.NewDatacenter(client.Client, esx.Datacenter.Self).Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := folders.NetworkFolder.CreateDVS(ctx, types.DVSCreateSpec{
+		ConfigSpec: &types.VMwareDVSConfigSpec{DVSConfigSpec: types.DVSConfigSpec{Name: "dvs0"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dvs := object.NewDistributedVirtualSwitch(client.Client, info.Result.(types.ManagedObjectReference))
+
+	config := func() *types.VMwareDVSConfigInfo {
+		var so mo.VmwareDistributedVirtualSwitch
+		if err = dvs.Properties(ctx, dvs.Reference(), []string{"config"}, &so); err != nil {
+			t.Fatal(err)
+		}
+		return so.Config.(*types.VMwareDVSConfigInfo)
+	}
+
+	// the switch is created with the default uplinks
+	c := config()
+	if policy, ok := c.UplinkPortPolicy.(*types.DVSNameArrayUplinkPortPolicy); !ok || len(policy.UplinkPortName) != 4 {
+		t.Errorf("unexpected uplink policy %#v", c.UplinkPortPolicy)
+	}
+	if c.LacpApiVersion != string(types.VMwareDvsLacpApiVersionSingleLag) || len(c.LacpGroupConfig) != 0 {
+		t.Errorf("unexpected LACP config %s %#v", c.LacpApiVersion, c.LacpGroupConfig)
+	}
+
+	sw := Map.Get(dvs.Reference()).(*VmwareDistributedVirtualSwitch)
+
+	uplinks := []string{"uplink-a", "uplink-b"}
+	sw.SetUplinkPortPolicy(&types.DVSNameArrayUplinkPortPolicy{UplinkPortName: uplinks})
+
+	lag := types.VMwareDvsLacpGroupConfig{
+		Key:                  "lag1",
+		Name:                 "lag1",
+		Mode:                 string(types.VMwareUplinkLacpModeActive),
+		UplinkNum:            2,
+		LoadbalanceAlgorithm: string(types.VMwareDvsLacpLoadBalanceAlgorithmSrcDestIpTcpUdpPortVlan),
+		UplinkName:           []string{"lag1-0", "lag1-1"},
+	}
+	sw.SetLacpGroupConfig(lag)
+
+	c = config()
+	if policy, ok := c.UplinkPortPolicy.(*types.DVSNameArrayUplinkPortPolicy); !ok || !reflect.DeepEqual(policy.UplinkPortName, uplinks) {
+		t.Errorf("unexpected uplink policy %#v", c.UplinkPortPolicy)
+	}
+	if c.LacpApiVersion != string(types.VMwareDvsLacpApiVersionMultipleLag) || len(c.LacpGroupConfig) != 1 || !reflect.DeepEqual(c.LacpGroupConfig[0], lag) {
+		t.Errorf("unexpected LACP config %s %#v", c.LacpApiVersion, c.LacpGroupConfig)
+	}
+	if c.ConfigVersion != "3" {
+		t.Errorf("unexpected config version %s", c.ConfigVersion)
+	}
+
+	// the policy can be read on its own, the client can't load it into the config interface
+	pc := property.DefaultCollector(client.Client)
+	res, err := pc.RetrieveProperties(ctx, types.RetrieveProperties{
+		SpecSet: []types.PropertyFilterSpec{{
+			ObjectSet: []types.ObjectSpec{{Obj: dvs.Reference()}},
+			PropSet:   []types.PropertySpec{{Type: dvs.Reference().Type, PathSet: []string{"config.uplinkPortPolicy"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Returnval) != 1 || len(res.Returnval[0].PropSet) != 1 {
+		t.Fatalf("unexpected content %#v", res.Returnval)
+	}
+	if policy, ok := res.Returnval[0].PropSet[0].Val.(types.DVSNameArrayUplinkPortPolicy); !ok || !reflect.DeepEqual(policy.UplinkPortName, uplinks) {
+		t.Errorf("unexpected uplink policy %#v", res.Returnval[0].PropSet[0].Val)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+type EnvironmentBrowser struct {
+	mo.EnvironmentBrowser
+
+	// ConfigOption is returned by QueryConfigOption, tests can modify it to change the
+	// guest OS types and default devices reported as supported
+	ConfigOption types.VirtualMachineConfigOption
+
+	// the ComputeResource whose hosts provide the QueryConfigTarget info
+	cr types.ManagedObjectReference
+}
+
+func NewEnvironmentBrowser(ref types.ManagedObjectReference, cr types.ManagedObjectReference) *EnvironmentBrowser {
+	b := &EnvironmentBrowser{
+		ConfigOption: esx.VirtualMachineConfigOption,
+		cr:           cr,
+	}
+	b.Self = ref
+	return b
+}
+
+// hosts returns the HostSystems of the ComputeResource
+func (b *EnvironmentBrowser) hosts() []*HostSystem {
+	var hosts []*HostSystem
+
+	cr, ok := Map.Get(b.cr).(*mo.ComputeResource)
+	if !ok {
+		return nil
+	}
+
+	for _, ref := range cr.Host {
+		if host, ok := Map.Get(ref).(*HostSystem); ok {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+func (b *EnvironmentBrowser) QueryConfigOption(*types.QueryConfigOption) soap.HasFault {
+	option := b.ConfigOption
+
+	return &methods.QueryConfigOptionBody{
+		Res: &types.QueryConfigOptionResponse{
+			Returnval: &option,
+		},
+	}
+}
+
+func (b *EnvironmentBrowser) QueryConfigTarget(*types.QueryConfigTarget) soap.HasFault {
+	target := &types.ConfigTarget{
+		SmcPresent:  types.NewBool(false),
+		AutoVmotion: types.NewBool(false),
+	}
+
+	seen := make(map[types.ManagedObjectReference]bool)
+
+	for _, host := range b.hosts() {
+		if hw := host.Summary.Hardware; hw != nil {
+			target.NumCpus += int32(hw.NumCpuThreads)
+			target.NumCpuCores += int32(hw.NumCpuCores)
+			target.NumNumaNodes++
+			target.MaxMemMBOptimalPerf += int32(hw.MemorySize / (1024 * 1024))
+		}
+
+		refs := append(append([]types.ManagedObjectReference{}, host.Network...), host.Datastore...)
+
+		for _, ref := range refs {
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+
+			switch o := Map.Get(ref).(type) {
+			case *mo.Network:
+				target.Network = append(target.Network, types.VirtualMachineNetworkInfo{
+					VirtualMachineTargetInfo: types.VirtualMachineTargetInfo{Name: o.Name},
+					Network: &types.NetworkSummary{
+						Network:    &o.Self,
+						Name:       o.Name,
+						Accessible: true,
+					},
+				})
+			case *Datastore:
+				summary := o.Summary
+				summary.Datastore = &o.Self
+				target.Datastore = append(target.Datastore, types.VirtualMachineDatastoreInfo{
+					VirtualMachineTargetInfo: types.VirtualMachineTargetInfo{Name: o.Name},
+					Datastore:                summary,
+					Capability:               o.Capability,
+					Mode:                     string(types.HostMountModeReadWrite),
+				})
+			}
+		}
+	}
+
+	return &methods.QueryConfigTargetBody{
+		Res: &types.QueryConfigTargetResponse{
+			Returnval: target,
+		},
+	}
+}
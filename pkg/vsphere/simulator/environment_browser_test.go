@@ -0,0 +1,114 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestEnvironmentBrowser(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := find.NewFinder(client.Client, false)
+
+	dc, err := finder.DatacenterOrDefault(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder.SetDatacenter(dc)
+
+	cr, err := finder.ComputeResourceOrDefault(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var props mo.ComputeResource
+	err = cr.Properties(ctx, cr.Reference(), []string{"environmentBrowser"}, &props)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if props.EnvironmentBrowser == nil {
+		t.Fatal("no environment browser")
+	}
+
+	browser := Map.Get(*props.EnvironmentBrowser).(*EnvironmentBrowser)
+	browser.ConfigOption.GuestOSDescriptor = append(browser.ConfigOption.GuestOSDescriptor, types.GuestOsDescriptor{Id: "photon64Guest"})
+
+	option, err := methods.QueryConfigOption(ctx, client, &types.QueryConfigOption{This: browser.Self})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	supported := func(id string) bool {
+		for _, guest := range option.Returnval.GuestOSDescriptor {
+			if guest.Id == id {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, id := range []string{"otherGuest", "ubuntu64Guest", "photon64Guest"} {
+		if !supported(id) {
+			t.Errorf("guest %s not reported as supported", id)
+		}
+	}
+
+	if supported("noSuchGuest") {
+		t.Error("unexpected guest reported as supported")
+	}
+
+	if len(option.Returnval.DefaultDevice) == 0 {
+		t.Error("no default devices")
+	}
+
+	target, err := methods.QueryConfigTarget(ctx, client, &types.QueryConfigTarget{This: browser.Self})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.Returnval.NumCpus == 0 {
+		t.Error("no cpus")
+	}
+
+	if len(target.Returnval.Network) != len(esx.HostSystem.Network) {
+		t.Fatalf("expected %d networks, got %d", len(esx.HostSystem.Network), len(target.Returnval.Network))
+	}
+
+	if name := target.Returnval.Network[0].Network.GetNetworkSummary().Name; name != "VM Network" {
+		t.Errorf("unexpected network %q", name)
+	}
+}
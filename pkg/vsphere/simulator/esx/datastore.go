@@ -0,0 +1,61 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package esx
+
+import (
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Datastore is the default local VMFS datastore of the ESX host
+var Datastore = mo.Datastore{
+	ManagedEntity: mo.ManagedEntity{
+		ExtensibleManagedObject: mo.ExtensibleManagedObject{
+			Self: types.ManagedObjectReference{Type: "Datastore", Value: "57089c25-85e3ccd4-17b6-000c29d0beb3"},
+		},
+		OverallStatus: "green",
+		ConfigStatus:  "gray",
+		Name:          "datastore1",
+	},
+	Info: &types.VmfsDatastoreInfo{
+		DatastoreInfo: types.DatastoreInfo{
+			Name:        "datastore1",
+			Url:         "ds:///vmfs/volumes/57089c25-85e3ccd4-17b6-000c29d0beb3/",
+			FreeSpace:   9981394944,
+			MaxFileSize: 2199023255552,
+		},
+		MaxPhysicalRDMFileSize: 2199023250944,
+		MaxVirtualRDMFileSize:  2199023250944,
+	},
+	Summary: types.DatastoreSummary{
+		Name:               "datastore1",
+		Url:                "ds:///vmfs/volumes/57089c25-85e3ccd4-17b6-000c29d0beb3/",
+		Capacity:           13153337344,
+		FreeSpace:          9981394944,
+		Accessible:         true,
+		MultipleHostAccess: types.NewBool(false),
+		Type:               "VMFS",
+		MaintenanceMode:    "normal",
+	},
+	Capability: types.DatastoreCapability{
+		DirectoryHierarchySupported:      true,
+		RawDiskMappingsSupported:         true,
+		PerFileThinProvisioningSupported: true,
+		StorageIORMSupported:             types.NewBool(false),
+		NativeSnapshotSupported:          types.NewBool(false),
+		TopLevelDirectoryCreateSupported: types.NewBool(true),
+		SeSparseSupported:                types.NewBool(true),
+	},
+}
@@ -0,0 +1,135 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package esx
+
+import "github.com/vmware/govmomi/vim25/types"
+
+// EnvironmentBrowser is the default reference of the ComputeResource EnvironmentBrowser
+var EnvironmentBrowser = types.ManagedObjectReference{Type: "EnvironmentBrowser", Value: "ha-env-browser"}
+
+// VirtualMachineConfigOption is the default value returned by EnvironmentBrowser.QueryConfigOption
+var VirtualMachineConfigOption = types.VirtualMachineConfigOption{
+	Version:     "vmx-11",
+	Description: "ESXi 6.0 virtual machine",
+	GuestOSDescriptor: []types.GuestOsDescriptor{
+		{Id: "otherGuest", Family: "otherGuestFamily", FullName: "Other (32-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 4, SupportedMaxMemMB: 4194304, RecommendedMemMB: 256},
+		{Id: "otherGuest64", Family: "otherGuestFamily", FullName: "Other (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 4, SupportedMaxMemMB: 4194304, RecommendedMemMB: 256},
+		{Id: "otherLinuxGuest", Family: "linuxGuest", FullName: "Other Linux (32-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 256},
+		{Id: "other3xLinux64Guest", Family: "linuxGuest", FullName: "Other 3.x or later Linux (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 512},
+		{Id: "otherLinux64Guest", Family: "linuxGuest", FullName: "Other Linux (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 256},
+		{Id: "ubuntu64Guest", Family: "linuxGuest", FullName: "Ubuntu Linux (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 1024},
+		{Id: "centos64Guest", Family: "linuxGuest", FullName: "CentOS 4/5/6/7 (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 1024},
+		{Id: "rhel7_64Guest", Family: "linuxGuest", FullName: "Red Hat Enterprise Linux 7 (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 2048},
+		{Id: "debian8_64Guest", Family: "linuxGuest", FullName: "Debian GNU/Linux 8 (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 32, SupportedMaxMemMB: 4194304, RecommendedMemMB: 1024},
+		{Id: "windows9_64Guest", Family: "windowsGuest", FullName: "Microsoft Windows 10 (64-bit)", SupportedMaxCPUs: 128, SupportedMinMemMB: 512, SupportedMaxMemMB: 4194304, RecommendedMemMB: 2048},
+	},
+	GuestOSDefaultIndex:  0,
+	SupportedMonitorType: []string{"release", "debug", "stats"},
+	DefaultDevice: []types.BaseVirtualDevice{
+		&types.VirtualIDEController{
+			VirtualController: types.VirtualController{
+				VirtualDevice: types.VirtualDevice{
+					Key:        200,
+					DeviceInfo: &types.Description{Label: "IDE 0", Summary: "IDE 0"},
+				},
+				BusNumber: 0,
+			},
+		},
+		&types.VirtualIDEController{
+			VirtualController: types.VirtualController{
+				VirtualDevice: types.VirtualDevice{
+					Key:        201,
+					DeviceInfo: &types.Description{Label: "IDE 1", Summary: "IDE 1"},
+				},
+				BusNumber: 1,
+			},
+		},
+		&types.VirtualPS2Controller{
+			VirtualController: types.VirtualController{
+				VirtualDevice: types.VirtualDevice{
+					Key:        300,
+					DeviceInfo: &types.Description{Label: "PS2 controller 0", Summary: "PS2 controller 0"},
+				},
+				BusNumber: 0,
+				Device:    []int32{600, 700},
+			},
+		},
+		&types.VirtualPCIController{
+			VirtualController: types.VirtualController{
+				VirtualDevice: types.VirtualDevice{
+					Key:        100,
+					DeviceInfo: &types.Description{Label: "PCI controller 0", Summary: "PCI controller 0"},
+				},
+				BusNumber: 0,
+				Device:    []int32{500, 12000},
+			},
+		},
+		&types.VirtualSIOController{
+			VirtualController: types.VirtualController{
+				VirtualDevice: types.VirtualDevice{
+					Key:        400,
+					DeviceInfo: &types.Description{Label: "SIO controller 0", Summary: "SIO controller 0"},
+				},
+				BusNumber: 0,
+			},
+		},
+		&types.VirtualKeyboard{
+			VirtualDevice: types.VirtualDevice{
+				Key:           600,
+				DeviceInfo:    &types.Description{Label: "Keyboard ", Summary: "Keyboard"},
+				ControllerKey: 300,
+				UnitNumber:    newInt32(0),
+			},
+		},
+		&types.VirtualPointingDevice{
+			VirtualDevice: types.VirtualDevice{
+				Key:        700,
+				DeviceInfo: &types.Description{Label: "Pointing device", Summary: "Pointing device; Device"},
+				Backing: &types.VirtualPointingDeviceDeviceBackingInfo{
+					VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: "", UseAutoDetect: types.NewBool(false)},
+					HostPointingDevice:             "autodetect",
+				},
+				ControllerKey: 300,
+				UnitNumber:    newInt32(1),
+			},
+		},
+		&types.VirtualMachineVideoCard{
+			VirtualDevice: types.VirtualDevice{
+				Key:           500,
+				DeviceInfo:    &types.Description{Label: "Video card ", Summary: "Video card"},
+				ControllerKey: 100,
+				UnitNumber:    newInt32(0),
+			},
+			VideoRamSizeInKB: 4096,
+			NumDisplays:      1,
+			UseAutoDetect:    types.NewBool(false),
+			Enable3DSupport:  types.NewBool(false),
+			Use3dRenderer:    "automatic",
+		},
+		&types.VirtualMachineVMCIDevice{
+			VirtualDevice: types.VirtualDevice{
+				Key:           12000,
+				DeviceInfo:    &types.Description{Label: "VMCI device", Summary: "Device on the virtual machine PCI bus that provides support for the virtual machine communication interface"},
+				ControllerKey: 100,
+				UnitNumber:    newInt32(17),
+			},
+			AllowUnrestrictedCommunication: types.NewBool(false),
+		},
+	},
+}
+
+func newInt32(n int32) *int32 {
+	return &n
+}
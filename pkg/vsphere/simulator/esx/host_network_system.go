@@ -0,0 +1,69 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package esx
+
+import "github.com/vmware/govmomi/vim25/types"
+
+// HostNetworkInfo is the default value of the HostNetworkSystem networkInfo property: the standard
+// switch vSwitch0 uplinked to vmnic0, with the VM and management port groups
+var HostNetworkInfo = types.HostNetworkInfo{
+	Vswitch: []types.HostVirtualSwitch{
+		{
+			Name:              "vSwitch0",
+			Key:               "key-vim.host.VirtualSwitch-vSwitch0",
+			NumPorts:          1536,
+			NumPortsAvailable: 1530,
+			Mtu:               1500,
+			Portgroup: []string{
+				"key-vim.host.PortGroup-VM Network",
+				"key-vim.host.PortGroup-Management Network",
+			},
+			Pnic: []string{"key-vim.host.PhysicalNic-vmnic0"},
+			Spec: types.HostVirtualSwitchSpec{
+				NumPorts: 128,
+				Bridge:   &types.HostVirtualSwitchBondBridge{NicDevice: []string{"vmnic0"}},
+				Mtu:      1500,
+			},
+		},
+	},
+	Portgroup: []types.HostPortGroup{
+		{
+			Key:     "key-vim.host.PortGroup-VM Network",
+			Vswitch: "key-vim.host.VirtualSwitch-vSwitch0",
+			Spec: types.HostPortGroupSpec{
+				Name:        "VM Network",
+				VswitchName: "vSwitch0",
+			},
+		},
+		{
+			Key:     "key-vim.host.PortGroup-Management Network",
+			Vswitch: "key-vim.host.VirtualSwitch-vSwitch0",
+			Spec: types.HostPortGroupSpec{
+				Name:        "Management Network",
+				VswitchName: "vSwitch0",
+			},
+		},
+	},
+	Pnic: []types.PhysicalNic{
+		{
+			Key:       "key-vim.host.PhysicalNic-vmnic0",
+			Device:    "vmnic0",
+			Pci:       "0000:0b:00.0",
+			Driver:    "vmxnet3",
+			LinkSpeed: &types.PhysicalNicLinkInfo{SpeedMb: 10000, Duplex: true},
+			Mac:       "00:0c:29:81:d8:a0",
+		},
+	},
+}
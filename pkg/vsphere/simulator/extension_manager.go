@@ -0,0 +1,127 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"sync"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type ExtensionManager struct {
+	mo.ExtensionManager
+
+	m sync.Mutex
+}
+
+func NewExtensionManager(ref types.ManagedObjectReference) object.Reference {
+	m := &ExtensionManager{}
+	m.Self = ref
+	return m
+}
+
+// find returns the index of the extension with the given key, -1 if there's no such extension
+func (m *ExtensionManager) find(key string) int {
+	for i, e := range m.ExtensionList {
+		if e.Key == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (m *ExtensionManager) RegisterExtension(req *types.RegisterExtension) soap.HasFault {
+	body := &methods.RegisterExtensionBody{}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if req.Extension.Key == "" || m.find(req.Extension.Key) != -1 {
+		body.Fault_ = Fault("", &types.InvalidArgument{InvalidProperty: "extension.key"})
+		return body
+	}
+
+	extension := req.Extension
+	extension.LastHeartbeatTime = now()
+	m.ExtensionList = append(m.ExtensionList, extension)
+
+	body.Res = &types.RegisterExtensionResponse{}
+
+	return body
+}
+
+func (m *ExtensionManager) UnregisterExtension(req *types.UnregisterExtension) soap.HasFault {
+	body := &methods.UnregisterExtensionBody{}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	i := m.find(req.ExtensionKey)
+	if i == -1 {
+		body.Fault_ = Fault("", &types.NotFound{})
+		return body
+	}
+
+	m.ExtensionList = append(m.ExtensionList[:i], m.ExtensionList[i+1:]...)
+
+	body.Res = &types.UnregisterExtensionResponse{}
+
+	return body
+}
+
+// FindExtension returns the extension with the given key, or no value if there's no such extension
+func (m *ExtensionManager) FindExtension(req *types.FindExtension) soap.HasFault {
+	body := &methods.FindExtensionBody{
+		Res: &types.FindExtensionResponse{},
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if i := m.find(req.ExtensionKey); i != -1 {
+		extension := m.ExtensionList[i]
+		body.Res.Returnval = &extension
+	}
+
+	return body
+}
+
+// findExtension returns the registered extension with the given key, nil if there's none
+func findExtension(key string) *types.Extension {
+	si, ok := Map.Get(serviceInstance).(*ServiceInstance)
+	if !ok || si.Content.ExtensionManager == nil {
+		return nil
+	}
+
+	m, ok := Map.Get(*si.Content.ExtensionManager).(*ExtensionManager)
+	if !ok {
+		return nil
+	}
+
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if i := m.find(key); i != -1 {
+		extension := m.ExtensionList[i]
+		return &extension
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/vc"
+)
+
+func TestExtensionManager(t *testing.T) {
+	s := New(NewServiceInstance(vc.ServiceContent, vc.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := object.NewExtensionManager(client.Client)
+	sm := session.NewManager(client.Client)
+
+	extension := types.Extension{
+		Key:     "com.vmware.vic",
+		Version: "1.0",
+		Description: &types.Description{
+			Label:   "VIC",
+			Summary: "vSphere Integrated Containers",
+		},
+	}
+
+	// logging in takes a registered extension
+	if err = sm.LoginExtensionByCertificate(ctx, extension.Key, ""); err == nil {
+		t.Error("expected login of an unknown extension to fail")
+	}
+
+	if err = m.Register(ctx, extension); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = m.Register(ctx, extension); err == nil {
+		t.Error("expected registering the extension twice to fail")
+	}
+
+	found, err := m.Find(ctx, extension.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.Version != extension.Version {
+		t.Fatalf("unexpected extension %#v", found)
+	}
+
+	if missing, _ := m.Find(ctx, "com.vmware.missing"); missing != nil {
+		t.Errorf("unexpected extension %#v", missing)
+	}
+
+	if err = sm.LoginExtensionByCertificate(ctx, extension.Key, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := sm.UserSession(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.UserName != extension.Key || user.FullName != "VIC" {
+		t.Errorf("unexpected session %#v", user)
+	}
+
+	if err = m.Unregister(ctx, extension.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := m.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected no extensions, got %d", len(list))
+	}
+
+	// unknown keys fault
+	em := Map.Get(m.Reference()).(*ExtensionManager)
+	res := em.UnregisterExtension(&types.UnregisterExtension{This: m.Reference(), ExtensionKey: extension.Key})
+	if _, ok := res.Fault().Detail.Fault.(*types.NotFound); !ok {
+		t.Errorf("unexpected fault %#v", res.Fault())
+	}
+
+	if err = sm.LoginExtensionByCertificate(ctx, extension.Key, ""); err == nil {
+		t.Error("expected login of an unregistered extension to fail")
+	}
+}
@@ -48,6 +48,20 @@ func (f *Folder) hasChildType(kind string) bool {
 	return false
 }
 
+// findChild returns the child entity with the given name
+func (f *Folder) findChild(name string) (types.ManagedObjectReference, bool) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for _, ref := range f.ChildEntity {
+		if e, ok := Map.Get(ref).(mo.Entity); ok && entityName(e) == name {
+			return ref, true
+		}
+	}
+
+	return types.ManagedObjectReference{}, false
+}
+
 func (f *Folder) typeNotSupported() *soap.Fault {
 	return Fault(fmt.Sprintf("%s supports types: %#v", f.Self, f.ChildType), &types.NotSupported{})
 }
@@ -60,7 +74,6 @@ func (f *Folder) CreateFolder(c *types.CreateFolder) soap.HasFault {
 
 		folder.Name = c.Name
 		folder.ChildType = f.ChildType
-		folder.ChildEntity = f.ChildEntity
 
 		f.putChild(folder)
 
@@ -78,6 +91,11 @@ func (f *Folder) CreateDatacenter(c *types.CreateDatacenter) soap.HasFault {
 	r := &methods.CreateDatacenterBody{}
 
 	if f.hasChildType("Datacenter") && f.hasChildType("Folder") {
+		if ref, ok := f.findChild(c.Name); ok {
+			r.Fault_ = Fault("", &types.DuplicateName{Name: c.Name, Object: ref})
+			return r
+		}
+
 		dc := &mo.Datacenter{}
 
 		dc.Name = c.Name
@@ -95,3 +113,102 @@ func (f *Folder) CreateDatacenter(c *types.CreateDatacenter) soap.HasFault {
 
 	return r
 }
+
+func (f *Folder) CreateVM_Task(c *types.CreateVM_Task) soap.HasFault {
+	r := &methods.CreateVM_TaskBody{}
+
+	if !f.hasChildType("VirtualMachine") {
+		r.Fault_ = f.typeNotSupported()
+		return r
+	}
+
+	task := NewTask(f, "Folder.createVm", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		if ref, ok := f.findChild(c.Config.Name); ok {
+			return nil, &types.DuplicateName{Name: c.Config.Name, Object: ref}
+		}
+
+		files, fault := createVMFiles(findDatacenter(&f.Self), &c.Config)
+		if fault != nil {
+			return nil, fault
+		}
+
+		vm, fault := NewVirtualMachine(&c.Config)
+		if fault != nil {
+			files.remove()
+			return nil, fault
+		}
+
+		f.putVM(vm, &c.Pool, c.Host, files)
+
+		return vm.Self, nil
+	})
+
+	r.Res = &types.CreateVM_TaskResponse{
+		Returnval: task.Run(),
+	}
+
+	return r
+}
+
+// putVM adds the new VM to the folder, to the pool and its host, and to the datastores of its
+// files. The host defaults to that of the pool, a template has neither.
+func (f *Folder) putVM(vm *VirtualMachine, pool *types.ManagedObjectReference, host *types.ManagedObjectReference, files vmFiles) {
+	if pool != nil {
+		ref := *pool
+		vm.ResourcePool = &ref
+		if host == nil {
+			host = poolHost(ref)
+		}
+	}
+	vm.Runtime.Host = host
+	vm.Datastore = files.datastores()
+
+	f.putChild(vm)
+
+	vm.Summary.Vm = &vm.Self
+	vm.Summary.Runtime = vm.Runtime
+
+	if pool != nil {
+		if rp, ok := Map.Get(*pool).(*ResourcePool); ok {
+			rp.Vm = append(rp.Vm, vm.Self)
+		}
+	}
+
+	if host != nil {
+		if h, ok := Map.Get(*host).(*HostSystem); ok {
+			h.Vm = append(h.Vm, vm.Self)
+		}
+	}
+
+	for _, ref := range vm.Datastore {
+		if ds, ok := Map.Get(ref).(*Datastore); ok {
+			ds.Vm = append(ds.Vm, vm.Self)
+		}
+	}
+}
+
+func (f *Folder) CreateDVS_Task(c *types.CreateDVS_Task) soap.HasFault {
+	r := &methods.CreateDVS_TaskBody{}
+
+	if !f.hasChildType("DistributedVirtualSwitch") {
+		r.Fault_ = f.typeNotSupported()
+		return r
+	}
+
+	task := NewTask(f, "Folder.createDistributedVirtualSwitch", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		dvs, fault := NewVmwareDistributedVirtualSwitch(c.Spec.ConfigSpec)
+		if fault != nil {
+			return nil, fault
+		}
+
+		f.putChild(dvs)
+
+		return dvs.Self, nil
+	})
+
+	r.Res = &types.CreateDVS_TaskResponse{
+		Returnval: task.Run(),
+	}
+
+	return r
+}
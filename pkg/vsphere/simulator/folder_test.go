@@ -18,6 +18,7 @@ import (
 	"testing"
 
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
@@ -106,3 +107,66 @@ func TestFolderFaults(t *testing.T) {
 		t.Error("expected fault")
 	}
 }
+
+func TestFolderCreateDatacenter(t *testing.T) {
+	s := New(NewServiceInstance(vc.ServiceContent, vc.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseline := entities()
+
+	root := object.NewRootFolder(c.Client)
+
+	dc, err := root.CreateDatacenter(ctx, "dc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = root.CreateDatacenter(ctx, "dc1"); err == nil {
+		t.Error("expected duplicate name error")
+	}
+
+	// the standard folders are created and linked
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := find.NewFinder(c.Client, false)
+
+	for _, f := range []*object.Folder{folders.VmFolder, folders.HostFolder, folders.DatastoreFolder, folders.NetworkFolder} {
+		e, ok := Map.Get(f.Reference()).(*Folder)
+		if !ok {
+			t.Fatalf("folder %s not found", f.Reference())
+		}
+
+		if *e.Parent != dc.Reference() {
+			t.Errorf("folder %s parent is %s", e.Name, e.Parent)
+		}
+
+		// and navigable by inventory path
+		if _, err = finder.Folder(ctx, "/dc1/"+e.Name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	task, err := dc.Destroy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// the folders go with the datacenter
+	if n := entities(); n != baseline {
+		t.Errorf("%d entities left, expected %d", n, baseline)
+	}
+}
@@ -0,0 +1,404 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+// HostNetworkSystem manages the standard switches and port groups of a host.  Each port group is
+// backed by a Network of the same name, attached to the host along with the port group.
+type HostNetworkSystem struct {
+	mo.HostNetworkSystem
+
+	host *HostSystem
+
+	m sync.Mutex
+}
+
+func NewHostNetworkSystem(host *HostSystem) *HostNetworkSystem {
+	s := &HostNetworkSystem{host: host}
+
+	s.Self = *host.ConfigManager.NetworkSystem
+	s.NetworkInfo = copyNetworkInfo(&esx.HostNetworkInfo)
+
+	return s
+}
+
+// copyNetworkInfo returns a deep copy of info, the changes are applied to a copy so that the
+// networkInfo is left untouched by a change that faults
+func copyNetworkInfo(info *types.HostNetworkInfo) *types.HostNetworkInfo {
+	return deepCopy(reflect.ValueOf(info)).Interface().(*types.HostNetworkInfo)
+}
+
+// portGroupNetwork returns the reference of the Network backing the port group
+func portGroupNetwork(name string) types.ManagedObjectReference {
+	return types.ManagedObjectReference{Type: "Network", Value: "HaNetwork-" + name}
+}
+
+func findVirtualSwitch(info *types.HostNetworkInfo, name string) int {
+	for i := range info.Vswitch {
+		if info.Vswitch[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func findPortGroup(info *types.HostNetworkInfo, name string) int {
+	for i := range info.Portgroup {
+		if info.Portgroup[i].Spec.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// removeString returns a copy of values without s
+func removeString(values []string, s string) []string {
+	var res []string
+	for _, v := range values {
+		if v != s {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// switchPnics returns the keys of the physical NICs the spec uplinks the switch to
+func switchPnics(info *types.HostNetworkInfo, spec *types.HostVirtualSwitchSpec) ([]string, types.BaseMethodFault) {
+	bridge, ok := spec.Bridge.(*types.HostVirtualSwitchBondBridge)
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []string
+	for _, device := range bridge.NicDevice {
+		found := false
+		for _, pnic := range info.Pnic {
+			if pnic.Device == device {
+				keys = append(keys, pnic.Key)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, &types.NotFound{}
+		}
+	}
+
+	return keys, nil
+}
+
+func addVirtualSwitch(info *types.HostNetworkInfo, name string, spec *types.HostVirtualSwitchSpec) types.BaseMethodFault {
+	if findVirtualSwitch(info, name) != -1 {
+		return &types.AlreadyExists{Name: name}
+	}
+
+	if spec == nil {
+		spec = &types.HostVirtualSwitchSpec{NumPorts: 128}
+	}
+
+	pnics, fault := switchPnics(info, spec)
+	if fault != nil {
+		return fault
+	}
+
+	vswitch := types.HostVirtualSwitch{
+		Name:              name,
+		Key:               "key-vim.host.VirtualSwitch-" + name,
+		NumPorts:          spec.NumPorts,
+		NumPortsAvailable: spec.NumPorts,
+		Mtu:               spec.Mtu,
+		Pnic:              pnics,
+		Spec:              *spec,
+	}
+	if vswitch.Mtu == 0 {
+		vswitch.Mtu = 1500
+	}
+
+	info.Vswitch = append(info.Vswitch, vswitch)
+
+	return nil
+}
+
+func updateVirtualSwitch(info *types.HostNetworkInfo, name string, spec *types.HostVirtualSwitchSpec) types.BaseMethodFault {
+	i := findVirtualSwitch(info, name)
+	if i == -1 {
+		return &types.NotFound{}
+	}
+
+	if spec == nil {
+		return &types.InvalidArgument{InvalidProperty: "spec"}
+	}
+
+	pnics, fault := switchPnics(info, spec)
+	if fault != nil {
+		return fault
+	}
+
+	vswitch := &info.Vswitch[i]
+	vswitch.NumPortsAvailable += spec.NumPorts - vswitch.NumPorts
+	vswitch.NumPorts = spec.NumPorts
+	if spec.Mtu != 0 {
+		vswitch.Mtu = spec.Mtu
+	}
+	vswitch.Pnic = pnics
+	vswitch.Spec = *spec
+
+	return nil
+}
+
+// removeVirtualSwitch removes the switch, which can't have port groups left
+func removeVirtualSwitch(info *types.HostNetworkInfo, name string) types.BaseMethodFault {
+	i := findVirtualSwitch(info, name)
+	if i == -1 {
+		return &types.NotFound{}
+	}
+
+	if len(info.Vswitch[i].Portgroup) != 0 {
+		return &types.ResourceInUse{Type: "HostVirtualSwitch", Name: name}
+	}
+
+	info.Vswitch = append(info.Vswitch[:i], info.Vswitch[i+1:]...)
+
+	return nil
+}
+
+func addPortGroup(info *types.HostNetworkInfo, spec *types.HostPortGroupSpec) types.BaseMethodFault {
+	if findPortGroup(info, spec.Name) != -1 {
+		return &types.AlreadyExists{Name: spec.Name}
+	}
+
+	i := findVirtualSwitch(info, spec.VswitchName)
+	if i == -1 {
+		return &types.NotFound{}
+	}
+
+	vswitch := &info.Vswitch[i]
+	key := "key-vim.host.PortGroup-" + spec.Name
+
+	info.Portgroup = append(info.Portgroup, types.HostPortGroup{
+		Key:     key,
+		Vswitch: vswitch.Key,
+		Spec:    *spec,
+	})
+	vswitch.Portgroup = append(vswitch.Portgroup, key)
+
+	return nil
+}
+
+// updatePortGroup replaces the spec of the port group, moving it to another switch if the spec
+// names one.  The port group can't be renamed.
+func updatePortGroup(info *types.HostNetworkInfo, spec *types.HostPortGroupSpec) types.BaseMethodFault {
+	i := findPortGroup(info, spec.Name)
+	if i == -1 {
+		return &types.NotFound{}
+	}
+
+	pg := &info.Portgroup[i]
+
+	if spec.VswitchName != pg.Spec.VswitchName {
+		to := findVirtualSwitch(info, spec.VswitchName)
+		if to == -1 {
+			return &types.NotFound{}
+		}
+
+		if from := findVirtualSwitch(info, pg.Spec.VswitchName); from != -1 {
+			info.Vswitch[from].Portgroup = removeString(info.Vswitch[from].Portgroup, pg.Key)
+		}
+		info.Vswitch[to].Portgroup = append(info.Vswitch[to].Portgroup, pg.Key)
+		pg.Vswitch = info.Vswitch[to].Key
+	}
+
+	pg.Spec = *spec
+
+	return nil
+}
+
+// removePortGroup removes the port group, which can't be removed while VMs use its network
+func removePortGroup(info *types.HostNetworkInfo, name string) types.BaseMethodFault {
+	i := findPortGroup(info, name)
+	if i == -1 {
+		return &types.NotFound{}
+	}
+
+	if network, ok := Map.Get(portGroupNetwork(name)).(*mo.Network); ok && len(network.Vm) != 0 {
+		return &types.ResourceInUse{Type: "Network", Name: name}
+	}
+
+	pg := info.Portgroup[i]
+	if s := findVirtualSwitch(info, pg.Spec.VswitchName); s != -1 {
+		info.Vswitch[s].Portgroup = removeString(info.Vswitch[s].Portgroup, pg.Key)
+	}
+
+	info.Portgroup = append(info.Portgroup[:i], info.Portgroup[i+1:]...)
+
+	return nil
+}
+
+// update applies change to a copy of the networkInfo, which replaces the networkInfo unless the
+// change faults.  The networks of the port groups that were added or removed are attached to or
+// detached from the host.
+func (s *HostNetworkSystem) update(change func(info *types.HostNetworkInfo) types.BaseMethodFault) types.BaseMethodFault {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	info := copyNetworkInfo(s.NetworkInfo)
+	if fault := change(info); fault != nil {
+		return fault
+	}
+
+	before := make(map[string]bool)
+	for _, pg := range s.NetworkInfo.Portgroup {
+		before[pg.Spec.Name] = true
+	}
+
+	for _, pg := range info.Portgroup {
+		if before[pg.Spec.Name] {
+			delete(before, pg.Spec.Name)
+			continue
+		}
+
+		network, ok := Map.Get(portGroupNetwork(pg.Spec.Name)).(*mo.Network)
+		if !ok {
+			network = &mo.Network{}
+			network.Self = portGroupNetwork(pg.Spec.Name)
+			network.Name = pg.Spec.Name
+		}
+		s.host.attachNetwork(network)
+	}
+
+	for name := range before {
+		if network, ok := Map.Get(portGroupNetwork(name)).(*mo.Network); ok {
+			s.host.detachNetwork(network)
+		}
+	}
+
+	s.NetworkInfo = info
+
+	return nil
+}
+
+func (s *HostNetworkSystem) AddPortGroup(req *types.AddPortGroup) soap.HasFault {
+	r := &methods.AddPortGroupBody{}
+
+	fault := s.update(func(info *types.HostNetworkInfo) types.BaseMethodFault {
+		return addPortGroup(info, &req.Portgrp)
+	})
+	if fault != nil {
+		r.Fault_ = Fault("", fault)
+		return r
+	}
+
+	r.Res = &types.AddPortGroupResponse{}
+
+	return r
+}
+
+func (s *HostNetworkSystem) RemovePortGroup(req *types.RemovePortGroup) soap.HasFault {
+	r := &methods.RemovePortGroupBody{}
+
+	fault := s.update(func(info *types.HostNetworkInfo) types.BaseMethodFault {
+		return removePortGroup(info, req.PgName)
+	})
+	if fault != nil {
+		r.Fault_ = Fault("", fault)
+		return r
+	}
+
+	r.Res = &types.RemovePortGroupResponse{}
+
+	return r
+}
+
+// UpdateNetworkConfig applies the switch and port group changes of the config.  The switches are
+// added and edited first, then the port groups are changed and the switches are removed last, so
+// that a switch can be removed along with its port groups.  Only the modify mode is supported.
+func (s *HostNetworkSystem) UpdateNetworkConfig(req *types.UpdateNetworkConfig) soap.HasFault {
+	r := &methods.UpdateNetworkConfigBody{}
+
+	if req.ChangeMode != string(types.HostConfigChangeModeModify) {
+		r.Fault_ = Fault("", &types.NotSupported{})
+		return r
+	}
+
+	fault := s.update(func(info *types.HostNetworkInfo) types.BaseMethodFault {
+		for _, c := range req.Config.Vswitch {
+			var fault types.BaseMethodFault
+			switch types.HostConfigChangeOperation(c.ChangeOperation) {
+			case types.HostConfigChangeOperationAdd:
+				fault = addVirtualSwitch(info, c.Name, c.Spec)
+			case types.HostConfigChangeOperationEdit, "":
+				fault = updateVirtualSwitch(info, c.Name, c.Spec)
+			case types.HostConfigChangeOperationRemove:
+				continue
+			default:
+				fault = &types.InvalidArgument{InvalidProperty: "changeOperation"}
+			}
+			if fault != nil {
+				return fault
+			}
+		}
+
+		for _, c := range req.Config.Portgroup {
+			if c.Spec == nil {
+				return &types.InvalidArgument{InvalidProperty: "spec"}
+			}
+
+			var fault types.BaseMethodFault
+			switch types.HostConfigChangeOperation(c.ChangeOperation) {
+			case types.HostConfigChangeOperationAdd:
+				fault = addPortGroup(info, c.Spec)
+			case types.HostConfigChangeOperationEdit, "":
+				fault = updatePortGroup(info, c.Spec)
+			case types.HostConfigChangeOperationRemove:
+				fault = removePortGroup(info, c.Spec.Name)
+			default:
+				fault = &types.InvalidArgument{InvalidProperty: "changeOperation"}
+			}
+			if fault != nil {
+				return fault
+			}
+		}
+
+		for _, c := range req.Config.Vswitch {
+			if types.HostConfigChangeOperation(c.ChangeOperation) == types.HostConfigChangeOperationRemove {
+				if fault := removeVirtualSwitch(info, c.Name); fault != nil {
+					return fault
+				}
+			}
+		}
+
+		return nil
+	})
+	if fault != nil {
+		r.Fault_ = Fault("", fault)
+		return r
+	}
+
+	r.Res = &types.UpdateNetworkConfigResponse{
+		Returnval: types.HostNetworkConfigResult{},
+	}
+
+	return r
+}
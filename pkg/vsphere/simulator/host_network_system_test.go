@@ -0,0 +1,215 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestHostNetworkSystem(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := find.NewFinder(client.Client, false)
+
+	dc, err := finder.DatacenterOrDefault(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder.SetDatacenter(dc)
+
+	host, err := finder.HostSystemOrDefault(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ns, err := host.ConfigManager().NetworkSystem(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	networkInfo := func() *types.HostNetworkInfo {
+		var o mo.HostNetworkSystem
+		if err := ns.Properties(ctx, ns.Reference(), []string{"networkInfo"}, &o); err != nil {
+			t.Fatal(err)
+		}
+		return o.NetworkInfo
+	}
+
+	portGroups := func() map[string]string {
+		groups := make(map[string]string)
+		for _, pg := range networkInfo().Portgroup {
+			groups[pg.Spec.Name] = pg.Spec.VswitchName
+		}
+		return groups
+	}
+
+	// the faults are checked in process, as the methods are invoked on the object directly
+	system := Map.Get(ns.Reference()).(*HostNetworkSystem)
+	fault := func(res soap.HasFault) types.BaseMethodFault {
+		if res.Fault() == nil {
+			t.Fatal("expected a fault")
+		}
+		return res.Fault().Detail.Fault.(types.BaseMethodFault)
+	}
+
+	info := networkInfo()
+	if len(info.Vswitch) != 1 || len(info.Pnic) != 1 || len(info.Portgroup) != 2 {
+		t.Fatalf("unexpected default network info %#v", info)
+	}
+
+	// the change is reported to the property collector
+	changed := make(chan struct{})
+	go func() {
+		defer close(changed)
+
+		pc := property.DefaultCollector(client.Client)
+		err := property.Wait(ctx, pc, ns.Reference(), []string{"networkInfo"}, func(changes []types.PropertyChange) bool {
+			for _, c := range changes {
+				if info, ok := c.Val.(types.HostNetworkInfo); ok {
+					return findPortGroup(&info, "VCH Network") != -1
+				}
+			}
+			return false
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	spec := types.HostPortGroupSpec{Name: "VCH Network", VlanId: 10, VswitchName: "vSwitch0"}
+	if err = ns.AddPortGroup(ctx, spec); err != nil {
+		t.Fatal(err)
+	}
+	<-changed
+
+	if groups := portGroups(); groups["VCH Network"] != "vSwitch0" {
+		t.Errorf("port group wasn't added: %v", groups)
+	}
+
+	info = networkInfo()
+	if pg := info.Portgroup[findPortGroup(info, "VCH Network")]; pg.Spec.VlanId != 10 || pg.Vswitch != info.Vswitch[0].Key {
+		t.Errorf("unexpected port group %#v", pg)
+	}
+	if keys := info.Vswitch[0].Portgroup; len(keys) != 3 || keys[2] != "key-vim.host.PortGroup-VCH Network" {
+		t.Errorf("port group isn't on the switch: %v", keys)
+	}
+
+	// the port group is backed by a network of the host
+	network, err := finder.Network(ctx, "VCH Network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := Map.Get(network.Reference()).(*mo.Network); len(n.Host) != 1 || n.Host[0] != host.Reference() {
+		t.Errorf("network isn't attached to the host: %v", n.Host)
+	}
+
+	if _, ok := fault(system.AddPortGroup(&types.AddPortGroup{Portgrp: spec})).(*types.AlreadyExists); !ok {
+		t.Error("expected AlreadyExists")
+	}
+
+	missing := types.HostPortGroupSpec{Name: "Missing", VswitchName: "vSwitch1"}
+	if _, ok := fault(system.AddPortGroup(&types.AddPortGroup{Portgrp: missing})).(*types.NotFound); !ok {
+		t.Error("expected NotFound")
+	}
+
+	// add a switch and move the port group to it
+	_, err = ns.UpdateNetworkConfig(ctx, types.HostNetworkConfig{
+		Vswitch: []types.HostVirtualSwitchConfig{
+			{ChangeOperation: string(types.HostConfigChangeOperationAdd), Name: "vSwitch1", Spec: &types.HostVirtualSwitchSpec{NumPorts: 64}},
+		},
+		Portgroup: []types.HostPortGroupConfig{
+			{ChangeOperation: string(types.HostConfigChangeOperationEdit), Spec: &types.HostPortGroupSpec{Name: "VCH Network", VswitchName: "vSwitch1"}},
+			{ChangeOperation: string(types.HostConfigChangeOperationAdd), Spec: &types.HostPortGroupSpec{Name: "Bridge", VswitchName: "vSwitch1"}},
+		},
+	}, string(types.HostConfigChangeModeModify))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if groups := portGroups(); groups["VCH Network"] != "vSwitch1" || groups["Bridge"] != "vSwitch1" {
+		t.Errorf("port groups weren't moved: %v", groups)
+	}
+	info = networkInfo()
+	if keys := info.Vswitch[0].Portgroup; len(keys) != 2 {
+		t.Errorf("port group is still on the old switch: %v", keys)
+	}
+
+	// a faulting change leaves the config untouched
+	res := system.UpdateNetworkConfig(&types.UpdateNetworkConfig{
+		Config: types.HostNetworkConfig{
+			Portgroup: []types.HostPortGroupConfig{
+				{ChangeOperation: string(types.HostConfigChangeOperationRemove), Spec: &types.HostPortGroupSpec{Name: "Bridge"}},
+				{ChangeOperation: string(types.HostConfigChangeOperationRemove), Spec: &types.HostPortGroupSpec{Name: "Missing"}},
+			},
+		},
+		ChangeMode: string(types.HostConfigChangeModeModify),
+	})
+	if _, ok := fault(res).(*types.NotFound); !ok {
+		t.Error("expected NotFound")
+	}
+	if groups := portGroups(); groups["Bridge"] == "" {
+		t.Errorf("port group was removed: %v", groups)
+	}
+
+	if err = ns.RemovePortGroup(ctx, "VCH Network"); err != nil {
+		t.Fatal(err)
+	}
+	if groups := portGroups(); groups["VCH Network"] != "" {
+		t.Errorf("port group wasn't removed: %v", groups)
+	}
+	if _, err = finder.Network(ctx, "VCH Network"); err == nil {
+		t.Error("network wasn't removed along with the port group")
+	}
+
+	if _, ok := fault(system.RemovePortGroup(&types.RemovePortGroup{PgName: "VCH Network"})).(*types.NotFound); !ok {
+		t.Error("expected NotFound")
+	}
+
+	// the switch goes along with its last port group
+	_, err = ns.UpdateNetworkConfig(ctx, types.HostNetworkConfig{
+		Vswitch: []types.HostVirtualSwitchConfig{
+			{ChangeOperation: string(types.HostConfigChangeOperationRemove), Name: "vSwitch1"},
+		},
+		Portgroup: []types.HostPortGroupConfig{
+			{ChangeOperation: string(types.HostConfigChangeOperationRemove), Spec: &types.HostPortGroupSpec{Name: "Bridge"}},
+		},
+	}, string(types.HostConfigChangeModeModify))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info = networkInfo(); len(info.Vswitch) != 1 || len(info.Portgroup) != 2 {
+		t.Errorf("unexpected network info %#v", info)
+	}
+}
@@ -15,10 +15,13 @@
 package simulator
 
 import (
+	"fmt"
 	"strings"
-	"time"
 
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
 	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
 )
 
@@ -27,11 +30,11 @@ type HostSystem struct {
 }
 
 func NewHostSystem(host mo.HostSystem) *HostSystem {
-	now := time.Now()
+	boot := now()
 
 	host.Name = host.Summary.Config.Name
 	host.Summary.Runtime = &host.Runtime
-	host.Summary.Runtime.BootTime = &now
+	host.Summary.Runtime.BootTime = &boot
 
 	return &HostSystem{
 		HostSystem: host,
@@ -39,20 +42,18 @@ func NewHostSystem(host mo.HostSystem) *HostSystem {
 }
 
 // CreateDefaultESX creates a standalone ESX
-// Adds objects of type: Datacenter, Network, ComputeResource, ResourcePool and HostSystem
+// Adds objects of type: Datacenter, Network, Datastore, ComputeResource, ResourcePool and HostSystem
 func CreateDefaultESX(f *Folder) {
-	dc := &esx.Datacenter
-	createDatacenterFolders(dc, false)
-	f.putChild(dc)
+	dc := esx.Datacenter
+	createDatacenterFolders(&dc, false)
+	// the networks and datastores are added back as they're attached to the host
+	dc.Network = nil
+	dc.Datastore = nil
+	f.putChild(&dc)
 
 	host := NewHostSystem(esx.HostSystem)
-
-	for _, ref := range host.Network {
-		network := &mo.Network{}
-		network.Self = ref
-		network.Name = strings.Split(ref.Value, "-")[1]
-		Map.Get(dc.NetworkFolder).(*Folder).putChild(network)
-	}
+	networks := host.Network
+	host.Network = nil
 
 	cr := &mo.ComputeResource{}
 	cr.Self = *host.Parent
@@ -60,9 +61,209 @@ func CreateDefaultESX(f *Folder) {
 	cr.Host = append(cr.Host, host.Reference())
 	Map.PutEntity(cr, host)
 
-	pool := esx.ResourcePool
+	browser := NewEnvironmentBrowser(esx.EnvironmentBrowser, cr.Self)
+	cr.EnvironmentBrowser = &browser.Self
+	Map.Put(browser)
+
+	pool := NewResourcePool(esx.ResourcePool)
 	cr.ResourcePool = &pool.Self
-	Map.PutEntity(cr, &pool)
+	Map.PutEntity(cr, pool)
 
 	Map.Get(dc.HostFolder).(*Folder).putChild(cr)
+
+	for _, ref := range networks {
+		network := &mo.Network{}
+		network.Self = ref
+		network.Name = strings.Split(ref.Value, "-")[1]
+		host.attachNetwork(network)
+	}
+
+	host.attachDatastore(NewDatastore(esx.Datastore))
+
+	Map.Put(NewHostNetworkSystem(host))
+}
+
+// datacenter returns the Datacenter the host belongs to
+func (h *HostSystem) datacenter() *mo.Datacenter {
+	return findDatacenter(h.Parent)
+}
+
+// AddNetwork creates a Network in the host's Datacenter and attaches it to the host
+func (h *HostSystem) AddNetwork(name string) *mo.Network {
+	network := &mo.Network{}
+	network.Name = name
+
+	h.attachNetwork(network)
+
+	return network
+}
+
+// AddDatastore creates a local VMFS Datastore in the host's Datacenter and mounts it on the host
+func (h *HostSystem) AddDatastore(name string) *Datastore {
+	ds := esx.Datastore
+	ds.Self = Map.CreateReference(&ds)
+	ds.Name = name
+
+	url := fmt.Sprintf("ds:///vmfs/volumes/%s/", ds.Self.Value)
+
+	info := *ds.Info.GetDatastoreInfo()
+	info.Name = name
+	info.Url = url
+	ds.Info = &info
+
+	ds.Summary.Name = name
+	ds.Summary.Url = url
+
+	d := NewDatastore(ds)
+	h.attachDatastore(d)
+
+	return d
+}
+
+// attachNetwork adds the network to the network folder of the host's Datacenter, if it isn't already
+// registered, and wires up the host.network and network.host relationships
+func (h *HostSystem) attachNetwork(network *mo.Network) {
+	dc := h.datacenter()
+
+	if Map.Get(network.Self) == nil {
+		Map.Get(dc.NetworkFolder).(*Folder).putChild(network)
+		dc.Network = append(dc.Network, network.Self)
+	}
+
+	for _, ref := range h.Network {
+		if ref == network.Self {
+			return
+		}
+	}
+
+	network.Host = append(network.Host, h.Self)
+	h.Network = append(h.Network, network.Self)
+}
+
+// detachNetwork undoes attachNetwork, the network is removed from the Datacenter along with its
+// last host
+func (h *HostSystem) detachNetwork(network *mo.Network) {
+	h.Network = removeReference(h.Network, network.Self)
+	network.Host = removeReference(network.Host, h.Self)
+
+	if len(network.Host) != 0 {
+		return
+	}
+
+	dc := h.datacenter()
+	dc.Network = removeReference(dc.Network, network.Self)
+
+	folder := Map.Get(dc.NetworkFolder).(*Folder)
+	folder.m.Lock()
+	folder.ChildEntity = removeReference(folder.ChildEntity, network.Self)
+	folder.m.Unlock()
+
+	Map.Remove(network.Self)
+}
+
+// attachDatastore adds the datastore to the datastore folder of the host's Datacenter, if it isn't already
+// registered, and mounts it on the host
+func (h *HostSystem) attachDatastore(ds *Datastore) {
+	dc := h.datacenter()
+
+	if Map.Get(ds.Self) == nil {
+		Map.Get(dc.DatastoreFolder).(*Folder).putChild(ds)
+		dc.Datastore = append(dc.Datastore, ds.Self)
+	}
+
+	ds.Host = append(ds.Host, types.DatastoreHostMount{
+		Key: h.Self,
+		MountInfo: types.HostMountInfo{
+			Path:       strings.TrimPrefix(ds.Summary.Url, "ds://"),
+			AccessMode: string(types.HostMountModeReadWrite),
+			Mounted:    types.NewBool(true),
+			Accessible: types.NewBool(true),
+		},
+	})
+	ds.Summary.MultipleHostAccess = types.NewBool(len(ds.Host) > 1)
+
+	h.Datastore = append(h.Datastore, ds.Self)
+}
+
+// poweredOnVMs returns the VMs running on the host
+func (h *HostSystem) poweredOnVMs() []types.ManagedObjectReference {
+	var refs []types.ManagedObjectReference
+
+	for _, ref := range h.Vm {
+		vm, ok := Map.Get(ref).(*VirtualMachine)
+		if !ok {
+			continue
+		}
+
+		vm.m.Lock()
+		state := vm.Runtime.PowerState
+		vm.m.Unlock()
+
+		if state == types.VirtualMachinePowerStatePoweredOn {
+			refs = append(refs, ref)
+		}
+	}
+
+	return refs
+}
+
+// SetConnectionState sets the connection state of the host, as when it stops responding. The VMs
+// on the host are disconnected along with it, they're connected again once the host is.
+func (h *HostSystem) SetConnectionState(state types.HostSystemConnectionState) {
+	h.Runtime.ConnectionState = state
+	if h.Summary.Runtime != nil {
+		h.Summary.Runtime.ConnectionState = state
+	}
+
+	vmState := types.VirtualMachineConnectionStateDisconnected
+	if state == types.HostSystemConnectionStateConnected {
+		vmState = types.VirtualMachineConnectionStateConnected
+	}
+
+	for _, ref := range h.Vm {
+		if vm, ok := Map.Get(ref).(*VirtualMachine); ok {
+			vm.SetConnectionState(vmState)
+		}
+	}
+}
+
+// EnterMaintenanceMode_Task puts the host in maintenance mode. There's no DRS to evacuate the
+// VMs, so the task times out if any of them is powered on - as it does on a standalone ESX.
+func (h *HostSystem) EnterMaintenanceMode_Task(req *types.EnterMaintenanceMode_Task) soap.HasFault {
+	task := NewTask(h, "HostSystem.enterMaintenanceMode", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		if h.Runtime.InMaintenanceMode {
+			return nil, &types.InvalidState{}
+		}
+
+		if len(h.poweredOnVMs()) > 0 {
+			return nil, &types.Timedout{}
+		}
+
+		h.Runtime.InMaintenanceMode = true
+		return nil, nil
+	})
+
+	return &methods.EnterMaintenanceMode_TaskBody{
+		Res: &types.EnterMaintenanceMode_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// ExitMaintenanceMode_Task takes the host out of maintenance mode
+func (h *HostSystem) ExitMaintenanceMode_Task(req *types.ExitMaintenanceMode_Task) soap.HasFault {
+	task := NewTask(h, "HostSystem.exitMaintenanceMode", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		if !h.Runtime.InMaintenanceMode {
+			return nil, &types.InvalidState{}
+		}
+
+		h.Runtime.InMaintenanceMode = false
+		return nil, nil
+	})
+
+	return &methods.ExitMaintenanceMode_TaskBody{
+		Res: &types.ExitMaintenanceMode_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
 }
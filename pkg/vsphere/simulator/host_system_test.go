@@ -21,6 +21,10 @@ import (
 
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
 	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
 )
 
@@ -74,3 +78,205 @@ func TestDefaultESX(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestHostDatastoresAndNetworks(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := find.NewFinder(client.Client, false)
+
+	dc, err := finder.DatacenterOrDefault(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder.SetDatacenter(dc)
+
+	host, err := finder.HostSystemOrDefault(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := Map.Get(host.Reference()).(*HostSystem)
+	h.AddDatastore("datastore2")
+	h.AddNetwork("VCH Network")
+
+	for _, name := range []string{"datastore1", "datastore2"} {
+		if _, err = finder.Datastore(ctx, name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, name := range []string{"VM Network", "VCH Network"} {
+		if _, err = finder.Network(ctx, name); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// traverse from obj along path, returning the names of the objects of the given type
+	traverse := func(obj types.ManagedObjectReference, path string, kind string) map[types.ManagedObjectReference]string {
+		req := types.RetrievePropertiesEx{
+			This: client.ServiceContent.PropertyCollector,
+			SpecSet: []types.PropertyFilterSpec{
+				{
+					ObjectSet: []types.ObjectSpec{
+						{
+							Obj:  obj,
+							Skip: types.NewBool(true),
+							SelectSet: []types.BaseSelectionSpec{
+								&types.TraversalSpec{Type: obj.Type, Path: path},
+							},
+						},
+					},
+					PropSet: []types.PropertySpec{{Type: kind, PathSet: []string{"name"}}},
+				},
+			},
+		}
+
+		res, err := methods.RetrievePropertiesEx(ctx, client, &req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names := make(map[types.ManagedObjectReference]string)
+		for _, content := range res.Returnval.Objects {
+			if content.Obj.Type != kind {
+				continue
+			}
+			for _, prop := range content.PropSet {
+				names[content.Obj] = prop.Val.(string)
+			}
+		}
+		return names
+	}
+
+	datastores := traverse(host.Reference(), "datastore", "Datastore")
+	if len(datastores) != 2 {
+		t.Fatalf("host.datastore: %v", datastores)
+	}
+
+	for ref := range datastores {
+		hosts := traverse(ref, "host", "HostSystem")
+		if hosts[host.Reference()] != esx.HostSystem.Summary.Config.Name {
+			t.Errorf("%s.host: %v", ref, hosts)
+		}
+	}
+
+	networks := traverse(host.Reference(), "network", "Network")
+	if len(networks) != 2 {
+		t.Fatalf("host.network: %v", networks)
+	}
+
+	for ref := range networks {
+		hosts := traverse(ref, "host", "HostSystem")
+		if len(hosts) != 1 {
+			t.Errorf("%s.host: %v", ref, hosts)
+		}
+	}
+}
+
+func TestHostMaintenanceMode(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := find.NewFinder(client.Client, false)
+
+	dc, err := finder.DatacenterOrDefault(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder.SetDatacenter(dc)
+
+	host, err := finder.HostSystemOrDefault(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inMaintenanceMode := func() bool {
+		var mhost mo.HostSystem
+		if err := host.Properties(ctx, host.Reference(), []string{"runtime.inMaintenanceMode"}, &mhost); err != nil {
+			t.Fatal(err)
+		}
+		return mhost.Runtime.InMaintenanceMode
+	}
+
+	// fault returns the fault the task failed with, nil if it succeeded
+	fault := func(task *object.Task, err error) types.BaseMethodFault {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(ctx); err == nil {
+			return nil
+		}
+		return Map.Get(task.Reference()).(*Task).Info.Error.Fault
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{Name: "foo"})
+	if f := fault(vm.PowerOn(ctx)); f != nil {
+		t.Fatalf("%#v", f)
+	}
+
+	// the powered on VM can't be evacuated
+	if f := fault(host.EnterMaintenanceMode(ctx, 0, false, nil)); f == nil {
+		t.Fatal("expected entering maintenance mode to fail with a powered on VM")
+	} else if _, ok := f.(*types.Timedout); !ok {
+		t.Errorf("expected Timedout, got %#v", f)
+	}
+	if inMaintenanceMode() {
+		t.Error("host is in maintenance mode after the failed task")
+	}
+
+	if f := fault(vm.PowerOff(ctx)); f != nil {
+		t.Fatalf("%#v", f)
+	}
+
+	if f := fault(host.EnterMaintenanceMode(ctx, 0, false, nil)); f != nil {
+		t.Fatalf("failed to enter maintenance mode: %#v", f)
+	}
+	if !inMaintenanceMode() {
+		t.Error("host isn't in maintenance mode")
+	}
+
+	// nothing powers on in maintenance mode, and it can't be entered twice
+	if f := fault(vm.PowerOn(ctx)); f == nil {
+		t.Error("expected the power on to fail in maintenance mode")
+	} else if _, ok := f.(*types.InvalidHostState); !ok {
+		t.Errorf("expected InvalidHostState, got %#v", f)
+	}
+	if f := fault(host.EnterMaintenanceMode(ctx, 0, false, nil)); f == nil {
+		t.Error("expected entering maintenance mode twice to fail")
+	}
+
+	if f := fault(host.ExitMaintenanceMode(ctx, 0)); f != nil {
+		t.Fatalf("failed to exit maintenance mode: %#v", f)
+	}
+	if inMaintenanceMode() {
+		t.Error("host is still in maintenance mode")
+	}
+	if f := fault(host.ExitMaintenanceMode(ctx, 0)); f == nil {
+		t.Error("expected exiting maintenance mode twice to fail")
+	}
+
+	if f := fault(vm.PowerOn(ctx)); f != nil {
+		t.Errorf("failed to power on after maintenance mode: %#v", f)
+	}
+}
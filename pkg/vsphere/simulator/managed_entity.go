@@ -0,0 +1,173 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ManagedEntity implements the methods common to all managed entities, for registry
+// objects that don't implement them directly
+type ManagedEntity struct {
+	mo.Entity
+}
+
+func (e ManagedEntity) Destroy_Task(*types.Destroy_Task) soap.HasFault {
+	task := NewTask(e.Entity, "ManagedEntity.destroy", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		// the root pool goes with its ComputeResource
+		if pool, ok := e.Entity.(*ResourcePool); ok && pool.Parent != nil && pool.Parent.Type != "ResourcePool" {
+			return nil, &types.InvalidArgument{InvalidProperty: "ResourcePool"}
+		}
+
+		if fault := checkDestroy(e.Entity); fault != nil {
+			return nil, fault
+		}
+
+		destroyEntity(e.Entity)
+
+		return nil, nil
+	})
+
+	return &methods.Destroy_TaskBody{
+		Res: &types.Destroy_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// contents returns the entities that are destroyed along with e
+func contents(e mo.Entity) []types.ManagedObjectReference {
+	switch o := e.(type) {
+	case *Folder:
+		return o.ChildEntity
+	case *mo.Datacenter:
+		return []types.ManagedObjectReference{o.VmFolder, o.HostFolder, o.DatastoreFolder, o.NetworkFolder}
+	case *mo.ComputeResource:
+		refs := o.Host
+		if o.ResourcePool != nil {
+			refs = append(refs, *o.ResourcePool)
+		}
+		return refs
+	}
+
+	return nil
+}
+
+// checkDestroy returns a fault if e, or any of the entities it contains, can't be destroyed
+func checkDestroy(e mo.Entity) types.BaseMethodFault {
+	if vm, ok := e.(*VirtualMachine); ok && vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn {
+		return &types.InvalidPowerState{
+			RequestedState: types.VirtualMachinePowerStatePoweredOff,
+			ExistingState:  vm.Runtime.PowerState,
+		}
+	}
+
+	for _, ref := range contents(e) {
+		if child, ok := Map.Get(ref).(mo.Entity); ok {
+			if fault := checkDestroy(child); fault != nil {
+				return fault
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeReference returns a copy of refs without ref
+func removeReference(refs []types.ManagedObjectReference, ref types.ManagedObjectReference) []types.ManagedObjectReference {
+	var res []types.ManagedObjectReference
+
+	for _, r := range refs {
+		if r != ref {
+			res = append(res, r)
+		}
+	}
+
+	return res
+}
+
+// destroyEntity removes e and the entities it contains from the registry, detaching e from its parent.
+// Like vSphere, destroying a ResourcePool moves its child pools and VMs to the parent pool.
+func destroyEntity(e mo.Entity) {
+	self := e.Entity().Self
+
+	for _, ref := range contents(e) {
+		if child, ok := Map.Get(ref).(mo.Entity); ok {
+			destroyEntity(child)
+		}
+	}
+
+	if parent := e.Entity().Parent; parent != nil {
+		switch p := Map.Get(*parent).(type) {
+		case *Folder:
+			p.m.Lock()
+			p.ChildEntity = removeReference(p.ChildEntity, self)
+			p.m.Unlock()
+		case *ResourcePool:
+			p.ResourcePool.ResourcePool = removeReference(p.ResourcePool.ResourcePool, self)
+
+			if pool, ok := e.(*ResourcePool); ok {
+				reparentPool(pool, p)
+			}
+		case *mo.ComputeResource:
+			p.Host = removeReference(p.Host, self)
+			if p.ResourcePool != nil && *p.ResourcePool == self {
+				p.ResourcePool = nil
+			}
+		}
+	}
+
+	if vm, ok := e.(*VirtualMachine); ok {
+		// release the distributed ports of the NICs
+		vm.configureDVPorts(vm.Config.Hardware.Device, nil)
+
+		if vm.ResourcePool != nil {
+			if pool, ok := Map.Get(*vm.ResourcePool).(*ResourcePool); ok {
+				pool.Vm = removeReference(pool.Vm, self)
+			}
+		}
+
+		if vm.Runtime.Host != nil {
+			if host, ok := Map.Get(*vm.Runtime.Host).(*HostSystem); ok {
+				host.Vm = removeReference(host.Vm, self)
+			}
+		}
+	}
+
+	Map.Remove(self)
+}
+
+// reparentPool moves the child pools and VMs of pool to parent
+func reparentPool(pool *ResourcePool, parent *ResourcePool) {
+	for _, ref := range pool.ResourcePool.ResourcePool {
+		if child, ok := Map.Get(ref).(*ResourcePool); ok {
+			child.Parent = &parent.Self
+			parent.ResourcePool.ResourcePool = append(parent.ResourcePool.ResourcePool, ref)
+		}
+	}
+
+	for _, ref := range pool.Vm {
+		if vm, ok := Map.Get(ref).(*VirtualMachine); ok {
+			vm.ResourcePool = &parent.Self
+			parent.Vm = append(parent.Vm, ref)
+		}
+	}
+
+	pool.ResourcePool.ResourcePool = nil
+	pool.Vm = nil
+}
@@ -0,0 +1,210 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+	"github.com/vmware/vic/pkg/vsphere/simulator/vc"
+)
+
+// entities returns the number of managed entities in the registry
+func entities() int {
+	n := 0
+	Map.ForEach(func(o mo.Reference) {
+		if _, ok := o.(mo.Entity); ok {
+			n++
+		}
+	})
+
+	return n
+}
+
+func TestDestroyFolder(t *testing.T) {
+	s := New(NewServiceInstance(vc.ServiceContent, vc.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	baseline := entities()
+
+	root := object.NewRootFolder(c.Client)
+
+	folder, err := root.CreateFolder(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = folder.CreateFolder(ctx, "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := folder.CreateDatacenter(ctx, "dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := object.NewResourcePool(c.Client, esx.ResourcePool.Self)
+	task, err := folders.VmFolder.CreateVM(ctx, types.VirtualMachineConfigSpec{Name: "vm"}, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := Map.Get(info.Result.(types.ManagedObjectReference)).(*VirtualMachine)
+
+	// watch the root folder child list
+	pc, err := property.DefaultCollector(c.Client).Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Destroy(ctx)
+
+	err = pc.CreateFilter(ctx, types.CreateFilter{
+		Spec: types.PropertyFilterSpec{
+			ObjectSet: []types.ObjectSpec{{Obj: root.Reference()}},
+			PropSet:   []types.PropertySpec{{Type: "Folder", PathSet: []string{"childEntity"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := pc.WaitForUpdates(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// powered on VMs can't be destroyed
+	vm.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOn
+
+	task, err = folder.Destroy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err == nil {
+		t.Fatal("expected error destroying a powered on VM")
+	}
+
+	if Map.Get(folder.Reference()) == nil || Map.Get(vm.Reference()) == nil {
+		t.Fatal("failed destroy removed objects")
+	}
+
+	vm.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOff
+
+	task, err = folder.Destroy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := entities(); n != baseline {
+		t.Errorf("expected %d entities after destroy, got %d", baseline, n)
+	}
+
+	set, err = pc.WaitForUpdates(ctx, set.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set == nil || len(set.FilterSet) != 1 || len(set.FilterSet[0].ObjectSet) != 1 {
+		t.Fatalf("expected a single object update, got %#v", set)
+	}
+
+	update := set.FilterSet[0].ObjectSet[0]
+	if update.Kind != types.ObjectUpdateKindModify || update.Obj != root.Reference() {
+		t.Errorf("unexpected update %#v", update)
+	}
+
+	if len(update.ChangeSet) != 1 || update.ChangeSet[0].Name != "childEntity" {
+		t.Errorf("unexpected changes %#v", update.ChangeSet)
+	}
+}
+
+func TestDestroyVmESX(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, c, types.VirtualMachineConfigSpec{Name: "foo"})
+
+	pool := Map.Get(esx.ResourcePool.Self).(*ResourcePool)
+	if len(pool.Vm) != 1 {
+		t.Fatalf("expected VM in pool, got %d", len(pool.Vm))
+	}
+
+	task, err := vm.Destroy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if Map.Get(vm.Reference()) != nil {
+		t.Error("VM not removed from registry")
+	}
+
+	if len(pool.Vm) != 0 {
+		t.Errorf("VM not removed from pool")
+	}
+
+	// the root pool can't be destroyed on its own
+	task, err = object.NewResourcePool(c.Client, pool.Self).Destroy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err == nil {
+		t.Error("expected error destroying the root pool")
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Handler handles a decoded request, returning the response body
+type Handler func(ctx context.Context, method *Method) soap.HasFault
+
+// Middleware wraps the dispatch of each request.  It can act before and after calling next,
+// which handles the request, or respond without calling it at all.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware to the method dispatch.  The first one added is the outermost, seeing the
+// requests first and the responses last.
+func (s *Service) Use(m ...Middleware) {
+	s.middleware = append(s.middleware, m...)
+}
+
+// handler returns the method dispatch wrapped in the middleware
+func (s *Service) handler() Handler {
+	h := Handler(func(_ context.Context, method *Method) soap.HasFault {
+		return s.call(method)
+	})
+
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+
+	return h
+}
+
+// LogMethods returns a Middleware that logs each method with the object it was invoked on, the
+// time it took to handle and the fault it resulted in, if any
+func LogMethods(l *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, method *Method) soap.HasFault {
+			start := time.Now()
+			res := next(ctx, method)
+			this := method.This.Type + ":" + method.This.Value
+
+			if f := res.Fault(); f != nil {
+				l.Printf("%s %s: %s (%s)", method.Name, this, f.String, time.Since(start))
+			} else {
+				l.Printf("%s %s (%s)", method.Name, this, time.Since(start))
+			}
+
+			return res
+		}
+	}
+}
+
+// InjectLatency returns a Middleware that delays the handling of the methods by the given durations,
+// keyed by method name, to simulate a slow server.  The request is dropped if its context is done
+// while waiting.
+func InjectLatency(delays map[string]time.Duration) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, method *Method) soap.HasFault {
+			if delay, ok := delays[method.Name]; ok {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return serverFault(ctx.Err().Error())
+				}
+			}
+
+			return next(ctx, method)
+		}
+	}
+}
+
+// MethodPrivileges maps methods to the privilege they require, for use with CheckPrivileges
+var MethodPrivileges = map[string]string{
+	"CreateVM_Task":           "VirtualMachine.Inventory.Create",
+	"CloneVM_Task":            "VirtualMachine.Provisioning.Clone",
+	"MarkAsTemplate":          "VirtualMachine.Provisioning.MarkAsTemplate",
+	"MarkAsVirtualMachine":    "VirtualMachine.Provisioning.MarkAsVM",
+	"CreateSnapshot_Task":     "VirtualMachine.State.CreateSnapshot",
+	"RemoveAllSnapshots_Task": "VirtualMachine.State.RemoveSnapshot",
+	"ConsolidateVMDisks_Task": "VirtualMachine.Interact.DiskConsolidate",
+	"PowerOnVM_Task":          "VirtualMachine.Interact.PowerOn",
+	"PowerOffVM_Task":         "VirtualMachine.Interact.PowerOff",
+	"ReconfigVM_Task":         "VirtualMachine.Config.Settings",
+	"CreateFolder":            "Folder.Create",
+	"CreateDatacenter":        "Datacenter.Create",
+}
+
+// CheckPrivileges returns a Middleware that denies the methods, keyed by name, with a NoPermission
+// fault unless the user of the current session holds the privilege on the object the method is
+// invoked on. The privileges are granted by the permissions set through the AuthorizationManager.
+// Methods that aren't in the map are allowed.
+func CheckPrivileges(privileges map[string]string) Middleware {
+	return func(next Handler) Handler {
+		return func(ctx context.Context, method *Method) soap.HasFault {
+			privilege, ok := privileges[method.Name]
+			if !ok {
+				return next(ctx, method)
+			}
+
+			si, _ := Map.Get(serviceInstance).(*ServiceInstance)
+			if si == nil || si.Content.AuthorizationManager == nil {
+				return next(ctx, method)
+			}
+			am, ok := Map.Get(*si.Content.AuthorizationManager).(*AuthorizationManager)
+			if !ok {
+				return next(ctx, method)
+			}
+
+			var user string
+			if session := currentSession(); session != nil {
+				user = session.UserName
+			}
+
+			if !am.HasPrivilege(user, method.This, privilege) {
+				return &serverFaultBody{Reason: Fault("Permission to perform this operation was denied.", &types.NoPermission{
+					Object:      method.This,
+					PrivilegeId: privilege,
+				})}
+			}
+
+			return next(ctx, method)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestMiddleware(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	var m sync.Mutex
+	var calls []string
+	counts := make(map[string]int)
+
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, method *Method) soap.HasFault {
+				m.Lock()
+				calls = append(calls, name+" before")
+				counts[name+" "+method.Name]++
+				m.Unlock()
+
+				res := next(ctx, method)
+
+				m.Lock()
+				calls = append(calls, name+" after")
+				m.Unlock()
+
+				return res
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	s.Use(trace("outer"), trace("inner"), LogMethods(log.New(&buf, "", 0)))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.Lock()
+	calls = nil
+	m.Unlock()
+
+	for i := 0; i < 3; i++ {
+		if _, err = methods.GetCurrentTime(ctx, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := counts["outer CurrentTime"]; n != 3 {
+		t.Errorf("expected 3 CurrentTime calls, got %d", n)
+	}
+
+	expected := []string{"outer before", "inner before", "inner after", "outer after"}
+	if !reflect.DeepEqual(calls[:4], expected) {
+		t.Errorf("expected %v, got %v", expected, calls[:4])
+	}
+
+	if !strings.Contains(buf.String(), "CurrentTime ServiceInstance:ServiceInstance (") {
+		t.Errorf("method wasn't logged: %s", buf.String())
+	}
+}
+
+func TestInjectLatency(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	delay := 100 * time.Millisecond
+	s.Use(InjectLatency(map[string]time.Duration{"CurrentTime": delay}))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if _, err = methods.GetCurrentTime(ctx, client); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("expected CurrentTime to take at least %s, took %s", delay, elapsed)
+	}
+
+	// a client that doesn't wait that long times out
+	tctx, cancel := context.WithTimeout(ctx, delay/10)
+	defer cancel()
+
+	if _, err = methods.GetCurrentTime(tctx, client); err == nil {
+		t.Error("expected timeout")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// realtimeInterval is the sampling period of the realtime stats of hosts and VMs
+const realtimeInterval = 20
+
+// perfCounters are the counters of the simulator, a subset of those of ESX reported for both
+// hosts and VMs
+var perfCounters = []struct {
+	key    int32
+	group  string
+	name   string
+	unit   string
+	rollup types.PerfSummaryType
+}{
+	{2, "cpu", "usage", "percent", types.PerfSummaryTypeAverage},
+	{24, "mem", "usage", "percent", types.PerfSummaryTypeAverage},
+	{125, "disk", "usage", "kiloBytesPerSecond", types.PerfSummaryTypeAverage},
+	{143, "net", "usage", "kiloBytesPerSecond", types.PerfSummaryTypeAverage},
+}
+
+// historicalIntervals are the default historical intervals of vCenter
+var historicalIntervals = []types.PerfInterval{
+	{Key: 1, SamplingPeriod: 300, Name: "Past day", Length: 86400, Level: 1, Enabled: true},
+	{Key: 2, SamplingPeriod: 1800, Name: "Past week", Length: 604800, Level: 1, Enabled: true},
+	{Key: 3, SamplingPeriod: 7200, Name: "Past month", Length: 2592000, Level: 1, Enabled: true},
+	{Key: 4, SamplingPeriod: 86400, Name: "Past year", Length: 31536000, Level: 1, Enabled: true},
+}
+
+type PerformanceManager struct {
+	mo.PerformanceManager
+}
+
+func NewPerformanceManager(ref types.ManagedObjectReference) object.Reference {
+	m := &PerformanceManager{}
+	m.Self = ref
+	m.HistoricalInterval = historicalIntervals
+
+	for _, c := range perfCounters {
+		m.PerfCounter = append(m.PerfCounter, types.PerfCounterInfo{
+			Key:        c.key,
+			NameInfo:   &types.ElementDescription{Key: c.name},
+			GroupInfo:  &types.ElementDescription{Key: c.group},
+			UnitInfo:   &types.ElementDescription{Key: c.unit},
+			RollupType: c.rollup,
+			StatsType:  types.PerfStatsTypeRate,
+			Level:      1,
+		})
+	}
+
+	return m
+}
+
+// uptime is a period an entity was running, end is zero while it still is
+type uptime struct {
+	start time.Time
+	end   time.Time
+}
+
+// entityUptime returns the periods the entity was running: the power on history of a VM or the
+// time since a host booted. Other entities have no stats.
+func entityUptime(obj mo.Reference) []uptime {
+	switch e := obj.(type) {
+	case *VirtualMachine:
+		e.m.Lock()
+		defer e.m.Unlock()
+
+		return append([]uptime(nil), e.uptime...)
+	case *HostSystem:
+		if e.Runtime.BootTime != nil {
+			return []uptime{{start: *e.Runtime.BootTime}}
+		}
+	}
+
+	return nil
+}
+
+// validInterval reports whether id is the realtime interval or one of the historical intervals
+func (m *PerformanceManager) validInterval(id int32) bool {
+	if id == realtimeInterval {
+		return true
+	}
+
+	for _, i := range m.HistoricalInterval {
+		if i.SamplingPeriod == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// QueryAvailablePerfMetric returns the metrics of the entity that have stats within the time
+// window: those of a VM while it was powered on, those of a host since it booted. The window
+// is open ended without a begin time and ends now without an end time.
+func (m *PerformanceManager) QueryAvailablePerfMetric(req *types.QueryAvailablePerfMetric) soap.HasFault {
+	body := &methods.QueryAvailablePerfMetricBody{}
+
+	obj := Map.Get(req.Entity)
+	if obj == nil {
+		body.Fault_ = Fault("", &types.ManagedObjectNotFound{Obj: req.Entity})
+		return body
+	}
+
+	if req.IntervalId != 0 && !m.validInterval(req.IntervalId) {
+		body.Fault_ = Fault("", &types.InvalidArgument{InvalidProperty: "intervalId"})
+		return body
+	}
+
+	current := now()
+
+	end := current
+	if req.EndTime != nil {
+		end = *req.EndTime
+	}
+
+	if req.BeginTime != nil && req.BeginTime.After(end) {
+		body.Fault_ = Fault("", &types.InvalidArgument{InvalidProperty: "beginTime"})
+		return body
+	}
+
+	body.Res = &types.QueryAvailablePerfMetricResponse{}
+
+	for _, u := range entityUptime(obj) {
+		stop := u.end
+		if stop.IsZero() {
+			stop = current
+		}
+
+		if u.start.After(end) || (req.BeginTime != nil && stop.Before(*req.BeginTime)) {
+			continue
+		}
+
+		for _, c := range perfCounters {
+			body.Res.Returnval = append(body.Res.Returnval, types.PerfMetricId{CounterId: c.key})
+		}
+		break
+	}
+
+	return body
+}
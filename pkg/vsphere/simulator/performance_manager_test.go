@@ -0,0 +1,133 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestQueryAvailablePerfMetric(t *testing.T) {
+	start := time.Date(2016, time.August, 1, 12, 0, 0, 0, time.UTC)
+	fake := NewFakeClock(start)
+
+	defer SetClock(SetClock(fake))
+
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{Name: "foo"})
+
+	// the VM is powered on from 1h to 3h
+	power := func(on bool) {
+		fake.Advance(time.Hour)
+
+		var task *object.Task
+		if on {
+			task, err = vm.PowerOn(ctx)
+		} else {
+			task, err = vm.PowerOff(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	power(true)
+	fake.Advance(time.Hour)
+	power(false)
+	fake.Advance(2 * time.Hour)
+
+	at := func(d time.Duration) *time.Time {
+		t := start.Add(d)
+		return &t
+	}
+
+	perf := *client.ServiceContent.PerfManager
+
+	tests := []struct {
+		entity    types.ManagedObjectReference
+		begin     *time.Time
+		end       *time.Time
+		available bool
+	}{
+		{vm.Reference(), nil, nil, true},
+		{vm.Reference(), at(0), at(30 * time.Minute), false},
+		{vm.Reference(), at(30 * time.Minute), at(90 * time.Minute), true},
+		{vm.Reference(), at(2 * time.Hour), at(4 * time.Hour), true},
+		{vm.Reference(), at(4 * time.Hour), nil, false},
+		{vm.Reference(), nil, at(time.Hour / 2), false},
+		{esx.HostSystem.Self, at(4 * time.Hour), nil, true},
+		{esx.Datacenter.Self, nil, nil, false},
+	}
+
+	for i, test := range tests {
+		res, err := methods.QueryAvailablePerfMetric(ctx, client.Client, &types.QueryAvailablePerfMetric{
+			This:      perf,
+			Entity:    test.entity,
+			BeginTime: test.begin,
+			EndTime:   test.end,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if available := len(res.Returnval) != 0; available != test.available {
+			t.Errorf("%d: expected metrics to be available=%t, got %#v", i, test.available, res.Returnval)
+		}
+	}
+
+	m := Map.Get(perf).(*PerformanceManager)
+
+	faults := []types.QueryAvailablePerfMetric{
+		{Entity: vm.Reference(), BeginTime: at(2 * time.Hour), EndTime: at(time.Hour)},
+		{Entity: vm.Reference(), IntervalId: 42},
+		{Entity: types.ManagedObjectReference{Type: "VirtualMachine", Value: "enoent"}},
+	}
+
+	for i, req := range faults {
+		fault := m.QueryAvailablePerfMetric(&req).Fault()
+		if fault == nil {
+			t.Errorf("%d: expected a fault", i)
+			continue
+		}
+
+		switch fault.Detail.Fault.(type) {
+		case *types.InvalidArgument, *types.ManagedObjectNotFound:
+		default:
+			t.Errorf("%d: unexpected fault %#v", i, fault.Detail.Fault)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// deepCopy returns a copy of v that shares no pointers, slices or maps with it
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopy(v.Elem()))
+		return c
+	case reflect.Interface:
+		c := reflect.New(v.Type()).Elem()
+		if !v.IsNil() {
+			c.Set(deepCopy(v.Elem()))
+		}
+		return c
+	case reflect.Struct:
+		// the unexported fields, such as those of time.Time, are copied as they are
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return reflect.Zero(v.Type())
+		}
+		c := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			c.SetMapIndex(key, deepCopy(v.MapIndex(key)))
+		}
+		return c
+	}
+
+	return v
+}
+
+// indirect dereferences pointers and interfaces
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// unwrapArray returns the slice held by the types.ArrayOf* wrappers used for encoding
+func unwrapArray(v reflect.Value) reflect.Value {
+	if s := indirect(v); s.IsValid() && s.Kind() == reflect.Struct && strings.HasPrefix(s.Type().Name(), "ArrayOf") && s.NumField() == 1 {
+		return s.Field(0)
+	}
+	return v
+}
+
+// elementKey returns the key selector of a data object array element, e.g. [4000] for a device
+// or ["guestinfo.ip"] for an option value
+func elementKey(v reflect.Value) (string, bool) {
+	e := indirect(v)
+	if !e.IsValid() || e.Kind() != reflect.Struct {
+		return "", false
+	}
+
+	key := e.FieldByName("Key")
+	switch key.Kind() {
+	case reflect.Int32, reflect.Int64, reflect.Int:
+		return fmt.Sprintf("[%d]", key.Int()), true
+	case reflect.String:
+		return fmt.Sprintf("[%q]", key.String()), true
+	}
+
+	return "", false
+}
+
+// keyedElements maps the elements of the slice by their key, returning false if any is unkeyed
+func keyedElements(s reflect.Value) ([]string, map[string]reflect.Value, bool) {
+	var keys []string
+	elements := make(map[string]reflect.Value)
+
+	for i := 0; i < s.Len(); i++ {
+		key, ok := elementKey(s.Index(i))
+		if !ok {
+			return nil, nil, false
+		}
+		keys = append(keys, key)
+		elements[key] = s.Index(i)
+	}
+
+	return keys, elements, true
+}
+
+// assignChange returns an assign of the value to the property
+func assignChange(name string, v reflect.Value) types.PropertyChange {
+	change := types.PropertyChange{
+		Name: name,
+		Op:   types.PropertyChangeOpAssign,
+	}
+
+	if v.IsValid() && !isEmpty(v) {
+		change.Val = fieldValueInterface(v)
+	}
+
+	return change
+}
+
+// propertyChanges returns the changes from prev to cur of the named property. Unless partial is set,
+// any change is reported as an assign of the entire value. Otherwise nested properties are compared
+// individually and elements of keyed data object arrays are reported as add, remove or a change of
+// the element, e.g. config.hardware.device[4000].
+func propertyChanges(name string, prev reflect.Value, cur reflect.Value, partial bool) []types.PropertyChange {
+	prev = unwrapArray(prev)
+	cur = unwrapArray(cur)
+
+	if reflect.DeepEqual(prev.Interface(), cur.Interface()) {
+		return nil
+	}
+
+	if !partial {
+		return []types.PropertyChange{assignChange(name, cur)}
+	}
+
+	p := indirect(prev)
+	c := indirect(cur)
+
+	if !p.IsValid() || !c.IsValid() || p.Type() != c.Type() {
+		return []types.PropertyChange{assignChange(name, cur)}
+	}
+
+	switch c.Kind() {
+	case reflect.Struct:
+		if c.Type().PkgPath() != reflect.TypeOf(types.DynamicData{}).PkgPath() {
+			// e.g. time.Time is a value as a whole
+			break
+		}
+		return structChanges(name, p, c)
+	case reflect.Slice:
+		if changes, ok := sliceChanges(name, p, c); ok {
+			return changes
+		}
+	}
+
+	return []types.PropertyChange{assignChange(name, cur)}
+}
+
+// structChanges compares the fields of a data object
+func structChanges(name string, prev reflect.Value, cur reflect.Value) []types.PropertyChange {
+	var changes []types.PropertyChange
+
+	for i := 0; i < cur.NumField(); i++ {
+		f := cur.Type().Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if f.Anonymous {
+			// embedded types, such as VirtualDevice in VirtualDisk, share the property path
+			changes = append(changes, structChanges(name, prev.Field(i), cur.Field(i))...)
+			continue
+		}
+
+		changes = append(changes, propertyChanges(name+"."+lcFirst(f.Name), prev.Field(i), cur.Field(i), true)...)
+	}
+
+	return changes
+}
+
+// sliceChanges compares data object arrays element by element, returning false if the
+// elements don't have keys to tell them apart
+func sliceChanges(name string, prev reflect.Value, cur reflect.Value) ([]types.PropertyChange, bool) {
+	_, before, ok := keyedElements(prev)
+	if !ok {
+		return nil, false
+	}
+
+	keys, after, ok := keyedElements(cur)
+	if !ok {
+		return nil, false
+	}
+
+	var changes []types.PropertyChange
+
+	for _, key := range keys {
+		e, ok := before[key]
+		if !ok {
+			changes = append(changes, types.PropertyChange{
+				Name: name + key,
+				Op:   types.PropertyChangeOpAdd,
+				Val:  after[key].Interface(),
+			})
+			continue
+		}
+
+		changes = append(changes, propertyChanges(name+key, e, after[key], true)...)
+	}
+
+	for i := 0; i < prev.Len(); i++ {
+		key, _ := elementKey(prev.Index(i))
+		if _, ok := after[key]; !ok {
+			changes = append(changes, types.PropertyChange{
+				Name: name + key,
+				Op:   types.PropertyChangeOpRemove,
+			})
+		}
+	}
+
+	return changes, true
+}
@@ -16,9 +16,15 @@ package simulator
 
 import (
 	"errors"
+	"fmt"
+	"log"
 	"path"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/methods"
@@ -29,6 +35,11 @@ import (
 
 type PropertyCollector struct {
 	mo.PropertyCollector
+
+	m       sync.Mutex
+	version int
+	// canceled is closed by CancelWaitForUpdates to wake up the pending WaitForUpdatesEx calls
+	canceled chan struct{}
 }
 
 func NewPropertyCollector(ref types.ManagedObjectReference) object.Reference {
@@ -40,30 +51,168 @@ func NewPropertyCollector(ref types.ManagedObjectReference) object.Reference {
 var errMissingField = errors.New("missing field")
 var errEmptyField = errors.New("empty field")
 
-func fieldValueInterface(f reflect.StructField, rval reflect.Value) interface{} {
-	pval := rval.Interface()
+// arrayKinds are the names of the ArrayOf wrappers of the primitive slices
+var arrayKinds = map[reflect.Kind]string{
+	reflect.Bool:    "Boolean",
+	reflect.Int8:    "Byte",
+	reflect.Uint8:   "Byte",
+	reflect.Int16:   "Short",
+	reflect.Int32:   "Int",
+	reflect.Int64:   "Long",
+	reflect.Float32: "Float",
+	reflect.Float64: "Double",
+	reflect.String:  "String",
+}
+
+// typeCache holds the reflected metadata of the types the property collector walks, so that
+// collecting the properties of many objects looks each type up only once
+type typeCache struct {
+	m sync.RWMutex
+
+	// fields holds the field of a struct type by property name, nil if there's no such field
+	fields map[typeField]*reflect.StructField
+	// properties holds the properties of the fields of a struct type, in field order
+	properties map[reflect.Type][]fieldProperty
+	// arrays holds the ArrayOf wrapper of a slice type, nil if there's no wrapper
+	arrays map[reflect.Type]reflect.Type
+}
+
+// typeField keys the fields of typeCache
+type typeField struct {
+	t    reflect.Type
+	name string
+}
+
+// fieldProperty is a field of a struct type as collected by PropSet.All
+type fieldProperty struct {
+	name      string
+	anonymous bool
+}
+
+var reflected = typeCache{
+	fields:     make(map[typeField]*reflect.StructField),
+	properties: make(map[reflect.Type][]fieldProperty),
+	arrays:     make(map[reflect.Type]reflect.Type),
+}
+
+// field returns the field of the struct type t for the property name, which may be promoted
+// from an embedded struct, or nil if there's no such field
+func (c *typeCache) field(t reflect.Type, name string) *reflect.StructField {
+	key := typeField{t, name}
+
+	c.m.RLock()
+	f, ok := c.fields[key]
+	c.m.RUnlock()
+	if ok {
+		return f
+	}
+
+	if t.Kind() == reflect.Struct {
+		if sf, found := t.FieldByName(ucFirst(name)); found {
+			f = &sf
+		}
+	}
+
+	c.m.Lock()
+	c.fields[key] = f
+	c.m.Unlock()
+
+	return f
+}
+
+// propertyList returns the properties of the fields of the struct type t
+func (c *typeCache) propertyList(t reflect.Type) []fieldProperty {
+	c.m.RLock()
+	props, ok := c.properties[t]
+	c.m.RUnlock()
+	if ok {
+		return props
+	}
+
+	props = make([]fieldProperty, t.NumField())
+	for i := range props {
+		f := t.Field(i)
+		props[i] = fieldProperty{name: lcFirst(f.Name), anonymous: f.Anonymous}
+	}
+
+	c.m.Lock()
+	c.properties[t] = props
+	c.m.Unlock()
+
+	return props
+}
 
+// arrayType returns the ArrayOf wrapper of the slice type t, nil if there's none
+func (c *typeCache) arrayType(t reflect.Type) reflect.Type {
+	c.m.RLock()
+	akind, ok := c.arrays[t]
+	c.m.RUnlock()
+	if ok {
+		return akind
+	}
+
+	akind = arrayWrapper(t)
+
+	c.m.Lock()
+	c.arrays[t] = akind
+	c.m.Unlock()
+
+	return akind
+}
+
+// arrayWrapper returns the types.ArrayOf* type of the slice type t. The wrapper is named after
+// the element type: the primitive one, or the data object type an interface such as
+// BaseVirtualDevice stands for. nil is returned if there's no such wrapper.
+func arrayWrapper(t reflect.Type) reflect.Type {
+	elem := t.Elem()
+
+	kind := elem.Name()
+	switch {
+	case elem.Kind() == reflect.Interface:
+		// BaseVirtualDevice is wrapped by ArrayOfVirtualDevice, AnyType by ArrayOfAnyType
+		kind = strings.TrimPrefix(kind, "Base")
+	case elem.PkgPath() == "" && arrayKinds[elem.Kind()] != "":
+		kind = arrayKinds[elem.Kind()]
+	}
+
+	akind, ok := typeFunc("ArrayOf" + kind)
+	if !ok || akind.Kind() != reflect.Struct || akind.NumField() != 1 {
+		return nil
+	}
+
+	return akind
+}
+
+// arrayOf wraps the slice in its types.ArrayOf* type, as slices are encoded. The slice is
+// returned as is if there's no such wrapper.
+func arrayOf(rval reflect.Value) interface{} {
+	akind := reflected.arrayType(rval.Type())
+	if akind == nil {
+		return rval.Interface()
+	}
+
+	// the field isn't always named after the kind, it's the only one of the wrapper
+	a := reflect.New(akind)
+	field := a.Elem().Field(0)
+	switch {
+	case rval.Type().AssignableTo(field.Type()):
+		field.Set(rval)
+	case rval.Type().ConvertibleTo(field.Type()):
+		field.Set(rval.Convert(field.Type()))
+	default:
+		return rval.Interface()
+	}
+
+	return a.Interface()
+}
+
+func fieldValueInterface(rval reflect.Value) interface{} {
 	if rval.Kind() == reflect.Slice {
 		// Convert slice to types.ArrayOf*
-		switch v := pval.(type) {
-		case []string:
-			pval = &types.ArrayOfString{
-				String: v,
-			}
-		case []int32:
-			pval = &types.ArrayOfInt{
-				Int: v,
-			}
-		default:
-			kind := f.Type.Elem().Name()
-			akind, _ := typeFunc("ArrayOf" + kind)
-			a := reflect.New(akind)
-			a.Elem().FieldByName(kind).Set(rval)
-			pval = a.Interface()
-		}
+		return arrayOf(rval)
 	}
 
-	return pval
+	return rval.Interface()
 }
 
 func fieldValue(rval reflect.Value, p string) (interface{}, error) {
@@ -76,19 +225,27 @@ func fieldValue(rval reflect.Value, p string) (interface{}, error) {
 	fields := strings.Split(p, ".")
 
 	for i, name := range fields {
-		x := ucFirst(name)
-		val := rval.FieldByName(x)
-		if !val.IsValid() {
+		// properties such as DistributedVirtualSwitch.config hold an interface
+		if rval.Kind() == reflect.Interface {
+			rval = rval.Elem()
+		}
+
+		if rval.Kind() == reflect.Ptr {
+			rval = rval.Elem()
+		}
+
+		f := reflected.field(rval.Type(), name)
+		if f == nil {
 			return nil, errMissingField
 		}
+		val := rval.FieldByIndex(f.Index)
 
 		if isEmpty(val) {
 			return nil, errEmptyField
 		}
 
 		if i == len(fields)-1 {
-			ftype, _ := rval.Type().FieldByName(x)
-			value = fieldValueInterface(ftype, val)
+			value = fieldValueInterface(val)
 			break
 		}
 
@@ -106,6 +263,12 @@ func fieldRefs(f interface{}) []types.ManagedObjectReference {
 		return []types.ManagedObjectReference{*fv}
 	case *types.ArrayOfManagedObjectReference:
 		return fv.ManagedObjectReference
+	case *types.ArrayOfDatastoreHostMount:
+		var refs []types.ManagedObjectReference
+		for _, mount := range fv.DatastoreHostMount {
+			refs = append(refs, mount.Key)
+		}
+		return refs
 	case nil:
 		// empty field
 	}
@@ -148,24 +311,22 @@ type retrieveResult struct {
 }
 
 func (rr *retrieveResult) collectAll(rval reflect.Value, rtype reflect.Type, content *types.ObjectContent) {
-	for i := 0; i < rval.NumField(); i++ {
+	for i, p := range reflected.propertyList(rtype) {
 		val := rval.Field(i)
 
 		if isEmpty(val) {
 			continue
 		}
 
-		f := rtype.Field(i)
-
-		if f.Anonymous {
+		if p.anonymous {
 			// recurse into embedded field
-			rr.collectAll(val, f.Type, content)
+			rr.collectAll(val, val.Type(), content)
 			continue
 		}
 
 		content.PropSet = append(content.PropSet, types.DynamicProperty{
-			Name: lcFirst(f.Name),
-			Val:  fieldValueInterface(f, val),
+			Name: p.name,
+			Val:  fieldValueInterface(val),
 		})
 	}
 }
@@ -211,44 +372,52 @@ func (rr *retrieveResult) collect(ref types.ManagedObjectReference) {
 	}
 
 	obj := Map.Get(ref)
+	if obj == nil {
+		// e.g. a reference to a destroyed entity
+		return
+	}
 
 	content := types.ObjectContent{
 		Obj: ref,
 	}
 
-	rval := reflect.ValueOf(obj).Elem()
-	rtype := rval.Type()
+	var refs []types.ManagedObjectReference
 
-	// PropertyCollector is for Managed Object types only (package mo).
-	// If the registry object is not in the mo package, assume it is a wrapper
-	// type where the first field is an embedded mo type.
-	// Otherwise, PropSet.All will not work as expected.
-	if path.Base(rtype.PkgPath()) != "mo" {
-		rval = rval.Field(0)
-		rtype = rval.Type()
-	}
+	Map.WithLock(obj, func() {
+		rval := reflect.ValueOf(obj).Elem()
+		rtype := rval.Type()
+
+		// PropertyCollector is for Managed Object types only (package mo).
+		// If the registry object is not in the mo package, assume it is a wrapper
+		// type where the first field is an embedded mo type.
+		// Otherwise, PropSet.All will not work as expected.
+		if path.Base(rtype.PkgPath()) != "mo" {
+			rval = rval.Field(0)
+			rtype = rval.Type()
+		}
 
-	var refs []types.ManagedObjectReference
+		rval = computeProperties(obj, rval)
+
+		for _, spec := range rr.req.SpecSet {
+			for _, p := range spec.PropSet {
+				if p.Type != ref.Type {
+					// e.g. ManagedEntity, ComputeResource
+					field := reflected.field(rtype, p.Type)
 
-	for _, spec := range rr.req.SpecSet {
-		for _, p := range spec.PropSet {
-			if p.Type != ref.Type {
-				// e.g. ManagedEntity, ComputeResource
-				field, ok := rtype.FieldByName(p.Type)
+					if !(field != nil && field.Anonymous) {
+						continue
+					}
+				}
 
-				if !(ok && field.Anonymous) {
+				if isTrue(p.All) {
+					rr.collectAll(rval, rtype, &content)
 					continue
 				}
-			}
 
-			if isTrue(p.All) {
-				rr.collectAll(rval, rtype, &content)
-				continue
+				refs = append(refs, rr.collectFields(rval, p.PathSet, &content)...)
 			}
-
-			refs = append(refs, rr.collectFields(rval, p.PathSet, &content)...)
 		}
-	}
+	})
 
 	rr.Objects = append(rr.Objects, content)
 	rr.collected[ref] = true
@@ -258,6 +427,71 @@ func (rr *retrieveResult) collect(ref types.ManagedObjectReference) {
 	}
 }
 
+// computeProperties returns a copy of rval, the mo value of obj, with the computed properties
+// registered for its type set. rval itself is returned if there are none.
+func computeProperties(obj mo.Reference, rval reflect.Value) reflect.Value {
+	properties := Map.computedProperties(obj.Reference().Type)
+	if len(properties) == 0 {
+		return rval
+	}
+
+	// the properties containing others are set first, so that they don't overwrite them
+	paths := make([]string, 0, len(properties))
+	for p := range properties {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	cp := reflect.New(rval.Type()).Elem()
+	cp.Set(rval)
+
+	for _, p := range paths {
+		if err := setFieldValue(cp, p, properties[p](obj)); err != nil {
+			log.Printf("failed to compute %s of %s: %s", p, obj.Reference(), err)
+		}
+	}
+
+	return cp
+}
+
+// setFieldValue sets the field at the path p below rval to value. The structs pointed to along
+// the path are copied before they're modified, as they're shared with the original object.
+func setFieldValue(rval reflect.Value, p string, value interface{}) error {
+	for _, name := range strings.Split(p, ".") {
+		if rval.Kind() == reflect.Ptr {
+			elem := reflect.New(rval.Type().Elem())
+			if !rval.IsNil() {
+				elem.Elem().Set(rval.Elem())
+			}
+			rval.Set(elem)
+			rval = elem.Elem()
+		}
+
+		if rval.Kind() != reflect.Struct {
+			return errMissingField
+		}
+
+		rval = rval.FieldByName(ucFirst(name))
+		if !rval.IsValid() {
+			return errMissingField
+		}
+	}
+
+	val := reflect.ValueOf(value)
+	switch {
+	case !val.IsValid():
+		rval.Set(reflect.Zero(rval.Type()))
+	case val.Type().AssignableTo(rval.Type()):
+		rval.Set(val)
+	case val.Type().ConvertibleTo(rval.Type()):
+		rval.Set(val.Convert(rval.Type()))
+	default:
+		return fmt.Errorf("%s isn't assignable to %s", val.Type(), rval.Type())
+	}
+
+	return nil
+}
+
 func (pc *PropertyCollector) collect(r *types.RetrievePropertiesEx) (*types.RetrieveResult, types.BaseMethodFault) {
 	var refs []types.ManagedObjectReference
 
@@ -284,7 +518,11 @@ func (pc *PropertyCollector) collect(r *types.RetrievePropertiesEx) (*types.Retr
 			}
 
 			for _, ss := range o.SelectSet {
-				ts := ss.(*types.TraversalSpec)
+				// a plain SelectionSpec refers to a named TraversalSpec, which isn't supported
+				ts, ok := ss.(*types.TraversalSpec)
+				if !ok {
+					return nil, &types.InvalidArgument{InvalidProperty: "selectSet"}
+				}
 
 				if ts.SelectSet != nil {
 					rr.recurse[ts.Path] = true
@@ -341,3 +579,298 @@ func (pc *PropertyCollector) RetrieveProperties(r *types.RetrieveProperties) soa
 
 	return body
 }
+
+type PropertyFilter struct {
+	mo.PropertyFilter
+
+	pc *PropertyCollector
+
+	// copies of the property values last reported for each object
+	state map[types.ManagedObjectReference]map[string]interface{}
+}
+
+func (pc *PropertyCollector) CreatePropertyCollector(c *types.CreatePropertyCollector) soap.HasFault {
+	cpc := &PropertyCollector{}
+	cpc.Self = Map.CreateReference(cpc)
+	Map.Put(cpc)
+
+	return &methods.CreatePropertyCollectorBody{
+		Res: &types.CreatePropertyCollectorResponse{
+			Returnval: cpc.Self,
+		},
+	}
+}
+
+func (pc *PropertyCollector) DestroyPropertyCollector(c *types.DestroyPropertyCollector) soap.HasFault {
+	pc.cancelWait()
+
+	for _, ref := range pc.Filter {
+		Map.Remove(ref)
+	}
+
+	Map.Remove(pc.Self)
+
+	return &methods.DestroyPropertyCollectorBody{
+		Res: &types.DestroyPropertyCollectorResponse{},
+	}
+}
+
+func (pc *PropertyCollector) CreateFilter(c *types.CreateFilter) soap.HasFault {
+	filter := &PropertyFilter{pc: pc}
+	filter.Self = Map.CreateReference(filter)
+	filter.Spec = c.Spec
+	filter.PartialUpdates = c.PartialUpdates
+	Map.Put(filter)
+
+	pc.Filter = append(pc.Filter, filter.Self)
+
+	return &methods.CreateFilterBody{
+		Res: &types.CreateFilterResponse{
+			Returnval: filter.Self,
+		},
+	}
+}
+
+func (f *PropertyFilter) DestroyPropertyFilter(c *types.DestroyPropertyFilter) soap.HasFault {
+	for i, ref := range f.pc.Filter {
+		if ref == f.Self {
+			f.pc.Filter = append(f.pc.Filter[:i], f.pc.Filter[i+1:]...)
+			break
+		}
+	}
+
+	Map.Remove(f.Self)
+
+	return &methods.DestroyPropertyFilterBody{
+		Res: &types.DestroyPropertyFilterResponse{},
+	}
+}
+
+// update collects the filtered properties, returning the changes since the last update.
+// Objects that were not reported before enter the filter, objects no longer found leave it.
+// With PartialUpdates set on the filter, only the nested properties that changed are reported.
+// At most max objects are reported unless max is negative, truncated tells if there were more -
+// those keep their last reported state, so they're reported by the next update.
+func (f *PropertyFilter) update(max int) (*types.PropertyFilterUpdate, bool, types.BaseMethodFault) {
+	spec := f.Spec
+	spec.ReportMissingObjectsInResults = types.NewBool(true)
+
+	res, fault := f.pc.collect(&types.RetrievePropertiesEx{
+		SpecSet: []types.PropertyFilterSpec{spec},
+	})
+	if fault != nil {
+		return nil, false, fault
+	}
+
+	update := &types.PropertyFilterUpdate{
+		Filter: f.Self,
+	}
+	truncated := false
+
+	// full reports whether the update can't take another object
+	full := func() bool {
+		return max >= 0 && len(update.ObjectSet) >= max
+	}
+
+	state := make(map[types.ManagedObjectReference]map[string]interface{})
+
+	for _, o := range res.Objects {
+		prev, seen := f.state[o.Obj]
+		props := make(map[string]interface{})
+		state[o.Obj] = props
+
+		ou := types.ObjectUpdate{
+			Kind: types.ObjectUpdateKindEnter,
+			Obj:  o.Obj,
+		}
+		if seen {
+			ou.Kind = types.ObjectUpdateKindModify
+		}
+
+		for _, prop := range o.PropSet {
+			// the objects are modified in place, so the reported state is a copy
+			props[prop.Name] = deepCopy(reflect.ValueOf(prop.Val)).Interface()
+
+			old, ok := prev[prop.Name]
+			if !ok {
+				ou.ChangeSet = append(ou.ChangeSet, types.PropertyChange{
+					Name: prop.Name,
+					Op:   types.PropertyChangeOpAssign,
+					Val:  prop.Val,
+				})
+				continue
+			}
+
+			ou.ChangeSet = append(ou.ChangeSet, propertyChanges(prop.Name, reflect.ValueOf(old), reflect.ValueOf(prop.Val), f.PartialUpdates)...)
+		}
+
+		// properties that are now empty
+		for name := range prev {
+			if _, ok := props[name]; !ok {
+				ou.ChangeSet = append(ou.ChangeSet, types.PropertyChange{
+					Name: name,
+					Op:   types.PropertyChangeOpAssign,
+				})
+			}
+		}
+
+		if !seen || len(ou.ChangeSet) != 0 {
+			if full() {
+				truncated = true
+				if seen {
+					state[o.Obj] = prev
+				} else {
+					delete(state, o.Obj)
+				}
+				continue
+			}
+			update.ObjectSet = append(update.ObjectSet, ou)
+		}
+	}
+
+	for ref, prev := range f.state {
+		if _, ok := state[ref]; !ok {
+			if full() {
+				truncated = true
+				state[ref] = prev
+				continue
+			}
+			update.ObjectSet = append(update.ObjectSet, types.ObjectUpdate{
+				Kind: types.ObjectUpdateKindLeave,
+				Obj:  ref,
+			})
+		}
+	}
+
+	f.state = state
+
+	return update, truncated, nil
+}
+
+const (
+	// waitForUpdatesPoll is the interval at which WaitForUpdatesEx checks for changes
+	waitForUpdatesPoll = 100 * time.Millisecond
+	// waitForUpdatesMax bounds how long WaitForUpdatesEx blocks without WaitOptions, so that
+	// server shutdown isn't held up by waiting clients; the client retries on an empty result
+	waitForUpdatesMax = 10 * time.Second
+)
+
+// waitCanceled returns the channel that's closed when the pending waits are canceled
+func (pc *PropertyCollector) waitCanceled() <-chan struct{} {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	if pc.canceled == nil {
+		pc.canceled = make(chan struct{})
+	}
+
+	return pc.canceled
+}
+
+// cancelWait wakes up the pending waits, the ones started afterwards aren't affected
+func (pc *PropertyCollector) cancelWait() {
+	pc.m.Lock()
+	defer pc.m.Unlock()
+
+	if pc.canceled != nil {
+		close(pc.canceled)
+		pc.canceled = nil
+	}
+}
+
+// CancelWaitForUpdates makes the pending WaitForUpdatesEx calls of the collector fail with RequestCanceled
+func (pc *PropertyCollector) CancelWaitForUpdates(r *types.CancelWaitForUpdates) soap.HasFault {
+	pc.cancelWait()
+
+	return &methods.CancelWaitForUpdatesBody{
+		Res: &types.CancelWaitForUpdatesResponse{},
+	}
+}
+
+// WaitForUpdatesEx reports the state of the filtered objects on the initial call (empty version),
+// then blocks until there are changes to report, the maximum wait is reached or the wait is canceled.
+// Once the maximum wait is reached, the update set has the version the client has and no changes.
+// With MaxObjectUpdates set, the update set is truncated to as many objects and the rest of the
+// changes are reported by the next call.
+func (pc *PropertyCollector) WaitForUpdatesEx(r *types.WaitForUpdatesEx) soap.HasFault {
+	body := &methods.WaitForUpdatesExBody{
+		Res: &types.WaitForUpdatesExResponse{},
+	}
+
+	canceled := pc.waitCanceled()
+
+	if r.Version == "" {
+		for _, ref := range pc.Filter {
+			if filter, ok := Map.Get(ref).(*PropertyFilter); ok {
+				filter.state = nil
+			}
+		}
+	}
+
+	// a MaxWaitSeconds of 0 only checks for changes, without options the wait is bounded instead
+	wait := waitForUpdatesMax
+	if r.Options != nil {
+		wait = time.Duration(r.Options.MaxWaitSeconds) * time.Second
+	}
+	deadline := time.Now().Add(wait)
+
+	max := -1
+	if r.Options != nil && r.Options.MaxObjectUpdates > 0 {
+		max = int(r.Options.MaxObjectUpdates)
+	}
+
+	for {
+		set := &types.UpdateSet{}
+		remaining := max
+
+		for _, ref := range pc.Filter {
+			filter, ok := Map.Get(ref).(*PropertyFilter)
+			if !ok {
+				continue
+			}
+
+			update, truncated, fault := filter.update(remaining)
+			if fault != nil {
+				body.Res = nil
+				body.Fault_ = Fault("", fault)
+				return body
+			}
+
+			if truncated {
+				set.Truncated = types.NewBool(true)
+			}
+			if remaining > 0 {
+				remaining -= len(update.ObjectSet)
+			}
+
+			if len(update.ObjectSet) != 0 {
+				set.FilterSet = append(set.FilterSet, *update)
+			}
+		}
+
+		if r.Version == "" || len(set.FilterSet) != 0 {
+			pc.m.Lock()
+			pc.version++
+			set.Version = strconv.Itoa(pc.version)
+			pc.m.Unlock()
+
+			body.Res.Returnval = set
+			return body
+		}
+
+		if time.Now().After(deadline) {
+			body.Res.Returnval = &types.UpdateSet{Version: r.Version}
+			return body
+		}
+
+		poll := time.NewTimer(waitForUpdatesPoll)
+		select {
+		case <-poll.C:
+		case <-canceled:
+			poll.Stop()
+			body.Res = nil
+			body.Fault_ = Fault("", &types.RequestCanceled{})
+			return body
+		}
+	}
+}
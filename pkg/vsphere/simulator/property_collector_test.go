@@ -16,13 +16,17 @@ package simulator
 
 import (
 	"reflect"
+	"strconv"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
@@ -232,3 +236,531 @@ func TestRetrieveProperties(t *testing.T) {
 		}
 	}
 }
+
+func TestWaitForUpdatesPartial(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, c, types.VirtualMachineConfigSpec{
+		Name: "foo",
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: "guestinfo.a", Value: "1"},
+			&types.OptionValue{Key: "guestinfo.b", Value: "2"},
+		},
+	})
+
+	reconfigure := func(spec types.VirtualMachineConfigSpec) {
+		task, err := vm.Reconfigure(ctx, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, partial := range []bool{true, false} {
+		pc, err := property.DefaultCollector(c.Client).Create(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = pc.CreateFilter(ctx, types.CreateFilter{
+			Spec: types.PropertyFilterSpec{
+				ObjectSet: []types.ObjectSpec{{Obj: vm.Reference()}},
+				PropSet: []types.PropertySpec{{
+					Type:    "VirtualMachine",
+					PathSet: []string{"name", "config.extraConfig", "config.hardware"},
+				}},
+			},
+			PartialUpdates: partial,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		set, err := pc.WaitForUpdates(ctx, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := len(set.FilterSet[0].ObjectSet[0].ChangeSet); n != 3 {
+			t.Errorf("expected all 3 properties initially, got %d", n)
+		}
+
+		version := set.Version
+
+		reconfigure(types.VirtualMachineConfigSpec{
+			NumCPUs: 2,
+			ExtraConfig: []types.BaseOptionValue{
+				&types.OptionValue{Key: "guestinfo.a", Value: "3"},
+				&types.OptionValue{Key: "guestinfo.b", Value: ""},
+				&types.OptionValue{Key: "guestinfo.c", Value: "4"},
+			},
+		})
+
+		set, err = pc.WaitForUpdates(ctx, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if mustAtoi(t, set.Version) <= mustAtoi(t, version) {
+			t.Errorf("version %s does not follow %s", set.Version, version)
+		}
+
+		changes := make(map[string]types.PropertyChangeOp)
+		for _, change := range set.FilterSet[0].ObjectSet[0].ChangeSet {
+			changes[change.Name] = change.Op
+		}
+
+		expect := map[string]types.PropertyChangeOp{
+			"config.extraConfig": types.PropertyChangeOpAssign,
+			"config.hardware":    types.PropertyChangeOpAssign,
+		}
+		if partial {
+			expect = map[string]types.PropertyChangeOp{
+				`config.extraConfig["guestinfo.a"].value`: types.PropertyChangeOpAssign,
+				`config.extraConfig["guestinfo.b"]`:       types.PropertyChangeOpRemove,
+				`config.extraConfig["guestinfo.c"]`:       types.PropertyChangeOpAdd,
+				"config.hardware.numCPU":                  types.PropertyChangeOpAssign,
+			}
+		}
+
+		if !reflect.DeepEqual(changes, expect) {
+			t.Errorf("partial=%t: expected %v, got %v", partial, expect, changes)
+		}
+
+		// restore the initial config for the next round
+		reconfigure(types.VirtualMachineConfigSpec{
+			NumCPUs: 1,
+			ExtraConfig: []types.BaseOptionValue{
+				&types.OptionValue{Key: "guestinfo.a", Value: "1"},
+				&types.OptionValue{Key: "guestinfo.b", Value: "2"},
+				&types.OptionValue{Key: "guestinfo.c", Value: ""},
+			},
+		})
+
+		pc.Destroy(ctx)
+	}
+}
+
+func mustAtoi(t *testing.T, s string) int {
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func TestRetrievePropertiesSelectionSpec(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := types.RetrieveProperties{
+		This: esx.ServiceContent.PropertyCollector,
+		SpecSet: []types.PropertyFilterSpec{
+			{
+				ObjectSet: []types.ObjectSpec{
+					{
+						Obj: esx.RootFolder.Reference(),
+						SelectSet: []types.BaseSelectionSpec{
+							&types.SelectionSpec{Name: "folderTraversal"},
+						},
+					},
+				},
+				PropSet: []types.PropertySpec{
+					{Type: "Folder", PathSet: []string{"name"}},
+				},
+			},
+		},
+	}
+
+	pc := Map.Get(esx.ServiceContent.PropertyCollector).(*PropertyCollector)
+	fault := pc.RetrieveProperties(&req).Fault()
+	if fault == nil {
+		t.Fatal("expected fault")
+	}
+
+	if f, ok := fault.Detail.Fault.(*types.InvalidArgument); !ok || f.InvalidProperty != "selectSet" {
+		t.Errorf("unexpected fault: %#v", fault.Detail.Fault)
+	}
+
+	// the client gets the fault instead of a dropped connection
+	_, err = methods.RetrieveProperties(ctx, client.Client, &req)
+	if err == nil || !soap.IsSoapFault(err) {
+		t.Errorf("expected soap fault, got %v", err)
+	}
+
+	// the simulator is still serving
+	f := mo.Folder{}
+	if err = client.RetrieveOne(ctx, esx.RootFolder.Reference(), []string{"name"}, &f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancelWaitForUpdates(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := property.DefaultCollector(c.Client).Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pc.CreateFilter(ctx, types.CreateFilter{
+		Spec: types.PropertyFilterSpec{
+			ObjectSet: []types.ObjectSpec{{Obj: esx.HostSystem.Self}},
+			PropSet:   []types.PropertySpec{{Type: "HostSystem", PathSet: []string{"name"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set, err := pc.WaitForUpdates(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing changes, so the wait blocks until it's canceled
+	done := make(chan error, 1)
+	go func() {
+		_, err := pc.WaitForUpdates(ctx, set.Version)
+		done <- err
+	}()
+
+	cancel := types.CancelWaitForUpdates{This: pc.Reference()}
+
+	// the cancel only affects the waits already started, keep canceling until the wait returns
+	deadline := time.After(5 * time.Second)
+	for err = nil; err == nil; {
+		if _, cerr := methods.CancelWaitForUpdates(ctx, c.Client, &cancel); cerr != nil {
+			t.Fatal(cerr)
+		}
+
+		select {
+		case err = <-done:
+			if err == nil {
+				t.Fatal("expected the wait to fail")
+			}
+		case <-deadline:
+			t.Fatal("wait wasn't canceled")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	if !soap.IsSoapFault(err) {
+		t.Errorf("expected a soap fault, got %s", err)
+	}
+
+	// later waits aren't canceled
+	res, err := methods.WaitForUpdatesEx(ctx, c.Client, &types.WaitForUpdatesEx{
+		This:    pc.Reference(),
+		Version: set.Version,
+		Options: &types.WaitOptions{MaxWaitSeconds: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Returnval == nil || res.Returnval.Version != set.Version || len(res.Returnval.FilterSet) != 0 {
+		t.Errorf("expected no updates, got %#v", res.Returnval)
+	}
+
+	// in-process the fault is a RequestCanceled
+	collector := Map.Get(pc.Reference()).(*PropertyCollector)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		collector.CancelWaitForUpdates(&cancel)
+	}()
+	fault := collector.WaitForUpdatesEx(&types.WaitForUpdatesEx{This: pc.Reference(), Version: set.Version}).Fault()
+	if fault == nil {
+		t.Fatal("expected a fault")
+	}
+	if _, ok := fault.Detail.Fault.(*types.RequestCanceled); !ok {
+		t.Errorf("expected RequestCanceled, got %#v", fault.Detail.Fault)
+	}
+}
+
+func TestWaitForUpdatesOptions(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := property.DefaultCollector(c.Client).Create(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = pc.CreateFilter(ctx, types.CreateFilter{
+		Spec: types.PropertyFilterSpec{
+			ObjectSet: []types.ObjectSpec{
+				{Obj: esx.RootFolder.Self},
+				{Obj: esx.Datacenter.Self},
+				{Obj: esx.HostSystem.Self},
+			},
+			PropSet: []types.PropertySpec{
+				{Type: "Folder", PathSet: []string{"name"}},
+				{Type: "Datacenter", PathSet: []string{"name"}},
+				{Type: "HostSystem", PathSet: []string{"name"}},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wait := func(version string, options types.WaitOptions) *types.UpdateSet {
+		res, err := methods.WaitForUpdatesEx(ctx, c.Client, &types.WaitForUpdatesEx{
+			This:    pc.Reference(),
+			Version: version,
+			Options: &options,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Returnval == nil {
+			t.Fatal("expected an update set")
+		}
+		return res.Returnval
+	}
+
+	count := func(set *types.UpdateSet) int {
+		n := 0
+		for _, f := range set.FilterSet {
+			n += len(f.ObjectSet)
+		}
+		return n
+	}
+
+	// the initial update is capped, the rest follows without waiting
+	set := wait("", types.WaitOptions{MaxObjectUpdates: 2})
+	if n := count(set); n != 2 || set.Truncated == nil || !*set.Truncated {
+		t.Fatalf("expected 2 objects in a truncated update, got %d (truncated=%v)", n, set.Truncated)
+	}
+
+	set = wait(set.Version, types.WaitOptions{MaxObjectUpdates: 2, MaxWaitSeconds: 5})
+	if n := count(set); n != 1 || (set.Truncated != nil && *set.Truncated) {
+		t.Fatalf("expected the remaining object in an update that isn't truncated, got %d (truncated=%v)", n, set.Truncated)
+	}
+
+	// nothing changed within the wait, the client keeps its version
+	start := time.Now()
+	next := wait(set.Version, types.WaitOptions{MaxWaitSeconds: 1})
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("expected the wait to last a second, returned after %s", elapsed)
+	}
+	if next.Version != set.Version || len(next.FilterSet) != 0 {
+		t.Errorf("expected an empty update of version %s, got %#v", set.Version, next)
+	}
+
+	// a zero wait only checks for changes
+	start = time.Now()
+	next = wait(set.Version, types.WaitOptions{})
+	if elapsed := time.Since(start); elapsed >= time.Second {
+		t.Errorf("expected the wait to return immediately, returned after %s", elapsed)
+	}
+	if next.Version != set.Version || len(next.FilterSet) != 0 {
+		t.Errorf("expected an empty update of version %s, got %#v", set.Version, next)
+	}
+}
+
+func TestRetrieveComputedProperties(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{Name: "foo"})
+
+	var calls int32
+	Map.RegisterProperty("VirtualMachine", "summary.quickStats.overallCpuUsage", func(obj mo.Reference) interface{} {
+		if obj.Reference() != vm.Reference() {
+			t.Errorf("unexpected object %s", obj.Reference())
+		}
+		calls++
+		return calls * 100
+	})
+
+	var mvm mo.VirtualMachine
+	if err = client.RetrieveOne(ctx, vm.Reference(), []string{"summary.quickStats.overallCpuUsage"}, &mvm); err != nil {
+		t.Fatal(err)
+	}
+	if usage := mvm.Summary.QuickStats.OverallCpuUsage; usage != 100 {
+		t.Errorf("expected the computed usage, got %d", usage)
+	}
+
+	// the value is merged into the properties containing it
+	mvm = mo.VirtualMachine{}
+	if err = client.RetrieveOne(ctx, vm.Reference(), []string{"summary"}, &mvm); err != nil {
+		t.Fatal(err)
+	}
+	if usage := mvm.Summary.QuickStats.OverallCpuUsage; usage != 200 {
+		t.Errorf("expected the computed usage in the summary, got %d", usage)
+	}
+	if mvm.Summary.Config.Name != "foo" {
+		t.Errorf("expected the rest of the summary, got %#v", mvm.Summary.Config)
+	}
+
+	// the object itself isn't modified
+	if usage := Map.Get(vm.Reference()).(*VirtualMachine).Summary.QuickStats.OverallCpuUsage; usage != 0 {
+		t.Errorf("expected the stored usage to be unchanged, got %d", usage)
+	}
+}
+
+func TestRetrieveDeviceArray(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nic := &types.VirtualE1000{}
+	nic.Backing = &types.VirtualEthernetCardNetworkBackingInfo{
+		VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: "VM Network"},
+	}
+	add, _ := object.VirtualDeviceList{nic, &types.VirtualLsiLogicController{}}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		DeviceChange: add,
+	})
+
+	res, err := methods.RetrieveProperties(ctx, client.Client, &types.RetrieveProperties{
+		This: client.ServiceContent.PropertyCollector,
+		SpecSet: []types.PropertyFilterSpec{{
+			ObjectSet: []types.ObjectSpec{{Obj: vm.Reference()}},
+			PropSet:   []types.PropertySpec{{Type: "VirtualMachine", PathSet: []string{"config.hardware.device"}}},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Returnval) != 1 || len(res.Returnval[0].PropSet) != 1 {
+		t.Fatalf("unexpected result %#v", res.Returnval)
+	}
+
+	devices, ok := res.Returnval[0].PropSet[0].Val.(types.ArrayOfVirtualDevice)
+	if !ok {
+		t.Fatalf("expected an ArrayOfVirtualDevice, got %T", res.Returnval[0].PropSet[0].Val)
+	}
+
+	list := object.VirtualDeviceList(devices.VirtualDevice)
+	if len(list.SelectByType((*types.VirtualEthernetCard)(nil))) != 1 || len(list.SelectByType((*types.VirtualLsiLogicController)(nil))) != 1 {
+		t.Errorf("unexpected devices %#v", devices.VirtualDevice)
+	}
+
+	// the wrappers of the primitive slices aren't named after the element type
+	for _, test := range []struct {
+		val     interface{}
+		wrapper interface{}
+	}{
+		{[]int64{1}, &types.ArrayOfLong{Long: []int64{1}}},
+		{[]bool{true}, &types.ArrayOfBoolean{Boolean: []bool{true}}},
+		{[]string{"a"}, &types.ArrayOfString{String: []string{"a"}}},
+		{[]types.BaseOptionValue{&types.OptionValue{Key: "a"}}, &types.ArrayOfOptionValue{OptionValue: []types.BaseOptionValue{&types.OptionValue{Key: "a"}}}},
+	} {
+		if val := fieldValueInterface(reflect.ValueOf(test.val)); !reflect.DeepEqual(val, test.wrapper) {
+			t.Errorf("expected %#v, got %#v", test.wrapper, val)
+		}
+	}
+}
+
+func BenchmarkRetrievePropertiesEx(b *testing.B) {
+	const count = 3000
+
+	New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	folder := Map.Get(esx.Datacenter.VmFolder).(*Folder)
+	pool := esx.ResourcePool.Self
+
+	var objects []types.ObjectSpec
+	for i := 0; i < count; i++ {
+		vm, fault := NewVirtualMachine(&types.VirtualMachineConfigSpec{
+			Name:        "vm" + strconv.Itoa(i),
+			NumCPUs:     2,
+			ExtraConfig: []types.BaseOptionValue{&types.OptionValue{Key: "guestinfo.index", Value: strconv.Itoa(i)}},
+		})
+		if fault != nil {
+			b.Fatalf("%#v", fault)
+		}
+
+		folder.putVM(vm, &pool, nil, nil)
+		objects = append(objects, types.ObjectSpec{Obj: vm.Self})
+	}
+
+	pc := Map.Get(esx.ServiceContent.PropertyCollector).(*PropertyCollector)
+
+	for _, bench := range []struct {
+		name string
+		spec types.PropertySpec
+	}{
+		{"paths", types.PropertySpec{Type: "VirtualMachine", PathSet: []string{"name", "runtime.powerState", "config.hardware.numCPU", "config.extraConfig", "resourcePool"}}},
+		{"inherited", types.PropertySpec{Type: "ManagedEntity", PathSet: []string{"name", "parent"}}},
+		{"all", types.PropertySpec{Type: "VirtualMachine", All: types.NewBool(true)}},
+	} {
+		req := &types.RetrievePropertiesEx{
+			SpecSet: []types.PropertyFilterSpec{{ObjectSet: objects, PropSet: []types.PropertySpec{bench.spec}}},
+		}
+
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				res, fault := pc.collect(req)
+				if fault != nil {
+					b.Fatalf("%#v", fault)
+				}
+				if len(res.Objects) != count {
+					b.Fatalf("collected %d objects", len(res.Objects))
+				}
+			}
+		})
+	}
+}
@@ -30,23 +30,76 @@ type Registry struct {
 	m       sync.Mutex
 	objects map[types.ManagedObjectReference]mo.Reference
 	counter int
+
+	// reference assigns the values of new references, nil for the default scheme
+	reference ReferenceFunc
+
+	// properties holds the computed properties, by object type and path
+	properties map[string]map[string]PropertyFunc
+
+	// locks serialize the collection of an object with the changes WithLock makes to it
+	locks map[types.ManagedObjectReference]*sync.Mutex
 }
 
+// PropertyFunc computes the value of a property of obj when it's collected
+type PropertyFunc func(obj mo.Reference) interface{}
+
 func NewRegistry() *Registry {
 	r := &Registry{
-		objects: make(map[types.ManagedObjectReference]mo.Reference),
+		objects:    make(map[types.ManagedObjectReference]mo.Reference),
+		properties: make(map[string]map[string]PropertyFunc),
+		locks:      make(map[types.ManagedObjectReference]*sync.Mutex),
 	}
 
 	return r
 }
 
+// ReferenceFunc returns the value of the reference to a new object of the given type
+type ReferenceFunc func(kind string) string
+
+// SequentialReferences returns a ReferenceFunc that numbers the objects of each type on their
+// own, starting from 1: virtualmachine-1, folder-1, virtualmachine-2 and so on. Unlike the default
+// scheme, the value of an object doesn't depend on how many objects of other types were created.
+func SequentialReferences() ReferenceFunc {
+	var m sync.Mutex
+	counters := make(map[string]int)
+
+	return func(kind string) string {
+		m.Lock()
+		defer m.Unlock()
+
+		counters[kind]++
+		return fmt.Sprintf("%s-%d", strings.ToLower(kind), counters[kind])
+	}
+}
+
+// SetReferenceFunc replaces the scheme CreateReference assigns the values of new references
+// with, nil restores the default. NewServiceInstance replaces Map, the scheme is set on the
+// registry it creates.
+func (r *Registry) SetReferenceFunc(f ReferenceFunc) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.reference = f
+}
+
 func (r *Registry) CreateReference(item mo.Reference) types.ManagedObjectReference {
-	r.counter++
 	kind := reflect.TypeOf(item).Elem().Name()
 
+	r.m.Lock()
+	f := r.reference
+	r.counter++
+	counter := r.counter
+	r.m.Unlock()
+
+	value := fmt.Sprintf("%s-%d", strings.ToLower(kind), counter)
+	if f != nil {
+		value = f(kind)
+	}
+
 	return types.ManagedObjectReference{
 		Type:  kind,
-		Value: fmt.Sprintf("%s-%d", strings.ToLower(kind), r.counter),
+		Value: value,
 	}
 }
 
@@ -85,4 +138,149 @@ func (r *Registry) Remove(item types.ManagedObjectReference) {
 	defer r.m.Unlock()
 
 	delete(r.objects, item)
+	delete(r.locks, item)
+}
+
+// WithLock calls f while the property collector can't collect obj, for the changes made to obj
+// outside of a method call, which would otherwise race with the collection
+func (r *Registry) WithLock(obj mo.Reference, f func()) {
+	ref := obj.Reference()
+
+	r.m.Lock()
+	l, ok := r.locks[ref]
+	if !ok {
+		l = new(sync.Mutex)
+		r.locks[ref] = l
+	}
+	r.m.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+
+	f()
+}
+
+// RegisterProperty has the property collector compute the property at the path, such as
+// summary.quickStats.overallCpuUsage, each time it collects an object of the given type. The value
+// is merged into a copy of the object the collector reads from, so it's reported whether the path
+// itself or a property containing it is requested. The object itself isn't modified.
+func (r *Registry) RegisterProperty(kind, path string, f PropertyFunc) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if r.properties[kind] == nil {
+		r.properties[kind] = make(map[string]PropertyFunc)
+	}
+	r.properties[kind][path] = f
+}
+
+// computedProperties returns a snapshot of the computed properties of the type, by path
+func (r *Registry) computedProperties(kind string) map[string]PropertyFunc {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	properties := make(map[string]PropertyFunc, len(r.properties[kind]))
+	for p, f := range r.properties[kind] {
+		properties[p] = f
+	}
+
+	return properties
+}
+
+// all returns a snapshot of the registered objects, so that they can be iterated without
+// holding the lock
+func (r *Registry) all() []mo.Reference {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	objects := make([]mo.Reference, 0, len(r.objects))
+	for _, o := range r.objects {
+		objects = append(objects, o)
+	}
+
+	return objects
+}
+
+// ForEach calls f for each registered object, in no particular order. The objects are those
+// registered when ForEach was called and the registry isn't locked while f runs, so f is free
+// to call back into the registry.
+func (r *Registry) ForEach(f func(mo.Reference)) {
+	for _, o := range r.all() {
+		f(o)
+	}
+}
+
+// AllByType returns the registered objects whose reference is of the given type, such as
+// "VirtualMachine", in no particular order
+func (r *Registry) AllByType(kind string) []mo.Reference {
+	var objects []mo.Reference
+
+	r.ForEach(func(o mo.Reference) {
+		if o.Reference().Type == kind {
+			objects = append(objects, o)
+		}
+	})
+
+	return objects
+}
+
+// rootFolder returns the Folder at the root of the inventory, the one without a parent
+func (r *Registry) rootFolder() *Folder {
+	for _, o := range r.AllByType("Folder") {
+		if f, ok := o.(*Folder); ok && f.Parent == nil {
+			return f
+		}
+	}
+
+	return nil
+}
+
+// entityName returns the name property of the entity
+func entityName(e mo.Entity) string {
+	// mo.Network shadows the ManagedEntity name field with its own
+	if n, ok := e.(*mo.Network); ok {
+		return n.Name
+	}
+
+	return e.Entity().Name
+}
+
+// FindByInventoryPath returns the entity at the slash delimited inventory path, such as
+// /DC0/vm/myVM or /DC0/host/localhost/Resources, resolved by the names of the entities
+// from the root folder down. nil is returned if there's no entity at the path.
+func (r *Registry) FindByInventoryPath(p string) mo.Entity {
+	root := r.rootFolder()
+	if root == nil {
+		return nil
+	}
+
+	var e mo.Entity = root
+
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+
+		// entities are listed below their parents, Datacenters by their vm, host, datastore and
+		// network folders and ResourcePools by their child pools
+		refs := contents(e)
+		if pool, ok := e.(*ResourcePool); ok {
+			refs = pool.ResourcePool.ResourcePool
+		}
+
+		var child mo.Entity
+		for _, ref := range refs {
+			if c, ok := r.Get(ref).(mo.Entity); ok && entityName(c) == name {
+				child = c
+				break
+			}
+		}
+
+		if child == nil {
+			return nil
+		}
+		e = child
+	}
+
+	return e
 }
@@ -17,8 +17,14 @@ package simulator
 import (
 	"testing"
 
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+	"github.com/vmware/vic/pkg/vsphere/simulator/vc"
 )
 
 func TestRegistry(t *testing.T) {
@@ -48,3 +54,161 @@ func TestRegistry(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestRegistryForEach(t *testing.T) {
+	r := NewRegistry()
+
+	for _, name := range []string{"a", "b", "c"} {
+		f := &mo.Folder{}
+		f.Self = types.ManagedObjectReference{Type: "Folder", Value: name}
+		r.Put(f)
+	}
+
+	h := &mo.HostSystem{}
+	h.Self = types.ManagedObjectReference{Type: "HostSystem", Value: "h"}
+	r.Put(h)
+
+	// the callback can read and write the registry while iterating
+	seen := make(map[string]bool)
+	r.ForEach(func(o mo.Reference) {
+		ref := o.Reference()
+		if r.Get(ref) == nil {
+			t.Errorf("%s wasn't found from the callback", ref)
+		}
+		seen[ref.Value] = true
+
+		if ref.Type == "HostSystem" {
+			r.Remove(ref)
+		}
+	})
+
+	if len(seen) != 4 {
+		t.Errorf("expected 4 objects, saw %d", len(seen))
+	}
+
+	folders := r.AllByType("Folder")
+	if len(folders) != 3 {
+		t.Errorf("expected 3 folders, got %d", len(folders))
+	}
+	for _, o := range folders {
+		if _, ok := o.(*mo.Folder); !ok {
+			t.Errorf("unexpected %T", o)
+		}
+	}
+
+	if hosts := r.AllByType("HostSystem"); len(hosts) != 0 {
+		t.Errorf("expected the host to be removed, got %d", len(hosts))
+	}
+}
+
+func TestFindByInventoryPath(t *testing.T) {
+	New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	vm, fault := NewVirtualMachine(&types.VirtualMachineConfigSpec{Name: "myVM"})
+	if fault != nil {
+		t.Fatal(fault)
+	}
+	Map.Get(esx.Datacenter.VmFolder).(*Folder).putChild(vm)
+
+	tests := []struct {
+		path   string
+		expect mo.Reference
+	}{
+		{"/", Map.Get(esx.RootFolder.Self)},
+		{"/ha-datacenter", Map.Get(esx.Datacenter.Self)},
+		{"/ha-datacenter/vm", Map.Get(esx.Datacenter.VmFolder)},
+		{"/ha-datacenter/vm/myVM", vm},
+		{"/ha-datacenter/host/localhost.localdomain/localhost.localdomain", Map.Get(esx.HostSystem.Self)},
+		{"/ha-datacenter/host/localhost.localdomain/Resources", Map.Get(esx.ResourcePool.Self)},
+		{"/ha-datacenter/datastore/datastore1", Map.Get(esx.Datastore.Self)},
+		{"/ha-datacenter/network/VM Network", Map.Get(esx.Datacenter.Network[0])},
+		{"/ha-datacenter/vm/noSuchVM", nil},
+		{"/noSuchDC/vm", nil},
+	}
+
+	for _, test := range tests {
+		e := Map.FindByInventoryPath(test.path)
+
+		if test.expect == nil {
+			if e != nil {
+				t.Errorf("%s: expected nil, got %s", test.path, e.Reference())
+			}
+			continue
+		}
+
+		if e == nil || e.Reference() != test.expect.Reference() {
+			t.Errorf("%s: expected %s, got %#v", test.path, test.expect.Reference(), e)
+		}
+	}
+}
+
+func TestRegistryReferenceFunc(t *testing.T) {
+	s := New(NewServiceInstance(vc.ServiceContent, vc.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	c, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Map.SetReferenceFunc(SequentialReferences())
+
+	root := object.NewRootFolder(c.Client)
+
+	foo, err := root.CreateFolder(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc, err := root.CreateDatacenter(ctx, "dc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bar, err := root.CreateFolder(ctx, "bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each type is numbered on its own, in order of creation
+	expect := map[object.Reference]string{
+		foo:                     "folder-1",
+		dc:                      "datacenter-1",
+		folders.VmFolder:        "folder-2",
+		folders.HostFolder:      "folder-3",
+		folders.DatastoreFolder: "folder-4",
+		folders.NetworkFolder:   "folder-5",
+		bar:                     "folder-6",
+	}
+
+	for o, value := range expect {
+		if ref := o.Reference(); ref.Value != value {
+			t.Errorf("expected %s, got %s", value, ref)
+		}
+	}
+
+	// a custom scheme
+	Map.SetReferenceFunc(func(kind string) string {
+		return "fixture-" + kind
+	})
+
+	if ref := Map.CreateReference(&Folder{}); ref.Type != "Folder" || ref.Value != "fixture-Folder" {
+		t.Errorf("unexpected reference %s", ref)
+	}
+
+	// and back to the default
+	Map.SetReferenceFunc(nil)
+
+	if ref := Map.CreateReference(&Folder{}); ref.Value == "fixture-Folder" {
+		t.Errorf("unexpected reference %s", ref)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type ResourcePool struct {
+	mo.ResourcePool
+}
+
+// NewResourcePool returns a copy of the pool that doesn't share its summary with the original
+func NewResourcePool(pool mo.ResourcePool) *ResourcePool {
+	if pool.Summary != nil {
+		summary := *pool.Summary.GetResourcePoolSummary()
+		pool.Summary = &summary
+	}
+
+	return &ResourcePool{
+		ResourcePool: pool,
+	}
+}
+
+// allocationInfo returns the ResourceAllocationInfo, faulting with the given property name if it's invalid
+func allocationInfo(info types.BaseResourceAllocationInfo, property string) (*types.ResourceAllocationInfo, types.BaseMethodFault) {
+	if info == nil {
+		return nil, &types.InvalidArgument{InvalidProperty: property}
+	}
+
+	a := info.GetResourceAllocationInfo()
+
+	if a.Reservation < 0 {
+		return nil, &types.InvalidArgument{InvalidProperty: property + ".reservation"}
+	}
+
+	// a limit of -1 means unlimited
+	if a.Limit != 0 && a.Limit != -1 && a.Limit < a.Reservation {
+		return nil, &types.InvalidArgument{InvalidProperty: property + ".limit"}
+	}
+
+	return a, nil
+}
+
+// updateAllocation returns a copy of cur with the fields set in spec applied
+func updateAllocation(cur types.BaseResourceAllocationInfo, spec *types.ResourceAllocationInfo) *types.ResourceAllocationInfo {
+	a := &types.ResourceAllocationInfo{}
+	if cur != nil {
+		*a = *cur.GetResourceAllocationInfo()
+	}
+
+	if spec.Reservation != 0 {
+		a.Reservation = spec.Reservation
+	}
+	if spec.ExpandableReservation != nil {
+		a.ExpandableReservation = spec.ExpandableReservation
+	}
+	if spec.Limit != 0 {
+		a.Limit = spec.Limit
+	}
+	if spec.Shares != nil {
+		a.Shares = spec.Shares
+	}
+	if spec.OverheadLimit != 0 {
+		a.OverheadLimit = spec.OverheadLimit
+	}
+
+	return a
+}
+
+func (p *ResourcePool) hasChild(name string) bool {
+	for _, ref := range p.ResourcePool.ResourcePool {
+		if child, ok := Map.Get(ref).(mo.Entity); ok && child.Entity().Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// poolHost returns the host of the standalone ComputeResource that owns the pool, nil if the
+// owner is a cluster or unknown
+func poolHost(pool types.ManagedObjectReference) *types.ManagedObjectReference {
+	rp, ok := Map.Get(pool).(*ResourcePool)
+	if !ok {
+		return nil
+	}
+
+	cr, ok := Map.Get(rp.Owner).(*mo.ComputeResource)
+	if !ok || len(cr.Host) != 1 {
+		return nil
+	}
+
+	host := cr.Host[0]
+	return &host
+}
+
+// setConfig applies the spec to the pool config, keeping the summary in sync
+func (p *ResourcePool) setConfig(spec *types.ResourceConfigSpec) types.BaseMethodFault {
+	cpu, fault := allocationInfo(spec.CpuAllocation, "spec.cpuAllocation")
+	if fault != nil {
+		return fault
+	}
+
+	mem, fault := allocationInfo(spec.MemoryAllocation, "spec.memoryAllocation")
+	if fault != nil {
+		return fault
+	}
+
+	config := p.Config
+	config.Entity = &p.Self
+	config.CpuAllocation = updateAllocation(config.CpuAllocation, cpu)
+	config.MemoryAllocation = updateAllocation(config.MemoryAllocation, mem)
+	config.ChangeVersion = fmt.Sprintf("%d", now().UnixNano())
+
+	modified := now()
+	config.LastModified = &modified
+
+	p.Config = config
+
+	if p.Summary == nil {
+		p.Summary = &types.ResourcePoolSummary{}
+	}
+	summary := p.Summary.GetResourcePoolSummary()
+	summary.Name = p.Name
+	summary.Config = config
+
+	return nil
+}
+
+func (p *ResourcePool) CreateResourcePool(c *types.CreateResourcePool) soap.HasFault {
+	body := &methods.CreateResourcePoolBody{}
+
+	if p.hasChild(c.Name) {
+		body.Fault_ = Fault("", &types.DuplicateName{
+			Name:   c.Name,
+			Object: p.Self,
+		})
+		return body
+	}
+
+	child := &ResourcePool{}
+	child.Name = c.Name
+	child.Owner = p.Owner
+	child.OverallStatus = types.ManagedEntityStatusGreen
+	child.ConfigStatus = types.ManagedEntityStatusGreen
+	child.Runtime = p.Runtime
+	child.Summary = &types.ResourcePoolSummary{Runtime: p.Runtime}
+
+	// the reference is needed for config.entity, so it's created up front
+	child.Self = Map.CreateReference(child)
+
+	if fault := child.setConfig(&c.Spec); fault != nil {
+		body.Fault_ = Fault("", fault)
+		return body
+	}
+
+	Map.PutEntity(p, child)
+
+	p.ResourcePool.ResourcePool = append(p.ResourcePool.ResourcePool, child.Self)
+
+	body.Res = &types.CreateResourcePoolResponse{
+		Returnval: child.Self,
+	}
+
+	return body
+}
+
+func (p *ResourcePool) UpdateConfig(c *types.UpdateConfig) soap.HasFault {
+	body := &methods.UpdateConfigBody{}
+
+	if c.Name != "" && c.Name != p.Name && p.Parent != nil {
+		if parent, ok := Map.Get(*p.Parent).(*ResourcePool); ok && parent.hasChild(c.Name) {
+			body.Fault_ = Fault("", &types.DuplicateName{
+				Name:   c.Name,
+				Object: parent.Self,
+			})
+			return body
+		}
+	}
+
+	if c.Config != nil {
+		spec := *c.Config
+
+		// allocations left unset in the spec are unchanged
+		if spec.CpuAllocation == nil {
+			spec.CpuAllocation = &types.ResourceAllocationInfo{}
+		}
+		if spec.MemoryAllocation == nil {
+			spec.MemoryAllocation = &types.ResourceAllocationInfo{}
+		}
+
+		if fault := p.setConfig(&spec); fault != nil {
+			body.Fault_ = Fault("", fault)
+			return body
+		}
+	}
+
+	if c.Name != "" {
+		p.Name = c.Name
+		if p.Summary != nil {
+			p.Summary.GetResourcePoolSummary().Name = c.Name
+		}
+	}
+
+	body.Res = &types.UpdateConfigResponse{}
+
+	return body
+}
@@ -0,0 +1,142 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func resourceConfigSpec(cpu, mem int64) types.ResourceConfigSpec {
+	allocation := func(reservation int64) *types.ResourceAllocationInfo {
+		return &types.ResourceAllocationInfo{
+			Reservation:           reservation,
+			ExpandableReservation: types.NewBool(true),
+			Limit:                 -1,
+			Shares: &types.SharesInfo{
+				Level: types.SharesLevelNormal,
+			},
+		}
+	}
+
+	return types.ResourceConfigSpec{
+		CpuAllocation:    allocation(cpu),
+		MemoryAllocation: allocation(mem),
+	}
+}
+
+func TestResourcePool(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder := find.NewFinder(client.Client, false)
+
+	dc, err := finder.DatacenterOrDefault(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder.SetDatacenter(dc)
+
+	root, err := finder.ResourcePoolOrDefault(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent, err := root.Create(ctx, "vch", resourceConfigSpec(100, 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = root.Create(ctx, "vch", resourceConfigSpec(100, 200)); err == nil {
+		t.Error("expected duplicate name error")
+	}
+
+	pool, err := parent.Create(ctx, "nested", resourceConfigSpec(10, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reservations := func(p *object.ResourcePool) (int64, int64) {
+		var props mo.ResourcePool
+		err = p.Properties(ctx, p.Reference(), []string{"parent", "config.cpuAllocation", "config.memoryAllocation"}, &props)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if *props.Parent != parent.Reference() {
+			t.Errorf("parent=%s", props.Parent)
+		}
+
+		return props.Config.CpuAllocation.GetResourceAllocationInfo().Reservation,
+			props.Config.MemoryAllocation.GetResourceAllocationInfo().Reservation
+	}
+
+	if cpu, mem := reservations(pool); cpu != 10 || mem != 20 {
+		t.Errorf("cpu=%d, mem=%d", cpu, mem)
+	}
+
+	// only the memory reservation is changed
+	err = pool.UpdateConfig(ctx, "", &types.ResourceConfigSpec{
+		MemoryAllocation: &types.ResourceAllocationInfo{Reservation: 64},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cpu, mem := reservations(pool); cpu != 10 || mem != 64 {
+		t.Errorf("cpu=%d, mem=%d", cpu, mem)
+	}
+
+	spec := resourceConfigSpec(10, 20)
+	spec.CpuAllocation.GetResourceAllocationInfo().Limit = 5
+	if err = pool.UpdateConfig(ctx, "", &spec); err == nil {
+		t.Error("expected invalid limit error")
+	}
+
+	task, err := pool.Destroy(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if Map.Get(pool.Reference()) != nil {
+		t.Error("pool not removed from registry")
+	}
+
+	if n := len(Map.Get(parent.Reference()).(*ResourcePool).ResourcePool.ResourcePool); n != 0 {
+		t.Errorf("%d child pools left", n)
+	}
+}
@@ -15,8 +15,6 @@
 package simulator
 
 import (
-	"time"
-
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
@@ -55,13 +53,63 @@ func NewServiceInstance(content types.ServiceContent, folder mo.Folder) *Service
 		NewPropertyCollector(s.Content.PropertyCollector),
 	}
 
+	if ref := s.Content.ViewManager; ref != nil {
+		objects = append(objects, NewViewManager(*ref))
+	}
+
+	if ref := s.Content.AuthorizationManager; ref != nil {
+		objects = append(objects, NewAuthorizationManager(*ref))
+	}
+
+	if ref := s.Content.ExtensionManager; ref != nil {
+		objects = append(objects, NewExtensionManager(*ref))
+	}
+
+	if ref := s.Content.PerfManager; ref != nil {
+		objects = append(objects, NewPerformanceManager(*ref))
+	}
+
 	for _, o := range objects {
 		Map.Put(o)
 	}
 
+	// the managers without an implementation of their own are registered as they are, so that
+	// every reference in the content resolves
+	for _, o := range contentManagers(s.Content) {
+		if Map.Get(o.Reference()) == nil {
+			Map.Put(o)
+		}
+	}
+
 	return s
 }
 
+// contentManagers returns the managers referenced by the content that clients look up on startup
+func contentManagers(content types.ServiceContent) []mo.Reference {
+	var objects []mo.Reference
+
+	if ref := content.SearchIndex; ref != nil {
+		objects = append(objects, &mo.SearchIndex{Self: *ref})
+	}
+	if ref := content.ViewManager; ref != nil {
+		objects = append(objects, &mo.ViewManager{Self: *ref})
+	}
+	if ref := content.EventManager; ref != nil {
+		objects = append(objects, &mo.EventManager{Self: *ref})
+	}
+	if ref := content.TaskManager; ref != nil {
+		objects = append(objects, &mo.TaskManager{Self: *ref})
+	}
+	if ref := content.PerfManager; ref != nil {
+		objects = append(objects, &mo.PerformanceManager{Self: *ref})
+	}
+	if ref := content.CustomFieldsManager; ref != nil {
+		objects = append(objects, &mo.CustomFieldsManager{Self: *ref})
+	}
+
+	return objects
+}
+
 func (s *ServiceInstance) RetrieveServiceContent(*types.RetrieveServiceContent) soap.HasFault {
 	return &methods.RetrieveServiceContentBody{
 		Res: &types.RetrieveServiceContentResponse{
@@ -73,7 +121,7 @@ func (s *ServiceInstance) RetrieveServiceContent(*types.RetrieveServiceContent)
 func (*ServiceInstance) CurrentTime(*types.CurrentTime) soap.HasFault {
 	return &methods.CurrentTimeBody{
 		Res: &types.CurrentTimeResponse{
-			Returnval: time.Now(),
+			Returnval: now(),
 		},
 	}
 }
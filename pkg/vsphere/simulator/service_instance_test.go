@@ -0,0 +1,88 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+	"github.com/vmware/vic/pkg/vsphere/simulator/vc"
+)
+
+func TestServiceContentReferences(t *testing.T) {
+	tests := []struct {
+		content types.ServiceContent
+		folder  mo.Folder
+	}{
+		{esx.ServiceContent, esx.RootFolder},
+		{vc.ServiceContent, vc.RootFolder},
+	}
+
+	ctx := context.Background()
+
+	for _, test := range tests {
+		s := New(NewServiceInstance(test.content, test.folder))
+
+		ts := s.NewServer()
+
+		client, err := govmomi.NewClient(ctx, ts.URL, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		content := client.ServiceContent
+
+		refs := map[string]*types.ManagedObjectReference{
+			"rootFolder":          &content.RootFolder,
+			"propertyCollector":   &content.PropertyCollector,
+			"sessionManager":      content.SessionManager,
+			"searchIndex":         content.SearchIndex,
+			"viewManager":         content.ViewManager,
+			"eventManager":        content.EventManager,
+			"taskManager":         content.TaskManager,
+			"perfManager":         content.PerfManager,
+			"customFieldsManager": content.CustomFieldsManager,
+		}
+
+		for name, ref := range refs {
+			if ref == nil {
+				// not every manager is there on ESX
+				if content.About.ApiType == "VirtualCenter" {
+					t.Errorf("%s: %s is missing", content.About.ApiType, name)
+				}
+				continue
+			}
+
+			if Map.Get(*ref) == nil {
+				t.Errorf("%s: %s %s isn't registered", content.About.ApiType, name, *ref)
+			}
+		}
+
+		// the managers can be queried like any other object
+		if content.TaskManager != nil {
+			var m mo.TaskManager
+			if err = client.RetrieveOne(ctx, *content.TaskManager, []string{"recentTask"}, &m); err != nil {
+				t.Errorf("%s: %s", content.About.ApiType, err)
+			}
+		}
+
+		ts.Close()
+	}
+}
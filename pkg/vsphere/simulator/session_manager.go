@@ -15,6 +15,9 @@
 package simulator
 
 import (
+	"crypto/rand"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/vmware/govmomi/object"
@@ -24,30 +27,150 @@ import (
 	"github.com/vmware/govmomi/vim25/types"
 )
 
+// CloneTicketExpiration is how long a ticket from AcquireCloneTicket can be exchanged for a session
+var CloneTicketExpiration = 30 * time.Second
+
+type cloneTicket struct {
+	session types.UserSession
+	expires time.Time
+}
+
 type SessionManager struct {
 	mo.SessionManager
+
+	m       sync.Mutex
+	tickets map[string]cloneTicket
 }
 
 func NewSessionManager(ref types.ManagedObjectReference) object.Reference {
-	s := &SessionManager{}
+	s := &SessionManager{
+		tickets: make(map[string]cloneTicket),
+	}
 	s.Self = ref
 	return s
 }
 
+// newSessionKey returns a random key to tell sessions and tickets apart
+func newSessionKey() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
 func (s *SessionManager) Login(login *types.Login) soap.HasFault {
 	body := &methods.LoginBody{}
 
 	if login.UserName == "" || login.Password == "" {
 		body.Fault_ = Fault("Login failure", &types.InvalidLogin{})
 	} else {
+		session := types.UserSession{
+			Key:       newSessionKey(),
+			UserName:  login.UserName,
+			FullName:  login.UserName,
+			LoginTime: now(),
+		}
+
+		s.m.Lock()
+		s.CurrentSession = &session
+		s.m.Unlock()
+
 		body.Res = &types.LoginResponse{
-			Returnval: types.UserSession{
-				UserName:  login.UserName,
-				FullName:  login.UserName,
-				LoginTime: time.Now(),
-			},
+			Returnval: session,
 		}
 	}
 
 	return body
 }
+
+// LoginExtensionByCertificate establishes a session for a registered extension. The simulator
+// doesn't see the client certificate of the connection, only the extension key is checked.
+func (s *SessionManager) LoginExtensionByCertificate(login *types.LoginExtensionByCertificate) soap.HasFault {
+	body := &methods.LoginExtensionByCertificateBody{}
+
+	extension := findExtension(login.ExtensionKey)
+	if extension == nil {
+		body.Fault_ = Fault("Login failure", &types.InvalidLogin{})
+		return body
+	}
+
+	session := types.UserSession{
+		Key:       newSessionKey(),
+		UserName:  extension.Key,
+		FullName:  extension.Key,
+		LoginTime: now(),
+		Locale:    login.Locale,
+	}
+
+	if d := extension.Description; d != nil && d.GetDescription().Label != "" {
+		session.FullName = d.GetDescription().Label
+	}
+
+	s.m.Lock()
+	s.CurrentSession = &session
+	s.m.Unlock()
+
+	body.Res = &types.LoginExtensionByCertificateResponse{
+		Returnval: session,
+	}
+
+	return body
+}
+
+// AcquireCloneTicket hands out a single use ticket that CloneSession exchanges for a session of the
+// same user. The simulator doesn't track the session of each client, the ticket is for the user
+// that logged in last.
+func (s *SessionManager) AcquireCloneTicket(req *types.AcquireCloneTicket) soap.HasFault {
+	body := &methods.AcquireCloneTicketBody{}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.CurrentSession == nil {
+		body.Fault_ = Fault("", &types.NotAuthenticated{})
+		return body
+	}
+
+	ticket := newSessionKey()
+	s.tickets[ticket] = cloneTicket{
+		session: *s.CurrentSession,
+		expires: now().Add(CloneTicketExpiration),
+	}
+
+	body.Res = &types.AcquireCloneTicketResponse{
+		Returnval: ticket,
+	}
+
+	return body
+}
+
+// CloneSession establishes a new session for the user the ticket was acquired by, consuming the ticket
+func (s *SessionManager) CloneSession(req *types.CloneSession) soap.HasFault {
+	body := &methods.CloneSessionBody{}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	ticket, ok := s.tickets[req.CloneTicket]
+	if !ok {
+		body.Fault_ = Fault("Invalid clone ticket", &types.InvalidLogin{})
+		return body
+	}
+	delete(s.tickets, req.CloneTicket)
+
+	if now().After(ticket.expires) {
+		body.Fault_ = Fault("Clone ticket expired", &types.InvalidLogin{})
+		return body
+	}
+
+	session := ticket.session
+	session.Key = newSessionKey()
+	session.LoginTime = now()
+	s.CurrentSession = &session
+
+	body.Res = &types.CloneSessionResponse{
+		Returnval: session,
+	}
+
+	return body
+}
@@ -0,0 +1,109 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestCloneSession(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	ts.URL.User = url.UserPassword("user", "pass")
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref := *esx.ServiceContent.SessionManager
+
+	acquire := types.AcquireCloneTicket{This: ref}
+	ticket, err := methods.AcquireCloneTicket(ctx, client, &acquire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := types.CloneSession{This: ref, CloneTicket: ticket.Returnval}
+	res, err := methods.CloneSession(ctx, client, &clone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Returnval.UserName != "user" || res.Returnval.Key == "" {
+		t.Errorf("unexpected session %#v", res.Returnval)
+	}
+
+	// tickets are single use
+	if _, err = methods.CloneSession(ctx, client, &clone); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestCloneSessionFaults(t *testing.T) {
+	start := time.Date(2016, time.August, 1, 12, 0, 0, 0, time.UTC)
+	fake := NewFakeClock(start)
+
+	defer SetClock(SetClock(fake))
+
+	ref := types.ManagedObjectReference{Type: "SessionManager", Value: "SessionManager"}
+	m := NewSessionManager(ref).(*SessionManager)
+
+	// no session, no ticket
+	if fault := m.AcquireCloneTicket(&types.AcquireCloneTicket{This: ref}).Fault(); fault == nil {
+		t.Error("expected fault")
+	} else if _, ok := fault.Detail.Fault.(*types.NotAuthenticated); !ok {
+		t.Errorf("unexpected fault: %#v", fault.Detail.Fault)
+	}
+
+	if m.Login(&types.Login{This: ref, UserName: "user", Password: "pass"}).Fault() != nil {
+		t.Fatal("login failed")
+	}
+
+	expectInvalidLogin := func(ticket string) {
+		fault := m.CloneSession(&types.CloneSession{This: ref, CloneTicket: ticket}).Fault()
+		if fault == nil {
+			t.Errorf("expected fault for ticket %q", ticket)
+			return
+		}
+		if _, ok := fault.Detail.Fault.(*types.InvalidLogin); !ok {
+			t.Errorf("unexpected fault: %#v", fault.Detail.Fault)
+		}
+	}
+
+	expectInvalidLogin("bogus")
+
+	body := m.AcquireCloneTicket(&types.AcquireCloneTicket{This: ref}).(*methods.AcquireCloneTicketBody)
+	if body.Fault_ != nil {
+		t.Fatal("expected ticket")
+	}
+
+	fake.Advance(CloneTicketExpiration + time.Second)
+
+	expectInvalidLogin(body.Res.Returnval)
+}
@@ -16,15 +16,28 @@ package simulator
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"strings"
+	"time"
 
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
 	"github.com/vmware/govmomi/vim25/xml"
@@ -40,8 +53,19 @@ type Method struct {
 // Service decodes incoming requests and dispatches to a Handler
 type Service struct {
 	readAll func(io.Reader) ([]byte, error)
+
+	// TLS, if set, has NewServer serve https rather than http.  A self-signed
+	// certificate is generated if the config doesn't provide one.
+	TLS *tls.Config
+
+	// middleware wraps the method dispatch, see Use
+	middleware []Middleware
 }
 
+// HealthPath is the path of the health endpoint, served next to /sdk. A GET or HEAD request
+// returns 200 once the ServiceContent is available and 503 Service Unavailable before that.
+const HealthPath = "/health"
+
 // Server provides a simulator Service over HTTP
 type Server struct {
 	*httptest.Server
@@ -87,6 +111,12 @@ func (s *Service) call(method *Method) soap.HasFault {
 	}
 
 	m := reflect.ValueOf(handler).MethodByName(method.Name)
+	if !m.IsValid() {
+		// fallback to the methods shared by all managed entities
+		if e, ok := handler.(mo.Entity); ok {
+			m = reflect.ValueOf(ManagedEntity{e}).MethodByName(method.Name)
+		}
+	}
 	if !m.IsValid() {
 		return serverFault(fmt.Sprintf("%s does not implement: %s", method.This, method.Name))
 	}
@@ -117,7 +147,7 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		res = serverFault(err.Error())
 	} else {
-		res = s.call(method)
+		res = s.handler()(r.Context(), method)
 	}
 
 	if res.Fault() == nil {
@@ -137,13 +167,44 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// ServeHealth reports whether the simulator is ready to serve requests, see HealthPath
+func (s *Service) ServeHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	if si, ok := Map.Get(serviceInstance).(*ServiceInstance); !ok || si.Content.RootFolder.Value == "" {
+		http.Error(w, "ServiceContent is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
 // NewServer returns an http Server instance for the given service
 func (s *Service) NewServer() *Server {
 	mux := http.NewServeMux()
 	path := "/sdk"
 	mux.Handle(path, s)
+	mux.HandleFunc(HealthPath, s.ServeHealth)
 
-	ts := httptest.NewServer(mux)
+	ts := httptest.NewUnstartedServer(mux)
+
+	if s.TLS == nil {
+		ts.Start()
+	} else {
+		ts.TLS = s.TLS
+		if len(ts.TLS.Certificates) == 0 {
+			cert, err := NewSelfSignedCertificate()
+			if err != nil {
+				log.Fatalf("failed to generate certificate: %s", err)
+			}
+			ts.TLS.Certificates = []tls.Certificate{cert}
+		}
+		ts.StartTLS()
+	}
 
 	u, _ := url.Parse(ts.URL)
 	u.Path = path
@@ -154,6 +215,136 @@ func (s *Service) NewServer() *Server {
 	}
 }
 
+// Ready blocks until the server accepts connections and its health endpoint reports the
+// ServiceContent available, or ctx is done
+func (s *Server) Ready(ctx context.Context) error {
+	u := *s.URL
+	u.Path = HealthPath
+
+	client := &http.Client{Timeout: time.Second}
+	if s.TLS != nil {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: s.CertificatePool()},
+		}
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		res, err := client.Get(u.String())
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+			err = fmt.Errorf("%s returned %s", u.String(), res.Status)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("simulator isn't ready: %s", err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Certificate returns the certificate presented by the server, nil if the server isn't using TLS
+func (s *Server) Certificate() *x509.Certificate {
+	if s.TLS == nil || len(s.TLS.Certificates) == 0 {
+		return nil
+	}
+
+	cert := s.TLS.Certificates[0]
+	if cert.Leaf != nil {
+		return cert.Leaf
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	return leaf
+}
+
+// CertificatePool returns a pool containing the server certificate, for use as the RootCAs of a
+// client that verifies the server
+func (s *Server) CertificatePool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	if cert := s.Certificate(); cert != nil {
+		pool.AddCert(cert)
+	}
+
+	return pool
+}
+
+// Thumbprint returns the SHA-1 thumbprint of the server certificate in the colon separated
+// hex form used by vCenter, empty if the server isn't using TLS
+func (s *Server) Thumbprint() string {
+	cert := s.Certificate()
+	if cert == nil {
+		return ""
+	}
+
+	return Thumbprint(cert)
+}
+
+// Thumbprint returns the SHA-1 thumbprint of the certificate in the form AB:CD:...
+func Thumbprint(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+
+	return strings.Join(hex, ":")
+}
+
+// NewSelfSignedCertificate generates a self-signed certificate valid for the loopback addresses
+func NewSelfSignedCertificate() (tls.Certificate, error) {
+	var cert tls.Certificate
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return cert, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return cert, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   "localhost",
+			Organization: []string{"VMware"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(24 * 365 * time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return cert, err
+	}
+
+	cert.Certificate = [][]byte{der}
+	cert.PrivateKey = key
+	cert.Leaf, err = x509.ParseCertificate(der)
+
+	return cert, err
+}
+
 var typeFunc = types.TypeFunc()
 
 // UnmarshalBody extracts the Body from a soap.Envelope and unmarshals to the corresponding govmomi type
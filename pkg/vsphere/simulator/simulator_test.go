@@ -15,6 +15,7 @@
 package simulator
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -27,6 +28,8 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
@@ -337,3 +340,105 @@ func TestServeHTTPErrors(t *testing.T) {
 		t.Errorf("expected status %d, got %s", http.StatusBadRequest, res.Status)
 	}
 }
+
+func TestServeTLS(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+	s.TLS = new(tls.Config)
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	if ts.URL.Scheme != "https" {
+		t.Fatalf("expected https, got %s", ts.URL)
+	}
+
+	thumbprint := ts.Thumbprint()
+	if len(thumbprint) != 59 || thumbprint != Thumbprint(ts.Certificate()) {
+		t.Errorf("unexpected thumbprint %q", thumbprint)
+	}
+
+	ctx := context.Background()
+
+	// the self-signed certificate must be rejected unless the client trusts it
+	if _, err := govmomi.NewClient(ctx, ts.URL, false); err == nil {
+		t.Error("expected certificate verification error")
+	}
+
+	sc := soap.NewClient(ts.URL, false)
+	sc.Client.Transport.(*http.Transport).TLSClientConfig.RootCAs = ts.CertificatePool()
+
+	vc, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &govmomi.Client{
+		Client:         vc,
+		SessionManager: session.NewManager(vc),
+	}
+
+	err = client.Login(ctx, url.UserPassword("user", "pass"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerReady(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+		if secure {
+			s.TLS = new(tls.Config)
+		}
+
+		ts := s.NewServer()
+		defer ts.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := ts.Ready(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+	ts := s.NewServer()
+	defer ts.Close()
+
+	u := *ts.URL
+	u.Path = HealthPath
+
+	status := func(method string) int {
+		req, err := http.NewRequest(method, u.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if code := status("GET"); code != http.StatusOK {
+		t.Errorf("expected GET %s to succeed, got %d", HealthPath, code)
+	}
+	if code := status("POST"); code != http.StatusMethodNotAllowed {
+		t.Errorf("expected POST %s to be rejected, got %d", HealthPath, code)
+	}
+
+	// without the ServiceContent the server isn't ready
+	Map = NewRegistry()
+
+	if code := status("GET"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected GET %s to be unavailable, got %d", HealthPath, code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := ts.Ready(ctx); err == nil {
+		t.Error("expected the server not to be ready")
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VirtualMachineSnapshot holds the config of a VM at the time the snapshot was taken
+type VirtualMachineSnapshot struct {
+	mo.VirtualMachineSnapshot
+}
+
+// findSnapshot returns the node of the snapshot in the tree, or nil
+func findSnapshot(tree []types.VirtualMachineSnapshotTree, ref types.ManagedObjectReference) *types.VirtualMachineSnapshotTree {
+	for i := range tree {
+		if tree[i].Snapshot == ref {
+			return &tree[i]
+		}
+		if node := findSnapshot(tree[i].ChildSnapshotList, ref); node != nil {
+			return node
+		}
+	}
+
+	return nil
+}
+
+// removeSnapshots removes the snapshots of the tree from the registry
+func removeSnapshots(tree []types.VirtualMachineSnapshotTree) {
+	for _, node := range tree {
+		removeSnapshots(node.ChildSnapshotList)
+		Map.Remove(node.Snapshot)
+	}
+}
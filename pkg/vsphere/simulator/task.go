@@ -0,0 +1,139 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// TaskWaitTimeout is how long WaitForTask waits for a task to complete
+var TaskWaitTimeout = 30 * time.Second
+
+// maxTaskPollInterval caps the backoff between the WaitForTask polls
+const maxTaskPollInterval = time.Second
+
+// TaskRunner is the function a Task executes, returning the task result or a fault
+type TaskRunner func(*Task) (types.AnyType, types.BaseMethodFault)
+
+type Task struct {
+	mo.Task
+
+	run TaskRunner
+}
+
+// NewTask returns a Task for the given entity that executes run when started
+func NewTask(entity mo.Entity, descriptionID string, run TaskRunner) *Task {
+	t := &Task{run: run}
+
+	t.Self = Map.CreateReference(t)
+
+	e := entity.Entity()
+	ref := e.Self
+
+	t.Info = types.TaskInfo{
+		Key:           t.Self.Value,
+		Task:          t.Self,
+		Name:          descriptionID,
+		DescriptionId: descriptionID,
+		Entity:        &ref,
+		EntityName:    e.Name,
+		State:         types.TaskInfoStateQueued,
+		QueueTime:     now(),
+	}
+
+	Map.Put(t)
+
+	return t
+}
+
+// Run executes the task to completion, recording the result or error in the task info.
+// The task reference is returned for use as the method response.
+func (t *Task) Run() types.ManagedObjectReference {
+	start := now()
+	t.Info.StartTime = &start
+	t.Info.State = types.TaskInfoStateRunning
+
+	res, fault := t.run(t)
+
+	complete := now()
+	t.Info.CompleteTime = &complete
+
+	if fault != nil {
+		t.Info.State = types.TaskInfoStateError
+		t.Info.Error = &types.LocalizedMethodFault{
+			Fault:            fault,
+			LocalizedMessage: fmt.Sprintf("%s fault", reflect.TypeOf(fault).Elem().Name()),
+		}
+	} else {
+		t.Info.State = types.TaskInfoStateSuccess
+		t.Info.Result = res
+		t.Info.Progress = 100
+	}
+
+	return t.Self
+}
+
+// WaitForTask polls the info of the task until it has completed, backing off exponentially
+// between the polls. The task result is returned on success, a task.Error holding the fault
+// if the task failed. Polling gives up after TaskWaitTimeout, so that a task that never
+// completes fails the test instead of hanging it:
+//
+//	res, err := WaitForTask(ctx, client.Client, ref)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//
+// The polls run on the wall clock, they aren't affected by SetClock.
+func WaitForTask(ctx context.Context, c *vim25.Client, ref types.ManagedObjectReference) (types.AnyType, error) {
+	ctx, cancel := context.WithTimeout(ctx, TaskWaitTimeout)
+	defer cancel()
+
+	pc := property.DefaultCollector(c)
+	interval := 10 * time.Millisecond
+
+	for {
+		var t mo.Task
+		if err := pc.RetrieveOne(ctx, ref, []string{"info"}, &t); err != nil {
+			return nil, err
+		}
+
+		switch t.Info.State {
+		case types.TaskInfoStateSuccess:
+			return t.Info.Result, nil
+		case types.TaskInfoStateError:
+			return nil, task.Error{LocalizedMethodFault: t.Info.Error}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("task %s didn't complete: %s", ref.Value, ctx.Err())
+		case <-time.After(interval):
+		}
+
+		if interval *= 2; interval > maxTaskPollInterval {
+			interval = maxTaskPollInterval
+		}
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestWaitForTask(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:    "foo",
+		GuestId: "otherGuest64",
+		Files:   &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+	})
+
+	on, err := vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = WaitForTask(ctx, client.Client, on.Reference()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the VM is already powered on
+	on, err = vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = WaitForTask(ctx, client.Client, on.Reference())
+	if terr, ok := err.(task.Error); !ok {
+		t.Errorf("expected a task error, got %v", err)
+	} else if _, ok = terr.Fault().(*types.InvalidPowerState); !ok {
+		t.Errorf("expected InvalidPowerState, got %T", terr.Fault())
+	}
+
+	// a task that's never run doesn't complete
+	saved := TaskWaitTimeout
+	TaskWaitTimeout = 100 * time.Millisecond
+	defer func() {
+		TaskWaitTimeout = saved
+	}()
+
+	queued := NewTask(Map.Get(vm.Reference()).(*VirtualMachine), "VirtualMachine.powerOff", nil)
+	if _, err = WaitForTask(ctx, client.Client, queued.Reference()); err == nil {
+		t.Error("expected the wait for a queued task to time out")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"path"
+	"reflect"
+	"sync"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type ViewManager struct {
+	mo.ViewManager
+
+	m sync.Mutex
+}
+
+func NewViewManager(ref types.ManagedObjectReference) object.Reference {
+	s := &ViewManager{}
+	s.Self = ref
+	return s
+}
+
+// ContainerView lists the entities below its container. The list is taken when the view is
+// created, entities created or destroyed later aren't reflected by it.
+type ContainerView struct {
+	mo.ContainerView
+
+	manager *ViewManager
+}
+
+func (m *ViewManager) CreateContainerView(req *types.CreateContainerView) soap.HasFault {
+	body := &methods.CreateContainerViewBody{}
+
+	container, ok := Map.Get(req.Container).(mo.Entity)
+	if !ok {
+		body.Fault_ = Fault("", &types.ManagedObjectNotFound{Obj: req.Container})
+		return body
+	}
+
+	view := &ContainerView{manager: m}
+	view.Self = Map.CreateReference(view)
+	view.Container = req.Container
+	view.Type = req.Type
+	view.Recursive = req.Recursive
+	view.View = viewContents(container, req.Type, req.Recursive, make(map[types.ManagedObjectReference]bool))
+	Map.Put(view)
+
+	m.m.Lock()
+	m.ViewList = append(m.ViewList, view.Self)
+	m.m.Unlock()
+
+	body.Res = &types.CreateContainerViewResponse{
+		Returnval: view.Self,
+	}
+
+	return body
+}
+
+func (v *ContainerView) DestroyView(*types.DestroyView) soap.HasFault {
+	Map.Remove(v.Self)
+
+	v.manager.m.Lock()
+	v.manager.ViewList = removeReference(v.manager.ViewList, v.Self)
+	v.manager.m.Unlock()
+
+	return &methods.DestroyViewBody{
+		Res: &types.DestroyViewResponse{},
+	}
+}
+
+// viewContents returns the entities contained by e that are of one of the kinds, any kind if
+// none is given. seen guards against listing an entity that's reachable by more than one path
+// twice, such as a VM that's in both a folder and a resource pool.
+func viewContents(e mo.Entity, kinds []string, recursive bool, seen map[types.ManagedObjectReference]bool) []types.ManagedObjectReference {
+	refs := contents(e)
+	if pool, ok := e.(*ResourcePool); ok {
+		refs = append(append([]types.ManagedObjectReference(nil), pool.ResourcePool.ResourcePool...), pool.Vm...)
+	}
+
+	var view []types.ManagedObjectReference
+
+	for _, ref := range refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+
+		child, ok := Map.Get(ref).(mo.Entity)
+		if !ok {
+			continue
+		}
+
+		if len(kinds) == 0 || isKind(child, kinds) {
+			view = append(view, ref)
+		}
+
+		if recursive {
+			view = append(view, viewContents(child, kinds, recursive, seen)...)
+		}
+	}
+
+	return view
+}
+
+// isKind returns true if the object is of one of the kinds, which may be a base type such as
+// ManagedEntity or ComputeResource
+func isKind(obj mo.Reference, kinds []string) bool {
+	rtype := reflect.TypeOf(obj).Elem()
+
+	// wrapper types embed the mo type as their first field
+	if path.Base(rtype.PkgPath()) != "mo" {
+		rtype = rtype.Field(0).Type
+	}
+
+	for _, kind := range kinds {
+		if embeds(rtype, kind) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// embeds returns true if rtype is named kind or embeds a type named kind
+func embeds(rtype reflect.Type, kind string) bool {
+	if rtype.Name() == kind {
+		return true
+	}
+
+	for i := 0; i < rtype.NumField(); i++ {
+		f := rtype.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && embeds(f.Type, kind) {
+			return true
+		}
+	}
+
+	return false
+}
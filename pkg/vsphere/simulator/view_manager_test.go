@@ -0,0 +1,168 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"sort"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+func TestContainerView(t *testing.T) {
+	content := esx.ServiceContent
+	s := New(NewServiceInstance(content, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var expect []string
+	for _, name := range []string{"foo", "bar"} {
+		createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+			Name:    name,
+			GuestId: "otherGuest64",
+			Files:   &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+		})
+		expect = append(expect, name)
+	}
+	sort.Strings(expect)
+
+	res, err := methods.CreateContainerView(ctx, client.Client, &types.CreateContainerView{
+		This:      *content.ViewManager,
+		Container: content.RootFolder,
+		Type:      []string{"VirtualMachine"},
+		Recursive: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := res.Returnval
+
+	// the way govmomi's view package lists objects, traversing the view property
+	req := types.RetrieveProperties{
+		SpecSet: []types.PropertyFilterSpec{
+			{
+				ObjectSet: []types.ObjectSpec{
+					{
+						Obj:  view,
+						Skip: types.NewBool(true),
+						SelectSet: []types.BaseSelectionSpec{
+							&types.TraversalSpec{Type: "ContainerView", Path: "view"},
+						},
+					},
+				},
+				PropSet: []types.PropertySpec{
+					{Type: "VirtualMachine", PathSet: []string{"name"}},
+				},
+			},
+		},
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(client.Client)
+	pres, err := pc.RetrieveProperties(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = mo.LoadRetrievePropertiesResponse(pres, &vms); err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, vm := range vms {
+		names = append(names, vm.Name)
+	}
+	sort.Strings(names)
+
+	if len(names) != len(expect) || names[0] != expect[0] || names[1] != expect[1] {
+		t.Errorf("expected VMs %v in the view, got %v", expect, names)
+	}
+
+	// the host isn't of the requested type
+	var cv mo.ContainerView
+	if err = pc.RetrieveOne(ctx, view, []string{"view"}, &cv); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range cv.View {
+		if ref.Type != "VirtualMachine" {
+			t.Errorf("unexpected %s in the view", ref)
+		}
+	}
+
+	// without recursion the root folder only contains the datacenter
+	res, err = methods.CreateContainerView(ctx, client.Client, &types.CreateContainerView{
+		This:      *content.ViewManager,
+		Container: content.RootFolder,
+		Type:      []string{"ManagedEntity"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = pc.RetrieveOne(ctx, res.Returnval, []string{"view"}, &cv); err != nil {
+		t.Fatal(err)
+	}
+	if len(cv.View) != 1 || cv.View[0].Type != "Datacenter" {
+		t.Errorf("expected the datacenter, got %v", cv.View)
+	}
+
+	var vm mo.ViewManager
+	if err = pc.RetrieveOne(ctx, *content.ViewManager, []string{"viewList"}, &vm); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.ViewList) != 2 {
+		t.Errorf("expected 2 views, got %v", vm.ViewList)
+	}
+
+	for _, ref := range vm.ViewList {
+		if _, err = methods.DestroyView(ctx, client.Client, &types.DestroyView{This: ref}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if Map.Get(view) != nil {
+		t.Errorf("view %s wasn't destroyed", view)
+	}
+
+	vm = mo.ViewManager{}
+	if err = pc.RetrieveOne(ctx, *content.ViewManager, []string{"viewList"}, &vm); err != nil {
+		t.Fatal(err)
+	}
+	if len(vm.ViewList) != 0 {
+		t.Errorf("expected no views, got %v", vm.ViewList)
+	}
+
+	// the container has to exist
+	_, err = methods.CreateContainerView(ctx, client.Client, &types.CreateContainerView{
+		This:      *content.ViewManager,
+		Container: types.ManagedObjectReference{Type: "Folder", Value: "enoent"},
+	})
+	if err == nil {
+		t.Error("expected a fault for a missing container")
+	}
+}
@@ -0,0 +1,1368 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sync"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+type VirtualMachine struct {
+	mo.VirtualMachine
+
+	// GuestIP, if set, is reported by tools as the guest IP address once the VM is powered on
+	GuestIP string
+
+	// changes holds the areas QueryChangedDiskAreas reports, by disk key and changeId
+	changes map[int32]map[string]types.DiskChangeInfo
+
+	// uptime holds the periods the VM was powered on, for the performance manager
+	uptime []uptime
+
+	// hostName, if set, is the host name tools report instead of the VM name, as customized by a clone
+	hostName string
+
+	// snapshotID is the id of the last snapshot taken of the VM
+	snapshotID int32
+
+	// guest and guestSummary hold the guest info while the VM isn't connected
+	guest        *types.GuestInfo
+	guestSummary *types.VirtualMachineGuestSummary
+
+	m sync.Mutex
+}
+
+// NewVirtualMachine returns a powered off VirtualMachine configured by the given spec
+func NewVirtualMachine(spec *types.VirtualMachineConfigSpec) (*VirtualMachine, types.BaseMethodFault) {
+	vm := &VirtualMachine{}
+
+	if spec.Name == "" {
+		return nil, &types.InvalidVmConfig{Property: "configSpec.name"}
+	}
+
+	vm.Config = &types.VirtualMachineConfigInfo{
+		GuestId: "otherGuest",
+		Hardware: types.VirtualHardware{
+			NumCPU:   1,
+			MemoryMB: 32,
+		},
+	}
+
+	vm.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOff
+	vm.Runtime.ConnectionState = types.VirtualMachineConnectionStateConnected
+	vm.Runtime.ConsolidationNeeded = types.NewBool(false)
+
+	if fault := vm.configure(spec); fault != nil {
+		return nil, fault
+	}
+
+	return vm, nil
+}
+
+// vmFile is a file created for a VM on a datastore
+type vmFile struct {
+	ds   *Datastore
+	name string
+}
+
+type vmFiles []vmFile
+
+// remove removes the files from their datastores
+func (files vmFiles) remove() {
+	for _, f := range files {
+		f.ds.remove(f.name)
+	}
+}
+
+// datastores returns the datastores the files are on
+func (files vmFiles) datastores() []types.ManagedObjectReference {
+	var refs []types.ManagedObjectReference
+
+	seen := make(map[types.ManagedObjectReference]bool)
+	for _, f := range files {
+		if !seen[f.ds.Self] {
+			seen[f.ds.Self] = true
+			refs = append(refs, f.ds.Self)
+		}
+	}
+
+	return refs
+}
+
+// createVMFiles creates the VMX and the new disks of the VM on the datastores of the datacenter,
+// filling in their paths in the spec. The files are placed in a directory named after the VM
+// unless the VMX path names one. No files are created if the spec doesn't name a datastore.
+func createVMFiles(dc *mo.Datacenter, spec *types.VirtualMachineConfigSpec) (vmFiles, types.BaseMethodFault) {
+	if spec.Files == nil || spec.Files.VmPathName == "" {
+		return nil, nil
+	}
+
+	var files vmFiles
+
+	create := func(ds *Datastore, name string, size int64) types.BaseMethodFault {
+		if fault := ds.createFile(name, size); fault != nil {
+			files.remove()
+			return fault
+		}
+		files = append(files, vmFile{ds, name})
+		return nil
+	}
+
+	dsName, vmx, ok := parseDatastorePath(spec.Files.VmPathName)
+	ds := findDatastore(dc, dsName)
+	if !ok || ds == nil {
+		return nil, &types.InvalidDatastorePath{DatastorePath: spec.Files.VmPathName}
+	}
+
+	dir := vmx
+	if path.Ext(vmx) == ".vmx" {
+		dir = path.Dir(vmx)
+	} else {
+		if dir == "" {
+			dir = spec.Name
+		}
+		vmx = path.Join(dir, spec.Name+".vmx")
+	}
+
+	if fault := create(ds, vmx, 0); fault != nil {
+		return nil, fault
+	}
+
+	spec.Files.VmPathName = ds.Path(vmx)
+	spec.Files.LogDirectory = ds.Path(dir)
+	spec.Files.SnapshotDirectory = ds.Path(dir)
+	spec.Files.SuspendDirectory = ds.Path(dir)
+
+	for _, change := range spec.DeviceChange {
+		dspec := change.GetVirtualDeviceConfigSpec()
+		if dspec.FileOperation != types.VirtualDeviceConfigSpecFileOperationCreate {
+			continue
+		}
+
+		disk, ok := dspec.Device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+		backing, ok := disk.Backing.(types.BaseVirtualDeviceFileBackingInfo)
+		if !ok {
+			continue
+		}
+		info := backing.GetVirtualDeviceFileBackingInfo()
+
+		// a disk without a file name, or with just a datastore, is placed next to the VMX
+		diskDS, name := ds, ""
+		if info.FileName != "" {
+			var dsName string
+			if dsName, name, ok = parseDatastorePath(info.FileName); !ok {
+				files.remove()
+				return nil, &types.InvalidDatastorePath{DatastorePath: info.FileName}
+			}
+			if diskDS = findDatastore(dc, dsName); diskDS == nil {
+				files.remove()
+				return nil, &types.InvalidDatastorePath{DatastorePath: info.FileName}
+			}
+		}
+
+		if name == "" {
+			name = path.Join(dir, spec.Name+".vmdk")
+			for i := 1; diskDS.exists(name); i++ {
+				name = path.Join(dir, fmt.Sprintf("%s_%d.vmdk", spec.Name, i))
+			}
+		}
+
+		if fault := create(diskDS, name, disk.CapacityInKB*1024); fault != nil {
+			return nil, fault
+		}
+
+		info.FileName = diskDS.Path(name)
+		info.Datastore = &diskDS.Self
+	}
+
+	return files, nil
+}
+
+// VMsOnVirtualDisk returns the VMs that have a disk backed by the given datastore path, either
+// directly or as the parent of a delta disk. The result is empty if the disk isn't referenced.
+func VMsOnVirtualDisk(name string) []types.ManagedObjectReference {
+	refs := []types.ManagedObjectReference{}
+
+	dsName, file, ok := parseDatastorePath(name)
+	if !ok {
+		return refs
+	}
+
+	for _, o := range Map.AllByType("VirtualMachine") {
+		vm, ok := o.(*VirtualMachine)
+		if !ok {
+			continue
+		}
+
+		if vm.usesDisk(dsName, path.Clean(file)) {
+			refs = append(refs, vm.Self)
+		}
+	}
+
+	return refs
+}
+
+// usesDisk reports whether any disk of the VM is backed by the file on the named datastore
+func (vm *VirtualMachine) usesDisk(dsName, file string) bool {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	if vm.Config == nil {
+		return false
+	}
+
+	for _, device := range vm.Config.Hardware.Device {
+		disk, ok := device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+
+		for backing := disk.Backing; backing != nil; backing = diskParent(backing) {
+			fb, ok := backing.(types.BaseVirtualDeviceFileBackingInfo)
+			if !ok {
+				break
+			}
+
+			n, f, ok := parseDatastorePath(fb.GetVirtualDeviceFileBackingInfo().FileName)
+			if ok && n == dsName && path.Clean(f) == file {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// diskParent returns the backing of the parent of a delta disk, nil if there's none
+func diskParent(backing types.BaseVirtualDeviceBackingInfo) types.BaseVirtualDeviceBackingInfo {
+	if b, ok := backing.(*types.VirtualDiskFlatVer2BackingInfo); ok && b.Parent != nil {
+		return b.Parent
+	}
+	return nil
+}
+
+// enabled returns the value of an optional flag of the config, which is false if unset
+func enabled(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// checkHotPlug returns a fault if the spec changes the CPUs or memory of a powered on VM in a way
+// its config doesn't allow.  Like vCenter, adding CPUs or memory requires the hot add to be
+// enabled, removing CPUs requires the hot remove to be enabled and memory can't be removed.  The
+// hot plug flags themselves can only be changed while the VM is powered off.
+func (vm *VirtualMachine) checkHotPlug(spec *types.VirtualMachineConfigSpec) types.BaseMethodFault {
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		return nil
+	}
+
+	changed := func(flag, current *bool) bool {
+		return flag != nil && *flag != enabled(current)
+	}
+
+	allowed := !changed(spec.MemoryHotAddEnabled, vm.Config.MemoryHotAddEnabled) &&
+		!changed(spec.CpuHotAddEnabled, vm.Config.CpuHotAddEnabled) &&
+		!changed(spec.CpuHotRemoveEnabled, vm.Config.CpuHotRemoveEnabled)
+
+	hardware := vm.Config.Hardware
+	if spec.NumCPUs > hardware.NumCPU && !enabled(vm.Config.CpuHotAddEnabled) {
+		allowed = false
+	}
+
+	if spec.NumCPUs > 0 && spec.NumCPUs < hardware.NumCPU && !enabled(vm.Config.CpuHotRemoveEnabled) {
+		allowed = false
+	}
+
+	if spec.MemoryMB > int64(hardware.MemoryMB) && !enabled(vm.Config.MemoryHotAddEnabled) {
+		allowed = false
+	}
+
+	if spec.MemoryMB > 0 && spec.MemoryMB < int64(hardware.MemoryMB) {
+		allowed = false
+	}
+
+	if allowed {
+		return nil
+	}
+
+	return &types.InvalidPowerState{
+		RequestedState: types.VirtualMachinePowerStatePoweredOff,
+		ExistingState:  vm.Runtime.PowerState,
+	}
+}
+
+// configure applies the spec to the VM config, leaving the config untouched if the spec is invalid
+func (vm *VirtualMachine) configure(spec *types.VirtualMachineConfigSpec) types.BaseMethodFault {
+	if fault := vm.checkHotPlug(spec); fault != nil {
+		return fault
+	}
+
+	devices, fault := configureDevices(vm.Config.Hardware.Device, spec.DeviceChange)
+	if fault != nil {
+		return fault
+	}
+
+	if fault = vm.configureDVPorts(vm.Config.Hardware.Device, devices); fault != nil {
+		return fault
+	}
+
+	vm.Config.Hardware.Device = devices
+	vm.Config.ExtraConfig = mergeExtraConfig(vm.Config.ExtraConfig, spec.ExtraConfig)
+
+	if spec.Name != "" {
+		vm.Name = spec.Name
+		vm.Config.Name = spec.Name
+	}
+
+	if spec.GuestId != "" {
+		vm.Config.GuestId = spec.GuestId
+	}
+
+	if spec.Files != nil {
+		vm.Config.Files = *spec.Files
+	}
+
+	if spec.NumCPUs > 0 {
+		vm.Config.Hardware.NumCPU = spec.NumCPUs
+	}
+
+	if spec.NumCoresPerSocket > 0 {
+		vm.Config.Hardware.NumCoresPerSocket = spec.NumCoresPerSocket
+	}
+
+	if spec.MemoryMB > 0 {
+		vm.Config.Hardware.MemoryMB = int32(spec.MemoryMB)
+	}
+
+	if spec.MemoryHotAddEnabled != nil {
+		vm.Config.MemoryHotAddEnabled = spec.MemoryHotAddEnabled
+	}
+
+	if spec.CpuHotAddEnabled != nil {
+		vm.Config.CpuHotAddEnabled = spec.CpuHotAddEnabled
+	}
+
+	if spec.CpuHotRemoveEnabled != nil {
+		vm.Config.CpuHotRemoveEnabled = spec.CpuHotRemoveEnabled
+	}
+
+	vm.Summary.Config.Name = vm.Name
+	vm.Summary.Config.GuestId = vm.Config.GuestId
+	vm.Summary.Config.NumCpu = vm.Config.Hardware.NumCPU
+	vm.Summary.Config.MemorySizeMB = vm.Config.Hardware.MemoryMB
+	vm.Summary.Config.NumVirtualDisks = 0
+	vm.Summary.Config.NumEthernetCards = 0
+
+	for _, device := range devices {
+		switch device.(type) {
+		case *types.VirtualDisk:
+			vm.Summary.Config.NumVirtualDisks++
+		case types.BaseVirtualEthernetCard:
+			vm.Summary.Config.NumEthernetCards++
+		}
+	}
+
+	return nil
+}
+
+// findDevice returns the index of the device with the given key, -1 if there's no such device
+func findDevice(devices []types.BaseVirtualDevice, key int32) int {
+	for i, device := range devices {
+		if device.GetVirtualDevice().Key == key {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// newDeviceKey returns a key that isn't used by any of the devices
+func newDeviceKey(devices []types.BaseVirtualDevice) int32 {
+	key := int32(1000)
+
+	for _, device := range devices {
+		if k := device.GetVirtualDevice().Key; k >= key {
+			key = k + 1
+		}
+	}
+
+	return key
+}
+
+// controllerUnits returns the number of unit numbers of the controller and the unit number
+// the controller itself takes, -1 if it doesn't take one
+func controllerUnits(controller types.BaseVirtualController) (int32, int32) {
+	switch c := controller.(type) {
+	case types.BaseVirtualSCSIController:
+		// the SCSI controller is unit 7 unless the spec says otherwise
+		if unit := c.GetVirtualSCSIController().ScsiCtlrUnitNumber; unit > 0 {
+			return 16, unit
+		}
+		return 16, 7
+	case *types.VirtualIDEController:
+		return 2, -1
+	}
+
+	return 30, -1
+}
+
+// attachDisk checks that the disk at index i of the spec refers to one of the controllers in
+// devices and that its unit number is free on that controller.  A disk without a unit number
+// is given the lowest free one.
+func attachDisk(devices []types.BaseVirtualDevice, disk *types.VirtualDisk, i int) types.BaseMethodFault {
+	invalid := func(property string) types.BaseMethodFault {
+		return &types.InvalidDeviceSpec{
+			InvalidVmConfig: types.InvalidVmConfig{Property: "virtualDeviceSpec.device." + property},
+			DeviceIndex:     int32(i),
+		}
+	}
+
+	ix := findDevice(devices, disk.ControllerKey)
+	if ix == -1 {
+		return invalid("controllerKey")
+	}
+
+	controller, ok := devices[ix].(types.BaseVirtualController)
+	if !ok {
+		return invalid("controllerKey")
+	}
+
+	units, reserved := controllerUnits(controller)
+
+	used := map[int32]bool{reserved: true}
+	for _, device := range devices {
+		d := device.GetVirtualDevice()
+		if d.Key != disk.Key && d.ControllerKey == disk.ControllerKey && d.UnitNumber != nil {
+			used[*d.UnitNumber] = true
+		}
+	}
+
+	if disk.UnitNumber != nil {
+		if unit := *disk.UnitNumber; unit < 0 || unit >= units || used[unit] {
+			return invalid("unitNumber")
+		}
+		return nil
+	}
+
+	for unit := int32(0); unit < units; unit++ {
+		if !used[unit] {
+			disk.UnitNumber = &unit
+			return nil
+		}
+	}
+
+	// the controller is full
+	return invalid("unitNumber")
+}
+
+// configureDevices applies the device changes to a copy of devices.  Devices added with a
+// non-positive key are assigned a new key, and references to that key from the ControllerKey
+// of other devices in the same spec are updated to match.  Disks have to be attached to a
+// controller on a free unit number.
+func configureDevices(devices []types.BaseVirtualDevice, changes []types.BaseVirtualDeviceConfigSpec) ([]types.BaseVirtualDevice, types.BaseMethodFault) {
+	devices = append([]types.BaseVirtualDevice(nil), devices...)
+	keys := make(map[int32]int32)
+
+	invalid := func(i int) types.BaseMethodFault {
+		return &types.InvalidDeviceSpec{
+			InvalidVmConfig: types.InvalidVmConfig{Property: "virtualDeviceSpec.device.key"},
+			DeviceIndex:     int32(i),
+		}
+	}
+
+	for i, change := range changes {
+		spec := change.GetVirtualDeviceConfigSpec()
+		if spec.Device == nil {
+			return nil, invalid(i)
+		}
+
+		device := spec.Device.GetVirtualDevice()
+
+		if key, ok := keys[device.ControllerKey]; ok {
+			device.ControllerKey = key
+		}
+
+		switch spec.Operation {
+		case types.VirtualDeviceConfigSpecOperationAdd:
+			if device.Key <= 0 {
+				key := newDeviceKey(devices)
+				keys[device.Key] = key
+				device.Key = key
+			} else if findDevice(devices, device.Key) != -1 {
+				return nil, invalid(i)
+			}
+
+			if card, ok := spec.Device.(types.BaseVirtualEthernetCard); ok {
+				generateMacAddress(card.GetVirtualEthernetCard())
+			}
+
+			if disk, ok := spec.Device.(*types.VirtualDisk); ok {
+				if fault := attachDisk(devices, disk, i); fault != nil {
+					return nil, fault
+				}
+			}
+
+			devices = append(devices, spec.Device)
+		case types.VirtualDeviceConfigSpecOperationEdit:
+			ix := findDevice(devices, device.Key)
+			if ix == -1 {
+				return nil, invalid(i)
+			}
+
+			if disk, ok := spec.Device.(*types.VirtualDisk); ok {
+				if fault := attachDisk(devices, disk, i); fault != nil {
+					return nil, fault
+				}
+			}
+
+			devices[ix] = spec.Device
+		case types.VirtualDeviceConfigSpecOperationRemove:
+			ix := findDevice(devices, device.Key)
+			if ix == -1 {
+				return nil, invalid(i)
+			}
+
+			devices = append(devices[:ix], devices[ix+1:]...)
+		default:
+			return nil, &types.InvalidDeviceOperation{
+				InvalidDeviceSpec: *invalid(i).(*types.InvalidDeviceSpec),
+				BadOp:             spec.Operation,
+			}
+		}
+	}
+
+	return devices, nil
+}
+
+// configureDVPorts connects the NICs in devices that are backed by a distributed portgroup to a
+// port of the portgroup, and releases the ports of the NICs in old that were removed or moved.
+// A NIC that stays on the same portgroup keeps its port.
+func (vm *VirtualMachine) configureDVPorts(old []types.BaseVirtualDevice, devices []types.BaseVirtualDevice) types.BaseMethodFault {
+	type connection struct {
+		key int32
+		pg  *DistributedVirtualPortgroup
+		s   *VmwareDistributedVirtualSwitch
+		c   *types.DistributedVirtualSwitchPortConnection
+	}
+
+	// validate all the connections before touching any of the ports
+	var connections []connection
+	for _, device := range devices {
+		c := dvPortConnection(device)
+		if c == nil {
+			continue
+		}
+
+		pg, s, fault := findPortgroup(c)
+		if fault != nil {
+			return fault
+		}
+		connections = append(connections, connection{device.GetVirtualDevice().Key, pg, s, c})
+	}
+
+	if len(connections) > 0 && vm.Self.Type == "" {
+		// the ports record the VM they're connected to
+		vm.Self = Map.CreateReference(vm)
+	}
+
+	prev := make(map[int32]*types.DistributedVirtualSwitchPortConnection)
+	for _, device := range old {
+		if c := dvPortConnection(device); c != nil {
+			prev[device.GetVirtualDevice().Key] = c
+		}
+	}
+
+	for _, conn := range connections {
+		c := conn.c
+
+		if p, ok := prev[conn.key]; ok && p.PortgroupKey == c.PortgroupKey && p.SwitchUuid == c.SwitchUuid {
+			if c.PortKey == "" {
+				c.PortKey = p.PortKey
+			}
+			if c.PortKey == p.PortKey {
+				delete(prev, conn.key)
+			}
+		}
+
+		if fault := conn.s.connect(conn.pg, c, vm.Self, conn.key); fault != nil {
+			return fault
+		}
+	}
+
+	// whatever is left was disconnected
+	releaseDVPorts(prev)
+
+	return nil
+}
+
+// releaseDVPorts releases the ports of the connections
+func releaseDVPorts(connections map[int32]*types.DistributedVirtualSwitchPortConnection) {
+	for _, c := range connections {
+		if _, s, fault := findPortgroup(c); fault == nil {
+			s.disconnect(c.PortKey)
+		}
+	}
+}
+
+// generateMacAddress assigns a MAC address derived from the device key if the card doesn't have one
+func generateMacAddress(card *types.VirtualEthernetCard) {
+	if card.MacAddress != "" {
+		return
+	}
+
+	card.MacAddress = fmt.Sprintf("00:50:56:%02x:%02x:%02x", byte(card.Key>>16), byte(card.Key>>8), byte(card.Key))
+	card.AddressType = string(types.VirtualEthernetCardMacTypeGenerated)
+}
+
+// mergeExtraConfig returns config with the values in changes applied: an existing value with the
+// same key is replaced, a change with an empty value removes the key, and new keys are appended
+func mergeExtraConfig(config []types.BaseOptionValue, changes []types.BaseOptionValue) []types.BaseOptionValue {
+	config = append([]types.BaseOptionValue(nil), config...)
+
+	for _, change := range changes {
+		opt := change.GetOptionValue()
+		remove := isEmptyOptionValue(opt.Value)
+
+		ix := -1
+		for i, existing := range config {
+			if existing.GetOptionValue().Key == opt.Key {
+				ix = i
+				break
+			}
+		}
+
+		switch {
+		case ix == -1 && !remove:
+			config = append(config, change)
+		case ix == -1:
+			// nothing to remove
+		case remove:
+			config = append(config[:ix], config[ix+1:]...)
+		default:
+			config[ix] = change
+		}
+	}
+
+	return config
+}
+
+// isEmptyOptionValue reports whether the value clears the option, as with vSphere
+func isEmptyOptionValue(value types.AnyType) bool {
+	switch v := value.(type) {
+	case nil:
+		return true
+	case string:
+		return v == ""
+	}
+
+	return false
+}
+
+func (vm *VirtualMachine) ReconfigVM_Task(req *types.ReconfigVM_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.reconfigure", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		vm.m.Lock()
+		defer vm.m.Unlock()
+
+		return nil, vm.configure(&req.Spec)
+	})
+
+	return &methods.ReconfigVM_TaskBody{
+		Res: &types.ReconfigVM_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// SetChangedDiskAreas sets the areas QueryChangedDiskAreas reports as changed on the disk with the
+// given key since changeId.  The changeId "*" asks for the allocated areas of the disk, if it's not
+// set the whole disk is reported.
+func (vm *VirtualMachine) SetChangedDiskAreas(key int32, changeID string, info types.DiskChangeInfo) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	if vm.changes == nil {
+		vm.changes = make(map[int32]map[string]types.DiskChangeInfo)
+	}
+	if vm.changes[key] == nil {
+		vm.changes[key] = make(map[string]types.DiskChangeInfo)
+	}
+	vm.changes[key][changeID] = info
+}
+
+// QueryChangedDiskAreas returns the changed areas of the disk that start at or after startOffset,
+// as set by SetChangedDiskAreas.  An area the offset falls into is cut at the offset.
+func (vm *VirtualMachine) QueryChangedDiskAreas(req *types.QueryChangedDiskAreas) soap.HasFault {
+	body := &methods.QueryChangedDiskAreasBody{}
+
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	invalid := func(property string) soap.HasFault {
+		body.Fault_ = Fault("", &types.InvalidArgument{InvalidProperty: property})
+		return body
+	}
+
+	ix := findDevice(vm.Config.Hardware.Device, req.DeviceKey)
+	if ix == -1 {
+		return invalid("deviceKey")
+	}
+
+	disk, ok := vm.Config.Hardware.Device[ix].(*types.VirtualDisk)
+	if !ok {
+		return invalid("deviceKey")
+	}
+
+	info, ok := vm.changes[req.DeviceKey][req.ChangeId]
+	if !ok {
+		if req.ChangeId != "*" {
+			return invalid("changeId")
+		}
+
+		size := disk.CapacityInKB * 1024
+		info = types.DiskChangeInfo{
+			Length:      size,
+			ChangedArea: []types.DiskChangeExtent{{Start: 0, Length: size}},
+		}
+	}
+
+	end := info.StartOffset + info.Length
+	if req.StartOffset < info.StartOffset || req.StartOffset > end {
+		return invalid("startOffset")
+	}
+
+	res := types.DiskChangeInfo{
+		StartOffset: req.StartOffset,
+		Length:      end - req.StartOffset,
+	}
+
+	for _, area := range info.ChangedArea {
+		if area.Start+area.Length <= req.StartOffset {
+			continue
+		}
+		if area.Start < req.StartOffset {
+			area.Length -= req.StartOffset - area.Start
+			area.Start = req.StartOffset
+		}
+		res.ChangedArea = append(res.ChangedArea, area)
+	}
+
+	body.Res = &types.QueryChangedDiskAreasResponse{
+		Returnval: res,
+	}
+
+	return body
+}
+
+// SetGuestNet sets the guest network info as reported by tools: the host name and the per-NIC
+// addresses.  The guest ipAddress is the first address of the first NIC that has one.
+func (vm *VirtualMachine) SetGuestNet(hostName string, nics ...types.GuestNicInfo) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	vm.setGuestNet(hostName, nics)
+}
+
+func (vm *VirtualMachine) setGuestNet(hostName string, nics []types.GuestNicInfo) {
+	if vm.Guest == nil {
+		vm.Guest = &types.GuestInfo{}
+	}
+
+	guest := *vm.Guest
+	guest.HostName = hostName
+	guest.Net = nil
+	guest.IpAddress = ""
+
+	for _, nic := range nics {
+		if guest.IpAddress == "" && len(nic.IpAddress) != 0 {
+			guest.IpAddress = nic.IpAddress[0]
+		}
+
+		// tools report the addresses in both forms
+		if nic.IpConfig == nil && len(nic.IpAddress) != 0 {
+			nic.IpConfig = &types.NetIpConfigInfo{}
+			for _, ip := range nic.IpAddress {
+				nic.IpConfig.IpAddress = append(nic.IpConfig.IpAddress, types.NetIpConfigInfoIpAddress{
+					IpAddress: ip,
+					State:     string(types.NetIpConfigInfoIpAddressStatusPreferred),
+				})
+			}
+		}
+
+		guest.Net = append(guest.Net, nic)
+	}
+
+	// replaced rather than modified, so that a retrieved GuestInfo isn't changed underneath the caller
+	vm.Guest = &guest
+
+	vm.Summary.Guest = &types.VirtualMachineGuestSummary{
+		GuestId:            guest.GuestId,
+		HostName:           guest.HostName,
+		IpAddress:          guest.IpAddress,
+		ToolsRunningStatus: guest.ToolsRunningStatus,
+		ToolsStatus:        guest.ToolsStatus,
+	}
+}
+
+// SetConnectionState sets the connection state of the VM, as when its host stops responding or its
+// files become inaccessible. The guest info isn't available while the VM isn't connected, it's
+// reported again once the VM is connected.
+func (vm *VirtualMachine) SetConnectionState(state types.VirtualMachineConnectionState) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	Map.WithLock(vm, func() {
+		vm.setConnectionState(state)
+	})
+}
+
+func (vm *VirtualMachine) setConnectionState(state types.VirtualMachineConnectionState) {
+	if vm.Runtime.ConnectionState == state {
+		return
+	}
+
+	connected := types.VirtualMachineConnectionStateConnected
+
+	switch {
+	case vm.Runtime.ConnectionState == connected:
+		vm.guest, vm.guestSummary = vm.Guest, vm.Summary.Guest
+		vm.Guest = &types.GuestInfo{
+			GuestState:         "unknown",
+			ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsNotRunning),
+		}
+		vm.Summary.Guest = nil
+	case state == connected:
+		vm.Guest, vm.Summary.Guest = vm.guest, vm.guestSummary
+		vm.guest, vm.guestSummary = nil, nil
+	}
+
+	vm.Runtime.ConnectionState = state
+	vm.Summary.Runtime.ConnectionState = state
+}
+
+// guestNics returns the guest NIC info for the ethernet cards of the VM, with ip assigned to the first
+func (vm *VirtualMachine) guestNics(ip string) []types.GuestNicInfo {
+	var nics []types.GuestNicInfo
+
+	for _, device := range vm.Config.Hardware.Device {
+		card, ok := device.(types.BaseVirtualEthernetCard)
+		if !ok {
+			continue
+		}
+
+		c := card.GetVirtualEthernetCard()
+
+		nic := types.GuestNicInfo{
+			MacAddress:     c.MacAddress,
+			Connected:      true,
+			DeviceConfigId: c.Key,
+		}
+
+		if backing, ok := c.Backing.(*types.VirtualEthernetCardNetworkBackingInfo); ok {
+			nic.Network = backing.DeviceName
+		}
+
+		if len(nics) == 0 && ip != "" {
+			nic.IpAddress = []string{ip}
+		}
+
+		nics = append(nics, nic)
+	}
+
+	return nics
+}
+
+// reportGuestIP simulates tools starting in the guest and reporting the network info
+func (vm *VirtualMachine) reportGuestIP() {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOn {
+		return
+	}
+
+	// tools can't be reached while the VM is disconnected
+	if vm.Runtime.ConnectionState != types.VirtualMachineConnectionStateConnected {
+		return
+	}
+
+	if vm.Guest == nil {
+		vm.Guest = &types.GuestInfo{}
+	}
+	vm.Guest.GuestId = vm.Config.GuestId
+	vm.Guest.GuestState = "running"
+	vm.Guest.ToolsRunningStatus = string(types.VirtualMachineToolsRunningStatusGuestToolsRunning)
+	vm.Guest.ToolsStatus = types.VirtualMachineToolsStatusToolsOk
+
+	nics := vm.guestNics(vm.GuestIP)
+	if len(nics) == 0 && vm.GuestIP != "" {
+		// no NIC, tools still report the address
+		nics = []types.GuestNicInfo{{IpAddress: []string{vm.GuestIP}, Connected: true}}
+	}
+
+	hostName := vm.Name
+	if vm.hostName != "" {
+		hostName = vm.hostName
+	}
+
+	vm.setGuestNet(hostName, nics)
+}
+
+func (vm *VirtualMachine) setPowerState(state types.VirtualMachinePowerState) types.BaseMethodFault {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	if vm.Runtime.ConnectionState != types.VirtualMachineConnectionStateConnected {
+		return &types.InvalidState{}
+	}
+
+	// templates can only be cloned
+	if vm.Config.Template && state == types.VirtualMachinePowerStatePoweredOn {
+		return &types.NotSupported{}
+	}
+
+	if vm.Runtime.PowerState == state {
+		return &types.InvalidPowerState{
+			RequestedState: state,
+			ExistingState:  vm.Runtime.PowerState,
+		}
+	}
+
+	vm.Runtime.PowerState = state
+	vm.Summary.Runtime.PowerState = state
+
+	if state == types.VirtualMachinePowerStatePoweredOn {
+		boot := now()
+		vm.Runtime.BootTime = &boot
+		vm.uptime = append(vm.uptime, uptime{start: boot})
+	} else if n := len(vm.uptime); n != 0 && vm.uptime[n-1].end.IsZero() {
+		vm.Runtime.BootTime = nil
+		vm.uptime[n-1].end = now()
+	}
+	vm.Summary.Runtime.BootTime = vm.Runtime.BootTime
+
+	if state == types.VirtualMachinePowerStatePoweredOff {
+		vm.Guest = &types.GuestInfo{
+			GuestState:         "notRunning",
+			ToolsRunningStatus: string(types.VirtualMachineToolsRunningStatusGuestToolsNotRunning),
+		}
+		vm.Summary.Guest = nil
+	}
+
+	return nil
+}
+
+func (vm *VirtualMachine) PowerOnVM_Task(c *types.PowerOnVM_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.powerOn", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		// VMs can't be powered on while their host is in maintenance mode
+		if vm.Runtime.Host != nil {
+			if host, ok := Map.Get(*vm.Runtime.Host).(*HostSystem); ok && host.Runtime.InMaintenanceMode {
+				return nil, &types.InvalidHostState{Host: vm.Runtime.Host}
+			}
+		}
+
+		if fault := vm.setPowerState(types.VirtualMachinePowerStatePoweredOn); fault != nil {
+			return nil, fault
+		}
+
+		// tools report the guest network info some time after the task completes
+		go vm.reportGuestIP()
+
+		return nil, nil
+	})
+
+	return &methods.PowerOnVM_TaskBody{
+		Res: &types.PowerOnVM_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+func (vm *VirtualMachine) PowerOffVM_Task(c *types.PowerOffVM_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.powerOff", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		return nil, vm.setPowerState(types.VirtualMachinePowerStatePoweredOff)
+	})
+
+	return &methods.PowerOffVM_TaskBody{
+		Res: &types.PowerOffVM_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// MarkAsTemplate turns the powered off VM into a template, which is taken out of its pool
+func (vm *VirtualMachine) MarkAsTemplate(req *types.MarkAsTemplate) soap.HasFault {
+	r := &methods.MarkAsTemplateBody{}
+
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	if vm.Config.Template {
+		r.Fault_ = Fault("", &types.NotSupported{})
+		return r
+	}
+
+	if vm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		r.Fault_ = Fault("", &types.InvalidPowerState{
+			RequestedState: types.VirtualMachinePowerStatePoweredOff,
+			ExistingState:  vm.Runtime.PowerState,
+		})
+		return r
+	}
+
+	if vm.ResourcePool != nil {
+		if pool, ok := Map.Get(*vm.ResourcePool).(*ResourcePool); ok {
+			pool.Vm = removeReference(pool.Vm, vm.Self)
+		}
+		vm.ResourcePool = nil
+	}
+
+	vm.Config.Template = true
+	vm.Summary.Config.Template = true
+
+	r.Res = &types.MarkAsTemplateResponse{}
+
+	return r
+}
+
+// MarkAsVirtualMachine turns the template back into a VM in the given pool
+func (vm *VirtualMachine) MarkAsVirtualMachine(req *types.MarkAsVirtualMachine) soap.HasFault {
+	r := &methods.MarkAsVirtualMachineBody{}
+
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	if !vm.Config.Template {
+		r.Fault_ = Fault("", &types.NotSupported{})
+		return r
+	}
+
+	pool, ok := Map.Get(req.Pool).(*ResourcePool)
+	if !ok {
+		r.Fault_ = Fault("", &types.ManagedObjectNotFound{Obj: req.Pool})
+		return r
+	}
+
+	if req.Host != nil {
+		if _, ok = Map.Get(*req.Host).(*HostSystem); !ok {
+			r.Fault_ = Fault("", &types.ManagedObjectNotFound{Obj: *req.Host})
+			return r
+		}
+		vm.Runtime.Host = req.Host
+		vm.Summary.Runtime.Host = req.Host
+	}
+
+	vm.ResourcePool = &pool.Self
+	pool.Vm = append(pool.Vm, vm.Self)
+
+	vm.Config.Template = false
+	vm.Summary.Config.Template = false
+
+	r.Res = &types.MarkAsVirtualMachineResponse{}
+
+	return r
+}
+
+// cloneSpec returns the config spec of a full clone of the VM named name, with its disks copied
+// next to the VMX on the given datastore.  The devices are copied so that the clone doesn't
+// share them with the VM.
+func (vm *VirtualMachine) cloneSpec(name string, ds *Datastore) *types.VirtualMachineConfigSpec {
+	spec := &types.VirtualMachineConfigSpec{
+		Name:                name,
+		GuestId:             vm.Config.GuestId,
+		NumCPUs:             vm.Config.Hardware.NumCPU,
+		NumCoresPerSocket:   vm.Config.Hardware.NumCoresPerSocket,
+		MemoryMB:            int64(vm.Config.Hardware.MemoryMB),
+		MemoryHotAddEnabled: vm.Config.MemoryHotAddEnabled,
+		CpuHotAddEnabled:    vm.Config.CpuHotAddEnabled,
+		CpuHotRemoveEnabled: vm.Config.CpuHotRemoveEnabled,
+		ExtraConfig:         mergeExtraConfig(nil, vm.Config.ExtraConfig),
+	}
+
+	if ds != nil {
+		spec.Files = &types.VirtualMachineFileInfo{VmPathName: ds.Path("")}
+	}
+
+	for _, device := range vm.Config.Hardware.Device {
+		device = deepCopy(reflect.ValueOf(device)).Interface().(types.BaseVirtualDevice)
+
+		dspec := &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationAdd,
+			Device:    device,
+		}
+
+		switch d := device.(type) {
+		case types.BaseVirtualEthernetCard:
+			// the clone gets its own MAC address
+			card := d.GetVirtualEthernetCard()
+			if card.AddressType != string(types.VirtualEthernetCardMacTypeManual) {
+				card.MacAddress = ""
+			}
+		case *types.VirtualDisk:
+			backing, ok := d.Backing.(types.BaseVirtualDeviceFileBackingInfo)
+			if !ok || ds == nil {
+				break
+			}
+
+			// a full clone flattens the delta disks into a new disk
+			if flat, ok := d.Backing.(*types.VirtualDiskFlatVer2BackingInfo); ok {
+				flat.Parent = nil
+			}
+			if sparse, ok := d.Backing.(*types.VirtualDiskSparseVer2BackingInfo); ok {
+				sparse.Parent = nil
+			}
+
+			info := backing.GetVirtualDeviceFileBackingInfo()
+			info.FileName = ds.Path("")
+			dspec.FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+		}
+
+		spec.DeviceChange = append(spec.DeviceChange, dspec)
+	}
+
+	return spec
+}
+
+// customize applies the customization of a clone: the host name and the address of the first
+// NIC with a fixed IP are what tools report once the clone is powered on
+func (vm *VirtualMachine) customize(spec *types.CustomizationSpec) {
+	var name types.BaseCustomizationName
+	switch identity := spec.Identity.(type) {
+	case *types.CustomizationLinuxPrep:
+		name = identity.HostName
+	case *types.CustomizationSysprep:
+		name = identity.UserData.ComputerName
+	}
+
+	switch n := name.(type) {
+	case *types.CustomizationFixedName:
+		vm.hostName = n.Name
+	case *types.CustomizationVirtualMachineName:
+		vm.hostName = vm.Name
+	}
+
+	for _, nic := range spec.NicSettingMap {
+		if ip, ok := nic.Adapter.Ip.(*types.CustomizationFixedIp); ok {
+			vm.GuestIP = ip.IpAddress
+			break
+		}
+	}
+}
+
+// CloneVM_Task creates a full clone of the VM, or template, in the given folder. The clone is
+// placed in the pool, host and datastore of the location, which default to those of the source;
+// a template has no pool, so cloning one requires a pool. Powered on VMs can be cloned as well.
+func (vm *VirtualMachine) CloneVM_Task(req *types.CloneVM_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.clone", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		folder, ok := Map.Get(req.Folder).(*Folder)
+		if !ok {
+			return nil, &types.ManagedObjectNotFound{Obj: req.Folder}
+		}
+
+		if !folder.hasChildType("VirtualMachine") {
+			return nil, &types.NotSupported{}
+		}
+
+		if ref, ok := folder.findChild(req.Name); ok {
+			return nil, &types.DuplicateName{Name: req.Name, Object: ref}
+		}
+
+		location := req.Spec.Location
+
+		vm.m.Lock()
+
+		pool, host := location.Pool, location.Host
+		if pool == nil {
+			pool = vm.ResourcePool
+			if host == nil {
+				host = vm.Runtime.Host
+			}
+		}
+
+		var ds *Datastore
+		if location.Datastore != nil {
+			if ds, ok = Map.Get(*location.Datastore).(*Datastore); !ok {
+				vm.m.Unlock()
+				return nil, &types.ManagedObjectNotFound{Obj: *location.Datastore}
+			}
+		} else if name, _, ok := parseDatastorePath(vm.Config.Files.VmPathName); ok {
+			ds = findDatastore(findDatacenter(&vm.Self), name)
+		}
+
+		spec := vm.cloneSpec(req.Name, ds)
+
+		vm.m.Unlock()
+
+		if pool == nil {
+			return nil, &types.InvalidArgument{InvalidProperty: "spec.location.pool"}
+		}
+
+		files, fault := createVMFiles(findDatacenter(&folder.Self), spec)
+		if fault != nil {
+			return nil, fault
+		}
+
+		clone, fault := NewVirtualMachine(spec)
+		if fault == nil && req.Spec.Config != nil {
+			fault = clone.configure(req.Spec.Config)
+		}
+		if fault != nil {
+			files.remove()
+			return nil, fault
+		}
+
+		if req.Spec.Customization != nil {
+			clone.customize(req.Spec.Customization)
+		}
+
+		if req.Spec.Template {
+			clone.Config.Template = true
+			clone.Summary.Config.Template = true
+			pool, host = nil, nil
+		}
+
+		folder.putVM(clone, pool, host, files)
+
+		if req.Spec.PowerOn && !req.Spec.Template {
+			if fault = clone.setPowerState(types.VirtualMachinePowerStatePoweredOn); fault != nil {
+				return nil, fault
+			}
+			go clone.reportGuestIP()
+		}
+
+		return clone.Self, nil
+	})
+
+	return &methods.CloneVM_TaskBody{
+		Res: &types.CloneVM_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// CreateSnapshot_Task takes a snapshot of the VM's config as a child of the current snapshot,
+// which the new snapshot replaces. Disk contents aren't tracked, so no delta disks are created.
+func (vm *VirtualMachine) CreateSnapshot_Task(req *types.CreateSnapshot_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.createSnapshot", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		vm.m.Lock()
+		defer vm.m.Unlock()
+
+		if vm.Config.Template {
+			return nil, &types.NotSupported{}
+		}
+
+		snapshot := &VirtualMachineSnapshot{}
+		snapshot.Self = Map.CreateReference(snapshot)
+		snapshot.Vm = vm.Self
+		snapshot.Config = deepCopy(reflect.ValueOf(*vm.Config)).Interface().(types.VirtualMachineConfigInfo)
+
+		vm.snapshotID++
+
+		poweredOn := vm.Runtime.PowerState == types.VirtualMachinePowerStatePoweredOn
+
+		node := types.VirtualMachineSnapshotTree{
+			Snapshot:    snapshot.Self,
+			Vm:          vm.Self,
+			Name:        req.Name,
+			Description: req.Description,
+			Id:          vm.snapshotID,
+			CreateTime:  now(),
+			State:       types.VirtualMachinePowerStatePoweredOff,
+			Quiesced:    req.Quiesce && poweredOn,
+		}
+		// without memory, reverting to the snapshot leaves the VM powered off
+		if req.Memory && poweredOn {
+			node.State = types.VirtualMachinePowerStatePoweredOn
+		}
+
+		if vm.Snapshot == nil {
+			vm.Snapshot = &types.VirtualMachineSnapshotInfo{}
+		}
+
+		if vm.Snapshot.CurrentSnapshot == nil {
+			vm.Snapshot.RootSnapshotList = append(vm.Snapshot.RootSnapshotList, node)
+			vm.RootSnapshot = append(vm.RootSnapshot, snapshot.Self)
+		} else {
+			parent := findSnapshot(vm.Snapshot.RootSnapshotList, *vm.Snapshot.CurrentSnapshot)
+			parent.ChildSnapshotList = append(parent.ChildSnapshotList, node)
+			if p, ok := Map.Get(parent.Snapshot).(*VirtualMachineSnapshot); ok {
+				p.ChildSnapshot = append(p.ChildSnapshot, snapshot.Self)
+			}
+		}
+
+		vm.Snapshot.CurrentSnapshot = &snapshot.Self
+		Map.Put(snapshot)
+
+		return snapshot.Self, nil
+	})
+
+	return &methods.CreateSnapshot_TaskBody{
+		Res: &types.CreateSnapshot_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// RemoveAllSnapshots_Task removes the VM's snapshot tree. Unless consolidate is false, the disks
+// are consolidated as well, otherwise the VM is left needing consolidation.
+func (vm *VirtualMachine) RemoveAllSnapshots_Task(req *types.RemoveAllSnapshots_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.removeAllSnapshots", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		vm.m.Lock()
+		defer vm.m.Unlock()
+
+		if vm.Snapshot != nil {
+			removeSnapshots(vm.Snapshot.RootSnapshotList)
+			vm.Snapshot = nil
+			vm.RootSnapshot = nil
+
+			vm.Runtime.ConsolidationNeeded = types.NewBool(req.Consolidate != nil && !*req.Consolidate)
+		}
+
+		return nil, nil
+	})
+
+	return &methods.RemoveAllSnapshots_TaskBody{
+		Res: &types.RemoveAllSnapshots_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
+
+// ConsolidateVMDisks_Task consolidates the disks left behind by snapshots removed without
+// consolidation
+func (vm *VirtualMachine) ConsolidateVMDisks_Task(req *types.ConsolidateVMDisks_Task) soap.HasFault {
+	task := NewTask(vm, "VirtualMachine.consolidateDisks", func(*Task) (types.AnyType, types.BaseMethodFault) {
+		vm.m.Lock()
+		defer vm.m.Unlock()
+
+		vm.Runtime.ConsolidationNeeded = types.NewBool(false)
+
+		return nil, nil
+	})
+
+	return &methods.ConsolidateVMDisks_TaskBody{
+		Res: &types.ConsolidateVMDisks_TaskResponse{
+			Returnval: task.Run(),
+		},
+	}
+}
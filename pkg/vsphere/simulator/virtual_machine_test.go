@@ -0,0 +1,1263 @@
+// Copyright 2016 VMware, Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package simulator
+
+import (
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+	"github.com/vmware/vic/pkg/vsphere/simulator/esx"
+)
+
+// createVM creates a VM in the default ESX inventory
+func createVM(ctx context.Context, t *testing.T, client *govmomi.Client, spec types.VirtualMachineConfigSpec) *object.VirtualMachine {
+	finder := find.NewFinder(client.Client, false)
+
+	dc, err := finder.DatacenterOrDefault(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finder.SetDatacenter(dc)
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := finder.ResourcePoolOrDefault(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := folders.VmFolder.CreateVM(ctx, spec, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return object.NewVirtualMachine(client.Client, info.Result.(types.ManagedObjectReference))
+}
+
+func TestReconfigVm(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:     "foo",
+		NumCPUs:  1,
+		MemoryMB: 512,
+	})
+
+	reconfigure := func(spec types.VirtualMachineConfigSpec) error {
+		task, err := vm.Reconfigure(ctx, spec)
+		if err != nil {
+			return err
+		}
+		return task.Wait(ctx)
+	}
+
+	// the disk refers to the controller added in the same spec by its temporary key
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = -1
+	disk := &types.VirtualDisk{CapacityInKB: 1024}
+	disk.Key = -2
+	disk.ControllerKey = -1
+	nic := &types.VirtualE1000{}
+	nic.Backing = &types.VirtualEthernetCardNetworkBackingInfo{
+		VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: "VM Network"},
+	}
+
+	add, _ := object.VirtualDeviceList{controller, disk, nic}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+
+	err = reconfigure(types.VirtualMachineConfigSpec{
+		NumCPUs:      2,
+		MemoryMB:     1024,
+		DeviceChange: add,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 3 {
+		t.Fatalf("expected 3 devices, got %d", len(devices))
+	}
+
+	ckey := devices.SelectByType(controller)[0].GetVirtualDevice().Key
+	disks := devices.SelectByType(disk)
+	if len(disks) != 1 {
+		t.Fatalf("expected a disk, got %d", len(disks))
+	}
+
+	d := disks[0].(*types.VirtualDisk)
+	if ckey <= 0 || d.Key <= 0 || d.Key == ckey {
+		t.Errorf("unexpected keys: controller=%d disk=%d", ckey, d.Key)
+	}
+
+	if d.ControllerKey != ckey {
+		t.Errorf("expected disk controller key %d, got %d", ckey, d.ControllerKey)
+	}
+
+	// edit
+	d.CapacityInKB = 2048
+	if err = vm.EditDevice(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	var o mo.VirtualMachine
+	err = vm.Properties(ctx, vm.Reference(), []string{"config"}, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Config.Hardware.NumCPU != 2 || o.Config.Hardware.MemoryMB != 1024 {
+		t.Errorf("unexpected hardware %#v", o.Config.Hardware)
+	}
+
+	devices = object.VirtualDeviceList(o.Config.Hardware.Device)
+	if capacity := devices.FindByKey(d.Key).(*types.VirtualDisk).CapacityInKB; capacity != 2048 {
+		t.Errorf("expected edited capacity, got %d", capacity)
+	}
+
+	// remove
+	if err = vm.RemoveDevice(ctx, false, devices.SelectByType(nic)...); err != nil {
+		t.Fatal(err)
+	}
+
+	devices, err = vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 || len(devices.SelectByType(nic)) != 0 {
+		t.Errorf("nic not removed: %d devices", len(devices))
+	}
+
+	// removing a nonexistent key faults and leaves the devices untouched
+	missing := &types.VirtualE1000{}
+	missing.Key = 4242
+	if err = vm.RemoveDevice(ctx, false, d, missing); err == nil {
+		t.Error("expected error removing nonexistent device")
+	}
+
+	devices, err = vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 2 {
+		t.Errorf("expected 2 devices after failed remove, got %d", len(devices))
+	}
+}
+
+func TestReconfigVmDiskAttach(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = -1
+	disk := &types.VirtualDisk{CapacityInKB: 1024}
+	disk.Key = -2
+	disk.ControllerKey = -1
+
+	add, _ := object.VirtualDeviceList{controller, disk}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		DeviceChange: add,
+	})
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ckey := devices.SelectByType(controller)[0].GetVirtualDevice().Key
+
+	// the disk without a unit number gets the first one
+	d := devices.SelectByType(disk)[0].GetVirtualDevice()
+	if d.UnitNumber == nil || *d.UnitNumber != 0 {
+		t.Fatalf("unexpected unit number %#v", d.UnitNumber)
+	}
+
+	attach := func(controllerKey int32, unit int32) types.BaseMethodFault {
+		disk := &types.VirtualDisk{CapacityInKB: 1024}
+		disk.ControllerKey = controllerKey
+		disk.UnitNumber = &unit
+
+		task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{
+			DeviceChange: []types.BaseVirtualDeviceConfigSpec{
+				&types.VirtualDeviceConfigSpec{
+					Operation: types.VirtualDeviceConfigSpecOperationAdd,
+					Device:    disk,
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if task.Wait(ctx) == nil {
+			return nil
+		}
+		return Map.Get(task.Reference()).(*Task).Info.Error.Fault
+	}
+
+	tests := []struct {
+		controller int32
+		unit       int32
+		property   string
+	}{
+		{ckey, 1, ""},
+		{ckey, 1, "virtualDeviceSpec.device.unitNumber"}, // taken by the disk above
+		{ckey, 0, "virtualDeviceSpec.device.unitNumber"},
+		{ckey, 7, "virtualDeviceSpec.device.unitNumber"},  // taken by the controller
+		{ckey, 16, "virtualDeviceSpec.device.unitNumber"}, // out of range
+		{4242, 2, "virtualDeviceSpec.device.controllerKey"},
+		{ckey, 2, ""},
+	}
+
+	for _, test := range tests {
+		fault := attach(test.controller, test.unit)
+
+		if test.property == "" {
+			if fault != nil {
+				t.Errorf("attach %d:%d: unexpected fault %#v", test.controller, test.unit, fault)
+			}
+			continue
+		}
+
+		spec, ok := fault.(*types.InvalidDeviceSpec)
+		if !ok || spec.Property != test.property {
+			t.Errorf("attach %d:%d: expected InvalidDeviceSpec for %s, got %#v", test.controller, test.unit, test.property, fault)
+		}
+	}
+
+	devices, err = vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(devices.SelectByType(disk)); n != 3 {
+		t.Errorf("expected 3 disks, got %d", n)
+	}
+}
+
+func TestReconfigVmExtraConfig(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name: "foo",
+		ExtraConfig: []types.BaseOptionValue{
+			&types.OptionValue{Key: "guestinfo.vice./common/id", Value: "foo"},
+			&types.OptionValue{Key: "guestinfo.vice./common/name", Value: "bar"},
+		},
+	})
+
+	reconfigure := func(values ...types.BaseOptionValue) {
+		task, err := vm.Reconfigure(ctx, types.VirtualMachineConfigSpec{ExtraConfig: values})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	extraConfig := func() map[string]interface{} {
+		var o mo.VirtualMachine
+		err := vm.Properties(ctx, vm.Reference(), []string{"config.extraConfig"}, &o)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := make(map[string]interface{})
+		for _, v := range o.Config.ExtraConfig {
+			opt := v.GetOptionValue()
+			if _, ok := m[opt.Key]; ok {
+				t.Errorf("duplicate key %s", opt.Key)
+			}
+			m[opt.Key] = opt.Value
+		}
+		return m
+	}
+
+	reconfigure(
+		&types.OptionValue{Key: "guestinfo.vice./common/name", Value: "baz"},   // replace
+		&types.OptionValue{Key: "guestinfo.vice./common/id", Value: ""},        // remove
+		&types.OptionValue{Key: "guestinfo.vice./common/notes", Value: "note"}, // add
+		&types.OptionValue{Key: "guestinfo.vice./missing", Value: ""},          // remove of unknown key is a noop
+	)
+
+	expect := map[string]interface{}{
+		"guestinfo.vice./common/name":  "baz",
+		"guestinfo.vice./common/notes": "note",
+	}
+
+	if m := extraConfig(); !reflect.DeepEqual(m, expect) {
+		t.Errorf("expected %#v, got %#v", expect, m)
+	}
+}
+
+func TestReconfigVmHotPlug(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:                "foo",
+		NumCPUs:             1,
+		MemoryMB:            32,
+		CpuHotAddEnabled:    types.NewBool(true),
+		MemoryHotAddEnabled: types.NewBool(false),
+	})
+
+	reconfigure := func(spec types.VirtualMachineConfigSpec) types.BaseMethodFault {
+		task, err := vm.Reconfigure(ctx, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = task.Wait(ctx); err == nil {
+			return nil
+		}
+		return Map.Get(task.Reference()).(*Task).Info.Error.Fault
+	}
+
+	hardware := func() types.VirtualHardware {
+		return Map.Get(vm.Reference()).(*VirtualMachine).Config.Hardware
+	}
+
+	// anything goes while powered off
+	if fault := reconfigure(types.VirtualMachineConfigSpec{MemoryMB: 64}); fault != nil {
+		t.Fatalf("unexpected fault %#v", fault)
+	}
+
+	task, err := vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec    types.VirtualMachineConfigSpec
+		allowed bool
+	}{
+		{types.VirtualMachineConfigSpec{NumCPUs: 2}, true},                                        // cpu hot add is enabled
+		{types.VirtualMachineConfigSpec{NumCPUs: 1}, false},                                       // cpu hot remove isn't
+		{types.VirtualMachineConfigSpec{MemoryMB: 128}, false},                                    // memory hot add isn't
+		{types.VirtualMachineConfigSpec{MemoryMB: 32}, false},                                     // memory can't be removed
+		{types.VirtualMachineConfigSpec{MemoryMB: 64, NumCPUs: 2}, true},                          // unchanged
+		{types.VirtualMachineConfigSpec{MemoryHotAddEnabled: types.NewBool(true)}, false},         // flags need a power off
+		{types.VirtualMachineConfigSpec{CpuHotAddEnabled: types.NewBool(true), NumCPUs: 4}, true}, // flag left as it is
+	}
+
+	for i, test := range tests {
+		before := hardware()
+
+		fault := reconfigure(test.spec)
+		if test.allowed {
+			if fault != nil {
+				t.Errorf("%d: unexpected fault %#v", i, fault)
+			}
+			continue
+		}
+
+		if _, ok := fault.(*types.InvalidPowerState); !ok {
+			t.Errorf("%d: expected InvalidPowerState, got %#v", i, fault)
+		}
+		if after := hardware(); after.NumCPU != before.NumCPU || after.MemoryMB != before.MemoryMB {
+			t.Errorf("%d: hardware changed from %d/%d to %d/%d", i, before.NumCPU, before.MemoryMB, after.NumCPU, after.MemoryMB)
+		}
+	}
+
+	if h := hardware(); h.NumCPU != 4 || h.MemoryMB != 64 {
+		t.Errorf("expected 4 cpus and 64MB, got %d/%d", h.NumCPU, h.MemoryMB)
+	}
+}
+
+func TestQueryChangedDiskAreas(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = -1
+	disk := &types.VirtualDisk{CapacityInKB: 1024}
+	disk.Key = -2
+	disk.ControllerKey = -1
+
+	add, _ := object.VirtualDeviceList{controller, disk}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		DeviceChange: add,
+	})
+
+	devices, err := vm.Device(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := devices.SelectByType(disk)[0].GetVirtualDevice().Key
+	size := int64(1024 * 1024)
+
+	Map.Get(vm.Reference()).(*VirtualMachine).SetChangedDiskAreas(key, "52 de 01/2", types.DiskChangeInfo{
+		Length: size,
+		ChangedArea: []types.DiskChangeExtent{
+			{Start: 0, Length: 4096},
+			{Start: 65536, Length: 8192},
+		},
+	})
+
+	query := func(key int32, offset int64, changeID string) (types.DiskChangeInfo, error) {
+		res, err := methods.QueryChangedDiskAreas(ctx, client, &types.QueryChangedDiskAreas{
+			This:        vm.Reference(),
+			DeviceKey:   key,
+			StartOffset: offset,
+			ChangeId:    changeID,
+		})
+		if err != nil {
+			return types.DiskChangeInfo{}, err
+		}
+		return res.Returnval, nil
+	}
+
+	info, err := query(key, 0, "52 de 01/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Length != size || len(info.ChangedArea) != 2 {
+		t.Errorf("unexpected changes %#v", info)
+	}
+
+	// the areas before the offset are left out, the one it falls into is cut
+	info, err = query(key, 65536+4096, "52 de 01/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.StartOffset != 65536+4096 || info.Length != size-65536-4096 {
+		t.Errorf("unexpected range %d+%d", info.StartOffset, info.Length)
+	}
+	if len(info.ChangedArea) != 1 || info.ChangedArea[0] != (types.DiskChangeExtent{Start: 65536 + 4096, Length: 4096}) {
+		t.Errorf("unexpected areas %#v", info.ChangedArea)
+	}
+
+	// the whole disk is allocated unless said otherwise
+	info, err = query(key, 0, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.ChangedArea) != 1 || info.ChangedArea[0].Length != size {
+		t.Errorf("unexpected areas %#v", info.ChangedArea)
+	}
+
+	// an unknown changeId asks for a full backup
+	if _, err = query(key, 0, "52 de 01/1"); err == nil {
+		t.Error("expected error for an unknown changeId")
+	}
+
+	if _, err = query(key, size+1, "52 de 01/2"); err == nil {
+		t.Error("expected error for an offset past the end of the disk")
+	}
+
+	if _, err = query(4242, 0, "*"); err == nil {
+		t.Error("expected error for a device that isn't there")
+	}
+
+	res := Map.Get(vm.Reference()).(*VirtualMachine).QueryChangedDiskAreas(&types.QueryChangedDiskAreas{
+		This:      vm.Reference(),
+		DeviceKey: key,
+		ChangeId:  "52 de 01/1",
+	})
+	if f, ok := res.Fault().Detail.Fault.(*types.InvalidArgument); !ok || f.InvalidProperty != "changeId" {
+		t.Errorf("unexpected fault %#v", res.Fault())
+	}
+}
+
+func TestGuestNet(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nic := &types.VirtualE1000{}
+	nic.Backing = &types.VirtualEthernetCardNetworkBackingInfo{
+		VirtualDeviceDeviceBackingInfo: types.VirtualDeviceDeviceBackingInfo{DeviceName: "VM Network"},
+	}
+	add, _ := object.VirtualDeviceList{nic}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		DeviceChange: add,
+	})
+
+	sim := Map.Get(vm.Reference()).(*VirtualMachine)
+	sim.GuestIP = "10.0.0.42"
+
+	task, err := vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := vm.WaitForIP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip != sim.GuestIP {
+		t.Errorf("expected %s, got %s", sim.GuestIP, ip)
+	}
+
+	macs, err := vm.WaitForNetIP(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(macs) != 1 {
+		t.Fatalf("expected a single NIC, got %#v", macs)
+	}
+
+	for mac, ips := range macs {
+		if mac == "" || len(ips) != 1 || ips[0] != sim.GuestIP {
+			t.Errorf("unexpected NIC %s: %#v", mac, ips)
+		}
+	}
+
+	// injected info
+	sim.SetGuestNet("bar",
+		types.GuestNicInfo{MacAddress: "00:50:56:00:00:01"},
+		types.GuestNicInfo{MacAddress: "00:50:56:00:00:02", IpAddress: []string{"10.0.0.2", "fe80::1"}},
+	)
+
+	var o mo.VirtualMachine
+	err = vm.Properties(ctx, vm.Reference(), []string{"guest.ipAddress", "guest.hostName", "guest.net"}, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Guest.IpAddress != "10.0.0.2" || o.Guest.HostName != "bar" || len(o.Guest.Net) != 2 {
+		t.Errorf("unexpected guest info %#v", o.Guest)
+	}
+
+	task, err = vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	o = mo.VirtualMachine{}
+	err = vm.Properties(ctx, vm.Reference(), []string{"guest.ipAddress"}, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Guest != nil && o.Guest.IpAddress != "" {
+		t.Errorf("unexpected ip after power off: %s", o.Guest.IpAddress)
+	}
+}
+
+func TestVmConnectionState(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{Name: "foo"})
+
+	sim := Map.Get(vm.Reference()).(*VirtualMachine)
+	sim.GuestIP = "10.0.0.42"
+
+	task, err := vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vm.WaitForIP(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// wait blocks until the VM reports the connection state
+	wait := func(state types.VirtualMachineConnectionState) {
+		pc := property.DefaultCollector(client.Client)
+		err := property.Wait(ctx, pc, vm.Reference(), []string{"runtime.connectionState"}, func(changes []types.PropertyChange) bool {
+			for _, c := range changes {
+				if c.Val == string(state) {
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	properties := func() mo.VirtualMachine {
+		var o mo.VirtualMachine
+		if err := vm.Properties(ctx, vm.Reference(), []string{"runtime.connectionState", "guest"}, &o); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wait(types.VirtualMachineConnectionStateInaccessible)
+		close(done)
+	}()
+
+	sim.SetConnectionState(types.VirtualMachineConnectionStateInaccessible)
+	<-done
+
+	o := properties()
+	if o.Runtime.ConnectionState != types.VirtualMachineConnectionStateInaccessible {
+		t.Errorf("unexpected connection state %s", o.Runtime.ConnectionState)
+	}
+	if o.Guest == nil || o.Guest.IpAddress != "" || o.Guest.GuestState != "unknown" {
+		t.Errorf("unexpected guest info of an inaccessible VM %#v", o.Guest)
+	}
+
+	// the VM can't be operated on while it's inaccessible
+	task, err = vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err == nil {
+		t.Error("expected powering off an inaccessible VM to fail")
+	} else if _, ok := Map.Get(task.Reference()).(*Task).Info.Error.Fault.(*types.InvalidState); !ok {
+		t.Errorf("unexpected fault %#v", Map.Get(task.Reference()).(*Task).Info.Error.Fault)
+	}
+
+	sim.SetConnectionState(types.VirtualMachineConnectionStateConnected)
+	wait(types.VirtualMachineConnectionStateConnected)
+
+	if o = properties(); o.Guest == nil || o.Guest.IpAddress != sim.GuestIP {
+		t.Errorf("expected the guest info to be reported again, got %#v", o.Guest)
+	}
+
+	// the VMs are disconnected along with their host
+	host := Map.Get(*sim.Runtime.Host).(*HostSystem)
+
+	host.SetConnectionState(types.HostSystemConnectionStateNotResponding)
+	wait(types.VirtualMachineConnectionStateDisconnected)
+
+	host.SetConnectionState(types.HostSystemConnectionStateConnected)
+	wait(types.VirtualMachineConnectionStateConnected)
+}
+
+func TestCreateVMFiles(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = -1
+	disk := &types.VirtualDisk{CapacityInKB: 1024}
+	disk.Key = -2
+	disk.ControllerKey = -1
+	disk.Backing = &types.VirtualDiskFlatVer2BackingInfo{
+		DiskMode:        string(types.VirtualDiskModePersistent),
+		ThinProvisioned: types.NewBool(true),
+	}
+
+	add, _ := object.VirtualDeviceList{controller, disk}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	add[1].GetVirtualDeviceConfigSpec().FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+
+	spec := types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		GuestId:      "otherGuest64",
+		Files:        &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+		DeviceChange: add,
+	}
+
+	vm := createVM(ctx, t, client, spec)
+
+	var mvm mo.VirtualMachine
+	if err = vm.Properties(ctx, vm.Reference(), []string{"config", "runtime", "datastore"}, &mvm); err != nil {
+		t.Fatal(err)
+	}
+
+	if mvm.Config.Files.VmPathName != "[datastore1] foo/foo.vmx" {
+		t.Errorf("unexpected vmx path %q", mvm.Config.Files.VmPathName)
+	}
+	if mvm.Config.GuestId != "otherGuest64" {
+		t.Errorf("unexpected guest id %q", mvm.Config.GuestId)
+	}
+	if mvm.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff ||
+		mvm.Runtime.ConnectionState != types.VirtualMachineConnectionStateConnected || mvm.Runtime.Host == nil {
+		t.Errorf("unexpected runtime %#v", mvm.Runtime)
+	}
+	if len(mvm.Datastore) != 1 || mvm.Datastore[0] != esx.Datastore.Self {
+		t.Errorf("unexpected datastores %#v", mvm.Datastore)
+	}
+
+	for _, device := range mvm.Config.Hardware.Device {
+		if d, ok := device.(*types.VirtualDisk); ok {
+			backing := d.Backing.(*types.VirtualDiskFlatVer2BackingInfo)
+			if backing.FileName != "[datastore1] foo/foo.vmdk" {
+				t.Errorf("unexpected disk path %q", backing.FileName)
+			}
+		}
+	}
+
+	// the files are visible to the datastore browser
+	ds := object.NewDatastore(client.Client, esx.Datastore.Self)
+	browser, err := ds.Browser(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(p string) (*types.HostDatastoreBrowserSearchResults, error) {
+		task, err := browser.SearchDatastore(ctx, p, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := task.WaitForResult(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res := info.Result.(types.HostDatastoreBrowserSearchResults)
+		return &res, nil
+	}
+
+	res, err := search("[datastore1] foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]int64)
+	for _, f := range res.File {
+		info := f.GetFileInfo()
+		files[info.Path] = info.FileSize
+	}
+
+	if !reflect.DeepEqual(files, map[string]int64{"foo.vmx": 0, "foo.vmdk": 1024 * 1024}) {
+		t.Errorf("unexpected files %#v", files)
+	}
+
+	res, err = search("[datastore1]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.File) != 1 {
+		t.Fatalf("expected the vm directory, got %d files", len(res.File))
+	}
+	if _, ok := res.File[0].(*types.FolderFileInfo); !ok || res.File[0].GetFileInfo().Path != "foo" {
+		t.Errorf("unexpected file %#v", res.File[0])
+	}
+
+	if _, err = search("[datastore1] enoent"); err == nil {
+		t.Error("expected error")
+	}
+
+	// names are unique within the folder
+	finder := find.NewFinder(client.Client, false)
+	dc, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder.SetDatacenter(dc)
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := finder.DefaultResourcePool(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	task, err := folders.VmFolder.CreateVM(ctx, types.VirtualMachineConfigSpec{Name: "foo"}, pool, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestVMsOnVirtualDisk(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec := func(name string, backing *types.VirtualDiskFlatVer2BackingInfo) types.VirtualMachineConfigSpec {
+		controller := &types.VirtualLsiLogicController{}
+		controller.Key = -1
+		disk := &types.VirtualDisk{CapacityInKB: 1024}
+		disk.Key = -2
+		disk.ControllerKey = -1
+		disk.Backing = backing
+
+		add, _ := object.VirtualDeviceList{controller, disk}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+		if backing.FileName == "" {
+			add[1].GetVirtualDeviceConfigSpec().FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+		}
+
+		return types.VirtualMachineConfigSpec{
+			Name:         name,
+			GuestId:      "otherGuest64",
+			Files:        &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+			DeviceChange: add,
+		}
+	}
+
+	persistent := string(types.VirtualDiskModePersistent)
+
+	foo := createVM(ctx, t, client, spec("foo", &types.VirtualDiskFlatVer2BackingInfo{DiskMode: persistent}))
+
+	// bar uses a delta disk on top of the disk of foo
+	delta := &types.VirtualDiskFlatVer2BackingInfo{DiskMode: persistent}
+	delta.FileName = "[datastore1] bar/bar-delta.vmdk"
+	delta.Parent = &types.VirtualDiskFlatVer2BackingInfo{DiskMode: persistent}
+	delta.Parent.FileName = "[datastore1] foo/foo.vmdk"
+	bar := createVM(ctx, t, client, spec("bar", delta))
+
+	refs := VMsOnVirtualDisk("[datastore1] foo/foo.vmdk")
+	expect := []types.ManagedObjectReference{foo.Reference(), bar.Reference()}
+	if len(refs) != 2 || !(reflect.DeepEqual(refs, expect) || reflect.DeepEqual(refs, []types.ManagedObjectReference{expect[1], expect[0]})) {
+		t.Errorf("expected foo and bar on the disk, got %v", refs)
+	}
+
+	refs = VMsOnVirtualDisk("[datastore1] bar/bar-delta.vmdk")
+	if len(refs) != 1 || refs[0] != bar.Reference() {
+		t.Errorf("expected bar on the delta disk, got %v", refs)
+	}
+
+	for _, name := range []string{"[datastore1] baz/baz.vmdk", "[other] foo/foo.vmdk", "foo/foo.vmdk"} {
+		if refs = VMsOnVirtualDisk(name); refs == nil || len(refs) != 0 {
+			t.Errorf("expected no VMs on %s, got %v", name, refs)
+		}
+	}
+}
+
+func TestCloneVm(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := &types.VirtualLsiLogicController{}
+	controller.Key = -1
+	disk := &types.VirtualDisk{CapacityInKB: 1024}
+	disk.Key = -2
+	disk.ControllerKey = -1
+	disk.Backing = &types.VirtualDiskFlatVer2BackingInfo{
+		DiskMode:        string(types.VirtualDiskModePersistent),
+		ThinProvisioned: types.NewBool(true),
+	}
+
+	add, _ := object.VirtualDeviceList{controller, disk}.ConfigSpec(types.VirtualDeviceConfigSpecOperationAdd)
+	add[1].GetVirtualDeviceConfigSpec().FileOperation = types.VirtualDeviceConfigSpecFileOperationCreate
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:         "foo",
+		NumCPUs:      2,
+		Files:        &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+		DeviceChange: add,
+		ExtraConfig:  []types.BaseOptionValue{&types.OptionValue{Key: "guestinfo.vice./common/name", Value: "foo"}},
+	})
+
+	finder := find.NewFinder(client.Client, false)
+	dc, err := finder.DefaultDatacenter(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finder.SetDatacenter(dc)
+
+	folders, err := dc.Folders(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool, err := finder.DefaultResourcePool(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clone := func(name string, spec types.VirtualMachineCloneSpec) (*object.VirtualMachine, types.BaseMethodFault) {
+		task, err := vm.Clone(ctx, folders.VmFolder, name, spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := task.WaitForResult(ctx, nil)
+		if err != nil {
+			return nil, Map.Get(task.Reference()).(*Task).Info.Error.Fault
+		}
+
+		// the clone is in the inventory
+		found, err := finder.VirtualMachine(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.Reference() != info.Result.(types.ManagedObjectReference) {
+			t.Errorf("found %s instead of %s", found.Reference(), info.Result)
+		}
+
+		return found, nil
+	}
+
+	task, err := vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// hot clone to the location of the source
+	bar, fault := clone("bar", types.VirtualMachineCloneSpec{})
+	if fault != nil {
+		t.Fatalf("unexpected fault %#v", fault)
+	}
+
+	b := Map.Get(bar.Reference()).(*VirtualMachine)
+	if b.Config.Files.VmPathName != "[datastore1] bar/bar.vmx" {
+		t.Errorf("unexpected vmx path %q", b.Config.Files.VmPathName)
+	}
+	if b.Runtime.PowerState != types.VirtualMachinePowerStatePoweredOff {
+		t.Errorf("clone is %s", b.Runtime.PowerState)
+	}
+	if b.Config.Hardware.NumCPU != 2 || len(b.Config.ExtraConfig) != 1 {
+		t.Errorf("config wasn't cloned: %#v", b.Config)
+	}
+	if b.ResourcePool == nil || *b.ResourcePool != pool.Reference() || b.Runtime.Host == nil {
+		t.Errorf("clone isn't in the pool of the source: %#v", b.ResourcePool)
+	}
+	if refs := Map.Get(pool.Reference()).(*ResourcePool).Vm; len(refs) != 2 {
+		t.Errorf("pool has %d VMs", len(refs))
+	}
+
+	for _, device := range b.Config.Hardware.Device {
+		if d, ok := device.(*types.VirtualDisk); ok {
+			if name := d.Backing.(*types.VirtualDiskFlatVer2BackingInfo).FileName; name != "[datastore1] bar/bar.vmdk" {
+				t.Errorf("unexpected disk path %q", name)
+			}
+		}
+	}
+
+	if _, fault = clone("bar", types.VirtualMachineCloneSpec{}); fault == nil {
+		t.Error("expected a fault")
+	} else if _, ok := fault.(*types.DuplicateName); !ok {
+		t.Errorf("unexpected fault %#v", fault)
+	}
+
+	// only powered off VMs can be marked as templates
+	v := Map.Get(vm.Reference()).(*VirtualMachine)
+	if res := v.MarkAsTemplate(&types.MarkAsTemplate{This: vm.Reference()}); res.Fault() == nil {
+		t.Error("expected a fault")
+	} else if _, ok := res.Fault().Detail.Fault.(*types.InvalidPowerState); !ok {
+		t.Errorf("unexpected fault %#v", res.Fault().Detail.Fault)
+	}
+
+	task, err = vm.PowerOff(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = vm.MarkAsTemplate(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !v.Config.Template || v.ResourcePool != nil {
+		t.Errorf("VM wasn't turned into a template")
+	}
+
+	// templates can't be powered on
+	task, err = vm.PowerOn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err == nil {
+		t.Error("powered on a template")
+	}
+
+	// templates have no pool to default to
+	if _, fault = clone("baz", types.VirtualMachineCloneSpec{}); fault == nil {
+		t.Error("expected a fault")
+	} else if _, ok := fault.(*types.InvalidArgument); !ok {
+		t.Errorf("unexpected fault %#v", fault)
+	}
+
+	poolRef := pool.Reference()
+	baz, fault := clone("baz", types.VirtualMachineCloneSpec{
+		Location: types.VirtualMachineRelocateSpec{Pool: &poolRef},
+		Config:   &types.VirtualMachineConfigSpec{MemoryMB: 64},
+		Customization: &types.CustomizationSpec{
+			Identity: &types.CustomizationLinuxPrep{HostName: &types.CustomizationFixedName{Name: "baz-host"}},
+			NicSettingMap: []types.CustomizationAdapterMapping{
+				{Adapter: types.CustomizationIPSettings{Ip: &types.CustomizationFixedIp{IpAddress: "10.0.0.2"}}},
+			},
+		},
+		PowerOn: true,
+	})
+	if fault != nil {
+		t.Fatalf("unexpected fault %#v", fault)
+	}
+
+	ip, err := baz.WaitForIP(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip != "10.0.0.2" {
+		t.Errorf("unexpected ip %s", ip)
+	}
+
+	z := Map.Get(baz.Reference()).(*VirtualMachine)
+	z.m.Lock()
+	if z.Config.Template || z.Config.Hardware.MemoryMB != 64 || z.Guest.HostName != "baz-host" {
+		t.Errorf("unexpected clone config %#v, guest %#v", z.Config, z.Guest)
+	}
+	z.m.Unlock()
+
+	if err = vm.MarkAsVirtualMachine(ctx, *pool, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v.Config.Template || v.ResourcePool == nil || *v.ResourcePool != poolRef {
+		t.Errorf("template wasn't turned back into a VM")
+	}
+}
+
+func TestRemoveAllSnapshots(t *testing.T) {
+	s := New(NewServiceInstance(esx.ServiceContent, esx.RootFolder))
+
+	ts := s.NewServer()
+	defer ts.Close()
+
+	ctx := context.Background()
+
+	client, err := govmomi.NewClient(ctx, ts.URL, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := createVM(ctx, t, client, types.VirtualMachineConfigSpec{
+		Name:  "foo",
+		Files: &types.VirtualMachineFileInfo{VmPathName: "[datastore1]"},
+	})
+
+	snapshot := func(name string) types.ManagedObjectReference {
+		task, err := vm.CreateSnapshot(ctx, name, "", false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		info, err := task.WaitForResult(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return info.Result.(types.ManagedObjectReference)
+	}
+
+	// each snapshot is a child of the previous one
+	var refs []types.ManagedObjectReference
+	for _, name := range []string{"one", "two", "three"} {
+		refs = append(refs, snapshot(name))
+	}
+
+	var o mo.VirtualMachine
+	err = vm.Properties(ctx, vm.Reference(), []string{"snapshot", "rootSnapshot", "runtime.consolidationNeeded"}, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Snapshot == nil || o.Snapshot.CurrentSnapshot == nil || *o.Snapshot.CurrentSnapshot != refs[2] {
+		t.Fatalf("unexpected snapshot info %#v", o.Snapshot)
+	}
+	if len(o.RootSnapshot) != 1 || o.RootSnapshot[0] != refs[0] {
+		t.Errorf("unexpected root snapshots %#v", o.RootSnapshot)
+	}
+
+	tree := o.Snapshot.RootSnapshotList
+	for i, name := range []string{"one", "two", "three"} {
+		if len(tree) != 1 || tree[0].Name != name || tree[0].Snapshot != refs[i] || tree[0].Id != int32(i+1) {
+			t.Fatalf("unexpected snapshot tree %#v", tree)
+		}
+		tree = tree[0].ChildSnapshotList
+	}
+
+	if o.Runtime.ConsolidationNeeded == nil || *o.Runtime.ConsolidationNeeded {
+		t.Errorf("consolidation needed before removing snapshots")
+	}
+
+	if s := Map.Get(refs[1]).(*VirtualMachineSnapshot); len(s.ChildSnapshot) != 1 || s.ChildSnapshot[0] != refs[2] || s.Vm != vm.Reference() {
+		t.Errorf("unexpected snapshot %#v", s.VirtualMachineSnapshot)
+	}
+
+	task, err := vm.RemoveAllSnapshot(ctx, types.NewBool(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = task.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	o = mo.VirtualMachine{}
+	err = vm.Properties(ctx, vm.Reference(), []string{"snapshot", "rootSnapshot", "runtime.consolidationNeeded"}, &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Snapshot != nil || len(o.RootSnapshot) != 0 {
+		t.Errorf("snapshots weren't removed: %#v %#v", o.Snapshot, o.RootSnapshot)
+	}
+	for _, ref := range refs {
+		if Map.Get(ref) != nil {
+			t.Errorf("%s is still registered", ref)
+		}
+	}
+
+	// the disks weren't consolidated
+	if o.Runtime.ConsolidationNeeded == nil || !*o.Runtime.ConsolidationNeeded {
+		t.Errorf("consolidation isn't needed after removing snapshots without it")
+	}
+
+	res, err := methods.ConsolidateVMDisks_Task(ctx, client.Client, &types.ConsolidateVMDisks_Task{This: vm.Reference()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = object.NewTask(client.Client, res.Returnval).Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if needed := Map.Get(vm.Reference()).(*VirtualMachine).Runtime.ConsolidationNeeded; needed == nil || *needed {
+		t.Errorf("consolidation needed after consolidating disks")
+	}
+
+	// snapshots can be taken again, starting a new tree
+	ref := snapshot("four")
+
+	v := Map.Get(vm.Reference()).(*VirtualMachine)
+	if v.Snapshot == nil || len(v.Snapshot.RootSnapshotList) != 1 || v.Snapshot.RootSnapshotList[0].Snapshot != ref {
+		t.Errorf("unexpected snapshot info %#v", v.Snapshot)
+	}
+}